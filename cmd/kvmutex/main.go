@@ -0,0 +1,98 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage KV mutex tool.
+// Lists KV mutices held by runtimes sharing a NATS KV bucket, reports stuck ones and releases ones of dead runtimes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+	natsURL := flag.String("nats", system.GetEnvMustProceed("FOLIAGE_RUNTIME_NATS_URL", statefun.NatsURL), "NATS server URL")
+	bucket := flag.String("bucket", system.GetEnvMustProceed("FOLIAGE_RUNTIME_KEY_VALUE_STORE_BUCKET_NAME", statefun.KeyValueStoreBucketName), "NATS KV bucket of the runtimes")
+	lifetime := flag.Int("lifetime", system.GetEnvMustProceed("FOLIAGE_RUNTIME_KV_MUTEX_LIFETIME_SEC", statefun.KVMutexLifetimeSec), "kv_mutex_lifetime_sec of the runtimes")
+	threshold := flag.Int("threshold", system.GetEnvMustProceed("FOLIAGE_RUNTIME_KV_MUTEX_STUCK_THRESHOLD_SEC", statefun.KVMutexStuckThresholdSec), "Age in seconds a mutex is reported as stuck after")
+	force := flag.Bool("force", false, "Release a mutex held by an alive runtime")
+	helpFlag := flag.Bool("h", false, "Show help message")
+	helpFlagAlias := flag.Bool("help", false, "Show help message (alias)")
+
+	flag.Parse()
+
+	if *helpFlag || *helpFlagAlias || flag.NArg() == 0 {
+		fmt.Println("usage: kvmutex [flags] list | stuck | release <key>")
+		flag.PrintDefaults()
+		return
+	}
+
+	nc, err := nats.Connect(*natsURL)
+	if err != nil {
+		fmt.Printf("ERROR: Could not connect to NATS: %s\n", err)
+		os.Exit(1)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		fmt.Printf("ERROR: Could not get JetStream context: %s\n", err)
+		os.Exit(1)
+	}
+	kv, err := js.KeyValue(*bucket)
+	if err != nil {
+		fmt.Printf("ERROR: Could not open KV bucket \"%s\": %s\n", *bucket, err)
+		os.Exit(1)
+	}
+	inspector := statefun.NewKeyMutexInspector(kv, *lifetime)
+
+	switch flag.Arg(0) {
+	case "list":
+		infos, err := inspector.List()
+		exitOnError(err)
+		printInfos(infos)
+	case "stuck":
+		infos, err := inspector.Stuck(time.Duration(*threshold) * time.Second)
+		exitOnError(err)
+		printInfos(infos)
+	case "release":
+		if flag.NArg() < 2 {
+			fmt.Println("usage: kvmutex [flags] release <key>")
+			os.Exit(1)
+		}
+		released, err := inspector.ForceRelease(flag.Arg(1), *force)
+		exitOnError(err)
+		fmt.Printf("Released %d holder(s) of \"%s\"\n", released, flag.Arg(1))
+	default:
+		fmt.Printf("Command \"%s\" not found!\n", flag.Arg(0))
+		os.Exit(1)
+	}
+}
+
+func printInfos(infos []statefun.KeyMutexInfo) {
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tRUNTIME\tCALLER\tSHARED\tACQUIRED\tAGE\tEXPIRED\tWAITERS")
+	for _, info := range infos {
+		if len(info.Holders) == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t%d\n", info.Key, info.Waiters)
+		}
+		for _, h := range info.Holders {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%t\t%d\n", info.Key, h.RuntimeID, h.Caller, h.Shared,
+				h.AcquiredAt.Format(time.RFC3339), h.Age(now).Truncate(time.Second), h.Expired(now), info.Waiters)
+		}
+	}
+	system.MsgOnErrorReturn(w.Flush())
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
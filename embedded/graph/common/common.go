@@ -5,10 +5,9 @@
 package common
 
 import (
-	"fmt"
-
 	"github.com/foliagecp/easyjson"
 
+	"github.com/foliagecp/sdk/statefun/logger"
 	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
 	sfSystem "github.com/foliagecp/sdk/statefun/system"
 )
@@ -33,6 +32,6 @@ func ReplyQueryID(queryID string, result *easyjson.JSON, contextProcessor *sfplu
 			contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, result, nil)
 		}
 	} else {
-		fmt.Println("ERROR: replyQueryId")
+		logger.Default().Error("replyQueryId: result or context processor is nil", logger.QueryIDKey, queryID)
 	}
 }
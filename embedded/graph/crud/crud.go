@@ -13,7 +13,6 @@ import (
 	"github.com/foliagecp/sdk/embedded/graph/common"
 	"github.com/foliagecp/sdk/statefun"
 	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
-	"github.com/foliagecp/sdk/statefun/system"
 	sfSystem "github.com/foliagecp/sdk/statefun/system"
 )
 
@@ -53,13 +52,22 @@ func LLAPIObjectCreate(executor sfplugins.StatefunExecutor, contextProcessor *sf
 	// Delete existing object ---------------------------------------------
 	deleteObjectPayload := easyjson.NewJSONObject()
 	deleteObjectPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
-	system.MsgOnErrorReturn(contextProcessor.GolangCallSync("functions.graph.ll.api.object.delete", contextProcessor.Self.ID, &deleteObjectPayload, nil))
+	if _, err := contextProcessor.GolangCallSync("functions.graph.ll.api.object.delete", contextProcessor.Self.ID, &deleteObjectPayload, nil); err != nil {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+		result.SetByPath("result", easyjson.NewJSON(fmt.Sprintf("ERROR LLAPIObjectCreate %s: cannot delete existing object: %s", contextProcessor.Self.ID, err)))
+		common.ReplyQueryID(queryID, &result, contextProcessor)
+		contextProcessor.GlobalCache.TransactionEnd(queryID)
+		return
+	}
 	// --------------------------------------------------------------------
 
-	contextProcessor.GlobalCache.SetValue(contextProcessor.Self.ID, objectBody.ToBytes(), true, -1, queryID)
-
-	result.SetByPath("status", easyjson.NewJSON("ok"))
-	result.SetByPath("result", easyjson.NewJSON(""))
+	if err := contextProcessor.GlobalCache.SetValueFenced(contextProcessor.Self.ID, objectBody.ToBytes(), true, -1, queryID, contextProcessor.Fence); err != nil {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+		result.SetByPath("result", easyjson.NewJSON(fmt.Sprintf("ERROR LLAPIObjectCreate %s: cannot store object body: %s", contextProcessor.Self.ID, err)))
+	} else {
+		result.SetByPath("status", easyjson.NewJSON("ok"))
+		result.SetByPath("result", easyjson.NewJSON(""))
+	}
 
 	common.ReplyQueryID(queryID, &result, contextProcessor)
 
@@ -146,7 +154,9 @@ func LLAPIObjectDelete(executor sfplugins.StatefunExecutor, contextProcessor *sf
 		deleteLinkPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
 		deleteLinkPayload.SetByPath("descendant_uuid", easyjson.NewJSON(toObjectID))
 		deleteLinkPayload.SetByPath("link_type", easyjson.NewJSON(linkType))
-		system.MsgOnErrorReturn(contextProcessor.GolangCallSync("functions.graph.ll.api.link.delete", contextProcessor.Self.ID, &deleteLinkPayload, nil))
+		if _, err := contextProcessor.GolangCallSync("functions.graph.ll.api.link.delete", contextProcessor.Self.ID, &deleteLinkPayload, nil); err != nil {
+			errorString += fmt.Sprintf("ERROR LLAPIObjectDelete %s: cannot delete out link %s: %s;", contextProcessor.Self.ID, outLinkKey, err)
+		}
 	}
 	// ----------------------------------------------------
 
@@ -161,12 +171,22 @@ func LLAPIObjectDelete(executor sfplugins.StatefunExecutor, contextProcessor *sf
 		deleteLinkPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
 		deleteLinkPayload.SetByPath("descendant_uuid", easyjson.NewJSON(contextProcessor.Self.ID))
 		deleteLinkPayload.SetByPath("link_type", easyjson.NewJSON(linkType))
-		system.MsgOnErrorReturn(contextProcessor.GolangCallSync("functions.graph.ll.api.link.delete", fromObjectID, &deleteLinkPayload, nil))
+		if _, err := contextProcessor.GolangCallSync("functions.graph.ll.api.link.delete", fromObjectID, &deleteLinkPayload, nil); err != nil {
+			errorString += fmt.Sprintf("ERROR LLAPIObjectDelete %s: cannot delete in link %s: %s;", contextProcessor.Self.ID, inLinkKey, err)
+		}
 	}
 	// ----------------------------------------------------
-	contextProcessor.GlobalCache.DeleteValue(contextProcessor.Self.ID, true, -1, queryID) // Delete object's body
 
-	result.SetByPath("status", easyjson.NewJSON("ok"))
+	if len(errorString) == 0 {
+		if err := contextProcessor.GlobalCache.DeleteValueFenced(contextProcessor.Self.ID, true, -1, queryID, contextProcessor.Fence); err != nil { // Delete object's body
+			errorString += fmt.Sprintf("ERROR LLAPIObjectDelete %s: cannot delete object body: %s;", contextProcessor.Self.ID, err)
+		}
+	}
+	if len(errorString) == 0 {
+		result.SetByPath("status", easyjson.NewJSON("ok"))
+	} else {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+	}
 	result.SetByPath("result", easyjson.NewJSON(errorString))
 
 	common.ReplyQueryID(queryID, &result, contextProcessor)
@@ -213,13 +233,17 @@ func LLAPILinkCreate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 		selfID := strings.Split(contextProcessor.Self.ID, "===")[0]
 		if inLinkType, ok := payload.GetByPath("in_link_type").AsString(); ok && len(inLinkType) > 0 {
 			if linkFromObjectUUID := contextProcessor.Caller.ID; len(linkFromObjectUUID) > 0 {
-				contextProcessor.GlobalCache.SetValue(selfID+".in.oid_ltp-nil."+linkFromObjectUUID+"."+inLinkType, nil, true, -1, queryID)
-				result.SetByPath("status", easyjson.NewJSON("ok"))
+				if err := contextProcessor.GlobalCache.SetValueFenced(selfID+".in.oid_ltp-nil."+linkFromObjectUUID+"."+inLinkType, nil, true, -1, queryID, contextProcessor.Fence); err != nil {
+					result.SetByPath("status", easyjson.NewJSON("failed"))
+					errorString = fmt.Sprintf("ERROR LLAPILinkCreate %s: cannot create in link: %s", selfID, err)
+				} else {
+					result.SetByPath("status", easyjson.NewJSON("ok"))
+				}
 			}
 		} else {
 			result.SetByPath("status", easyjson.NewJSON("failed"))
 			errorString = fmt.Sprintf("ERROR LLAPILinkCreate %s: in_link_type:string must be a non empty string", selfID)
-			fmt.Println(errorString)
+			contextProcessor.Logger.Error(errorString)
 		}
 		result.SetByPath("result", easyjson.NewJSON(errorString))
 		contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, &result, nil)
@@ -249,15 +273,25 @@ func LLAPILinkCreate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			nextCallPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
 			nextCallPayload.SetByPath("descendant_uuid", easyjson.NewJSON(descendantUUID))
 			nextCallPayload.SetByPath("link_type", easyjson.NewJSON(linkType))
-			system.MsgOnErrorReturn(contextProcessor.GolangCallSync("functions.graph.ll.api.link.delete", contextProcessor.Self.ID, &nextCallPayload, nil))
+			if _, err := contextProcessor.GolangCallSync("functions.graph.ll.api.link.delete", contextProcessor.Self.ID, &nextCallPayload, nil); err != nil {
+				result.SetByPath("status", easyjson.NewJSON("failed"))
+				result.SetByPath("result", easyjson.NewJSON(fmt.Sprintf("ERROR LLAPILinkCreate %s: cannot delete existing link: %s", contextProcessor.Self.ID, err)))
+				common.ReplyQueryID(queryID, &result, contextProcessor)
+				contextProcessor.GlobalCache.TransactionEnd(queryID)
+				return
+			}
 			// --------------------------------------------------------
 
 			// Create out link on this object -------------------------
-			contextProcessor.GlobalCache.SetValue(contextProcessor.Self.ID+".out.ltp_oid-bdy."+linkType+"."+descendantUUID, linkBody.ToBytes(), true, -1, queryID) // Store link body in KV
+			if err := contextProcessor.GlobalCache.SetValueFenced(contextProcessor.Self.ID+".out.ltp_oid-bdy."+linkType+"."+descendantUUID, linkBody.ToBytes(), true, -1, queryID, contextProcessor.Fence); err != nil { // Store link body in KV
+				errorString += fmt.Sprintf("ERROR LLAPILinkCreate %s: cannot store link body: %s;", contextProcessor.Self.ID, err)
+			}
 			if linkBody.GetByPath("tags").IsNonEmptyArray() {
 				if linkTags, ok := linkBody.GetByPath("tags").AsArrayString(); ok {
 					for _, linkTag := range linkTags {
-						contextProcessor.GlobalCache.SetValue(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, nil, true, -1, queryID)
+						if err := contextProcessor.GlobalCache.SetValueFenced(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, nil, true, -1, queryID, contextProcessor.Fence); err != nil {
+							errorString += fmt.Sprintf("ERROR LLAPILinkCreate %s: cannot store link tag %s: %s;", contextProcessor.Self.ID, linkTag, err)
+						}
 					}
 				}
 			}
@@ -267,14 +301,23 @@ func LLAPILinkCreate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			nextCallPayload = easyjson.NewJSONObject()
 			nextCallPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
 			nextCallPayload.SetByPath("in_link_type", easyjson.NewJSON(linkType))
+			descendantCallID := descendantUUID
 			if descendantUUID == contextProcessor.Self.ID {
-				system.MsgOnErrorReturn(contextProcessor.GolangCallSync(contextProcessor.Self.Typename, descendantUUID+"===create_in_link", &nextCallPayload, nil))
-			} else {
-				system.MsgOnErrorReturn(contextProcessor.GolangCallSync(contextProcessor.Self.Typename, descendantUUID, &nextCallPayload, nil))
+				descendantCallID = descendantUUID + "===create_in_link"
+			}
+			if reply, err := contextProcessor.GolangCallSync(contextProcessor.Self.Typename, descendantCallID, &nextCallPayload, nil); err != nil {
+				errorString += fmt.Sprintf("ERROR LLAPILinkCreate %s: cannot create in link on descendant %s: %s;", contextProcessor.Self.ID, descendantUUID, err)
+			} else if status, _ := reply.GetByPath("status").AsString(); status != "ok" {
+				reason, _ := reply.GetByPath("result").AsString()
+				errorString += fmt.Sprintf("ERROR LLAPILinkCreate %s: cannot create in link on descendant %s: %s;", contextProcessor.Self.ID, descendantUUID, reason)
 			}
 			// --------------------------------------------------------
 
-			result.SetByPath("status", easyjson.NewJSON("ok"))
+			if len(errorString) == 0 {
+				result.SetByPath("status", easyjson.NewJSON("ok"))
+			} else {
+				result.SetByPath("status", easyjson.NewJSON("failed"))
+			}
 			result.SetByPath("result", easyjson.NewJSON(errorString))
 		} else {
 			result.SetByPath("status", easyjson.NewJSON("failed"))
@@ -341,20 +384,26 @@ func LLAPILinkUpdate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			if oldLinkBody.GetByPath("tags").IsNonEmptyArray() {
 				if linkTags, ok := oldLinkBody.GetByPath("tags").AsArrayString(); ok {
 					for _, linkTag := range linkTags {
-						contextProcessor.GlobalCache.DeleteValue(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, true, -1, queryID)
+						if err := contextProcessor.GlobalCache.DeleteValueFenced(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, true, -1, queryID, contextProcessor.Fence); err != nil {
+							errorString += fmt.Sprintf("ERROR LLAPILinkUpdate %s: cannot delete link tag %s: %s;", contextProcessor.Self.ID, linkTag, err)
+						}
 					}
 				}
 			}
 			// ------------------------------------------------------------
 			// Update link body -------------------------------------------
 			oldLinkBody.DeepMerge(linkBody)
-			contextProcessor.GlobalCache.SetValue(contextProcessor.Self.ID+".out.ltp_oid-bdy."+linkType+"."+descendantUUID, oldLinkBody.ToBytes(), true, -1, queryID) // Store link body in KV
+			if err := contextProcessor.GlobalCache.SetValueFenced(contextProcessor.Self.ID+".out.ltp_oid-bdy."+linkType+"."+descendantUUID, oldLinkBody.ToBytes(), true, -1, queryID, contextProcessor.Fence); err != nil { // Store link body in KV
+				errorString += fmt.Sprintf("ERROR LLAPILinkUpdate %s: cannot store link body: %s;", contextProcessor.Self.ID, err)
+			}
 			// ------------------------------------------------------------
 			// Create new indices -----------------------------------------
 			if oldLinkBody.GetByPath("tags").IsNonEmptyArray() {
 				if linkTags, ok := oldLinkBody.GetByPath("tags").AsArrayString(); ok {
 					for _, linkTag := range linkTags {
-						contextProcessor.GlobalCache.SetValue(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, nil, true, -1, queryID)
+						if err := contextProcessor.GlobalCache.SetValueFenced(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, nil, true, -1, queryID, contextProcessor.Fence); err != nil {
+							errorString += fmt.Sprintf("ERROR LLAPILinkUpdate %s: cannot store link tag %s: %s;", contextProcessor.Self.ID, linkTag, err)
+						}
 					}
 				}
 			}
@@ -366,10 +415,16 @@ func LLAPILinkUpdate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			createLinkPayload.SetByPath("descendant_uuid", easyjson.NewJSON(descendantUUID))
 			createLinkPayload.SetByPath("link_type", easyjson.NewJSON(linkType))
 			createLinkPayload.SetByPath("link_body", linkBody)
-			system.MsgOnErrorReturn(contextProcessor.GolangCallSync("functions.graph.ll.api.link.create", contextProcessor.Self.ID, &createLinkPayload, nil))
+			if _, err := contextProcessor.GolangCallSync("functions.graph.ll.api.link.create", contextProcessor.Self.ID, &createLinkPayload, nil); err != nil {
+				errorString += fmt.Sprintf("ERROR LLAPILinkUpdate %s: cannot create link: %s;", contextProcessor.Self.ID, err)
+			}
 		}
 
-		result.SetByPath("status", easyjson.NewJSON("ok"))
+		if len(errorString) == 0 {
+			result.SetByPath("status", easyjson.NewJSON("ok"))
+		} else {
+			result.SetByPath("status", easyjson.NewJSON("failed"))
+		}
 		result.SetByPath("result", easyjson.NewJSON(errorString))
 	} else {
 		result.SetByPath("status", easyjson.NewJSON("failed"))
@@ -415,13 +470,17 @@ func LLAPILinkDelete(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 		selfID := strings.Split(contextProcessor.Self.ID, "===")[0]
 		if inLinkType, ok := payload.GetByPath("in_link_type").AsString(); ok && len(inLinkType) > 0 {
 			if linkFromObjectUUID := contextProcessor.Caller.ID; len(linkFromObjectUUID) > 0 {
-				contextProcessor.GlobalCache.DeleteValue(selfID+".in.oid_ltp-nil."+linkFromObjectUUID+"."+inLinkType, true, -1, queryID)
-				result.SetByPath("status", easyjson.NewJSON("ok"))
+				if err := contextProcessor.GlobalCache.DeleteValueFenced(selfID+".in.oid_ltp-nil."+linkFromObjectUUID+"."+inLinkType, true, -1, queryID, contextProcessor.Fence); err != nil {
+					result.SetByPath("status", easyjson.NewJSON("failed"))
+					errorString = fmt.Sprintf("ERROR LLAPILinkDelete %s: cannot delete in link: %s", selfID, err)
+				} else {
+					result.SetByPath("status", easyjson.NewJSON("ok"))
+				}
 			}
 		} else {
 			result.SetByPath("status", easyjson.NewJSON("failed"))
 			errorString = fmt.Sprintf("ERROR LLAPILinkDelete %s: in_link_type:string must be a non empty string", selfID)
-			fmt.Println(errorString)
+			contextProcessor.Logger.Error(errorString)
 		}
 		result.SetByPath("result", easyjson.NewJSON(errorString))
 		contextProcessor.Call(contextProcessor.Self.Typename, contextProcessor.Caller.ID, &result, nil)
@@ -447,12 +506,16 @@ func LLAPILinkDelete(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			} else {
 				lbk := contextProcessor.Self.ID + ".out.ltp_oid-bdy." + linkType + "." + descendantUUID
 				linkBody, _ := contextProcessor.GlobalCache.GetValueAsJSON(lbk)
-				contextProcessor.GlobalCache.DeleteValue(lbk, true, -1, queryID)
+				if err := contextProcessor.GlobalCache.DeleteValueFenced(lbk, true, -1, queryID, contextProcessor.Fence); err != nil {
+					errorString += fmt.Sprintf("ERROR LLAPILinkDelete %s: cannot delete link body: %s;", contextProcessor.Self.ID, err)
+				}
 
 				if linkBody != nil && linkBody.GetByPath("tags").IsNonEmptyArray() {
 					if linkTags, ok := linkBody.GetByPath("tags").AsArrayString(); ok {
 						for _, linkTag := range linkTags {
-							contextProcessor.GlobalCache.DeleteValue(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, true, -1, queryID)
+							if err := contextProcessor.GlobalCache.DeleteValueFenced(contextProcessor.Self.ID+".out.tag_ltp_oid-nil."+linkTag+"."+linkType+"."+descendantUUID, true, -1, queryID, contextProcessor.Fence); err != nil {
+								errorString += fmt.Sprintf("ERROR LLAPILinkDelete %s: cannot delete link tag %s: %s;", contextProcessor.Self.ID, linkTag, err)
+							}
 						}
 					}
 				}
@@ -460,12 +523,21 @@ func LLAPILinkDelete(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 				nextCallPayload := easyjson.NewJSONObject()
 				nextCallPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
 				nextCallPayload.SetByPath("in_link_type", easyjson.NewJSON(linkType))
+				descendantCallID := descendantUUID
 				if descendantUUID == contextProcessor.Self.ID {
-					system.MsgOnErrorReturn(contextProcessor.GolangCallSync(contextProcessor.Self.Typename, descendantUUID+"===delete_in_link", &nextCallPayload, nil))
+					descendantCallID = descendantUUID + "===delete_in_link"
+				}
+				if reply, err := contextProcessor.GolangCallSync(contextProcessor.Self.Typename, descendantCallID, &nextCallPayload, nil); err != nil {
+					errorString += fmt.Sprintf("ERROR LLAPILinkDelete %s: cannot delete in link on descendant %s: %s;", contextProcessor.Self.ID, descendantUUID, err)
+				} else if status, _ := reply.GetByPath("status").AsString(); status != "ok" {
+					reason, _ := reply.GetByPath("result").AsString()
+					errorString += fmt.Sprintf("ERROR LLAPILinkDelete %s: cannot delete in link on descendant %s: %s;", contextProcessor.Self.ID, descendantUUID, reason)
+				}
+				if len(errorString) == 0 {
+					result.SetByPath("status", easyjson.NewJSON("ok"))
 				} else {
-					system.MsgOnErrorReturn(contextProcessor.GolangCallSync(contextProcessor.Self.Typename, descendantUUID, &nextCallPayload, nil))
+					result.SetByPath("status", easyjson.NewJSON("failed"))
 				}
-				result.SetByPath("status", easyjson.NewJSON("ok"))
 				result.SetByPath("result", easyjson.NewJSON(errorString))
 			}
 		} else {
@@ -0,0 +1,113 @@
+// Copyright 2023 NJWS Inc.
+
+package crud_test
+
+import (
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/embedded/graph/crud"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+const (
+	objectCreateTypename = "functions.graph.ll.api.object.create"
+	objectDeleteTypename = "functions.graph.ll.api.object.delete"
+	linkCreateTypename   = "functions.graph.ll.api.link.create"
+	linkDeleteTypename   = "functions.graph.ll.api.link.delete"
+)
+
+var testCaller = sfPlugins.StatefunAddress{Typename: "test", ID: "caller"}
+
+func newHarness(t *testing.T) *statefuntest.Harness {
+	h := statefuntest.New().
+		RegisterHandler(objectCreateTypename, crud.LLAPIObjectCreate, nil).
+		RegisterHandler(objectDeleteTypename, crud.LLAPIObjectDelete, nil).
+		RegisterHandler(linkCreateTypename, crud.LLAPILinkCreate, nil).
+		RegisterHandler(linkDeleteTypename, crud.LLAPILinkDelete, nil)
+	t.Cleanup(h.Close)
+	return h
+}
+
+func call(t *testing.T, h *statefuntest.Harness, handler func(sfPlugins.StatefunExecutor, *sfPlugins.StatefunContextProcessor), typename string, id string, payload string) {
+	t.Helper()
+	j, ok := easyjson.JSONFromString(payload)
+	if !ok {
+		t.Fatalf("payload is not a JSON: %s", payload)
+	}
+	reply, err := h.InvokeSync(handler, sfPlugins.StatefunAddress{Typename: typename, ID: id}, testCaller, &j, nil)
+	if err != nil {
+		t.Fatalf("%s.%s: %s", typename, id, err)
+	}
+	if status, _ := reply.GetByPath("status").AsString(); status != "ok" {
+		t.Fatalf("%s.%s replied %s", typename, id, reply.ToString())
+	}
+}
+
+func assertKey(t *testing.T, h *statefuntest.Harness, key string, exists bool) {
+	t.Helper()
+	if _, err := h.Cache.GetValue(key); (err == nil) != exists {
+		t.Errorf("key %s: exists=%t, want %t", key, err == nil, exists)
+	}
+}
+
+func TestLLAPIObjectCreate(t *testing.T) {
+	h := newHarness(t)
+
+	call(t, h, crud.LLAPIObjectCreate, objectCreateTypename, "a", `{"body": {"name": "a"}}`)
+	h.AssertObjectContext(t, "a", easyjson.NewJSONObjectWithKeyValue("name", easyjson.NewJSON("a")).GetPtr())
+
+	// An existing object is replaced
+	call(t, h, crud.LLAPIObjectCreate, objectCreateTypename, "a", `{"body": {"size": 1}}`)
+	h.AssertObjectContext(t, "a", easyjson.NewJSONObjectWithKeyValue("size", easyjson.NewJSON(1)).GetPtr())
+}
+
+func TestLLAPILinkCreateAndDelete(t *testing.T) {
+	h := newHarness(t)
+	call(t, h, crud.LLAPIObjectCreate, objectCreateTypename, "a", `{"body": {}}`)
+	call(t, h, crud.LLAPIObjectCreate, objectCreateTypename, "b", `{"body": {}}`)
+
+	call(t, h, crud.LLAPILinkCreate, linkCreateTypename, "a", `{"descendant_uuid": "b", "link_type": "owns", "link_body": {"tags": ["t1"]}}`)
+	assertKey(t, h, "a.out.ltp_oid-bdy.owns.b", true)
+	assertKey(t, h, "a.out.tag_ltp_oid-nil.t1.owns.b", true)
+	assertKey(t, h, "b.in.oid_ltp-nil.a.owns", true)
+
+	call(t, h, crud.LLAPILinkDelete, linkDeleteTypename, "a", `{"descendant_uuid": "b", "link_type": "owns"}`)
+	assertKey(t, h, "a.out.ltp_oid-bdy.owns.b", false)
+	assertKey(t, h, "a.out.tag_ltp_oid-nil.t1.owns.b", false)
+	assertKey(t, h, "b.in.oid_ltp-nil.a.owns", false)
+}
+
+func TestLLAPIObjectDeleteRemovesLinks(t *testing.T) {
+	h := newHarness(t)
+	for _, id := range []string{"a", "b", "c"} {
+		call(t, h, crud.LLAPIObjectCreate, objectCreateTypename, id, `{"body": {}}`)
+	}
+	call(t, h, crud.LLAPILinkCreate, linkCreateTypename, "a", `{"descendant_uuid": "b", "link_type": "owns", "link_body": {}}`)
+	call(t, h, crud.LLAPILinkCreate, linkCreateTypename, "b", `{"descendant_uuid": "c", "link_type": "owns", "link_body": {}}`)
+
+	call(t, h, crud.LLAPIObjectDelete, objectDeleteTypename, "b", `{}`)
+	assertKey(t, h, "b", false)
+	assertKey(t, h, "a.out.ltp_oid-bdy.owns.b", false)
+	assertKey(t, h, "b.out.ltp_oid-bdy.owns.c", false)
+	assertKey(t, h, "c.in.oid_ltp-nil.b.owns", false)
+	assertKey(t, h, "a", true)
+	assertKey(t, h, "c", true)
+}
+
+func TestLLAPILinkCreateWithoutBody(t *testing.T) {
+	h := newHarness(t)
+	payload := easyjson.NewJSONObjectWithKeyValue("descendant_uuid", easyjson.NewJSON("b"))
+	reply, err := h.InvokeSync(crud.LLAPILinkCreate, sfPlugins.StatefunAddress{Typename: linkCreateTypename, ID: "a"}, testCaller, &payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := reply.GetByPath("status").AsString(); status != "failed" {
+		t.Errorf("got status %s, want failed", status)
+	}
+	if syncCalls := h.SyncCalls(); len(syncCalls) > 0 {
+		t.Errorf("got %d sync calls, want none", len(syncCalls))
+	}
+}
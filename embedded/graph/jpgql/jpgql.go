@@ -14,6 +14,7 @@ import (
 	"github.com/foliagecp/sdk/embedded/graph/common"
 	"github.com/foliagecp/sdk/statefun"
 	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	sfSystem "github.com/foliagecp/sdk/statefun/system"
 )
@@ -60,7 +61,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 	if c == 1 {
 		rootProcess = false
 	} else if c > 1 {
-		fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: contextProcessor.Self.ID for descendant must be composite according to the following format: <object_id>===<process_id>\n")
+		contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: contextProcessor.Self.ID for descendant must be composite according to the following format: <object_id>===<process_id>")
 		return
 	}
 
@@ -101,7 +102,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 
 						//fmt.Println(processID + "::: " + "LLAPIQueryJPGQLCallTreeResultAggregation evaluation timeout!")
 						errorString := "LLAPIQueryJPGQLCallTreeResultAggregation evaluation timeout!"
-						fmt.Println(errorString)
+						contextProcessor.Logger.Error(errorString)
 
 						result := easyjson.NewJSONObject()
 						result.SetByPath("status", easyjson.NewJSON("failed"))
@@ -115,7 +116,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 	} else {
 		idTokens := strings.Split(contextProcessor.Self.ID, "===")
 		if len(idTokens) != 2 {
-			fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: contextProcessor.Self.ID for descendant must be composite according to the following format: <object_id>===<process_id>\n")
+			contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: contextProcessor.Self.ID for descendant must be composite according to the following format: <object_id>===<process_id>")
 			return
 		}
 		var thisObjectID string = idTokens[0]
@@ -125,7 +126,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 		if s, ok := payload.GetByPath("query_id").AsString(); ok {
 			queryID = s
 		} else {
-			fmt.Printf("Error LLAPIQueryJPGQLCallTreeResultAggregation: this function was called by another LLAPIQueryJPGQLCallTreeResultAggregation - \"query_id\" must exist")
+			contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: this function was called by another LLAPIQueryJPGQLCallTreeResultAggregation - \"query_id\" must exist")
 			return
 		}
 
@@ -200,13 +201,13 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 										contextProcessor.Call(typename, objectID, &callPayload, nil)
 									}
 								} else {
-									fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation cannot make call on target: no result objects\n")
+									contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation cannot make call on target: no result objects")
 								}
 							} else {
-								fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation cannot make call on target: call payload is not a JSON object\n")
+								contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation cannot make call on target: call payload is not a JSON object")
 							}
 						} else {
-							fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation cannot make call on target: call typename is not a string\n")
+							contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation cannot make call on target: call typename is not a string")
 						}
 					}
 				}
@@ -238,7 +239,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 
 		state, err := getState()
 		if err != nil { // Cannot get current state
-			fmt.Println(err.Error())
+			contextProcessor.Logger.Error(err.Error())
 			return
 		}
 
@@ -247,7 +248,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 			//fmt.Println(processID + ":0:: " + "(" + thisObjectID + ") " + "1")
 			currentObjectLinksQuery, err := getQuery()
 			if err != nil {
-				fmt.Println(err.Error())
+				contextProcessor.Logger.Error(err.Error())
 				return
 			}
 
@@ -255,20 +256,20 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 			//fmt.Println(processID + ":0:: " + "(" + thisObjectID + ") " + "2")
 			callerAggregationID, ok := context.GetByPath(thisFunctionAggregationID + "_caller_aggregation_id").AsString()
 			if !ok {
-				fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id on state=0 for object_id=%s\n", thisObjectID)
+				contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id on state=0", "object_id", thisObjectID)
 				return
 			}
 			//fmt.Println(processID + ":0:: " + "(" + thisObjectID + ") " + "3")
 			if !(uniqueParentAndQuery) { // This query from that parent was already registered
 				if err := replyCallerPreventSameQueryCall(); err != nil {
-					fmt.Println(err.Error())
+					contextProcessor.Logger.Error(err.Error())
 					return
 				}
 			} else {
 				//fmt.Println(processID + ":0:: " + "(" + thisObjectID + ") " + "4")
 				queryHeadLinkType, queryHeadFilter, queryTail, anyDepthStop, err := GetQueryHeadAndTailsParts(currentObjectLinksQuery)
 				if err != nil {
-					fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: currentObjectLinksQuery is invalid: %s\n", err)
+					contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: currentObjectLinksQuery is invalid", logger.ErrorKey, err)
 					return
 				}
 				//fmt.Println(processID + ":0:: " + "(" + thisObjectID + ") " + "5")
@@ -283,7 +284,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 					replyPayload.SetByPath("result", easyjson.NewJSONObject())
 					//fmt.Println(processID + ":0:: " + "(" + thisObjectID + ") " + "7")
 					if err := replyCaller(thisFunctionAggregationID, &replyPayload); err != nil {
-						fmt.Println(err.Error())
+						contextProcessor.Logger.Error(err.Error())
 						return
 					}
 					//fmt.Println(processID+"::: 0:0 "+thisObjectID+" | Context:", context.ToString())
@@ -317,7 +318,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 						replyPayload.SetByPath("aggregation_id", easyjson.NewJSON(callerAggregationID))
 						replyPayload.SetByPath("result", immediateAggregationResult)
 						if err := replyCaller(thisFunctionAggregationID, &replyPayload); err != nil {
-							fmt.Println(err.Error())
+							contextProcessor.Logger.Error(err.Error())
 							return
 						}
 						//fmt.Println(processID+"::: 0:1 "+thisObjectID+" | Context:", context.ToString())
@@ -333,17 +334,17 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 			//fmt.Println(processID + ":1:: " + "(" + thisObjectID + ") " + "11")
 			thisFunctionAggregationID, ok := payload.GetByPath("aggregation_id").AsString()
 			if !ok {
-				fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: \"aggregationID\" must be a string\n")
+				contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: \"aggregationID\" must be a string")
 				return
 			}
 			result, ok := payload.GetByPath("result").AsObject()
 			if !ok {
-				fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: \"result\" must be a string array\n")
+				contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: \"result\" must be a string array")
 				return
 			}
 			callbacksFloat, ok := context.GetByPath(thisFunctionAggregationID + "_callbacks").AsNumeric()
 			if !ok || callbacksFloat < 0 {
-				fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: no valid callbacks counter for result aggregation for object_id=%s\n", thisObjectID)
+				contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: no valid callbacks counter for result aggregation", "object_id", thisObjectID)
 				return
 			}
 			callbacks := int(callbacksFloat)
@@ -361,7 +362,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 				//fmt.Println(processID+"::: 1:0 "+thisObjectID+" | Context:", context.ToString())
 				callerAggregationID, ok := context.GetByPath(thisFunctionAggregationID + "_caller_aggregation_id").AsString()
 				if !ok {
-					fmt.Printf("ERROR LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id on state=1 for object_id=%s\n", thisObjectID)
+					contextProcessor.Logger.Error("LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id on state=1", "object_id", thisObjectID)
 					return
 				}
 
@@ -371,7 +372,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 				replyPayload.SetByPath("result", easyjson.NewJSON(totalResult))
 				//fmt.Println(processID + ":1:: " + "(" + thisObjectID + ") " + "13.1")
 				if err := replyCaller(thisFunctionAggregationID, &replyPayload); err != nil {
-					fmt.Println(err.Error())
+					contextProcessor.Logger.Error(err.Error())
 					return
 				}
 			}
@@ -435,7 +436,7 @@ func LLAPIQueryJPGQLDirectCacheResultAggregation(executor sfPlugins.StatefunExec
 	if c == 1 {
 		rootProcess = false
 	} else if c > 1 {
-		fmt.Printf("ERROR LLAPIQueryJPGQLDirectCacheResultAggregation: contextProcessor.Self.ID for descendant must be composite according to the following format: <object_id>===<process_id>\n")
+		contextProcessor.Logger.Error("LLAPIQueryJPGQLDirectCacheResultAggregation: contextProcessor.Self.ID for descendant must be composite according to the following format: <object_id>===<process_id>")
 		return
 	}
 
@@ -443,7 +444,7 @@ func LLAPIQueryJPGQLDirectCacheResultAggregation(executor sfPlugins.StatefunExec
 	if v, ok := payload.GetByPath("jpgql_query").AsString(); ok && len(v) > 0 {
 		currentQuery = v
 	} else {
-		fmt.Println("ERROR LLAPIQueryJPGQLDirectCacheResultAggregation: \"jpgql_query\" must be a string with len>0")
+		contextProcessor.Logger.Error("LLAPIQueryJPGQLDirectCacheResultAggregation: \"jpgql_query\" must be a string with len>0")
 		return
 	}
 
@@ -517,7 +518,7 @@ func LLAPIQueryJPGQLDirectCacheResultAggregation(executor sfPlugins.StatefunExec
 						contextProcessor.GlobalCache.UnsubscribeLevelCallback(fmt.Sprintf("%s.%s.pending.%s", modifiedTypename, aggregationID, "*"), aggregationID)
 
 						errorString := "LLAPIQueryJPGQLDirectCacheResultAggregation evaluation timeout!"
-						fmt.Println(errorString)
+						contextProcessor.Logger.Error(errorString)
 
 						result := easyjson.NewJSONObject()
 						result.SetByPath("status", easyjson.NewJSON("failed"))
@@ -547,7 +548,7 @@ func LLAPIQueryJPGQLDirectCacheResultAggregation(executor sfPlugins.StatefunExec
 		if s, ok := payload.GetByPath("aggregation_id").AsString(); ok {
 			aggregationID = s
 		} else {
-			fmt.Printf("ERROR LLAPIQueryJPGQLDirectCacheResultAggregation for descendant: aggregation_id is invalid, must be string\n")
+			contextProcessor.Logger.Error("LLAPIQueryJPGQLDirectCacheResultAggregation for descendant: aggregation_id is invalid, must be string")
 			return
 		}
 
@@ -560,7 +561,7 @@ func LLAPIQueryJPGQLDirectCacheResultAggregation(executor sfPlugins.StatefunExec
 		}
 		queryHeadLinkType, queryHeadFilter, queryTail, anyDepthStop, err := GetQueryHeadAndTailsParts(currentQuery)
 		if err != nil {
-			fmt.Printf("ERROR LLAPIQueryJPGQLDirectCacheResultAggregation: currentQuery is invalid: %s\n", err)
+			contextProcessor.Logger.Error("LLAPIQueryJPGQLDirectCacheResultAggregation: currentQuery is invalid", logger.ErrorKey, err)
 			return
 		}
 		resultObjects := GetObjectIDsFromLinkTypeAndLinkFilterQueryWithAnyDepthStop(contextProcessor.GlobalCache, thisObjectID, queryHeadLinkType, queryHeadFilter, anyDepthStop)
@@ -578,10 +579,10 @@ func LLAPIQueryJPGQLDirectCacheResultAggregation(executor sfPlugins.StatefunExec
 							if callPayload := call.GetByPath("payload"); callPayload.IsObject() {
 								contextProcessor.Call(typename, objectID, &callPayload, nil)
 							} else {
-								fmt.Printf("ERROR LLAPIQueryJPGQLDirectCacheResultAggregation cannot make call on target %s: call payload is not a JSON object\n", objectID)
+								contextProcessor.Logger.Error("LLAPIQueryJPGQLDirectCacheResultAggregation cannot make call on target: call payload is not a JSON object", "object_id", objectID)
 							}
 						} else {
-							fmt.Printf("ERROR LLAPIQueryJPGQLDirectCacheResultAggregation cannot make call on target %s: call typename is not a string\n", objectID)
+							contextProcessor.Logger.Error("LLAPIQueryJPGQLDirectCacheResultAggregation cannot make call on target: call typename is not a string", "object_id", objectID)
 						}
 					}
 					//fmt.Println("RESULT " + objectID)
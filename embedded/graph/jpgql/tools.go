@@ -9,6 +9,7 @@ import (
 
 	"github.com/PaesslerAG/gval"
 	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
 )
 
 const QueryResultTopic = "functions.graph.query"
@@ -145,7 +146,7 @@ func GetObjectIDsFromLinkTypeAndTag(cacheStore *cache.Store, objectID string, li
 			objectID := string(tokens[len(tokens)-1])
 			resultObjects[objectID] = 0
 		} else {
-			fmt.Printf("ERROR getObjectIDsFromLinkTypeAndTag: linksQuery GetKeysByPattern key %s must consist from 6 tokens, but consists from %d\n", key, len(tokens))
+			logger.Default().Error("getObjectIDsFromLinkTypeAndTag: linksQuery GetKeysByPattern key must consist from 6 tokens", "key", key, "tokens", len(tokens))
 		}
 	}
 	// --------------------------------------------------------------------
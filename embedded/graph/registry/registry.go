@@ -0,0 +1,342 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage graph store registry package.
+// Provides publishing of function types registered in runtimes into the graph for their discovery
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/embedded/graph/common"
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/logger"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
+	sfSystem "github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	// Vertex with out links to all function-vertices
+	FunctionsVertexID = "functions"
+	// Vertex with out links to all runtime-vertices
+	RuntimesVertexID = "runtimes"
+	FunctionLinkType = "__function"
+	RuntimeLinkType  = "__runtime"
+
+	PublishTypename   = "functions.graph.registry.runtime.publish"
+	UnpublishTypename = "functions.graph.registry.runtime.unpublish"
+
+	HeartbeatIntervalSec = 10
+	// A runtime which missed that many heartbeats is considered dead and is removed from the graph by other runtimes
+	StaleHeartbeats = 3
+)
+
+func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
+	statefun.NewFunctionType(runtime, PublishTypename, RuntimePublish, *statefun.NewFunctionTypeConfig())
+	statefun.NewFunctionType(runtime, UnpublishTypename, RuntimeUnpublish, *statefun.NewFunctionTypeConfig())
+}
+
+// FunctionVertexID returns the id of the vertex describing the function type, dots of the typename are replaced by "_"
+func FunctionVertexID(typename string) string {
+	return "function_" + strings.ReplaceAll(typename, ".", "_")
+}
+
+func RuntimeVertexID(instanceID string) string {
+	return "runtime_" + instanceID
+}
+
+/*
+Publish publishes the function types of the runtime into the graph (see RuntimePublish) and republishes them every
+heartbeatIntervalSec, so function types started or unregistered later are reflected too. On the runtime shutdown
+the runtime is unpublished. Must be called after the runtime is started (e.g. in onAfterStart), the graph crud function
+types and the ones of this package must be registered.
+*/
+func Publish(runtime *statefun.Runtime, heartbeatIntervalSec int) {
+	if heartbeatIntervalSec <= 0 {
+		heartbeatIntervalSec = HeartbeatIntervalSec
+	}
+	runtimeID := RuntimeVertexID(runtime.InstanceID())
+	startedAt := sfSystem.GetCurrentTimeNs()
+
+	publish := func() {
+		descriptions := runtime.DescribeFunctionTypes()
+		names := make([]string, 0, len(descriptions))
+		for name := range descriptions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		functionTypes := easyjson.NewJSONArray()
+		for _, name := range names {
+			functionTypes.AddToArray(*descriptions[name])
+		}
+
+		payload := easyjson.NewJSONObject()
+		payload.SetByPath("instance_id", easyjson.NewJSON(runtime.InstanceID()))
+		payload.SetByPath("started_at", easyjson.NewJSON(startedAt))
+		payload.SetByPath("heartbeat_interval_sec", easyjson.NewJSON(heartbeatIntervalSec))
+		payload.SetByPath("function_types", functionTypes)
+		if err := checkResult(runtime.IngressGolangSync(PublishTypename, runtimeID, &payload, nil)); err != nil {
+			runtime.Logger().Error("Cannot publish function types into the graph", logger.ErrorKey, err)
+		}
+	}
+
+	publish()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Duration(heartbeatIntervalSec) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				publish()
+			}
+		}
+	}()
+
+	runtime.OnShutdown(func(runtime *statefun.Runtime) {
+		close(stop)
+		<-stopped
+		if err := checkResult(runtime.IngressGolangSync(UnpublishTypename, runtimeID, easyjson.NewJSONObject().GetPtr(), nil)); err != nil {
+			runtime.Logger().Error("Cannot unpublish function types from the graph", logger.ErrorKey, err)
+		}
+	})
+}
+
+/*
+Publishes a runtime and its function types into the graph, called on the runtime-vertex with id=runtime_<instance_id>:
+
+	functions --__function--> function_<typename> (body: the description of the function type)
+	runtimes --__runtime--> runtime_<instance_id> (body: instance_id, started_at, heartbeat, heartbeat_interval_sec)
+	runtime_<instance_id> --__function--> function_<typename>
+
+Links from "functions" and "runtimes" are tagged with name_<typename> and name_<instance_id>. Function types not
+published by the runtime anymore are unlinked from it and deleted if no other runtime publishes them. Runtimes which
+missed StaleHeartbeats heartbeats are unpublished.
+
+Request:
+
+	payload: json - required
+		query_id: string - optional // ID for this query.
+		instance_id: string - required // Instance id of the runtime.
+		started_at: int - optional // Start time of the runtime in ns.
+		heartbeat_interval_sec: int - required // Interval of publishing of the runtime.
+		function_types: []json - required // Descriptions of function types (see statefun.Runtime.DescribeFunctionTypes).
+
+Reply:
+
+	payload: json
+		status: string
+		result: any
+*/
+func RuntimePublish(executor sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	payload := contextProcessor.Payload
+	selfID := contextProcessor.Self.ID
+
+	queryID := common.GetQueryID(contextProcessor)
+	g := graph{contextProcessor: contextProcessor, queryID: queryID}
+	result := easyjson.NewJSONObject()
+
+	instanceID, _ := payload.GetByPath("instance_id").AsString()
+	heartbeatIntervalSec, _ := payload.GetByPath("heartbeat_interval_sec").AsNumeric()
+	if len(instanceID) == 0 || heartbeatIntervalSec <= 0 || !payload.GetByPath("function_types").IsArray() {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+		result.SetByPath("result", easyjson.NewJSON(fmt.Sprintf("ERROR RuntimePublish %s: instance_id:string, heartbeat_interval_sec:int and function_types:[]json are required", selfID)))
+		common.ReplyQueryID(queryID, &result, contextProcessor)
+		return
+	}
+
+	g.updateObject(FunctionsVertexID, easyjson.NewJSONObject())
+	g.updateObject(RuntimesVertexID, easyjson.NewJSONObject())
+
+	runtimeBody := easyjson.NewJSONObject()
+	runtimeBody.SetByPath("instance_id", easyjson.NewJSON(instanceID))
+	runtimeBody.SetByPath("heartbeat", easyjson.NewJSON(sfSystem.GetCurrentTimeNs()))
+	runtimeBody.SetByPath("heartbeat_interval_sec", easyjson.NewJSON(int(heartbeatIntervalSec)))
+	if payload.PathExists("started_at") {
+		runtimeBody.SetByPath("started_at", payload.GetByPath("started_at"))
+	}
+	g.updateObject(selfID, runtimeBody)
+	g.updateLink(RuntimesVertexID, selfID, RuntimeLinkType, "name_"+instanceID)
+
+	// Publish function types -----------------------------------------
+	published := map[string]bool{}
+	functionTypes := payload.GetByPath("function_types")
+	for i := 0; i < functionTypes.ArraySize(); i++ {
+		description := functionTypes.ArrayElement(i)
+		typename, ok := description.GetByPath("name").AsString()
+		if !ok {
+			continue
+		}
+		functionID := FunctionVertexID(typename)
+		published[functionID] = true
+		g.updateObject(functionID, description)
+		g.updateLink(FunctionsVertexID, functionID, FunctionLinkType, "name_"+strings.ReplaceAll(typename, ".", "_"))
+		g.updateLink(selfID, functionID, FunctionLinkType, "")
+	}
+	// ----------------------------------------------------------------
+
+	// Unlink function types not published anymore --------------------
+	for _, functionID := range g.outLinks(selfID, FunctionLinkType) {
+		if !published[functionID] {
+			g.deleteLink(selfID, functionID, FunctionLinkType)
+			g.deleteFunctionIfNotPublished(functionID)
+		}
+	}
+	// ----------------------------------------------------------------
+
+	// Unpublish dead runtimes ----------------------------------------
+	now := sfSystem.GetCurrentTimeNs()
+	for _, runtimeID := range g.outLinks(RuntimesVertexID, RuntimeLinkType) {
+		if runtimeID == selfID {
+			continue
+		}
+		body, err := contextProcessor.GlobalCache.GetValueAsJSON(runtimeID)
+		if err != nil {
+			continue
+		}
+		heartbeat, _ := body.GetByPath("heartbeat").AsNumeric()
+		interval, _ := body.GetByPath("heartbeat_interval_sec").AsNumeric()
+		if interval <= 0 {
+			interval = HeartbeatIntervalSec
+		}
+		if now-int64(heartbeat) > int64(StaleHeartbeats*interval)*int64(time.Second) {
+			contextProcessor.Logger.Warn("Unpublishing runtime which missed heartbeats", "runtime", runtimeID)
+			unpublishPayload := easyjson.NewJSONObject()
+			unpublishPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
+			g.check(UnpublishTypename, runtimeID, checkResult(contextProcessor.GolangCallSync(UnpublishTypename, runtimeID, &unpublishPayload, nil)))
+		}
+	}
+	// ----------------------------------------------------------------
+
+	g.reply(&result)
+}
+
+/*
+Removes a runtime-vertex the function being called on from the graph along with the function-vertices which are
+not published by other runtimes.
+
+Request:
+
+	payload: json - required
+		query_id: string - optional // ID for this query.
+
+Reply:
+
+	payload: json
+		status: string
+		result: any
+*/
+func RuntimeUnpublish(executor sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	selfID := contextProcessor.Self.ID
+
+	queryID := common.GetQueryID(contextProcessor)
+	g := graph{contextProcessor: contextProcessor, queryID: queryID}
+	result := easyjson.NewJSONObject()
+
+	functionIDs := g.outLinks(selfID, FunctionLinkType)
+	g.deleteObject(selfID) // Deletes all its links as well
+	for _, functionID := range functionIDs {
+		g.deleteFunctionIfNotPublished(functionID)
+	}
+
+	g.reply(&result)
+}
+
+// graph performs graph crud operations from a function collecting their errors
+type graph struct {
+	contextProcessor *sfplugins.StatefunContextProcessor
+	queryID          string
+	errorString      string
+}
+
+func (g *graph) call(typename string, id string, payload easyjson.JSON) {
+	payload.SetByPath("query_id", easyjson.NewJSON(g.queryID))
+	g.check(typename, id, checkResult(g.contextProcessor.GolangCallSync(typename, id, &payload, nil)))
+}
+
+func (g *graph) check(typename string, id string, err error) {
+	if err != nil {
+		g.errorString += fmt.Sprintf("ERROR %s %s: %s;", typename, id, err)
+	}
+}
+
+func (g *graph) updateObject(id string, body easyjson.JSON) {
+	g.call("functions.graph.ll.api.object.update", id, easyjson.NewJSONObjectWithKeyValue("body", body))
+}
+
+func (g *graph) deleteObject(id string) {
+	g.call("functions.graph.ll.api.object.delete", id, easyjson.NewJSONObject())
+}
+
+func (g *graph) updateLink(fromID string, toID string, linkType string, tag string) {
+	linkBody := easyjson.NewJSONObject()
+	if len(tag) > 0 {
+		linkBody.SetByPath("tags", easyjson.JSONFromArray([]string{tag}))
+	}
+	payload := easyjson.NewJSONObject()
+	payload.SetByPath("descendant_uuid", easyjson.NewJSON(toID))
+	payload.SetByPath("link_type", easyjson.NewJSON(linkType))
+	payload.SetByPath("link_body", linkBody)
+	g.call("functions.graph.ll.api.link.update", fromID, payload)
+}
+
+func (g *graph) deleteLink(fromID string, toID string, linkType string) {
+	payload := easyjson.NewJSONObject()
+	payload.SetByPath("descendant_uuid", easyjson.NewJSON(toID))
+	payload.SetByPath("link_type", easyjson.NewJSON(linkType))
+	g.call("functions.graph.ll.api.link.delete", fromID, payload)
+}
+
+// outLinks returns ids of objects the out links of the type of the object lead to
+func (g *graph) outLinks(id string, linkType string) []string {
+	ids := []string{}
+	for _, key := range g.contextProcessor.GlobalCache.GetKeysByPattern(id + ".out.ltp_oid-bdy." + linkType + ".*") {
+		tokens := strings.Split(key, ".")
+		ids = append(ids, tokens[len(tokens)-1])
+	}
+	return ids
+}
+
+// deleteFunctionIfNotPublished deletes the function-vertex if no runtime-vertex links to it
+func (g *graph) deleteFunctionIfNotPublished(functionID string) {
+	for _, key := range g.contextProcessor.GlobalCache.GetKeysByPattern(functionID + ".in.oid_ltp-nil.>") {
+		tokens := strings.Split(key, ".")
+		fromID, linkType := tokens[len(tokens)-2], tokens[len(tokens)-1]
+		if linkType == FunctionLinkType && fromID != FunctionsVertexID {
+			return
+		}
+	}
+	g.deleteObject(functionID)
+}
+
+func (g *graph) reply(result *easyjson.JSON) {
+	if len(g.errorString) == 0 {
+		result.SetByPath("status", easyjson.NewJSON("ok"))
+	} else {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+	}
+	result.SetByPath("result", easyjson.NewJSON(g.errorString))
+	common.ReplyQueryID(g.queryID, result, g.contextProcessor)
+}
+
+// checkResult converts a failed reply of a graph function into an error
+func checkResult(result *easyjson.JSON, err error) error {
+	if err != nil {
+		return err
+	}
+	if result != nil {
+		if status, _ := result.GetByPath("status").AsString(); status == "failed" {
+			return fmt.Errorf("%s", result.GetByPath("result").ToString())
+		}
+	}
+	return nil
+}
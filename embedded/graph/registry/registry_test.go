@@ -0,0 +1,150 @@
+// Copyright 2023 NJWS Inc.
+
+package registry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/embedded/graph/crud"
+	"github.com/foliagecp/sdk/embedded/graph/registry"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+var testCaller = sfPlugins.StatefunAddress{Typename: "test", ID: "caller"}
+
+func newHarness(t *testing.T) *statefuntest.Harness {
+	h := statefuntest.New().
+		RegisterHandler("functions.graph.ll.api.object.create", crud.LLAPIObjectCreate, nil).
+		RegisterHandler("functions.graph.ll.api.object.update", crud.LLAPIObjectUpdate, nil).
+		RegisterHandler("functions.graph.ll.api.object.delete", crud.LLAPIObjectDelete, nil).
+		RegisterHandler("functions.graph.ll.api.link.create", crud.LLAPILinkCreate, nil).
+		RegisterHandler("functions.graph.ll.api.link.update", crud.LLAPILinkUpdate, nil).
+		RegisterHandler("functions.graph.ll.api.link.delete", crud.LLAPILinkDelete, nil).
+		RegisterHandler(registry.PublishTypename, registry.RuntimePublish, nil).
+		RegisterHandler(registry.UnpublishTypename, registry.RuntimeUnpublish, nil)
+	t.Cleanup(h.Close)
+	return h
+}
+
+// publish publishes the runtime with the function types as registry.Publish does
+func publish(t *testing.T, h *statefuntest.Harness, instanceID string, typenames ...string) {
+	t.Helper()
+	functionTypes := easyjson.NewJSONArray()
+	for _, typename := range typenames {
+		functionTypes.AddToArray(easyjson.NewJSONObjectWithKeyValue("name", easyjson.NewJSON(typename)))
+	}
+	payload := easyjson.NewJSONObject()
+	payload.SetByPath("instance_id", easyjson.NewJSON(instanceID))
+	payload.SetByPath("heartbeat_interval_sec", easyjson.NewJSON(registry.HeartbeatIntervalSec))
+	payload.SetByPath("function_types", functionTypes)
+	call(t, h, registry.RuntimePublish, registry.PublishTypename, registry.RuntimeVertexID(instanceID), &payload)
+}
+
+func unpublish(t *testing.T, h *statefuntest.Harness, instanceID string) {
+	t.Helper()
+	call(t, h, registry.RuntimeUnpublish, registry.UnpublishTypename, registry.RuntimeVertexID(instanceID), easyjson.NewJSONObject().GetPtr())
+}
+
+func call(t *testing.T, h *statefuntest.Harness, handler func(sfPlugins.StatefunExecutor, *sfPlugins.StatefunContextProcessor), typename string, id string, payload *easyjson.JSON) {
+	t.Helper()
+	reply, err := h.InvokeSync(handler, sfPlugins.StatefunAddress{Typename: typename, ID: id}, testCaller, payload, nil)
+	if err != nil {
+		t.Fatalf("%s.%s: %s", typename, id, err)
+	}
+	if status, _ := reply.GetByPath("status").AsString(); status != "ok" {
+		t.Fatalf("%s.%s replied %s", typename, id, reply.ToString())
+	}
+}
+
+// assertPublished checks which function-vertices exist and which runtime links to which of them
+func assertPublished(t *testing.T, h *statefuntest.Harness, runtimes map[string][]string, functions ...string) {
+	t.Helper()
+	exists := func(key string) bool {
+		_, err := h.Cache.GetValue(key)
+		return err == nil
+	}
+	for _, typename := range []string{"a.fn", "b.fn", "c.fn"} {
+		functionID := registry.FunctionVertexID(typename)
+		published := false
+		for _, f := range functions {
+			published = published || f == typename
+		}
+		if exists(functionID) != published {
+			t.Errorf("got %s exists=%t, want %t", functionID, !published, published)
+		}
+		if linked := exists(registry.FunctionsVertexID + ".out.ltp_oid-bdy." + registry.FunctionLinkType + "." + functionID); linked != published {
+			t.Errorf("got %s linked from %s=%t, want %t", functionID, registry.FunctionsVertexID, linked, published)
+		}
+	}
+	for _, instanceID := range []string{"r1", "r2", "r3"} {
+		runtimeID := registry.RuntimeVertexID(instanceID)
+		typenames, published := runtimes[instanceID]
+		if exists(runtimeID) != published {
+			t.Errorf("got %s exists=%t, want %t", runtimeID, !published, published)
+		}
+		if linked := exists(registry.RuntimesVertexID + ".out.ltp_oid-bdy." + registry.RuntimeLinkType + "." + runtimeID); linked != published {
+			t.Errorf("got %s linked from %s=%t, want %t", runtimeID, registry.RuntimesVertexID, linked, published)
+		}
+		for _, typename := range []string{"a.fn", "b.fn", "c.fn"} {
+			want := false
+			for _, f := range typenames {
+				want = want || f == typename
+			}
+			if linked := exists(runtimeID + ".out.ltp_oid-bdy." + registry.FunctionLinkType + "." + registry.FunctionVertexID(typename)); linked != want {
+				t.Errorf("got %s linked to %s=%t, want %t", runtimeID, typename, linked, want)
+			}
+		}
+	}
+}
+
+func TestRuntimePublish(t *testing.T) {
+	h := newHarness(t)
+
+	publish(t, h, "r1", "a.fn", "b.fn")
+	publish(t, h, "r2", "b.fn", "c.fn")
+	assertPublished(t, h, map[string][]string{"r1": {"a.fn", "b.fn"}, "r2": {"b.fn", "c.fn"}}, "a.fn", "b.fn", "c.fn")
+
+	// Function types not published anymore are unlinked, deleted unless another runtime publishes them
+	publish(t, h, "r1", "a.fn")
+	publish(t, h, "r2", "c.fn")
+	assertPublished(t, h, map[string][]string{"r1": {"a.fn"}, "r2": {"c.fn"}}, "a.fn", "c.fn")
+
+	unpublish(t, h, "r2")
+	assertPublished(t, h, map[string][]string{"r1": {"a.fn"}}, "a.fn")
+	unpublish(t, h, "r1")
+	assertPublished(t, h, map[string][]string{})
+}
+
+func TestRuntimePublishDeadRuntime(t *testing.T) {
+	h := newHarness(t)
+	publish(t, h, "r1", "a.fn")
+	publish(t, h, "r2", "a.fn", "b.fn")
+	publish(t, h, "r3", "c.fn")
+
+	// r2 missed its heartbeats, r3 did not
+	runtimeID := registry.RuntimeVertexID("r2")
+	body := h.ObjectContext(runtimeID)
+	stale := time.Now().Add(-time.Duration(registry.StaleHeartbeats*registry.HeartbeatIntervalSec+1) * time.Second).UnixNano()
+	body.SetByPath("heartbeat", easyjson.NewJSON(stale))
+	h.SetObjectContext(runtimeID, body)
+
+	publish(t, h, "r1", "a.fn")
+	assertPublished(t, h, map[string][]string{"r1": {"a.fn"}, "r3": {"c.fn"}}, "a.fn", "c.fn")
+}
+
+func TestRuntimePublishInvalid(t *testing.T) {
+	h := newHarness(t)
+	payload := easyjson.NewJSONObjectWithKeyValue("instance_id", easyjson.NewJSON("r1"))
+	reply, err := h.InvokeSync(registry.RuntimePublish, sfPlugins.StatefunAddress{Typename: registry.PublishTypename, ID: registry.RuntimeVertexID("r1")}, testCaller, &payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := reply.GetByPath("status").AsString(); status != "failed" {
+		t.Errorf("got reply %s, want failed", reply.ToString())
+	}
+	assertPublished(t, h, map[string][]string{})
+}
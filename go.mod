@@ -1,12 +1,14 @@
 module github.com/foliagecp/sdk
 
-go 1.19
+go 1.21
 
 require (
 	github.com/PaesslerAG/gval v1.2.2
 	github.com/foliagecp/easyjson v0.1.0
 	github.com/goccy/go-graphviz v0.1.1
+	github.com/nats-io/nats-server/v2 v2.9.22
 	github.com/nats-io/nats.go v1.28.0
+	gopkg.in/yaml.v3 v3.0.1
 	rogchap.com/v8go v0.9.0
 )
 
@@ -15,13 +17,16 @@ require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/klauspost/compress v1.16.7 // indirect
-	github.com/nats-io/nats-server/v2 v2.9.22 // indirect
+	github.com/minio/highwayhash v1.0.2 // indirect
+	github.com/nats-io/jwt/v2 v2.5.0 // indirect
 	github.com/nats-io/nkeys v0.4.4 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/shopspring/decimal v1.3.1 // indirect
+	go.uber.org/automaxprocs v1.5.3 // indirect
 	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/image v0.6.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
+	golang.org/x/time v0.3.0 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 )
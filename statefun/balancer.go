@@ -0,0 +1,368 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	balancerKVPrefix         = "balancer.runtimes"
+	forwardSubjectPrefix     = "statefun_forward"
+	balancerMissedHeartbeats = 3
+	hashRingVirtualNodes     = 64
+)
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	// FNV hashes of keys differing only at the end are close, mixing spreads them over the ring (MurmurHash3 finalizer)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashRing maps keys to members by consistent hashing, so only keys of a member joining or leaving change their member
+type hashRing struct {
+	hashes  []uint64
+	members []string // Members of the points with hashes at the same indexes
+}
+
+func newHashRing(members []string) *hashRing {
+	type point struct {
+		hash   uint64
+		member string
+	}
+	points := make([]point, 0, len(members)*hashRingVirtualNodes)
+	for _, member := range members {
+		for i := 0; i < hashRingVirtualNodes; i++ {
+			points = append(points, point{hash: hash64(member + "#" + strconv.Itoa(i)), member: member})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	hr := &hashRing{hashes: make([]uint64, len(points)), members: make([]string, len(points))}
+	for i, p := range points {
+		hr.hashes[i], hr.members[i] = p.hash, p.member
+	}
+	return hr
+}
+
+// owner returns the member of the key, empty if the ring has no members
+func (hr *hashRing) owner(key string) string {
+	if len(hr.hashes) == 0 {
+		return ""
+	}
+	h := hash64(key)
+	i := sort.Search(len(hr.hashes), func(i int) bool { return hr.hashes[i] >= h })
+	if i == len(hr.hashes) {
+		i = 0
+	}
+	return hr.members[i]
+}
+
+type balancerMember struct {
+	revision  uint64
+	heartbeat int64
+	typenames []string
+}
+
+/*
+balancer spreads partitions of function types balanced by partitions over live runtimes serving them. Runtimes announce
+themselves and the function types they serve by heartbeats in the NATS KV, every runtime watches them and maps
+partitions to runtimes by the same consistent hash ring. A runtime owns a partition while it holds the KV mutex of it,
+partitions are acquired and handed off on every heartbeat and every change of runtimes. Messages received by a runtime
+which does not own the partition of their id are forwarded to the owner over NATS, the original message is acked or
+NAK'd as the owner does it with the forwarded one.
+*/
+type balancer struct {
+	runtime *Runtime
+	logger  logger.Logger
+
+	mutex   sync.RWMutex
+	members map[string]balancerMember // Instance id -> last heartbeat
+	rings   map[string]*hashRing      // Typename -> ring of live runtimes serving it
+
+	forwardInbox      string
+	forwardSeq        uint64
+	forwards          sync.Map // Reply subject -> *nats.Msg forwarded to the owner of its partition
+	forwardRepliesSub *nats.Subscription
+
+	wake    chan struct{}
+	stopped chan struct{}
+}
+
+func newBalancer(runtime *Runtime) *balancer {
+	return &balancer{
+		runtime:      runtime,
+		logger:       runtime.logger.With("subsystem", "balancer"),
+		members:      map[string]balancerMember{},
+		rings:        map[string]*hashRing{},
+		forwardInbox: nats.NewInbox(),
+		wake:         make(chan struct{}, 1),
+		stopped:      make(chan struct{}),
+	}
+}
+
+func (b *balancer) heartbeatInterval() time.Duration {
+	if b.runtime.config.balancerHeartbeatIntervalSec <= 0 { // Not validated by setters, a ticker cannot have a zero interval
+		return BalancerHeartbeatIntervalSec * time.Second
+	}
+	return time.Duration(b.runtime.config.balancerHeartbeatIntervalSec) * time.Second
+}
+
+// start announces the runtime and runs the balancer until the runtime is stopped
+func (b *balancer) start() (err error) {
+	b.forwardRepliesSub, err = b.runtime.nc.Subscribe(b.forwardInbox+".*", b.onForwardReply)
+	if err != nil {
+		close(b.stopped)
+		return err
+	}
+	w, err := b.runtime.kv.Watch(balancerKVPrefix + ".*")
+	if err != nil {
+		close(b.stopped)
+		return err
+	}
+	go b.run(w)
+	return nil
+}
+
+// touch makes the balancer announce the runtime and balance partitions at once, e.g. when a function type is started
+func (b *balancer) touch() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *balancer) run(w nats.KeyWatcher) {
+	defer close(b.stopped)
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	ticker := time.NewTicker(b.heartbeatInterval())
+	defer ticker.Stop()
+	b.heartbeat()
+	updates := w.Updates()
+
+	for {
+		select {
+		case <-b.runtime.ctx.Done():
+			// Other runtimes take over partitions once they are released on shutdown
+			system.MsgOnErrorReturn(b.runtime.kv.Delete(balancerKVPrefix + "." + b.runtime.instanceID))
+			return
+		case entry, ok := <-updates:
+			if !ok { // Closed by the KV, e.g. on a lost connection
+				b.logger.Warn("Heartbeats watcher is closed, watching again")
+				updates = nil
+				continue
+			}
+			if entry == nil { // All heartbeats are loaded
+				b.balance()
+			} else if b.onHeartbeat(entry) {
+				b.balance()
+			}
+		case <-b.wake:
+			b.heartbeat()
+			b.balance()
+		case <-ticker.C:
+			b.heartbeat()
+			if updates == nil {
+				// Members which left meanwhile are dropped by their missed heartbeats
+				if newW, err := b.runtime.kv.Watch(balancerKVPrefix + ".*"); err == nil {
+					system.MsgOnErrorReturn(w.Stop())
+					w, updates = newW, newW.Updates()
+				} else {
+					b.logger.Warn("Cannot watch heartbeats", logger.ErrorKey, err)
+				}
+			}
+			b.dropDeadMembers()
+			b.balance()
+		}
+	}
+}
+
+func (b *balancer) heartbeat() {
+	typenames := []string{}
+	b.runtime.registrationMutex.Lock()
+	for _, ft := range b.runtime.functionTypes() {
+		if ft.partitioned() && ft.started() {
+			typenames = append(typenames, ft.name)
+		}
+	}
+	b.runtime.registrationMutex.Unlock()
+	sort.Strings(typenames)
+
+	j := easyjson.NewJSONObject()
+	j.SetByPath("heartbeat", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	j.SetByPath("typenames", easyjson.JSONFromArray(typenames))
+	if _, err := b.runtime.kv.Put(balancerKVPrefix+"."+b.runtime.instanceID, j.ToBytes()); err != nil {
+		b.logger.Warn("Cannot put heartbeat", logger.ErrorKey, err)
+	}
+}
+
+// onHeartbeat updates the member by its heartbeat, returns true if the members have changed
+func (b *balancer) onHeartbeat(entry nats.KeyValueEntry) bool {
+	instanceID := strings.TrimPrefix(entry.Key(), balancerKVPrefix+".")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	old, existed := b.members[instanceID]
+	if entry.Operation() != nats.KeyValuePut {
+		delete(b.members, instanceID)
+		b.rebuildRings()
+		return existed
+	}
+	j, ok := easyjson.JSONFromBytes(entry.Value())
+	if !ok {
+		b.logger.Error("Heartbeat is not a JSON", "key", entry.Key())
+		return false
+	}
+	heartbeat, _ := j.GetByPath("heartbeat").AsNumeric()
+	typenames, _ := j.GetByPath("typenames").AsArrayString()
+	b.members[instanceID] = balancerMember{revision: entry.Revision(), heartbeat: int64(heartbeat), typenames: typenames}
+	if existed && strings.Join(old.typenames, ",") == strings.Join(typenames, ",") {
+		return false
+	}
+	b.rebuildRings()
+	return true
+}
+
+// dropDeadMembers removes members which missed heartbeats, their heartbeats are removed from the KV too
+func (b *balancer) dropDeadMembers() {
+	deadline := system.GetCurrentTimeNs() - int64(balancerMissedHeartbeats)*b.heartbeatInterval().Nanoseconds()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	dropped := false
+	for instanceID, member := range b.members {
+		if member.heartbeat < deadline && instanceID != b.runtime.instanceID {
+			b.logger.Info("Runtime missed heartbeats, its partitions are handed off", "runtime", instanceID)
+			delete(b.members, instanceID)
+			// Fails if the runtime is back meanwhile
+			_ = b.runtime.kv.Delete(balancerKVPrefix+"."+instanceID, nats.LastRevision(member.revision))
+			dropped = true
+		}
+	}
+	if dropped {
+		b.rebuildRings()
+	}
+}
+
+// rebuildRings must be called under the balancer mutex
+func (b *balancer) rebuildRings() {
+	members := map[string][]string{}
+	for instanceID, member := range b.members {
+		for _, typename := range member.typenames {
+			members[typename] = append(members[typename], instanceID)
+		}
+	}
+	b.rings = map[string]*hashRing{}
+	for typename, instanceIDs := range members {
+		b.rings[typename] = newHashRing(instanceIDs)
+	}
+}
+
+// owner returns the instance id of the runtime which must own the partition, empty if no runtime serves the function type
+func (b *balancer) owner(typename string, partition int) string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	ring, ok := b.rings[typename]
+	if !ok {
+		return ""
+	}
+	return ring.owner(partitionKey(typename, partition))
+}
+
+// balance acquires partitions the runtime must own and hands off ones it must not own anymore
+func (b *balancer) balance() {
+	b.runtime.registrationMutex.Lock() // Function types are not started or unregistered meanwhile
+	defer b.runtime.registrationMutex.Unlock()
+	for _, ft := range b.runtime.functionTypes() {
+		if b.runtime.ctx.Err() != nil {
+			return
+		}
+		if ft.partitioned() && ft.started() {
+			ft.balancePartitions(b.owner)
+		}
+	}
+}
+
+func (b *balancer) handoffDelay() time.Duration {
+	return b.heartbeatInterval()
+}
+
+// forward sends the message to the runtime owning the partition of its id
+func (b *balancer) forward(owner string, ft *FunctionType, id string, msg *nats.Msg) {
+	reply := b.forwardInbox + "." + strconv.FormatUint(atomic.AddUint64(&b.forwardSeq, 1), 10)
+	forwarded := nats.NewMsg(forwardSubject(owner, ft.name) + "." + id)
+	forwarded.Reply = reply
+	forwarded.Data = msg.Data
+	for key, values := range msg.Header {
+		forwarded.Header[key] = values
+	}
+
+	b.forwards.Store(reply, msg)
+	if err := b.runtime.nc.PublishMsg(forwarded); err != nil {
+		b.forwards.Delete(reply)
+		ft.logger.Warn("Cannot forward message to the owner of its partition", logger.IDKey, id, "owner", owner, logger.ErrorKey, err)
+		system.MsgOnErrorReturn(msg.NakWithDelay(b.handoffDelay()))
+		return
+	}
+	ft.metrics.forwardedMsgs.Inc()
+	// The stream redelivers the message after the ack wait if the owner does not reply
+	time.AfterFunc(time.Duration(ft.config.msgAckWaitMs)*time.Millisecond, func() { b.forwards.Delete(reply) })
+}
+
+// onForwardReply acks or NAKs the original message the same way the owner did it with the forwarded one
+func (b *balancer) onForwardReply(reply *nats.Msg) {
+	v, ok := b.forwards.Load(reply.Subject)
+	if !ok {
+		return
+	}
+	msg := v.(*nats.Msg)
+
+	ack := string(reply.Data)
+	switch {
+	case reply.Header.Get("Status") == "503": // No responders, the owner is gone and is not dropped from the ring yet
+		system.MsgOnErrorReturn(msg.NakWithDelay(b.handoffDelay()))
+	case strings.HasPrefix(ack, "+WPI"):
+		system.MsgOnErrorReturn(msg.InProgress())
+		return
+	case strings.HasPrefix(ack, "+ACK"):
+		system.MsgOnErrorReturn(msg.Ack())
+	case strings.HasPrefix(ack, "+TERM"):
+		system.MsgOnErrorReturn(msg.Term())
+	default: // -NAK with an optional delay
+		nakDelay := struct {
+			Delay int64 `json:"delay"`
+		}{}
+		if i := strings.Index(ack, "{"); i >= 0 && json.Unmarshal([]byte(ack[i:]), &nakDelay) == nil && nakDelay.Delay > 0 {
+			system.MsgOnErrorReturn(msg.NakWithDelay(time.Duration(nakDelay.Delay)))
+		} else {
+			system.MsgOnErrorReturn(msg.Nak())
+		}
+	}
+	b.forwards.Delete(reply.Subject)
+}
+
+// forwardSubject is the subject prefix of messages forwarded to the runtime for the function type
+func forwardSubject(instanceID string, typename string) string {
+	return forwardSubjectPrefix + "." + instanceID + "." + typename
+}
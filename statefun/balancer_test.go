@@ -0,0 +1,146 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestHashRingOwnershipChanges(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = partitionKey("test.fn", i)
+	}
+	owners := func(hr *hashRing) map[string]string {
+		m := map[string]string{}
+		for _, key := range keys {
+			m[key] = hr.owner(key)
+		}
+		return m
+	}
+	before := owners(newHashRing([]string{"a", "b", "c"}))
+
+	tests := []struct {
+		name    string
+		members []string
+		moved   func(oldOwner string, newOwner string) bool // Whether a key may move between the owners
+	}{
+		{name: "joining runtime", members: []string{"a", "b", "c", "d"}, moved: func(_ string, newOwner string) bool { return newOwner == "d" }},
+		{name: "leaving runtime", members: []string{"a", "b"}, moved: func(oldOwner string, _ string) bool { return oldOwner == "c" }},
+		{name: "order of members", members: []string{"c", "a", "b"}, moved: func(string, string) bool { return false }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movedKeys := 0
+			for key, newOwner := range owners(newHashRing(tt.members)) {
+				if oldOwner := before[key]; oldOwner != newOwner {
+					movedKeys++
+					if !tt.moved(oldOwner, newOwner) {
+						t.Fatalf("key %s moved from %s to %s", key, oldOwner, newOwner)
+					}
+				}
+			}
+			if len(tt.members) != 3 && movedKeys == 0 {
+				t.Error("no key moved")
+			}
+		})
+	}
+
+	if owner := newHashRing(nil).owner(keys[0]); owner != "" {
+		t.Errorf("got owner %q on an empty ring", owner)
+	}
+}
+
+func TestOnForwardReply(t *testing.T) {
+	s, err := server.NewServer(&server.Options{NoSigs: true, DontListen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(EmbeddedNatsStartTimeoutSec * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	acks, err := nc.SubscribeSync("acks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := nc.SubscribeSync("msgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &balancer{runtime: &Runtime{config: RuntimeConfig{balancerHeartbeatIntervalSec: 3}}}
+
+	tests := []struct {
+		name      string
+		reply     string
+		status    string
+		wantAck   string
+		wantStays bool // The original message is still waiting for the final reply of the owner
+	}{
+		{name: "ack", reply: "+ACK", wantAck: "+ACK"},
+		{name: "in progress", reply: "+WPI", wantAck: "+WPI", wantStays: true},
+		{name: "term", reply: "+TERM", wantAck: "+TERM"},
+		{name: "nak", reply: "-NAK", wantAck: "-NAK"},
+		{name: "nak with delay", reply: `-NAK {"delay": 5000000000}`, wantAck: `-NAK {"delay": 5000000000}`},
+		{name: "no responders", status: "503", wantAck: `-NAK {"delay": 3000000000}`},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := nc.PublishMsg(&nats.Msg{Subject: "msgs", Reply: "acks"}); err != nil {
+				t.Fatal(err)
+			}
+			original, err := msgs.NextMsg(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replySubject := "forward_replies." + strconv.Itoa(i)
+			b.forwards.Store(replySubject, original)
+
+			reply := nats.NewMsg(replySubject)
+			reply.Data = []byte(tt.reply)
+			if len(tt.status) > 0 {
+				reply.Header.Set("Status", tt.status)
+			}
+			b.onForwardReply(reply)
+
+			ack, err := acks.NextMsg(time.Second)
+			if err != nil {
+				t.Fatalf("original message is not acked: %s", err)
+			}
+			if string(ack.Data) != tt.wantAck {
+				t.Errorf("got ack %q, want %q", ack.Data, tt.wantAck)
+			}
+			if _, stays := b.forwards.Load(replySubject); stays != tt.wantStays {
+				t.Errorf("got forward kept=%t, want %t", stays, tt.wantStays)
+			}
+		})
+	}
+
+	t.Run("unknown reply", func(t *testing.T) {
+		b.onForwardReply(&nats.Msg{Subject: "forward_replies.unknown", Data: []byte("+ACK")})
+		if ack, err := acks.NextMsg(100 * time.Millisecond); err == nil {
+			t.Errorf("got ack %q for an unknown reply", ack.Data)
+		}
+	})
+}
+
+func TestHeartbeatIntervalNotPositive(t *testing.T) {
+	for _, intervalSec := range []int{0, -1} {
+		b := &balancer{runtime: &Runtime{config: *NewRuntimeConfig().SetBalancerHeartbeatIntervalSec(intervalSec)}}
+		if got := b.heartbeatInterval(); got != BalancerHeartbeatIntervalSec*time.Second {
+			t.Errorf("got heartbeat interval %s for %d, want the default", got, intervalSec)
+		}
+	}
+}
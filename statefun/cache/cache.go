@@ -6,7 +6,6 @@ package cache
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"sort"
 	"strings"
@@ -16,6 +15,7 @@ import (
 
 	"github.com/foliagecp/easyjson"
 
+	"github.com/foliagecp/sdk/statefun/logger"
 	"github.com/foliagecp/sdk/statefun/system"
 	"github.com/nats-io/nats.go"
 )
@@ -40,6 +40,9 @@ type StoreValue struct {
 	notifyUpdates                  sync.Map
 	syncNeeded                     bool
 	syncedWithKV                   bool
+	// Fence of the last write, see Fence
+	fenceLock  string
+	fenceToken uint64
 }
 
 func notifySubscriber(c chan KeyValue, key interface{}, value interface{}) {
@@ -120,8 +123,17 @@ func (csv *StoreValue) StoreChild(key interface{}, child *StoreValue, safe bool)
 }
 
 func (csv *StoreValue) Put(value interface{}, updateInKV bool, customPutTime int64) {
+	system.MsgOnErrorReturn(csv.put(value, updateInKV, customPutTime, Fence{}))
+}
+
+func (csv *StoreValue) put(value interface{}, updateInKV bool, customPutTime int64, fence Fence) error {
 	csv.Lock("Put")
 	key := csv.keyInParent
+	if err := csv.admits(fence); err != nil {
+		csv.Unlock("Put")
+		return err
+	}
+	csv.stamp(fence)
 
 	csv.value = value
 	csv.valueExists = true
@@ -141,6 +153,7 @@ func (csv *StoreValue) Put(value interface{}, updateInKV bool, customPutTime int
 	}
 
 	csv.Unlock("Put")
+	return nil
 }
 
 func (csv *StoreValue) collectGarbage() {
@@ -195,8 +208,17 @@ func (csv *StoreValue) TryPurgeConfirm(safe bool) bool {
 }
 
 func (csv *StoreValue) Delete(updateInKV bool, customDeleteTime int64) {
+	system.MsgOnErrorReturn(csv.delete(updateInKV, customDeleteTime, Fence{}))
+}
+
+func (csv *StoreValue) delete(updateInKV bool, customDeleteTime int64, fence Fence) error {
 	csv.Lock("Delete")
 	key := csv.keyInParent
+	if err := csv.admits(fence); err != nil {
+		csv.Unlock("Delete")
+		return err
+	}
+	csv.stamp(fence)
 	// Cannot really remove this value from the parent's store map beacause of the time comparison when updates come from NATS KV
 	csv.value = nil
 	csv.valueExists = false
@@ -221,6 +243,7 @@ func (csv *StoreValue) Delete(updateInKV bool, customDeleteTime int64) {
 			return true
 		})
 	}
+	return nil
 }
 
 func (csv *StoreValue) Range(f func(key, value interface{}) bool) {
@@ -239,6 +262,7 @@ type TransactionOperator struct {
 	value        []byte
 	updateInKV   bool
 	customTime   int64
+	fence        Fence
 }
 
 type Transaction struct {
@@ -247,16 +271,32 @@ type Transaction struct {
 	mutex        *sync.Mutex
 }
 
+// Stats holds counters of the store since its creation
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	LRUPurges uint64
+	// Age of the oldest value which was not yet written into the KV during the last pass of the lazy writer
+	KVWriteLagNs int64
+}
+
 type Store struct {
 	cacheConfig *Config
 	kv          nats.KeyValue
 	ctx         context.Context
 	cancel      context.CancelFunc
+	logger      logger.Logger
+
+	initChan          chan bool
+	lazyWriterStopped chan bool
+	rootValue         *StoreValue
+	lruTresholdTime   int64
+	valuesInCache     int
 
-	initChan        chan bool
-	rootValue       *StoreValue
-	lruTresholdTime int64
-	valuesInCache   int
+	hits         uint64
+	misses       uint64
+	lruPurges    uint64
+	kvWriteLagNs int64
 
 	transactions                sync.Map
 	transactionsMutex           *sync.Mutex
@@ -265,9 +305,10 @@ type Store struct {
 
 func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *Store {
 	cs := Store{
-		cacheConfig: cacheConfig,
-		kv:          kv,
-		initChan:    make(chan bool),
+		cacheConfig:       cacheConfig,
+		kv:                kv,
+		initChan:          make(chan bool),
+		lazyWriterStopped: make(chan bool),
 		rootValue: &StoreValue{
 			parent:                         nil,
 			value:                          nil,
@@ -288,6 +329,11 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *
 
 	cs.ctx, cs.cancel = context.WithCancel(ctx)
 
+	cs.logger = cacheConfig.logger
+	if cs.logger == nil {
+		cs.logger = logger.Default()
+	}
+
 	storeUpdatesHandler := func(cs *Store) {
 		if w, err := kv.Watch(cacheConfig.kvStorePrefix + ".>"); err == nil {
 			activeKVSync := true
@@ -295,21 +341,32 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *
 				select {
 				case <-cs.ctx.Done():
 					activeKVSync = false
-				case entry := <-w.Updates():
-					if entry != nil {
+				case entry, ok := <-w.Updates():
+					if !ok { // Watcher is stopped, e.g. the NATS connection is closed
+						activeKVSync = false
+					} else if entry != nil {
 						key := cs.fromStoreKey(entry.Key())
 						valueBytes := entry.Value()
-						if len(valueBytes) >= 9 { // Update or delete signal from KV store
-							appendFlag := valueBytes[8]
-							kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
+						if record, ok := decodeKVRecord(valueBytes); ok { // Update or delete signal from KV store
+							kvRecordTime := record.time
 
 							cacheRecordTime := cs.GetValueUpdateTime(key)
 							if kvRecordTime > cacheRecordTime {
-								if appendFlag == 1 {
-									//fmt.Printf("---CACHE_KV TF UPDATE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
-									cs.SetValue(key, valueBytes[9:], false, kvRecordTime, "")
+								if record.exists {
+									//fmt.Printf("---CACHE_KV TF UPDATE: %s, %d\n", key, kvRecordTime)
+									if err := cs.setValue(key, record.data, false, kvRecordTime, "", record.fence); err != nil {
+										// Written by a stale holder of the mutex, restoring the value of the newer holder
+										cs.logger.Warn("storeUpdatesHandler: rejected stale update", "key", key, logger.ErrorKey, err)
+										if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+											csv.Lock("storeUpdatesHandler")
+											csv.valueUpdateTime = system.GetCurrentTimeNs()
+											csv.syncNeeded = true
+											csv.syncedWithKV = false
+											csv.Unlock("storeUpdatesHandler")
+										}
+									}
 								} else { // Someone else (other module) deleted a key from the cache
-									//fmt.Printf("---CACHE_KV TF DELETE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
+									//fmt.Printf("---CACHE_KV TF DELETE: %s, %d\n", key, kvRecordTime)
 									system.MsgOnErrorReturn(kv.Delete(entry.Key()))
 
 									//cs.rootValue.purgeReady
@@ -318,7 +375,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *
 									//}
 								}
 							} else if kvRecordTime == cacheRecordTime { // KV confirmes update
-								if appendFlag == 0 {
+								if !record.exists {
 									system.MsgOnErrorReturn(kv.Delete(entry.Key()))
 								}
 								if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
@@ -327,7 +384,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *
 									csv.TryPurgeConfirm(false)
 									csv.Unlock("storeUpdatesHandler")
 								}
-								//fmt.Printf("---CACHE_KV TF TOO OLD: %s, %d, %d\n", key, kvRecordTime, appendFlag)
+								//fmt.Printf("---CACHE_KV TF TOO OLD: %s, %d\n", key, kvRecordTime)
 							}
 						} else if len(valueBytes) == 0 { // Complete delete signal from KV store
 							if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
@@ -341,7 +398,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *
 							// Deletion notify - omitting cause value must already be deleted from the cache
 						} else {
 							//fmt.Printf("---CACHE_KV !T!F: %s\n", key)
-							fmt.Printf("ERROR storeUpdatesHandler: received value without time and append flag!\n")
+							cs.logger.Error("storeUpdatesHandler: received value without time and append flag!", "key", key)
 						}
 					} else {
 						close(cs.initChan)
@@ -350,122 +407,133 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, kv nats.KeyValue) *
 			}
 			system.MsgOnErrorReturn(w.Stop())
 		} else {
-			fmt.Printf("storeUpdatesHandler kv.Watch error %s\n", err)
+			cs.logger.Error("storeUpdatesHandler kv.Watch error", logger.ErrorKey, err)
 		}
 	}
 	kvLazyWriter := func(cs *Store) {
+		defer close(cs.lazyWriterStopped)
 		for {
-			select {
-			case <-cs.ctx.Done():
-			default:
-				cacheStoreValueStack := []*StoreValue{cs.rootValue}
-				suffixPathsStack := []string{""}
-				depthsStack := []int{0}
+			// After the store is destroyed one more pass is made to flush all not yet synced values into the KV
+			stopping := cs.ctx.Err() != nil
+
+			cacheStoreValueStack := []*StoreValue{cs.rootValue}
+			suffixPathsStack := []string{""}
+			depthsStack := []int{0}
+
+			lruTimes := []int64{}
+			var kvWriteLagNs int64 = 0
+			passStartTime := system.GetCurrentTimeNs()
 
-				lruTimes := []int64{}
+			for len(cacheStoreValueStack) > 0 {
+				lastID := len(cacheStoreValueStack) - 1
 
-				for len(cacheStoreValueStack) > 0 {
-					lastID := len(cacheStoreValueStack) - 1
+				currentStoreValue := cacheStoreValueStack[lastID]
 
-					currentStoreValue := cacheStoreValueStack[lastID]
+				currentStoreValue.Lock("kvLazyWriter")
+				lruTimes = append(lruTimes, currentStoreValue.valueUpdateTime)
+				currentStoreValue.Unlock("kvLazyWriter")
+
+				currentSuffix := suffixPathsStack[lastID]
+				currentDepth := depthsStack[lastID]
 
-					currentStoreValue.Lock("kvLazyWriter")
-					lruTimes = append(lruTimes, currentStoreValue.valueUpdateTime)
-					currentStoreValue.Unlock("kvLazyWriter")
+				cacheStoreValueStack = cacheStoreValueStack[:lastID]
+				suffixPathsStack = suffixPathsStack[:lastID]
+				depthsStack = depthsStack[:lastID]
 
-					currentSuffix := suffixPathsStack[lastID]
-					currentDepth := depthsStack[lastID]
+				noChildred := true
+				currentStoreValue.Range(func(key, value interface{}) bool {
+					noChildred = false
 
-					cacheStoreValueStack = cacheStoreValueStack[:lastID]
-					suffixPathsStack = suffixPathsStack[:lastID]
-					depthsStack = depthsStack[:lastID]
+					var newSuffix string
+					if currentDepth == 0 {
+						newSuffix = currentSuffix + key.(string)
+					} else {
+						newSuffix = currentSuffix + "." + key.(string)
+					}
 
-					noChildred := true
-					currentStoreValue.Range(func(key, value interface{}) bool {
-						noChildred = false
+					var finalBytes []byte = nil
 
-						var newSuffix string
-						if currentDepth == 0 {
-							newSuffix = currentSuffix + key.(string)
-						} else {
-							newSuffix = currentSuffix + "." + key.(string)
+					csvChild := value.(*StoreValue)
+					var valueUpdateTime int64 = 0
+					csvChild.Lock("kvLazyWriter")
+					if csvChild.syncNeeded {
+						valueUpdateTime = csvChild.valueUpdateTime
+						if lag := passStartTime - valueUpdateTime; valueUpdateTime > 0 && lag > kvWriteLagNs {
+							kvWriteLagNs = lag
 						}
-
-						var finalBytes []byte = nil
-
-						csvChild := value.(*StoreValue)
-						var valueUpdateTime int64 = 0
-						csvChild.Lock("kvLazyWriter")
-						if csvChild.syncNeeded {
-							valueUpdateTime = csvChild.valueUpdateTime
-							timeBytes := make([]byte, 8)
-							binary.BigEndian.PutUint64(timeBytes, uint64(csvChild.valueUpdateTime))
-							if csvChild.valueExists {
-								header := append(timeBytes, 1) // Add append flag "1"
-								finalBytes = append(header, csvChild.value.([]byte)...)
-							} else {
-								finalBytes = append(timeBytes, 0) // Add delete flag "0"
-							}
-						} else {
-							if csvChild.valueUpdateTime > 0 && csvChild.valueUpdateTime <= cs.lruTresholdTime && csvChild.purgeState == 0 { // Older than or equal to specific time
-								// currentStoreValue locked by range no locking/unlocking needed
-								currentStoreValue.ConsistencyLoss(system.GetCurrentTimeNs())
-								//fmt.Printf("Consistency lost for key=\"%s\" store\n", currentStoreValue.GetFullKeyString())
-								//fmt.Println("Purging: " + newSuffix)
-								csvChild.TryPurgeReady(false)
-								csvChild.TryPurgeConfirm(false)
+						record := kvRecord{time: csvChild.valueUpdateTime, exists: csvChild.valueExists}
+						if cs.cacheConfig.kvRecordFences {
+							record.fence = Fence{Lock: csvChild.fenceLock, Token: csvChild.fenceToken}
+						}
+						if csvChild.valueExists {
+							record.data = csvChild.value.([]byte)
+						}
+						finalBytes = record.encode()
+					} else {
+						if csvChild.valueUpdateTime > 0 && csvChild.valueUpdateTime <= cs.lruTresholdTime && csvChild.purgeState == 0 { // Older than or equal to specific time
+							// currentStoreValue locked by range no locking/unlocking needed
+							currentStoreValue.ConsistencyLoss(system.GetCurrentTimeNs())
+							//fmt.Printf("Consistency lost for key=\"%s\" store\n", currentStoreValue.GetFullKeyString())
+							//fmt.Println("Purging: " + newSuffix)
+							if csvChild.TryPurgeReady(false) {
+								atomic.AddUint64(&cs.lruPurges, 1)
 							}
+							csvChild.TryPurgeConfirm(false)
 						}
-						csvChild.Unlock("kvLazyWriter")
-
-						// Putting value into KV store ------------------
-						if csvChild.syncNeeded {
-							keyStr := key.(string)
-							_, putErr := kv.Put(cs.toStoreKey(newSuffix), finalBytes)
-							if putErr == nil {
-								csvChild.Lock("kvLazyWriter")
-								if valueUpdateTime == csvChild.valueUpdateTime {
-									csvChild.syncNeeded = false
-								}
-								csvChild.Unlock("kvLazyWriter")
-							} else {
-								fmt.Printf("Store kvLazyWriter cannot update key=%s\n: %s", keyStr, putErr)
+					}
+					csvChild.Unlock("kvLazyWriter")
+
+					// Putting value into KV store ------------------
+					if csvChild.syncNeeded {
+						keyStr := key.(string)
+						_, putErr := kv.Put(cs.toStoreKey(newSuffix), finalBytes)
+						if putErr == nil {
+							csvChild.Lock("kvLazyWriter")
+							if valueUpdateTime == csvChild.valueUpdateTime {
+								csvChild.syncNeeded = false
 							}
+							csvChild.Unlock("kvLazyWriter")
+						} else {
+							cs.logger.Error("Store kvLazyWriter cannot update key", "key", keyStr, logger.ErrorKey, putErr)
 						}
-						// ----------------------------------------------
+					}
+					// ----------------------------------------------
 
-						cacheStoreValueStack = append(cacheStoreValueStack, value.(*StoreValue))
-						suffixPathsStack = append(suffixPathsStack, newSuffix)
-						depthsStack = append(depthsStack, currentDepth+1)
-						return true
-					})
+					cacheStoreValueStack = append(cacheStoreValueStack, value.(*StoreValue))
+					suffixPathsStack = append(suffixPathsStack, newSuffix)
+					depthsStack = append(depthsStack, currentDepth+1)
+					return true
+				})
 
-					if noChildred {
-						currentStoreValue.collectGarbage()
-					}
+				if noChildred {
+					currentStoreValue.collectGarbage()
 				}
+			}
 
-				sort.Slice(lruTimes, func(i, j int) bool { return lruTimes[i] > lruTimes[j] })
-				if len(lruTimes) > cacheConfig.lruSize {
-					cs.lruTresholdTime = lruTimes[cacheConfig.lruSize-1]
-				} else {
-					cs.lruTresholdTime = lruTimes[len(lruTimes)-1]
-				}
+			sort.Slice(lruTimes, func(i, j int) bool { return lruTimes[i] > lruTimes[j] })
+			if len(lruTimes) > cacheConfig.lruSize {
+				cs.lruTresholdTime = lruTimes[cacheConfig.lruSize-1]
+			} else {
+				cs.lruTresholdTime = lruTimes[len(lruTimes)-1]
+			}
 
-				/*// Debug info -----------------------------------------------------
-				if cs.valuesInCache != len(lruTimes) {
-					cmpr := []bool{}
-					for i := 0; i < len(lruTimes); i++ {
-						cmpr = append(cmpr, lruTimes[i] > 0 && lruTimes[i] <= cs.lruTresholdTime)
-					}
-					fmt.Printf("LEFT IN CACHE: %d (%d) - %s %s\n", len(lruTimes), cs.lruTresholdTime, fmt.Sprintln(cmpr), fmt.Sprintln(lruTimes))
+			/*// Debug info -----------------------------------------------------
+			if cs.valuesInCache != len(lruTimes) {
+				cmpr := []bool{}
+				for i := 0; i < len(lruTimes); i++ {
+					cmpr = append(cmpr, lruTimes[i] > 0 && lruTimes[i] <= cs.lruTresholdTime)
 				}
-				// ----------------------------------------------------------------*/
+				fmt.Printf("LEFT IN CACHE: %d (%d) - %s %s\n", len(lruTimes), cs.lruTresholdTime, fmt.Sprintln(cmpr), fmt.Sprintln(lruTimes))
+			}
+			// ----------------------------------------------------------------*/
 
-				cs.valuesInCache = len(lruTimes)
+			cs.valuesInCache = len(lruTimes)
+			atomic.StoreInt64(&cs.kvWriteLagNs, kvWriteLagNs)
 
-				time.Sleep(100 * time.Millisecond) // Prevents too many locks and prevents too much processor time consumption
+			if stopping {
+				return
 			}
+			time.Sleep(100 * time.Millisecond) // Prevents too many locks and prevents too much processor time consumption
 		}
 	}
 	go storeUpdatesHandler(&cs)
@@ -480,7 +548,7 @@ func (cs *Store) SubscribeLevelCallback(key string, callbackID string) chan KeyV
 	if _, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true); parentCacheStoreValue != nil {
 
 		onBufferOverflow := func() {
-			fmt.Printf("WARNING: SubscribeLevelCallback SubscriptionNotificationsBuffer overflow for key=%s!\n", key)
+			cs.logger.Warn("SubscribeLevelCallback SubscriptionNotificationsBuffer overflow!", "key", key)
 		}
 		callbackChannelIn, callbackChannelOut := system.CreateDimSizeChannel[KeyValue](cs.cacheConfig.levelSubscriptionNotificationsBufferMaxSize, onBufferOverflow)
 		parentCacheStoreValue.notifyUpdates.Store(callbackID, callbackChannelIn)
@@ -518,6 +586,7 @@ func (cs *Store) GetValue(key string) ([]byte, error) {
 	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
 		if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
 			cacheMiss = false // Value exists in cache - no cache miss then
+			atomic.AddUint64(&cs.hits, 1)
 			csv.Lock("GetValue")
 			if csv.ValueExists() {
 				if bv, ok := csv.value.([]byte); ok {
@@ -532,16 +601,13 @@ func (cs *Store) GetValue(key string) ([]byte, error) {
 
 	// Cache miss -----------------------------------------
 	if cacheMiss {
+		atomic.AddUint64(&cs.misses, 1)
 		if entry, err := cs.kv.Get(cs.toStoreKey(key)); err == nil {
 			key := cs.fromStoreKey(entry.Key())
-			valueBytes := entry.Value()
-			result = valueBytes[9:]
-
-			if len(valueBytes) >= 9 { // Updated or deleted value exists in KV store
-				appendFlag := valueBytes[8]
-				kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
-				if appendFlag == 1 { // Valid value exists in KV store
-					cs.SetValue(key, result, false, kvRecordTime, "")
+			if record, ok := decodeKVRecord(entry.Value()); ok { // Updated or deleted value exists in KV store
+				result = record.data
+				if record.exists { // Valid value exists in KV store
+					system.MsgOnErrorReturn(cs.setValue(key, result, false, record.time, "", record.fence))
 					resultError = nil
 				}
 			}
@@ -584,11 +650,15 @@ func (cs *Store) TransactionEnd(transactionID string) {
 		if transaction.beginCounter == 0 {
 			cs.transactionsMutex.Lock()
 			for _, op := range transaction.operators {
+				var err error
 				switch op.operatorType {
 				case 0:
-					cs.SetValue(op.key, op.value, op.updateInKV, op.customTime, "")
+					err = cs.SetValueFenced(op.key, op.value, op.updateInKV, op.customTime, "", op.fence)
 				case 1:
-					cs.DeleteValue(op.key, op.updateInKV, op.customTime, "")
+					err = cs.DeleteValueFenced(op.key, op.updateInKV, op.customTime, "", op.fence)
+				}
+				if err != nil {
+					cs.logger.Error("TransactionEnd: operation rejected", "key", op.key, logger.QueryIDKey, transactionID, logger.ErrorKey, err)
 				}
 			}
 			cs.transactionsMutex.Unlock()
@@ -646,6 +716,10 @@ func (cs *Store) SetValueIfDoesNotExist(key string, newValue []byte, updateInKV
 }
 
 func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string) {
+	system.MsgOnErrorReturn(cs.setValue(key, value, updateInKV, customSetTime, transactionID, Fence{}))
+}
+
+func (cs *Store) setValue(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string, fence Fence) error {
 	if customSetTime < 0 {
 		customSetTime = system.GetCurrentTimeNs()
 	}
@@ -656,10 +730,14 @@ func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTi
 			var csvUpdate *StoreValue
 			if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
 				//fmt.Println(">>3 " + key)
-				csv.Put(value, updateInKV, customSetTime)
+				return csv.put(value, updateInKV, customSetTime, fence)
 			} else {
 				//fmt.Println(">>4 " + key)
 				csvUpdate = &StoreValue{value: value, storeMutex: &sync.Mutex{}, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime}
+				if err := csvUpdate.admits(fence); err != nil {
+					return err
+				}
+				csvUpdate.stamp(fence)
 				//fmt.Println(">>5 " + key)
 				parentCacheStoreValue.StoreChild(keyLastToken, csvUpdate, true)
 				//fmt.Println(">>6 " + key)
@@ -669,19 +747,36 @@ func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTi
 		if v, ok := cs.transactions.Load(transactionID); ok {
 			transaction := v.(*Transaction)
 			transaction.mutex.Lock()
-			transaction.operators = append(transaction.operators, &TransactionOperator{operatorType: 0, key: key, value: value, updateInKV: updateInKV, customTime: customSetTime})
+			transaction.operators = append(transaction.operators, &TransactionOperator{operatorType: 0, key: key, value: value, updateInKV: updateInKV, customTime: customSetTime, fence: fence})
 			transaction.mutex.Unlock()
 		} else {
-			fmt.Printf("ERROR SetValue: transaction with id=%s doesn't exist\n", transactionID)
+			cs.logger.Error("SetValue: transaction doesn't exist", logger.QueryIDKey, transactionID)
 		}
 	}
+	return nil
 }
 
+// Stats returns cache counters of the store and its current lag of writes into the NATS KV
+func (cs *Store) Stats() Stats {
+	return Stats{
+		Hits:         atomic.LoadUint64(&cs.hits),
+		Misses:       atomic.LoadUint64(&cs.misses),
+		LRUPurges:    atomic.LoadUint64(&cs.lruPurges),
+		KVWriteLagNs: atomic.LoadInt64(&cs.kvWriteLagNs),
+	}
+}
+
+// Destroy stops the store and blocks until all values not yet synced are flushed into the NATS KV
 func (cs *Store) Destroy() {
 	cs.cancel()
+	<-cs.lazyWriterStopped
 }
 
 func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string) {
+	system.MsgOnErrorReturn(cs.deleteValue(key, updateInKV, customDeleteTime, transactionID, Fence{}))
+}
+
+func (cs *Store) deleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string, fence Fence) error {
 	if customDeleteTime < 0 {
 		customDeleteTime = system.GetCurrentTimeNs()
 	}
@@ -689,7 +784,7 @@ func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64
 		if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
 			if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
 				if csv.valueExists {
-					csv.Delete(updateInKV, customDeleteTime)
+					return csv.delete(updateInKV, customDeleteTime, fence)
 				}
 			}
 		}
@@ -697,12 +792,64 @@ func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64
 		if v, ok := cs.transactions.Load(transactionID); ok {
 			transaction := v.(*Transaction)
 			transaction.mutex.Lock()
-			transaction.operators = append(transaction.operators, &TransactionOperator{operatorType: 1, key: key, value: nil, updateInKV: updateInKV, customTime: customDeleteTime})
+			transaction.operators = append(transaction.operators, &TransactionOperator{operatorType: 1, key: key, value: nil, updateInKV: updateInKV, customTime: customDeleteTime, fence: fence})
 			transaction.mutex.Unlock()
 		} else {
-			fmt.Printf("ERROR DeleteValue: transaction with id=%s doesn't exist\n", transactionID)
+			cs.logger.Error("DeleteValue: transaction doesn't exist", logger.QueryIDKey, transactionID)
+		}
+	}
+	return nil
+}
+
+/*
+DeleteValuesNotUpdatedSince deletes values of keys matching the pattern which were last updated before the time in ns.
+Update times are read from the KV records of the keys, values purged from the cache are not loaded back but deleted
+right in the KV if their records were not changed meanwhile. A value is deleted as of right after its last update, so
+a newer update made concurrently elsewhere is not lost.
+*/
+func (cs *Store) DeleteValuesNotUpdatedSince(pattern string, sinceNs int64) (deleted int) {
+	type kvState struct {
+		updateTime int64
+		revision   uint64
+	}
+	kvStates := map[string]kvState{}
+	w, err := cs.kv.Watch(cs.toStoreKey(pattern))
+	if err != nil {
+		cs.logger.Error("DeleteValuesNotUpdatedSince kv.Watch error", logger.ErrorKey, err)
+		return
+	}
+	for entry := range w.Updates() {
+		if entry == nil { // All current values are delivered
+			break
+		}
+		if record, ok := decodeKVRecord(entry.Value()); ok && record.exists {
+			kvStates[cs.fromStoreKey(entry.Key())] = kvState{updateTime: record.time, revision: entry.Revision()}
+		}
+	}
+	system.MsgOnErrorReturn(w.Stop())
+
+	for key, state := range kvStates {
+		cacheUpdateTime := cs.GetValueUpdateTime(key)
+		if cacheUpdateTime < 0 { // Purged from the cache
+			if state.updateTime >= sinceNs {
+				continue
+			}
+			record := kvRecord{time: state.updateTime + 1}
+			if _, err := cs.kv.Update(cs.toStoreKey(key), record.encode(), state.revision); err == nil {
+				deleted++
+			}
+			continue
+		}
+		updateTime := state.updateTime
+		if cacheUpdateTime > updateTime { // Not yet written into the KV
+			updateTime = cacheUpdateTime
+		}
+		if updateTime > 0 && updateTime < sinceNs {
+			cs.DeleteValue(key, true, updateTime+1, "")
+			deleted++
 		}
 	}
+	return
 }
 
 func (cs *Store) GetKeysByPattern(pattern string) []string {
@@ -719,8 +866,9 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 					break
 				}
 			}
+			system.MsgOnErrorReturn(w.Stop())
 		} else {
-			fmt.Printf("GetKeysByPattern kv.Watch error %s\n", err)
+			cs.logger.Error("GetKeysByPattern kv.Watch error", logger.ErrorKey, err)
 		}
 		//fmt.Println("!!! GetKeysByPattern ended appendKeysFromKV")
 		cs.getKeysByPatternFromKVMutex.Unlock()
@@ -843,7 +991,7 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 				// Cannot restore consistency here
 			}
 		} else {
-			fmt.Printf("ERROR GetKeysByPattern: getLastExistingCacheStoreValueByKey returns nil\n")
+			cs.logger.Error("GetKeysByPattern: getLastExistingCacheStoreValueByKey returns nil", "pattern", pattern)
 		}
 	}
 
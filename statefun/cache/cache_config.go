@@ -2,6 +2,8 @@
 
 package cache
 
+import "github.com/foliagecp/sdk/statefun/logger"
+
 const (
 	KVStorePrefix                               = "store"
 	LRUSize                                     = 1000000
@@ -12,6 +14,8 @@ type Config struct {
 	kvStorePrefix                               string
 	lruSize                                     int
 	levelSubscriptionNotificationsBufferMaxSize int
+	kvRecordFences                              bool
+	logger                                      logger.Logger
 }
 
 func NewCacheConfig() *Config {
@@ -19,6 +23,7 @@ func NewCacheConfig() *Config {
 		kvStorePrefix: KVStorePrefix,
 		lruSize:       LRUSize,
 		levelSubscriptionNotificationsBufferMaxSize: LevelSubscriptionNotificationsBufferMaxSize,
+		kvRecordFences: true,
 	}
 }
 
@@ -36,3 +41,20 @@ func (ro *Config) SetLevelSubscriptionNotificationsBufferMaxSize(levelSubscripti
 	ro.levelSubscriptionNotificationsBufferMaxSize = levelSubscriptionNotificationsBufferMaxSize
 	return ro
 }
+
+/*
+SetKVRecordFences sets whether fences of writes are stored in their NATS KV records, so writes are fenced across
+runtimes (enabled by default). This changes the record format: runtimes of SDK versions without fencing read such
+records as deletes. Disable it while such runtimes share the KV bucket (e.g. during a rolling upgrade), writes are
+fenced by the cache of the writing runtime only then.
+*/
+func (ro *Config) SetKVRecordFences(kvRecordFences bool) *Config {
+	ro.kvRecordFences = kvRecordFences
+	return ro
+}
+
+// SetLogger sets the logger for the store, the default one of the logger package is used if not set
+func (ro *Config) SetLogger(l logger.Logger) *Config {
+	ro.logger = l
+	return ro
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 NJWS Inc.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+// waitForKV waits until the value of the key is written into the KV
+func waitForKV(t *testing.T, kv *statefuntest.MemoryKeyValue, key string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := kv.Get(cache.KVStorePrefix + "." + key); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("value of %s was not written into the KV", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeleteValuesNotUpdatedSince(t *testing.T) {
+	const since = 2000
+	values := map[string]int64{ // Update times
+		"fn.old":    since - 1,
+		"fn.new":    since,
+		"other.old": since - 1,
+	}
+	cs, kv := newStore(t, cache.NewCacheConfig())
+	for key, updateTime := range values {
+		cs.SetValue(key, []byte("v"), true, updateTime, "")
+	}
+	for key := range values {
+		waitForKV(t, kv, key)
+	}
+	expectValues := func(t *testing.T, cs *cache.Store, want map[string]bool) {
+		t.Helper()
+		for key, exists := range want {
+			if _, err := cs.GetValue(key); (err == nil) != exists {
+				t.Errorf("got %s exists=%t, want %t", key, err == nil, exists)
+			}
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		if deleted := cs.DeleteValuesNotUpdatedSince("fn.*", since); deleted != 1 {
+			t.Errorf("got %d deleted values, want 1", deleted)
+		}
+		expectValues(t, cs, map[string]bool{"fn.old": false, "fn.new": true, "other.old": true})
+		if updateTime := cs.GetValueUpdateTime("fn.old"); updateTime != since {
+			t.Errorf("got delete time %d, want right after the last update", updateTime)
+		}
+	})
+
+	t.Run("not cached", func(t *testing.T) {
+		cs.SetValue("fn.older", []byte("v"), true, since-1, "")
+		waitForKV(t, kv, "fn.older")
+		// Another store over the same KV has nothing in its cache
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		other := cache.NewCacheStore(ctx, cache.NewCacheConfig().SetLogger(logger.NewNopLogger()), kv)
+		defer other.Destroy()
+		if deleted := other.DeleteValuesNotUpdatedSince("fn.*", since); deleted != 1 {
+			t.Errorf("got %d deleted values, want 1", deleted)
+		}
+		expectValues(t, other, map[string]bool{"fn.older": false, "fn.old": false, "fn.new": true})
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrFenced is returned when a write is rejected because its fence is stale
+var ErrFenced = errors.New("write is fenced off")
+
+/*
+Fence guards writes made while holding a KV mutex lease. A fenced write is rejected if the lease is not valid anymore
+or if the value was already written under the same mutex with a greater fencing token, i.e. by a newer holder.
+Values remember the fence of their last write in the NATS KV, so writes are fenced across runtimes.
+*/
+type Fence struct {
+	Lock  string      // Key of the mutex, empty for an unfenced write
+	Token uint64      // Fencing token the mutex was acquired with
+	Valid func() bool // Reports whether the lease is still held, nil if not checked
+}
+
+func (f Fence) IsZero() bool {
+	return len(f.Lock) == 0
+}
+
+// admits checks the fence against the fence of the last write of the value, must be called under the value lock
+func (csv *StoreValue) admits(fence Fence) error {
+	if fence.IsZero() {
+		return nil
+	}
+	if fence.Valid != nil && !fence.Valid() {
+		return fmt.Errorf("%w: lease of %s with token %d is lost", ErrFenced, fence.Lock, fence.Token)
+	}
+	if csv.fenceLock == fence.Lock && csv.fenceToken > fence.Token {
+		return fmt.Errorf("%w: %s was acquired with token %d after token %d", ErrFenced, fence.Lock, csv.fenceToken, fence.Token)
+	}
+	return nil
+}
+
+// stamp remembers the fence of the last write of the value, must be called under the value lock
+func (csv *StoreValue) stamp(fence Fence) {
+	if fence.IsZero() {
+		return
+	}
+	if csv.fenceLock != fence.Lock || csv.fenceToken < fence.Token {
+		csv.fenceLock = fence.Lock
+		csv.fenceToken = fence.Token
+	}
+}
+
+// SetValueFenced is SetValue rejecting the write with ErrFenced if the fence is stale. Writes within a transaction are
+// checked when made and once more on its end, ones rejected there are logged.
+func (cs *Store) SetValueFenced(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string, fence Fence) error {
+	if fence.IsZero() {
+		return cs.setValue(key, value, updateInKV, customSetTime, transactionID, fence)
+	}
+	if err := cs.checkFence(key, fence); err != nil {
+		return err
+	}
+	return cs.setValue(key, value, updateInKV, customSetTime, transactionID, fence)
+}
+
+// DeleteValueFenced is DeleteValue rejecting the delete with ErrFenced if the fence is stale. Deletes within a
+// transaction are checked when made and once more on its end, ones rejected there are logged.
+func (cs *Store) DeleteValueFenced(key string, updateInKV bool, customDeleteTime int64, transactionID string, fence Fence) error {
+	if fence.IsZero() {
+		return cs.deleteValue(key, updateInKV, customDeleteTime, transactionID, fence)
+	}
+	if err := cs.checkFence(key, fence); err != nil {
+		return err
+	}
+	return cs.deleteValue(key, updateInKV, customDeleteTime, transactionID, fence)
+}
+
+// checkFence checks the fence against the fence of the last write of the value without writing it
+func (cs *Store) checkFence(key string, fence Fence) error {
+	cs.GetValue(key) // Loads the value along with its fence into the cache on cache miss
+	csv := cs.getLastKeyCacheStoreValue(key)
+	if csv == nil {
+		csv = &StoreValue{}
+	} else {
+		csv.Lock("checkFence")
+		defer csv.Unlock("checkFence")
+	}
+	return csv.admits(fence)
+}
+
+/*
+kvRecord is a value of the cache in the NATS KV:
+[8 bytes time][flag: 1 - value, 0 - deleted][data] or for fenced writes
+[8 bytes time][flag: 3 - value, 2 - deleted][8 bytes fencing token][2 bytes mutex key length][mutex key][data]
+Flags 2 and 3 are not understood by SDK versions without fencing, see Config.SetKVRecordFences.
+*/
+type kvRecord struct {
+	time   int64
+	exists bool
+	fence  Fence
+	data   []byte
+}
+
+func (r kvRecord) encode() []byte {
+	flag := byte(0)
+	if r.exists {
+		flag = 1
+	}
+	b := make([]byte, 0, 9+10+len(r.fence.Lock)+len(r.data))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.time))
+	if r.fence.IsZero() {
+		b = append(b, flag)
+	} else {
+		b = append(b, flag+2)
+		b = binary.BigEndian.AppendUint64(b, r.fence.Token)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.fence.Lock)))
+		b = append(b, r.fence.Lock...)
+	}
+	return append(b, r.data...)
+}
+
+func decodeKVRecord(b []byte) (r kvRecord, ok bool) {
+	if len(b) < 9 {
+		return r, false
+	}
+	r.time = int64(binary.BigEndian.Uint64(b[:8]))
+	flag := b[8]
+	r.exists = flag&1 == 1
+	b = b[9:]
+	if flag >= 2 {
+		if len(b) < 10 {
+			return r, false
+		}
+		r.fence.Token = binary.BigEndian.Uint64(b[:8])
+		lockLen := int(binary.BigEndian.Uint16(b[8:10]))
+		if len(b) < 10+lockLen {
+			return r, false
+		}
+		r.fence.Lock = string(b[10 : 10+lockLen])
+		b = b[10+lockLen:]
+	}
+	r.data = b
+	return r, true
+}
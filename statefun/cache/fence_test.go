@@ -0,0 +1,95 @@
+// Copyright 2023 NJWS Inc.
+
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+func newStore(t *testing.T, config *cache.Config) (*cache.Store, *statefuntest.MemoryKeyValue) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	kv := statefuntest.NewMemoryKeyValue("cache_test")
+	cs := cache.NewCacheStore(ctx, config.SetLogger(logger.NewNopLogger()), kv)
+	t.Cleanup(func() {
+		cs.Destroy()
+		cancel()
+	})
+	return cs, kv
+}
+
+func TestFencedWriteInTransaction(t *testing.T) {
+	cs, _ := newStore(t, cache.NewCacheConfig())
+	newer := cache.Fence{Lock: "lock", Token: 2}
+	if err := cs.SetValueFenced("a", []byte("newer"), true, -1, "", newer); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		write func(transactionID string, fence cache.Fence) error
+	}{
+		{name: "set", write: func(transactionID string, fence cache.Fence) error {
+			return cs.SetValueFenced("a", []byte("stale"), true, -1, transactionID, fence)
+		}},
+		{name: "delete", write: func(transactionID string, fence cache.Fence) error {
+			return cs.DeleteValueFenced("a", true, -1, transactionID, fence)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs.TransactionBegin("tx")
+			if err := tt.write("tx", cache.Fence{Lock: "lock", Token: 1}); !errors.Is(err, cache.ErrFenced) {
+				t.Errorf("got %v for an older token, want ErrFenced", err)
+			}
+			lost := cache.Fence{Lock: "lock", Token: 3, Valid: func() bool { return false }}
+			if err := tt.write("tx", lost); !errors.Is(err, cache.ErrFenced) {
+				t.Errorf("got %v for a lost lease, want ErrFenced", err)
+			}
+			cs.TransactionEnd("tx")
+			if value, err := cs.GetValue("a"); err != nil || string(value) != "newer" {
+				t.Errorf("got value %q (%v), want the newer one", value, err)
+			}
+		})
+	}
+}
+
+func TestKVRecordFences(t *testing.T) {
+	tests := []struct {
+		name     string
+		fences   bool
+		wantFlag byte
+	}{
+		{name: "enabled", fences: true, wantFlag: 3},
+		{name: "disabled for older runtimes", fences: false, wantFlag: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, kv := newStore(t, cache.NewCacheConfig().SetKVRecordFences(tt.fences))
+			if err := cs.SetValueFenced("a", []byte("v"), true, -1, "", cache.Fence{Lock: "lock", Token: 1}); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				entry, err := kv.Get(cache.KVStorePrefix + ".a")
+				if err == nil && len(entry.Value()) > 8 {
+					if flag := entry.Value()[8]; flag != tt.wantFlag {
+						t.Errorf("got record flag %d, want %d", flag, tt.wantFlag)
+					}
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("value was not written into the KV")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
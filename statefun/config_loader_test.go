@@ -0,0 +1,200 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEnvPrefix = "STATEFUN_TEST"
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigRuntime(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		check   func(t *testing.T, rc *RuntimeConfig)
+	}{
+		{
+			name: "defaults without file and env",
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if rc.natsURL != NatsURL || rc.kvMutexLifeTimeSec != KVMutexLifetimeSec {
+					t.Errorf("got nats_url=%s kv_mutex_lifetime_sec=%d, want defaults", rc.natsURL, rc.kvMutexLifeTimeSec)
+				}
+			},
+		},
+		{
+			name:    "yaml file",
+			file:    "config.yaml",
+			content: "runtime:\n  nats_url: nats://file:4222\n  kv_mutex_lifetime_sec: 7\n",
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if rc.natsURL != "nats://file:4222" || rc.kvMutexLifeTimeSec != 7 {
+					t.Errorf("got nats_url=%s kv_mutex_lifetime_sec=%d", rc.natsURL, rc.kvMutexLifeTimeSec)
+				}
+			},
+		},
+		{
+			name:    "json file",
+			file:    "config.json",
+			content: `{"runtime": {"nats_url": "nats://file:4222"}}`,
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if rc.natsURL != "nats://file:4222" {
+					t.Errorf("got nats_url=%s", rc.natsURL)
+				}
+			},
+		},
+		{
+			name:    "env over file",
+			file:    "config.yaml",
+			content: "runtime:\n  nats_url: nats://file:4222\n  kv_mutex_lifetime_sec: 7\n",
+			env:     map[string]string{testEnvPrefix + "_RUNTIME_NATS_URL": "nats://env:4222"},
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if rc.natsURL != "nats://env:4222" {
+					t.Errorf("got nats_url=%s, want the env one", rc.natsURL)
+				}
+				if rc.kvMutexLifeTimeSec != 7 {
+					t.Errorf("got kv_mutex_lifetime_sec=%d, want the file one", rc.kvMutexLifeTimeSec)
+				}
+			},
+		},
+		{
+			name: "nats servers split and trimmed",
+			env:  map[string]string{testEnvPrefix + "_RUNTIME_NATS_SERVERS": " nats://a:4222, nats://b:4222 ,,"},
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if want := []string{"nats://a:4222", "nats://b:4222"}; !reflect.DeepEqual(rc.natsServers, want) {
+					t.Errorf("got nats servers %q, want %q", rc.natsServers, want)
+				}
+			},
+		},
+		{
+			name: "empty yaml file",
+			file: "config.yaml",
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if rc.natsURL != NatsURL {
+					t.Errorf("got nats_url=%s, want the default", rc.natsURL)
+				}
+			},
+		},
+		{
+			name: "empty json file",
+			file: "config.json",
+			check: func(t *testing.T, rc *RuntimeConfig) {
+				if rc.natsURL != NatsURL {
+					t.Errorf("got nats_url=%s, want the default", rc.natsURL)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if len(tt.file) > 0 {
+				path = writeConfigFile(t, tt.file, tt.content)
+			}
+			lc, err := LoadConfig(path, testEnvPrefix)
+			if err != nil {
+				t.Fatalf("LoadConfig: %s", err)
+			}
+			tt.check(t, lc.Runtime)
+		})
+	}
+}
+
+func TestLoadConfigFunctionTypeOverrides(t *testing.T) {
+	content := `
+function_types:
+  "*":
+    msg_ack_wait_ms: 20000
+    options:
+      a: 1
+  test.fn:
+    max_deliver: 5
+    msg_channel_size: 10
+    options:
+      b: 2
+`
+	tests := []struct {
+		name           string
+		typename       string
+		env            map[string]string
+		wantAckWaitMs  int
+		wantMaxDeliver int
+		wantOptions    string
+	}{
+		{name: "all function types", typename: "other.fn", wantAckWaitMs: 20000, wantMaxDeliver: MsgMaxDeliver, wantOptions: `{"a":1}`},
+		{name: "typename over all function types", typename: "test.fn", wantAckWaitMs: 20000, wantMaxDeliver: 5, wantOptions: `{"a":1,"b":2}`},
+		{
+			name:           "env over all function types",
+			typename:       "test.fn",
+			env:            map[string]string{testEnvPrefix + "_FUNCTION_TYPES_MSG_ACK_WAIT_MS": "30000", testEnvPrefix + "_FUNCTION_TYPES_MAX_DELIVER": "3"},
+			wantAckWaitMs:  30000,
+			wantMaxDeliver: 5, // Env applies to all function types, the typename one is more specific
+			wantOptions:    `{"a":1,"b":2}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			lc, err := LoadConfig(writeConfigFile(t, "config.yaml", content), testEnvPrefix)
+			if err != nil {
+				t.Fatalf("LoadConfig: %s", err)
+			}
+			ftc := lc.Runtime.applyFunctionTypeOverrides(tt.typename, *NewFunctionTypeConfig())
+			if ftc.msgAckWaitMs != tt.wantAckWaitMs || ftc.maxDeliver != tt.wantMaxDeliver {
+				t.Errorf("got msg_ack_wait_ms=%d max_deliver=%d, want %d and %d", ftc.msgAckWaitMs, ftc.maxDeliver, tt.wantAckWaitMs, tt.wantMaxDeliver)
+			}
+			if ftc.options == nil || ftc.options.ToString() != tt.wantOptions {
+				t.Errorf("got options %v, want %s", ftc.options, tt.wantOptions)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		env       map[string]string
+		wantError string
+	}{
+		{name: "unknown field", file: "config.yaml", content: "runtime:\n  nats_uri: nats://file:4222\n", wantError: "nats_uri"},
+		{name: "not positive", file: "config.yaml", content: "runtime:\n  kv_mutex_lifetime_sec: 0\n", wantError: "kv_mutex_lifetime_sec"},
+		{name: "typename max deliver", file: "config.json", content: `{"function_types": {"test.fn": {"max_deliver": 0}}}`, wantError: "function_types.test.fn.max_deliver"},
+		{name: "env not a number", env: map[string]string{testEnvPrefix + "_CACHE_LRU_SIZE": "many"}, wantError: testEnvPrefix + "_CACHE_LRU_SIZE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if len(tt.file) > 0 {
+				path = writeConfigFile(t, tt.file, tt.content)
+			}
+			_, err := LoadConfig(path, testEnvPrefix)
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got error %v, want one about %s", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+)
+
+const (
+	// ContextVersionKey is the key of the context schema version stored in versioned function contexts
+	ContextVersionKey = "__context_version"
+)
+
+// ContextMigration upgrades a context from one schema version to the next one
+type ContextMigration func(context *easyjson.JSON) (*easyjson.JSON, error)
+
+/*
+MigrateContext applies migrations to the context stored at an older schema version, the i-th migration upgrades
+version i to i+1. A context without a version has version 0. Returns the context without the version key and whether
+it was migrated. Function types apply it to contexts they read, it is exported for test harnesses to do the same.
+*/
+func MigrateContext(context *easyjson.JSON, migrations []ContextMigration) (*easyjson.JSON, bool, error) {
+	if !context.IsObject() {
+		return context, false, nil
+	}
+	version := 0
+	if v, ok := context.GetByPath(ContextVersionKey).AsNumeric(); ok {
+		version = int(v)
+		context.RemoveByPath(ContextVersionKey)
+	}
+	if version > len(migrations) {
+		return nil, false, fmt.Errorf("context version %d is newer than the latest known one %d", version, len(migrations))
+	}
+
+	migrated := version < len(migrations)
+	for ; version < len(migrations); version++ {
+		next, err := migrations[version](context)
+		if err != nil {
+			return nil, false, fmt.Errorf("context migration from version %d failed: %w", version, err)
+		}
+		if next == nil {
+			next = easyjson.NewJSONObject().GetPtr()
+		}
+		context = next
+	}
+	return context, migrated, nil
+}
+
+// VersionedContext returns a copy of the context with the latest schema version set, non-object contexts are returned as is
+func VersionedContext(context *easyjson.JSON, migrations []ContextMigration) *easyjson.JSON {
+	if len(migrations) == 0 || !context.IsObject() {
+		return context
+	}
+	versioned := context.Clone()
+	versioned.SetByPath(ContextVersionKey, easyjson.NewJSON(len(migrations)))
+	return &versioned
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+)
+
+// testMigrations renames "a" to "b" (version 0 to 1) and adds "c" (version 1 to 2)
+var testMigrations = []ContextMigration{
+	func(context *easyjson.JSON) (*easyjson.JSON, error) {
+		migrated := easyjson.NewJSONObjectWithKeyValue("b", context.GetByPath("a"))
+		return &migrated, nil
+	},
+	func(context *easyjson.JSON) (*easyjson.JSON, error) {
+		context.SetByPath("c", easyjson.NewJSON(true))
+		return context, nil
+	},
+}
+
+func TestMigrateContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		context     string
+		migrations  []ContextMigration
+		want        string
+		wantChanged bool
+		wantError   string
+	}{
+		{name: "chain from no version", context: `{"a":1}`, migrations: testMigrations, want: `{"b":1,"c":true}`, wantChanged: true},
+		{name: "chain from version", context: `{"__context_version":1,"b":1}`, migrations: testMigrations, want: `{"b":1,"c":true}`, wantChanged: true},
+		{name: "latest version", context: `{"__context_version":2,"b":1}`, migrations: testMigrations, want: `{"b":1}`},
+		{name: "no migrations", context: `{"a":1}`, want: `{"a":1}`},
+		{name: "newer version", context: `{"__context_version":3}`, migrations: testMigrations, wantError: "context version 3 is newer than the latest known one 2"},
+		{
+			name:    "nil result",
+			context: `{"a":1}`,
+			migrations: []ContextMigration{
+				func(*easyjson.JSON) (*easyjson.JSON, error) { return nil, nil },
+			},
+			want:        `{}`,
+			wantChanged: true,
+		},
+		{
+			name:    "failure",
+			context: `{"a":1}`,
+			migrations: append([]ContextMigration{testMigrations[0]}, func(*easyjson.JSON) (*easyjson.JSON, error) {
+				return nil, errors.New("broken")
+			}),
+			wantError: "context migration from version 1 failed: broken",
+		},
+		{name: "non-object", context: `[1,2]`, migrations: testMigrations, want: `[1,2]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			context, ok := easyjson.JSONFromString(tt.context)
+			if !ok {
+				t.Fatalf("invalid context %s", tt.context)
+			}
+			got, changed, err := MigrateContext(&context, tt.migrations)
+			if len(tt.wantError) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Errorf("got error %v, want %s", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ToString() != tt.want || changed != tt.wantChanged {
+				t.Errorf("got %s changed=%t, want %s changed=%t", got.ToString(), changed, tt.want, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestVersionedContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		context    string
+		migrations []ContextMigration
+		want       string
+	}{
+		{name: "versioned", context: `{"b":1}`, migrations: testMigrations, want: `{"__context_version":2,"b":1}`},
+		{name: "no migrations", context: `{"b":1}`, want: `{"b":1}`},
+		{name: "non-object", context: `"s"`, migrations: testMigrations, want: `"s"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			context, ok := easyjson.JSONFromString(tt.context)
+			if !ok {
+				t.Fatalf("invalid context %s", tt.context)
+			}
+			if got := VersionedContext(&context, tt.migrations).ToString(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if context.ToString() != tt.context {
+				t.Errorf("context is modified: %s", context.ToString())
+			}
+		})
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		context := easyjson.NewJSONObjectWithKeyValue("b", easyjson.NewJSON(1))
+		got, changed, err := MigrateContext(VersionedContext(&context, testMigrations), testMigrations)
+		if err != nil || changed || got.ToString() != context.ToString() {
+			t.Errorf("got %s changed=%t (%v), want %s unchanged", got.ToString(), changed, err, context.ToString())
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun cron package.
+// Provides parsing of cron-like schedule specifications
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes recurring activation times
+type Schedule interface {
+	// Next returns the first activation time after t, zero time if there is none
+	Next(t time.Time) time.Time
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+type fieldsSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+type fieldBounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteBounds = fieldBounds{0, 59, nil}
+	hourBounds   = fieldBounds{0, 23, nil}
+	domBounds    = fieldBounds{1, 31, nil}
+	monthBounds  = fieldBounds{1, 12, map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}}
+	dowBounds    = fieldBounds{0, 7, map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+/*
+Parse parses a schedule specification which is one of:
+
+	"<minute> <hour> <day of month> <month> <day of week>" - standard cron fields supporting "*", lists "1,2", ranges "1-5", steps "*\/15" and names "jan", "mon"
+	"@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly"
+	"@every <duration>" - e.g. "@every 1m30s"
+*/
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be at least 1s", spec)
+		}
+		return everySchedule{interval: interval}, nil
+	}
+	if d, ok := descriptors[spec]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields, got %d", spec, len(fields))
+	}
+	s := &fieldsSchedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q minute: %w", spec, err)
+	}
+	if s.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q hour: %w", spec, err)
+	}
+	if s.dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q day of month: %w", spec, err)
+	}
+	if s.month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q month: %w", spec, err)
+	}
+	if s.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q day of week: %w", spec, err)
+	}
+	if s.dow&(1<<7) != 0 { // 7 is also sunday
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return s, nil
+}
+
+func parseField(field string, bounds fieldBounds) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		var from, to int
+		switch {
+		case part == "*" || part == "?":
+			from, to = bounds.min, bounds.max
+		case strings.Contains(part, "-"):
+			rangeTokens := strings.SplitN(part, "-", 2)
+			if from, err = parseValue(rangeTokens[0], bounds); err != nil {
+				return 0, err
+			}
+			if to, err = parseValue(rangeTokens[1], bounds); err != nil {
+				return 0, err
+			}
+		default:
+			if from, err = parseValue(part, bounds); err != nil {
+				return 0, err
+			}
+			to = from
+			if step > 1 {
+				to = bounds.max
+			}
+		}
+		if from > to {
+			return 0, fmt.Errorf("invalid range in %q", part)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, bounds fieldBounds) (int, error) {
+	if v, ok := bounds.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < bounds.min || v > bounds.max {
+		return 0, fmt.Errorf("value %d is out of range [%d, %d]", v, bounds.min, bounds.max)
+	}
+	return v, nil
+}
+
+/*
+Next returns the first activation time after t in t's location. Activations in the hour skipped by a daylight saving
+time change are skipped, the ones in the hour repeated by it happen in both offsets.
+*/
+func (s *fieldsSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + 5
+
+	for t.Year() <= yearLimit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute) // Not time.Date, the next hour may be skipped
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// advance moves t to next unless time.Date normalized next, the midnight skipped by a daylight saving time change, to
+// an earlier time. t is moved by an hour then to get out of the skipped time.
+func advance(t time.Time, next time.Time) time.Time {
+	if !next.After(t) {
+		return t.Add(time.Hour)
+	}
+	return next
+}
+
+// dayMatches follows the cron rule: if both day of month and day of week are restricted, either of them has to match
+func (s *fieldsSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 NJWS Inc.
+
+package cron_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/cron"
+)
+
+func mustTime(t *testing.T, location *time.Location, value string) time.Time {
+	t.Helper()
+	tm, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want []string // Consecutive activations after from
+	}{
+		{name: "every minute", spec: "* * * * *", from: "2023-01-01 10:00", want: []string{"2023-01-01 10:01", "2023-01-01 10:02"}},
+		{name: "minute and hour", spec: "30 9 * * *", from: "2023-01-01 10:00", want: []string{"2023-01-02 09:30", "2023-01-03 09:30"}},
+		{name: "list", spec: "0,15 12 * * *", from: "2023-01-01 12:00", want: []string{"2023-01-01 12:15", "2023-01-02 12:00"}},
+		{name: "range", spec: "0 9-10 * * *", from: "2023-01-01 09:00", want: []string{"2023-01-01 10:00", "2023-01-02 09:00"}},
+		{name: "step", spec: "*/20 * * * *", from: "2023-01-01 10:00", want: []string{"2023-01-01 10:20", "2023-01-01 10:40", "2023-01-01 11:00"}},
+		{name: "step from value", spec: "50/5 * * * *", from: "2023-01-01 10:00", want: []string{"2023-01-01 10:50", "2023-01-01 10:55", "2023-01-01 11:50"}},
+		{name: "step of range", spec: "0 8-12/2 * * *", from: "2023-01-01 09:00", want: []string{"2023-01-01 10:00", "2023-01-01 12:00", "2023-01-02 08:00"}},
+		{name: "month names", spec: "0 0 1 jan,JUL *", from: "2023-02-01 00:00", want: []string{"2023-07-01 00:00", "2024-01-01 00:00"}},
+		{name: "day of week names", spec: "0 0 * * mon-wed", from: "2023-01-01 00:00", want: []string{"2023-01-02 00:00", "2023-01-03 00:00", "2023-01-04 00:00", "2023-01-09 00:00"}},
+		{name: "sunday as 7", spec: "0 0 * * 7", from: "2023-01-02 00:00", want: []string{"2023-01-08 00:00"}},
+		{name: "day of month or day of week", spec: "0 0 13 * fri", from: "2023-01-01 00:00", want: []string{"2023-01-06 00:00", "2023-01-13 00:00", "2023-01-20 00:00"}},
+		{name: "day of month and any day of week", spec: "0 0 13 * *", from: "2023-01-01 00:00", want: []string{"2023-01-13 00:00", "2023-02-13 00:00"}},
+		{name: "any day of month and day of week", spec: "0 0 ? * fri", from: "2023-01-01 00:00", want: []string{"2023-01-06 00:00", "2023-01-13 00:00"}},
+		{name: "leap day", spec: "0 0 29 2 *", from: "2023-01-01 00:00", want: []string{"2024-02-29 00:00", "2028-02-29 00:00"}},
+		{name: "never", spec: "0 0 31 2 *", from: "2023-01-01 00:00", want: []string{"0001-01-01 00:00"}},
+		{name: "yearly", spec: "@yearly", from: "2023-06-01 00:00", want: []string{"2024-01-01 00:00"}},
+		{name: "monthly", spec: "@monthly", from: "2023-06-01 00:00", want: []string{"2023-07-01 00:00"}},
+		{name: "weekly", spec: "@weekly", from: "2023-01-02 00:00", want: []string{"2023-01-08 00:00"}},
+		{name: "daily", spec: "@daily", from: "2023-01-01 12:00", want: []string{"2023-01-02 00:00"}},
+		{name: "hourly", spec: "@hourly", from: "2023-01-01 12:30", want: []string{"2023-01-01 13:00"}},
+		{name: "every", spec: "@every 1h30m", from: "2023-01-01 12:30", want: []string{"2023-01-01 14:00", "2023-01-01 15:30"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := cron.Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := mustTime(t, time.UTC, tt.from)
+			for _, want := range tt.want {
+				next = s.Next(next)
+				if got := next.Format("2006-01-02 15:04"); got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNextSeconds(t *testing.T) {
+	s, err := cron.Parse("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2023, 1, 1, 10, 0, 59, 999, time.UTC)
+	if got, want := s.Next(from), time.Date(2023, 1, 1, 10, 1, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		spec     string
+		from     string
+		want     []time.Time
+	}{
+		{
+			name:     "skipped hour of spring forward",
+			location: "America/New_York",
+			spec:     "30 2 * * *",
+			from:     "2023-03-11 03:00",
+			want:     []time.Time{time.Date(2023, 3, 13, 6, 30, 0, 0, time.UTC)}, // 02:30 does not exist on 2023-03-12
+		},
+		{
+			name:     "hour after spring forward",
+			location: "America/New_York",
+			spec:     "30 3 * * *",
+			from:     "2023-03-12 00:00",
+			want:     []time.Time{time.Date(2023, 3, 12, 7, 30, 0, 0, time.UTC)}, // 03:30 EDT
+		},
+		{
+			name:     "repeated hour of fall back",
+			location: "America/New_York",
+			spec:     "30 1 * * *",
+			from:     "2023-11-05 00:00",
+			want: []time.Time{
+				time.Date(2023, 11, 5, 5, 30, 0, 0, time.UTC), // 01:30 EDT
+				time.Date(2023, 11, 5, 6, 30, 0, 0, time.UTC), // 01:30 EST
+				time.Date(2023, 11, 6, 6, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:     "every keeps the interval",
+			location: "America/New_York",
+			spec:     "@every 1h",
+			from:     "2023-03-12 01:00",
+			want:     []time.Time{time.Date(2023, 3, 12, 7, 0, 0, 0, time.UTC)}, // 03:00 EDT
+		},
+		{
+			name:     "skipped midnight",
+			location: "America/Sao_Paulo",
+			spec:     "0 12 * * *",
+			from:     "2018-11-03 13:00",
+			want:     []time.Time{time.Date(2018, 11, 4, 14, 0, 0, 0, time.UTC)}, // Clocks moved from 00:00 to 01:00
+		},
+		{
+			name:     "activation at skipped midnight",
+			location: "America/Sao_Paulo",
+			spec:     "0 0 * * *",
+			from:     "2018-11-03 12:00",
+			want:     []time.Time{time.Date(2018, 11, 5, 2, 0, 0, 0, time.UTC)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, err := time.LoadLocation(tt.location)
+			if err != nil {
+				t.Skip("no time zone database:", err)
+			}
+			s, err := cron.Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := mustTime(t, location, tt.from)
+			for _, want := range tt.want {
+				next = s.Next(next)
+				if !next.Equal(want) {
+					t.Fatalf("got %s, want %s", next, want.In(location))
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantError string
+	}{
+		{name: "empty", spec: "", wantError: "expected 5 fields, got 0"},
+		{name: "too many fields", spec: "0 0 * * * *", wantError: "expected 5 fields, got 6"},
+		{name: "minute out of range", spec: "60 * * * *", wantError: "minute: value 60 is out of range [0, 59]"},
+		{name: "hour out of range", spec: "0 24 * * *", wantError: "hour: value 24 is out of range [0, 23]"},
+		{name: "day of month zero", spec: "0 0 0 * *", wantError: "day of month: value 0 is out of range [1, 31]"},
+		{name: "unknown month name", spec: "0 0 1 foo *", wantError: `month: invalid value "foo"`},
+		{name: "day of week out of range", spec: "0 0 * * 8", wantError: "day of week: value 8 is out of range [0, 7]"},
+		{name: "reversed range", spec: "0 5-1 * * *", wantError: `hour: invalid range in "5-1"`},
+		{name: "zero step", spec: "*/0 * * * *", wantError: `minute: invalid step in "*/0"`},
+		{name: "step not a number", spec: "*/x * * * *", wantError: `minute: invalid step in "*/x"`},
+		{name: "unknown descriptor", spec: "@sometimes", wantError: "expected 5 fields, got 1"},
+		{name: "every without a duration", spec: "@every x", wantError: `invalid schedule "@every x": time: invalid duration`},
+		{name: "every too often", spec: "@every 500ms", wantError: "interval must be at least 1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cron.Parse(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got error %v, want %s", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	maxDeliveriesAdvisoryPrefix = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES"
+
+	DeadLetterTypenameHeader      = "Statefun-Typename"
+	DeadLetterIDHeader            = "Statefun-Id"
+	DeadLetterErrorHeader         = "Statefun-Error"
+	DeadLetterDeliveryCountHeader = "Statefun-Delivery-Count"
+)
+
+func (r *Runtime) createDeadLetterStream() error {
+	if _, err := r.js.StreamInfo(r.config.deadLetterStreamName); err == nil {
+		return nil
+	} else if err != nats.ErrStreamNotFound {
+		return err
+	}
+	_, err := r.js.AddStream(&nats.StreamConfig{
+		Name:     r.config.deadLetterStreamName,
+		Subjects: []string{r.config.deadLetterSubjectPrefix + ".>"},
+	})
+	return err
+}
+
+/*
+ReplayDeadLetters publishes messages from the dead letter stream back to functions they were addressed to and removes them from the
+dead letter stream. If typename is empty messages for all function types are replayed. Returns the number of replayed messages.
+
+Each dead letter message keeps the original message data, the typename, id, error and delivery count are stored in its headers:
+Statefun-Typename, Statefun-Id, Statefun-Error, Statefun-Delivery-Count.
+*/
+func (r *Runtime) ReplayDeadLetters(typename string) (replayed int, err error) {
+	filterSubject := r.config.deadLetterSubjectPrefix + ".>"
+	if len(typename) > 0 {
+		filterSubject = r.config.deadLetterSubjectPrefix + "." + typename + ".*"
+	}
+
+	sub, err := r.js.SubscribeSync(filterSubject, nats.BindStream(r.config.deadLetterStreamName), nats.DeliverAll(), nats.AckNone())
+	if err != nil {
+		return 0, err
+	}
+	defer func() { system.MsgOnErrorReturn(sub.Unsubscribe()) }()
+
+	for {
+		msg, err := sub.NextMsg(time.Second)
+		if err == nats.ErrTimeout { // No messages left
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return replayed, err
+		}
+
+		targetTypename := msg.Header.Get(DeadLetterTypenameHeader)
+		targetID := msg.Header.Get(DeadLetterIDHeader)
+		if len(targetTypename) == 0 || len(targetID) == 0 {
+			r.logger.Warn("Dead letter message has no typename or id, skipping", "sequence", meta.Sequence.Stream)
+		} else {
+			if _, err := r.js.Publish(targetTypename+"."+targetID, msg.Data); err != nil {
+				return replayed, err
+			}
+			if err := r.js.DeleteMsg(r.config.deadLetterStreamName, meta.Sequence.Stream); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+
+		if meta.NumPending == 0 {
+			return replayed, nil
+		}
+	}
+}
+
+// retryOrDeadLetter NAKs a message the handler failed on, or moves it to the dead letter stream if it was the last delivery
+func (ft *FunctionType) retryOrDeadLetter(id string, msg *nats.Msg, handlerErr error) {
+	if meta, err := msg.Metadata(); err == nil && ft.config.maxDeliver > 0 && meta.NumDelivered >= uint64(ft.config.maxDeliver) {
+		ft.deadLetter(id, msg.Data, handlerErr, meta.NumDelivered)
+		system.MsgOnErrorReturn(msg.Term())
+		return
+	}
+	system.MsgOnErrorReturn(msg.Nak())
+	ft.metrics.nak(NakReasonHandlerFailed)
+}
+
+func (ft *FunctionType) deadLetterNatsMsg(id string, msg *nats.Msg, err error) {
+	var deliveryCount uint64 = 1
+	if meta, e := msg.Metadata(); e == nil {
+		deliveryCount = meta.NumDelivered
+	}
+	ft.deadLetter(id, msg.Data, err, deliveryCount)
+}
+
+func (ft *FunctionType) deadLetter(id string, data []byte, err error, deliveryCount uint64) {
+	ft.logger.Warn("Message is moved to the dead letter stream", logger.IDKey, id, "deliveries", deliveryCount, logger.ErrorKey, err)
+
+	dlMsg := nats.NewMsg(ft.runtime.config.deadLetterSubjectPrefix + "." + ft.name + "." + id)
+	dlMsg.Header.Set(DeadLetterTypenameHeader, ft.name)
+	dlMsg.Header.Set(DeadLetterIDHeader, id)
+	dlMsg.Header.Set(DeadLetterErrorHeader, err.Error())
+	dlMsg.Header.Set(DeadLetterDeliveryCountHeader, strconv.FormatUint(deliveryCount, 10))
+	dlMsg.Data = data
+	_, pubErr := ft.runtime.js.PublishMsg(dlMsg)
+	system.MsgOnErrorReturn(pubErr)
+}
+
+// handleMaxDeliveriesAdvisory moves a message which reached max deliveries without being handled (for e.g. was NAK'd because
+// of the locked mutex every time) to the dead letter stream
+func (ft *FunctionType) handleMaxDeliveriesAdvisory(advisory *nats.Msg) {
+	j, ok := easyjson.JSONFromBytes(advisory.Data)
+	if !ok {
+		return
+	}
+	streamSeq := uint64(j.GetByPath("stream_seq").AsNumericDefault(0))
+	deliveries := uint64(j.GetByPath("deliveries").AsNumericDefault(0))
+
+	msg, err := ft.runtime.js.GetMsg(ft.streamName, streamSeq)
+	if err != nil {
+		system.MsgOnErrorReturn(err)
+		return
+	}
+	tokens := strings.Split(msg.Subject, ".")
+	id := tokens[len(tokens)-1]
+
+	ft.deadLetter(id, msg.Data, fmt.Errorf("maximum deliveries exceeded"), deliveries)
+	system.MsgOnErrorReturn(ft.runtime.js.DeleteMsg(ft.streamName, streamSeq))
+}
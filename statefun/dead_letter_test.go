@@ -0,0 +1,133 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestDeadLetters(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	const (
+		failingTypename = "dead_letter.failing"
+		lockedTypename  = "dead_letter.locked"
+	)
+	var failing atomic.Bool
+	calls := make(chan string, 10)
+	handler := func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls <- contextProcessor.Self.Typename + "." + contextProcessor.Self.ID
+		if failing.Load() {
+			panic("failing")
+		}
+	}
+	r := startTestRuntime(t, newTestRuntimeConfig(newTestServer(t)), func(r *Runtime) {
+		NewFunctionType(r, failingTypename, handler, *NewFunctionTypeConfig().SetBalanceNeeded(false).SetMaxDeliver(2))
+		NewFunctionType(r, lockedTypename, handler, *NewFunctionTypeConfig().SetMaxDeliver(2).SetMsgAckWaitMs(200))
+	})
+
+	// deadLetter waits for the dead letter of the function and returns it
+	deadLetter := func(t *testing.T, typename string, id string) *nats.RawStreamMsg {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			msg, err := r.js.GetLastMsg(r.config.deadLetterStreamName, r.config.deadLetterSubjectPrefix+"."+typename+"."+id)
+			if err == nil {
+				return msg
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("no dead letter: %s", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	expectCalls := func(t *testing.T, want string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case got := <-calls:
+				if got != want {
+					t.Fatalf("got call of %s, want %s", got, want)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("got %d calls of %s, want %d", i, want, n)
+			}
+		}
+	}
+	replay := func(t *testing.T, typename string) {
+		t.Helper()
+		replayed, err := r.ReplayDeadLetters(typename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replayed != 1 {
+			t.Fatalf("got %d replayed messages, want 1", replayed)
+		}
+		if _, err := r.js.GetLastMsg(r.config.deadLetterStreamName, r.config.deadLetterSubjectPrefix+"."+typename+".*"); err == nil {
+			t.Error("replayed message is kept in the dead letter stream")
+		}
+	}
+	payload := easyjson.NewJSONObjectWithKeyValue("n", easyjson.NewJSON(1))
+
+	t.Run("handler failures", func(t *testing.T) {
+		failing.Store(true)
+		r.IngressNATS(failingTypename, "a", &payload, nil)
+		expectCalls(t, failingTypename+".a", 2) // Retried till max deliveries
+		failing.Store(false)
+
+		msg := deadLetter(t, failingTypename, "a")
+		if got := msg.Header.Get(DeadLetterTypenameHeader); got != failingTypename {
+			t.Errorf("got typename header %q", got)
+		}
+		if got := msg.Header.Get(DeadLetterIDHeader); got != "a" {
+			t.Errorf("got id header %q", got)
+		}
+		if got := msg.Header.Get(DeadLetterErrorHeader); !strings.Contains(got, "panicked: failing") {
+			t.Errorf("got error header %q", got)
+		}
+		if got := msg.Header.Get(DeadLetterDeliveryCountHeader); got != "2" {
+			t.Errorf("got delivery count header %q, want 2", got)
+		}
+		if data, _ := easyjson.JSONFromBytes(msg.Data); data.GetByPath("payload").ToString() != payload.ToString() {
+			t.Errorf("got dead letter data %s", msg.Data)
+		}
+
+		replay(t, failingTypename)
+		expectCalls(t, failingTypename+".a", 1)
+	})
+
+	t.Run("max deliveries exceeded", func(t *testing.T) {
+		// Messages are NAK'd while the typename is locked by another runtime
+		token, err := KeyMutexTryLock(r, lockedTypename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.IngressNATS(lockedTypename, "b", &payload, nil)
+
+		msg := deadLetter(t, lockedTypename, "b")
+		if got := msg.Header.Get(DeadLetterErrorHeader); got != "maximum deliveries exceeded" {
+			t.Errorf("got error header %q", got)
+		}
+		if err := KeyMutexUnlock(r, lockedTypename, token); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-calls:
+			t.Fatalf("got call of %s before the replay", got)
+		default:
+		}
+
+		replay(t, lockedTypename)
+		expectCalls(t, lockedTypename+".b", 1)
+	})
+}
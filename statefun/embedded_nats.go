@@ -0,0 +1,91 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// EmbeddedNatsNoListen makes the embedded NATS server accept in-process connections only
+	EmbeddedNatsNoListen = 0
+	// EmbeddedNatsRandomPort makes the embedded NATS server listen on a random free port
+	EmbeddedNatsRandomPort      = -1
+	EmbeddedNatsStartTimeoutSec = 10
+)
+
+// startEmbeddedNats starts an in-process NATS server with JetStream and returns the option to connect to it in-process
+func (r *Runtime) startEmbeddedNats() (nats.Option, error) {
+	storeDir := r.config.embeddedNatsStoreDir
+	if len(storeDir) == 0 {
+		dir, err := os.MkdirTemp("", "foliage-nats-*")
+		if err != nil {
+			return nil, err
+		}
+		storeDir = dir
+		r.embeddedNatsTempDir = dir
+	}
+
+	opts := &server.Options{
+		ServerName: r.config.traceServiceName,
+		JetStream:  true,
+		StoreDir:   storeDir,
+		NoSigs:     true,
+		Port:       r.config.embeddedNatsPort,
+		DontListen: r.config.embeddedNatsPort == EmbeddedNatsNoListen,
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		r.stopEmbeddedNats()
+		return nil, err
+	}
+	r.embeddedNats = ns
+
+	go ns.Start()
+	if !ns.ReadyForConnections(EmbeddedNatsStartTimeoutSec * time.Second) {
+		r.stopEmbeddedNats()
+		return nil, fmt.Errorf("embedded NATS server is not ready for connections in %ds", EmbeddedNatsStartTimeoutSec)
+	}
+	if !opts.DontListen {
+		r.logger.Info("Embedded NATS server is started", "url", ns.ClientURL(), "store_dir", storeDir)
+	} else {
+		r.logger.Info("Embedded NATS server is started", "store_dir", storeDir)
+	}
+	return nats.InProcessServer(ns), nil
+}
+
+func (r *Runtime) stopEmbeddedNats() {
+	if r.embeddedNats != nil {
+		r.embeddedNats.Shutdown()
+		r.embeddedNats.WaitForShutdown()
+		r.embeddedNats = nil
+	}
+	if len(r.embeddedNatsTempDir) > 0 {
+		if err := os.RemoveAll(r.embeddedNatsTempDir); err != nil {
+			r.logger.Warn("Cannot remove embedded NATS store dir", "dir", r.embeddedNatsTempDir, "error", err)
+		}
+		r.embeddedNatsTempDir = ""
+	}
+}
+
+// NatsURL returns the URL of the NATS server the runtime is connected to, e.g. to connect other clients
+// to the embedded server. Empty if the embedded server accepts in-process connections only.
+func (r *Runtime) NatsURL() string {
+	if r.embeddedNats != nil {
+		if r.config.embeddedNatsPort == EmbeddedNatsNoListen {
+			return ""
+		}
+		return r.embeddedNats.ClientURL()
+	}
+	return r.nc.ConnectedUrl()
+}
+
+// EmbeddedNatsServer returns the embedded NATS server, nil if the runtime is connected to an external one
+func (r *Runtime) EmbeddedNatsServer() *server.Server {
+	return r.embeddedNats
+}
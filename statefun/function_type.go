@@ -11,18 +11,29 @@ import (
 
 	"github.com/foliagecp/easyjson"
 
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	sfPluginJS "github.com/foliagecp/sdk/statefun/plugins/js"
 	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/foliagecp/sdk/statefun/trace"
 
 	"github.com/nats-io/nats.go"
 )
 
+// Header of a reply to a NATS request/reply call, which contains an error returned by the called function instead of a result
+const replyErrorHeader = "Statefun-Error"
+
+// Header of an egress message, which contains the W3C traceparent of the span the message was sent from
+const traceParentHeader = "traceparent"
+
 type GoMsg struct {
 	ResultJSONChannel chan *easyjson.JSON
+	ErrorChannel      chan error
 	Caller            *sfPlugins.StatefunAddress
 	Payload           *easyjson.JSON
 	Options           *easyjson.JSON
+	TraceParent       string
 }
 
 type FunctionHandler func(sfPlugins.StatefunExecutor, *sfPlugins.StatefunContextProcessor)
@@ -35,49 +46,74 @@ type FunctionType struct {
 	handler                FunctionHandler
 	idHandlersChannel      sync.Map
 	idHandlersLastMsgTime  sync.Map
+	idHandlersRunning      sync.WaitGroup
+	typenameLockMutex      sync.Mutex // Guards config.balanced and typenameLockRevisionID
 	typenameLockRevisionID uint64
+	partitions             []*functionTypePartition // Of a function type balanced by partitions
+	partitionReleases      sync.WaitGroup           // Partitions being released in the background
+	forwardSubscription    *nats.Subscription
 	executor               *sfPlugins.TypenameExecutorPlugin
+	streamName             string
+	subscription           *nats.Subscription
+	maxDeliveriesSub       *nats.Subscription
+	logger                 logger.Logger
+	metrics                *functionTypeMetrics
+	schemas                functionTypeSchemas
 }
 
+/*
+NewFunctionType registers a function type in the runtime. On a running runtime it must be started by Runtime.StartFunctionType.
+A function type with the name of an already registered one is rejected: it is not registered and Runtime.StartFunctionType
+fails for it. The registered one must be unregistered first.
+*/
 func NewFunctionType(runtime *Runtime, name string, handler FunctionHandler, config FunctionTypeConfig) *FunctionType {
 	ft := &FunctionType{
 		runtime: runtime,
 		name:    name,
 		subject: name + ".*",
 		handler: handler,
-		config:  config,
+		config:  runtime.config.applyFunctionTypeOverrides(name, config),
+		logger:  runtime.logger.With(logger.TypenameKey, name),
+		metrics: runtime.metrics.forFunctionType(name),
+	}
+	ft.schemas = compileFunctionTypeSchemas(&ft.config)
+	if ft.partitioned() {
+		for p := 0; p < ft.config.balancePartitions; p++ {
+			ft.partitions = append(ft.partitions, &functionTypePartition{fence: KeyMutexFence(runtime, partitionKey(name, p), 0)})
+		}
+	}
+	ft.logSchemasError()
+	runtime.functionTypesMutex.Lock()
+	defer runtime.functionTypesMutex.Unlock()
+	if _, ok := runtime.registeredFunctionTypes[ft.name]; ok {
+		// Replacing would leave subscriptions and id handlers of the registered one running unnoticed
+		ft.logger.Error("Function type is already registered, the new one is rejected")
+		return ft
 	}
 	runtime.registeredFunctionTypes[ft.name] = ft
 	return ft
 }
 
 func (ft *FunctionType) Start(streamName string) error {
-	consumerName := strings.ReplaceAll(ft.name, ".", "")
+	if ft.schemas.err != nil {
+		return ft.schemas.err
+	}
+
+	consumerName := ft.consumerName()
 	consumerGroup := consumerName + "-group"
-	fmt.Printf("Handling function type %s\n", ft.name)
+	ft.streamName = streamName
+	ft.logger.Info("Handling function type", "stream", streamName)
 
-	// Create stream consumer if does not exist ---------------------
-	consumerExists := false
-	for info := range ft.runtime.js.Consumers(streamName, nats.MaxWait(10*time.Second)) {
-		if info.Name == consumerName {
-			consumerExists = true
-		}
-	}
-	if !consumerExists {
-		_, err := ft.runtime.js.AddConsumer(streamName, &nats.ConsumerConfig{
-			Name:           consumerName,
-			Durable:        consumerName,
-			DeliverSubject: consumerName,
-			DeliverGroup:   consumerGroup,
-			FilterSubject:  ft.subject,
-			AckPolicy:      nats.AckExplicitPolicy,
-			AckWait:        time.Duration(ft.config.msgAckWaitMs) * time.Millisecond, // AckWait should be long due to async message Ack
-		})
-		system.MsgOnErrorReturn(err)
+	// Create stream consumer or reconcile the existing one ---------
+	if err := ft.ensureConsumer(streamName); err != nil {
+		ft.logger.Error("Cannot create or update consumer for function type", logger.ErrorKey, err)
+		return err
 	}
+	ft.removeStaleConsumer()
 	// --------------------------------------------------------------
 
-	_, err := ft.runtime.js.QueueSubscribe(
+	var err error
+	ft.subscription, err = ft.runtime.js.QueueSubscribe(
 		ft.subject,
 		consumerGroup,
 		func(msg *nats.Msg) {
@@ -87,35 +123,145 @@ func (ft *FunctionType) Start(streamName string) error {
 		nats.ManualAck(),
 	)
 	if err != nil {
-		fmt.Printf("Invalid subscription for function type %s: %s\n", ft.name, err)
+		ft.logger.Error("Invalid subscription for function type", logger.ErrorKey, err)
+		return err
+	}
+
+	// Receive messages forwarded by other runtimes to the owner of the partition of their id
+	if ft.partitioned() {
+		ft.forwardSubscription, err = ft.runtime.nc.Subscribe(forwardSubject(ft.runtime.instanceID, ft.name)+".*", ft.handleForwardedMsg)
+		if err != nil {
+			ft.logger.Error("Invalid forwarded messages subscription for function type", logger.ErrorKey, err)
+			return err
+		}
+	}
+
+	// Move messages which exceeded max deliveries (e.g. were NAK'd too many times) to the dead letter stream
+	if ft.config.maxDeliver > 0 {
+		advisorySubject := fmt.Sprintf("%s.%s.%s", maxDeliveriesAdvisoryPrefix, streamName, consumerName)
+		ft.maxDeliveriesSub, err = ft.runtime.nc.QueueSubscribe(advisorySubject, consumerGroup+"-dead-letter", ft.handleMaxDeliveriesAdvisory)
+		if err != nil {
+			ft.logger.Error("Invalid max deliveries advisory subscription for function type", logger.ErrorKey, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// stop drains the subscription of the function type and waits until all received messages are passed to id handlers
+func (ft *FunctionType) stop() error {
+	if ft.maxDeliveriesSub != nil {
+		system.MsgOnErrorReturn(ft.maxDeliveriesSub.Unsubscribe())
+	}
+	if ft.forwardSubscription != nil {
+		system.MsgOnErrorReturn(ft.forwardSubscription.Unsubscribe()) // Forwarders get no reply, their messages are redelivered
+	}
+	if ft.subscription == nil {
+		return nil
+	}
+	if err := ft.subscription.Drain(); err != nil {
 		return err
 	}
+	for ft.subscription.IsValid() {
+		time.Sleep(10 * time.Millisecond)
+	}
 	return nil
 }
 
+// stopIDHandlers asks all running id handlers to stop after processing messages already sent to them
+func (ft *FunctionType) stopIDHandlers() (stopped int) {
+	ft.idHandlersChannel.Range(func(key, value interface{}) bool {
+		if ft.stopIDHandler(key.(string)) {
+			stopped++
+		}
+		return true
+	})
+	return
+}
+
+// stopIDHandler asks the id handler to stop after processing messages already sent to it, returns false if it is not running
+func (ft *FunctionType) stopIDHandler(id string) bool {
+	value, ok := ft.idHandlersChannel.LoadAndDelete(id) // Only one of concurrent callers stops the handler
+	if !ok {
+		return false
+	}
+	value.(chan interface{}) <- nil
+	ft.idHandlersLastMsgTime.Delete(id)
+	if ft.executor != nil {
+		ft.executor.RemoveForID(id)
+	}
+	return true
+}
+
 func (ft *FunctionType) SetExecutor(alias string, content string, constructor func(alias string, source string) sfPlugins.StatefunExecutor) error {
 	ft.executor = sfPlugins.NewTypenameExecutor(alias, content, sfPluginJS.StatefunExecutorPluginJSContructor)
 	return nil
 }
 
 func (ft *FunctionType) handleMsg(msg *nats.Msg) (err error) {
+	tokens := strings.Split(msg.Subject, ".")
+	id := tokens[len(tokens)-1]
+
+	if ft.partitioned() {
+		ft.handlePartitionedMsg(id, msg, false)
+		return
+	}
+
 	// After message was received do typename balance if the one is needed and hasn't been done yet -------
 	if ft.config.balanceNeeded {
-		if !ft.config.balanced {
-			ft.typenameLockRevisionID, err = FunctionTypeMutexLock(ft, true)
-			if err != nil {
-				system.MsgOnErrorReturn(msg.Nak())
-				fmt.Printf("WARNING: function with type %s has received a message, but this typename was already locked! Skipping message...\n", ft.name)
-				// Preventing from rapidly calling this function over and over again if no function
-				// in other runtime that can handle this message and kv mutex is already dead
-				time.Sleep(time.Duration(ft.config.msgAckWaitMs) * time.Millisecond)
-				return
-			}
-			ft.config.balanced = true
+		if err = ft.balanceTypename(); err != nil {
+			// Delayed for preventing from rapidly receiving this message over and over again if no function in other runtime
+			// can handle it and kv mutex is already dead. The subscription is not blocked by sleeping meanwhile, otherwise
+			// messages received after this one outlive their ack wait and are handled after they were redelivered and acked.
+			system.MsgOnErrorReturn(msg.NakWithDelay(time.Duration(ft.config.msgAckWaitMs) * time.Millisecond))
+			ft.metrics.nak(NakReasonTypenameLocked)
+			ft.logger.Warn("Function type has received a message, but this typename was already locked! Skipping message...")
+			return
 		}
 	}
 	// ----------------------------------------------------------------------------------------------------
 
+	ft.dispatchNatsMsg(id, msg)
+	return
+}
+
+// balanceTypename locks the typename mutex unless the runtime already holds it
+func (ft *FunctionType) balanceTypename() error {
+	ft.typenameLockMutex.Lock()
+	defer ft.typenameLockMutex.Unlock()
+	if ft.config.balanced && !KeyMutexFence(ft.runtime, ft.name, ft.typenameLockRevisionID).Valid() {
+		ft.logger.Warn("Typename lease is lost, balancing again")
+		ft.config.balanced = false
+	}
+	if !ft.config.balanced {
+		revisionID, err := FunctionTypeMutexLock(ft, true)
+		if err != nil {
+			return err
+		}
+		ft.typenameLockRevisionID, ft.config.balanced = revisionID, true
+	}
+	return nil
+}
+
+// releaseTypename unlocks the typename mutex if the runtime holds it
+func (ft *FunctionType) releaseTypename() {
+	ft.typenameLockMutex.Lock()
+	defer ft.typenameLockMutex.Unlock()
+	if ft.config.balanced {
+		ft.config.balanced = false
+		system.MsgOnErrorReturn(FunctionTypeMutexUnlock(ft, ft.typenameLockRevisionID))
+	}
+}
+
+// typenameFence returns the fence of writes guarded by the typename mutex
+func (ft *FunctionType) typenameFence() cache.Fence {
+	ft.typenameLockMutex.Lock()
+	defer ft.typenameLockMutex.Unlock()
+	return KeyMutexFence(ft.runtime, ft.name, ft.typenameLockRevisionID)
+}
+
+// dispatchNatsMsg passes the message to the id handler, it is NAK'd if the handler is full
+func (ft *FunctionType) dispatchNatsMsg(id string, msg *nats.Msg) {
 	gc := atomic.LoadInt64(&ft.runtime.gc)
 
 	if gc == 0 {
@@ -125,15 +271,11 @@ func (ft *FunctionType) handleMsg(msg *nats.Msg) (err error) {
 	}
 	atomic.AddInt64(&ft.runtime.gc, 1)
 
-	tokens := strings.Split(msg.Subject, ".")
-	id := tokens[len(tokens)-1]
-
 	ft.sendMsgToIDHandler(id, msg, func() {
 		atomic.AddInt64(&ft.runtime.gc, -1)
 		system.MsgOnErrorReturn(msg.Nak()) // Typename id handler is full for current id, NAK message to contunue processing other ids for this typename
+		ft.metrics.nak(NakReasonChannelFull)
 	})
-
-	return
 }
 
 func (ft *FunctionType) sendMsgToIDHandler(id string, msg interface{}, onChannelFullCallback func()) {
@@ -143,7 +285,17 @@ func (ft *FunctionType) sendMsgToIDHandler(id string, msg interface{}, onChannel
 		msgChannel = value.(chan interface{})
 	} else {
 		msgChannel = make(chan interface{}, ft.config.msgChannelSize)
-		go ft.idHandler(id, msgChannel)
+		ft.idHandlersRunning.Add(1)
+		if ft.partitioned() {
+			part := ft.partitions[ft.partitionOf(id)]
+			atomic.AddInt64(&part.handlers, 1)
+			go func() {
+				defer atomic.AddInt64(&part.handlers, -1)
+				ft.idHandler(id, msgChannel)
+			}()
+		} else {
+			go ft.idHandler(id, msgChannel)
+		}
 		ft.idHandlersChannel.Store(id, msgChannel)
 		if ft.executor != nil {
 			ft.executor.AddForID(id)
@@ -165,8 +317,14 @@ func (ft *FunctionType) sendMsgToIDHandler(id string, msg interface{}, onChannel
 }
 
 func (ft *FunctionType) idHandler(id string, msgChannel chan interface{}) {
+	defer ft.idHandlersRunning.Done()
+	ft.metrics.idHandlers.Inc()
+	defer ft.metrics.idHandlers.Dec()
+
 	// For idHandlerNatsMsg msg ---------------------------
+	msgAckerStopped := make(chan bool)
 	msgAcker := func(msgAckChannel chan *nats.Msg) {
+		defer close(msgAckerStopped)
 		for msg := range msgAckChannel {
 			if msg == nil {
 				return
@@ -179,26 +337,52 @@ func (ft *FunctionType) idHandler(id string, msgChannel chan interface{}) {
 	// ----------------------------------------------------
 
 	functionTypeIDContextProcessor := sfPlugins.StatefunContextProcessor{
-		GlobalCache:        ft.runtime.cacheStore,
-		GetFunctionContext: func() *easyjson.JSON { return ft.getContext(ft.name + "." + id) },
-		SetFunctionContext: func(context *easyjson.JSON) { ft.setContext(ft.name+"."+id, context) },
-		GetObjectContext:   func() *easyjson.JSON { return ft.getContext(id) },
-		SetObjectContext:   func(context *easyjson.JSON) { ft.setContext(id, context) },
-		GolangCallSync: func(targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
-			return ft.runtime.callFunctionGolangSync(ft.name, id, targetTypename, targetID, payload, options)
-		},
-		Self:   sfPlugins.StatefunAddress{Typename: ft.name, ID: id},
-		Egress: ft.egress,
+		GlobalCache: ft.runtime.cacheStore,
+		Self:        sfPlugins.StatefunAddress{Typename: ft.name, ID: id},
+		Logger:      ft.logger.With(logger.IDKey, id),
 		// To be assigned later:
+		// Fence: ...
 		// Call: ...
 		// Payload: ...
 		// Options: ... // Otions from initial typename declaration will be merged and overwritten by the incoming one in message
 		// Caller: ...
+		// TraceParent: ...
+	}
+	// Context writes are fenced by the lease of the mutex guarding the current call
+	functionTypeIDContextProcessor.GetFunctionContext = func() *easyjson.JSON {
+		return ft.getContext(ft.name+"."+id, ft.config.contextMigrations, functionTypeIDContextProcessor.Fence)
+	}
+	functionTypeIDContextProcessor.SetFunctionContext = func(context *easyjson.JSON) {
+		ft.setContext(ft.name+"."+id, context, ft.config.contextMigrations, functionTypeIDContextProcessor.Fence)
+	}
+	functionTypeIDContextProcessor.DeleteFunctionContext = func() {
+		if err := ft.runtime.cacheStore.DeleteValueFenced(ft.name+"."+id, true, -1, "", functionTypeIDContextProcessor.Fence); err != nil {
+			functionTypeIDContextProcessor.Logger.Error("Cannot delete function context", logger.ErrorKey, err)
+		}
+	}
+	functionTypeIDContextProcessor.GetObjectContext = func() *easyjson.JSON {
+		return ft.getContext(id, nil, functionTypeIDContextProcessor.Fence)
+	}
+	functionTypeIDContextProcessor.SetObjectContext = func(context *easyjson.JSON) {
+		ft.setContext(id, context, nil, functionTypeIDContextProcessor.Fence)
+	}
+	// Calls made by the handler carry the trace context of its current invocation
+	functionTypeIDContextProcessor.GolangCallSync = func(targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+		return ft.runtime.callFunctionGolangSync(ft.name, id, targetTypename, targetID, payload, options, functionTypeIDContextProcessor.TraceParent)
+	}
+	functionTypeIDContextProcessor.CallAfter = func(targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, delay time.Duration) {
+		if err := ft.runtime.callFunctionAfter(ft.name, id, targetTypename, targetID, payload, options, functionTypeIDContextProcessor.TraceParent, delay); err != nil {
+			functionTypeIDContextProcessor.Logger.Error("Cannot schedule delayed call", "target", targetTypename+"."+targetID, logger.ErrorKey, err)
+		}
+	}
+	functionTypeIDContextProcessor.Egress = func(natsTopic string, payload *easyjson.JSON) {
+		ft.egressTraced(natsTopic, payload, functionTypeIDContextProcessor.TraceParent)
 	}
 
 	for msg := range msgChannel {
 		if msg == nil {
 			msgAckChannel <- nil
+			<-msgAckerStopped // Wait for all messages to be acked
 			return
 		}
 
@@ -218,10 +402,17 @@ func (ft *FunctionType) idHandlerNatsMsg(id string, msg *nats.Msg, functionTypeI
 		lockRevisionID, err = ContextMutexLock(ft, id, false)
 		if err != nil {
 			system.MsgOnErrorReturn(msg.Nak())
+			ft.metrics.nak(NakReasonContextLocked)
 			return
 		}
+		functionTypeIDContextProcessor.Fence = KeyMutexFence(ft.runtime, ft.name+"."+id, lockRevisionID)
+	} else if ft.partitioned() {
+		functionTypeIDContextProcessor.Fence, _ = ft.partitionFence(id) // Not valid if the partition was handed off meanwhile
+	} else {
+		functionTypeIDContextProcessor.Fence = ft.typenameFence()
 	}
 
+	var handlerErr error
 	var data *easyjson.JSON
 	if j, ok := easyjson.JSONFromBytes(msg.Data); ok {
 		data = &j
@@ -248,28 +439,58 @@ func (ft *FunctionType) idHandlerNatsMsg(id string, msg *nats.Msg, functionTypeI
 			caller.ID, _ = data.GetByPath("caller_id").AsString()
 		}
 
+		// Caller waits for the reply on a NATS subject (request/reply), route calls to the caller there
+		replySubject, _ := data.GetByPath("reply_subject").AsString()
+		if len(replySubject) > 0 && (len(caller.Typename) == 0 || len(caller.ID) == 0) {
+			caller = sfPlugins.StatefunAddress{Typename: "ingress", ID: "nats"}
+		}
+
 		functionTypeIDContextProcessor.Call = func(targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) {
-			ft.runtime.callFunction(ft.name, id, targetTypename, targetID, j, o)
+			if len(replySubject) > 0 && caller.Typename == targetTypename && caller.ID == targetID {
+				if j == nil {
+					j = easyjson.NewJSONObject().GetPtr()
+				}
+				ft.egressTraced(replySubject, j, functionTypeIDContextProcessor.TraceParent)
+			} else {
+				ft.runtime.callFunction(ft.name, id, targetTypename, targetID, j, o, functionTypeIDContextProcessor.TraceParent)
+			}
+		}
+		functionTypeIDContextProcessor.ReplyError = func(err error) {
+			if len(replySubject) > 0 {
+				ft.egressError(replySubject, err)
+			} else {
+				functionTypeIDContextProcessor.Logger.Error("Function replied with error", logger.ErrorKey, err)
+			}
 		}
 		functionTypeIDContextProcessor.Payload = payload
-		functionTypeIDContextProcessor.Options = ft.config.options
+		functionTypeIDContextProcessor.Options = ft.config.options.Clone().GetPtr() // Merged options must not leak into other calls
 		if msgOptions != nil {
 			functionTypeIDContextProcessor.Options.DeepMerge(*msgOptions)
 		}
 		functionTypeIDContextProcessor.Caller = caller
 
+		traceParent, _ := data.GetByPath("trace_parent").AsString()
+
 		// Calling typename handler function --------------------
-		if ft.executor != nil {
-			ft.handler(ft.executor.GetForID(id), functionTypeIDContextProcessor)
-		} else {
-			ft.handler(nil, functionTypeIDContextProcessor)
+		if violations := ft.validateCall(functionTypeIDContextProcessor); len(violations) > 0 {
+			ft.replyInvalidCall(functionTypeIDContextProcessor, violations)
+		} else if err := ft.callHandler(id, functionTypeIDContextProcessor, traceParent); err != nil {
+			functionTypeIDContextProcessor.ReplyError(err)
+			if len(replySubject) == 0 {
+				handlerErr = err // A call the caller waits for is not retried, the caller already has the error
+			}
 		}
 		// ------------------------------------------------------
 	} else {
-		fmt.Printf("Data for function %s with id=%s is not a JSON\n", ft.name, id)
+		functionTypeIDContextProcessor.Logger.Error("Message data is not a JSON")
+		ft.deadLetterNatsMsg(id, msg, fmt.Errorf("data is not a JSON"))
 	}
 
-	msgAckChannel <- msg
+	if handlerErr == nil {
+		msgAckChannel <- msg
+	} else {
+		ft.retryOrDeadLetter(id, msg, handlerErr)
+	}
 
 	if !ft.config.balanceNeeded { // Use context mutex lock if function type is not typename balanced
 		system.MsgOnErrorReturn(ContextMutexUnlock(ft, id, lockRevisionID))
@@ -282,21 +503,78 @@ func (ft *FunctionType) idHandlerGoMsg(id string, msg *GoMsg, functionTypeIDCont
 		if msg.Caller.Typename == targetTypename && msg.Caller.ID == targetID {
 			msg.ResultJSONChannel <- j
 		} else {
-			ft.runtime.callFunction(ft.name, id, targetTypename, targetID, j, o)
+			ft.runtime.callFunction(ft.name, id, targetTypename, targetID, j, o, functionTypeIDContextProcessor.TraceParent)
+		}
+	}
+	functionTypeIDContextProcessor.ReplyError = func(err error) {
+		select {
+		case msg.ErrorChannel <- err:
+		default:
+			functionTypeIDContextProcessor.Logger.Error("Function replied with error", logger.ErrorKey, err)
 		}
 	}
 	functionTypeIDContextProcessor.Payload = msg.Payload
-	functionTypeIDContextProcessor.Options = ft.config.options
+	functionTypeIDContextProcessor.Options = ft.config.options.Clone().GetPtr()
 	if msg.Options != nil {
 		functionTypeIDContextProcessor.Options.DeepMerge(*msg.Options)
 	}
 	functionTypeIDContextProcessor.Caller = *msg.Caller
+	functionTypeIDContextProcessor.Fence = cache.Fence{} // Golang sync calls of not balanced function types are not guarded by a mutex
+	if ft.partitioned() {
+		// Calls of ids of not owned partitions are forwarded to the owner on send, this one was queued before a handoff
+		fence, owned := ft.partitionFence(id)
+		if !owned {
+			functionTypeIDContextProcessor.ReplyError(fmt.Errorf("%w: %s", ErrPartitionNotOwned, partitionKey(ft.name, ft.partitionOf(id))))
+			return
+		}
+		functionTypeIDContextProcessor.Fence = fence
+	} else if ft.config.balanceNeeded {
+		functionTypeIDContextProcessor.Fence = ft.typenameFence()
+	}
+
+	if violations := ft.validateCall(functionTypeIDContextProcessor); len(violations) > 0 {
+		ft.replyInvalidCall(functionTypeIDContextProcessor, violations)
+	} else if err := ft.callHandler(id, functionTypeIDContextProcessor, msg.TraceParent); err != nil {
+		functionTypeIDContextProcessor.ReplyError(err)
+	}
+}
+
+// callHandler calls the typename handler function, a panic inside of it is recovered and returned as an error.
+// If tracing is enabled the call is traced by a span which is a child of the one described by parentTraceParent,
+// otherwise parentTraceParent is passed on to calls made by the handler, so the trace is not broken by the runtime.
+func (ft *FunctionType) callHandler(id string, functionTypeIDContextProcessor *sfPlugins.StatefunContextProcessor, parentTraceParent string) (err error) {
+	functionTypeIDContextProcessor.TraceParent = parentTraceParent
+	if ft.runtime.tracer != nil {
+		span := ft.runtime.tracer.StartSpan(ft.name, parentTraceParent,
+			trace.Attribute{Key: "statefun.typename", Value: ft.name},
+			trace.Attribute{Key: "statefun.id", Value: id},
+			trace.Attribute{Key: "statefun.caller", Value: functionTypeIDContextProcessor.Caller.Typename + "." + functionTypeIDContextProcessor.Caller.ID},
+		)
+		if payload := functionTypeIDContextProcessor.Payload; payload != nil {
+			if queryID, ok := payload.GetByPath("query_id").AsString(); ok {
+				span.SetAttribute("statefun.query_id", queryID)
+			}
+		}
+		functionTypeIDContextProcessor.TraceParent = span.Context.TraceParent()
+		defer func() { span.Finish(err) }() // Deferred before the panic recovery to get the recovered error
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("function %s with id=%s panicked: %v", ft.name, id, r)
+		}
+	}()
+
+	ft.metrics.calls.Inc()
+	start := time.Now()
+	defer func() { ft.metrics.handlerDuration.Observe(time.Since(start).Seconds()) }()
 
 	if ft.executor != nil {
 		ft.handler(ft.executor.GetForID(id), functionTypeIDContextProcessor)
 	} else {
 		ft.handler(nil, functionTypeIDContextProcessor)
 	}
+	return nil
 }
 
 func (ft *FunctionType) gc(functionTypeIDLifetimeMs int) (garbageCollected int, handlersRunning int) {
@@ -306,16 +584,12 @@ func (ft *FunctionType) gc(functionTypeIDLifetimeMs int) (garbageCollected int,
 		id := key.(string)
 		lastMsgTime := value.(int64)
 		if lastMsgTime+int64(functionTypeIDLifetimeMs)*int64(time.Millisecond) < now {
-			v, _ := ft.idHandlersChannel.Load(id)
-			msgChannel := v.(chan interface{})
-			msgChannel <- nil
-			ft.idHandlersChannel.Delete(id)
-			ft.idHandlersLastMsgTime.Delete(id)
-			if ft.executor != nil {
-				ft.executor.RemoveForID(id)
+			if !ft.stopIDHandler(id) {
+				return true // Stopped meanwhile, e.g. on a handoff of its partition
+			}
+			if ft.config.contextLifetimePolicy == ContextDeleteOnGC {
+				ft.deleteGarbageCollectedContext(id)
 			}
-			// TODO: When to delete  function context??? function's context may be needed later!!!!
-			// cacheStore.DeleteValue(ft.name+"."+id, true, -1, "") // Deleting function context
 			garbageCollected++
 			//fmt.Printf(">>>>>>>>>>>>>> Garbage collected handler for %s:%s\n", ft.name, id)
 		} else {
@@ -324,34 +598,117 @@ func (ft *FunctionType) gc(functionTypeIDLifetimeMs int) (garbageCollected int,
 		return true
 	})
 	if garbageCollected > 0 && handlersRunning == 0 {
-		fmt.Printf(">>>>>>>>>>>>>> Garbage collected for typename %s - no id handlers left\n", ft.name)
-		if ft.config.balanced {
-			ft.config.balanced = false
-			system.MsgOnErrorReturn(FunctionTypeMutexUnlock(ft, ft.typenameLockRevisionID))
-		}
+		ft.logger.Debug("Garbage collected for typename - no id handlers left")
+		ft.releaseTypename()
 	}
 
 	return
 }
 
-func (ft *FunctionType) getContext(keyValueID string) *easyjson.JSON {
-	if j, err := ft.runtime.cacheStore.GetValueAsJSON(keyValueID); err == nil {
+/*
+deleteGarbageCollectedContext deletes the function context of the garbage collected id with the fence of the mutex
+guarding its handling: the context mutex or the typename mutex or partition of a balanced function type. The context is
+kept if the id is being handled elsewhere, i.e. the context mutex is locked or the typename or partition is not held.
+*/
+func (ft *FunctionType) deleteGarbageCollectedContext(id string) {
+	keyValueID := ft.name + "." + id
+	var fence cache.Fence
+	switch {
+	case !ft.config.balanceNeeded:
+		lockRevisionID, err := ContextMutexLock(ft, id, true)
+		if err != nil {
+			ft.logger.Debug("Context of garbage collected id is locked, keeping it", logger.IDKey, id)
+			return
+		}
+		defer func() {
+			system.MsgOnErrorReturn(ContextMutexUnlock(ft, id, lockRevisionID))
+		}()
+		fence = KeyMutexFence(ft.runtime, keyValueID, lockRevisionID)
+	case ft.partitioned():
+		fence, _ = ft.partitionFence(id) // Not valid if the partition is not owned
+	default:
+		fence = ft.typenameFence()
+	}
+	if err := ft.runtime.cacheStore.DeleteValueFenced(keyValueID, true, -1, "", fence); err != nil {
+		ft.logger.Debug("Context of garbage collected id is not deleted", logger.IDKey, id, logger.ErrorKey, err)
+	}
+}
+
+/*
+deleteExpiredContexts deletes function contexts which were not written for the TTL if the function type has the
+ContextTTL policy. Only one runtime scans the contexts of the function type at a time, the others skip the check.
+*/
+func (ft *FunctionType) deleteExpiredContexts() int {
+	if ft.config.contextLifetimePolicy != ContextTTL || ft.config.contextTTLSec <= 0 {
+		return 0
+	}
+	lockKey := "context_ttl." + ft.name
+	lockRevisionID, err := KeyMutexTryLock(ft.runtime, lockKey, "deleteExpiredContexts")
+	if err != nil { // Being checked by another runtime
+		return 0
+	}
+	defer func() {
+		system.MsgOnErrorReturn(KeyMutexUnlock(ft.runtime, lockKey, lockRevisionID, "deleteExpiredContexts"))
+	}()
+	expiredBefore := system.GetCurrentTimeNs() - int64(ft.config.contextTTLSec)*int64(time.Second)
+	return ft.runtime.cacheStore.DeleteValuesNotUpdatedSince(ft.name+".*", expiredBefore)
+}
+
+// getContext returns the context migrated to the latest schema version, the migrated one is stored back. A failed
+// migration panics, so the handler is not called with a context it does not expect and the message is retried.
+func (ft *FunctionType) getContext(keyValueID string, migrations []ContextMigration, fence cache.Fence) *easyjson.JSON {
+	j, err := ft.runtime.cacheStore.GetValueAsJSON(keyValueID)
+	if err != nil {
+		return easyjson.NewJSONObject().GetPtr() // A new context has the latest version
+	}
+	if len(migrations) == 0 {
 		return j
 	}
-	j := easyjson.NewJSONObject()
-	return &j
+	migrated, changed, err := MigrateContext(j, migrations)
+	if err != nil {
+		panic(fmt.Errorf("context %s: %w", keyValueID, err))
+	}
+	if changed {
+		ft.setContext(keyValueID, migrated, migrations, fence)
+	}
+	return migrated
 }
 
-func (ft *FunctionType) setContext(keyValueID string, context *easyjson.JSON) {
-	if context == nil {
-		ft.runtime.cacheStore.SetValue(keyValueID, nil, true, -1, "")
-	} else {
-		ft.runtime.cacheStore.SetValue(keyValueID, context.ToBytes(), true, -1, "")
+// setContext stores the context unless the fence is stale, a rejected write is logged
+func (ft *FunctionType) setContext(keyValueID string, context *easyjson.JSON, migrations []ContextMigration, fence cache.Fence) {
+	var value []byte
+	if context != nil {
+		value = VersionedContext(context, migrations).ToBytes()
+	}
+	if err := ft.runtime.cacheStore.SetValueFenced(keyValueID, value, true, -1, "", fence); err != nil {
+		ft.logger.Error("Cannot store context", "key", keyValueID, logger.ErrorKey, err)
 	}
 }
 
+// egressTraced publishes payload into natsTopic along with the traceparent header if tracing is enabled
+func (ft *FunctionType) egressTraced(natsTopic string, payload *easyjson.JSON, traceParent string) {
+	if len(traceParent) == 0 {
+		ft.egress(natsTopic, payload)
+		return
+	}
+	msg := nats.NewMsg(natsTopic)
+	msg.Header.Set(traceParentHeader, traceParent)
+	msg.Data = payload.ToBytes()
+	go func() {
+		system.MsgOnErrorReturn(ft.runtime.nc.PublishMsg(msg))
+	}()
+}
+
 func (ft *FunctionType) egress(natsTopic string, payload *easyjson.JSON) {
 	go func() {
 		system.MsgOnErrorReturn(ft.runtime.nc.Publish(natsTopic, payload.ToBytes()))
 	}()
 }
+
+func (ft *FunctionType) egressError(natsTopic string, err error) {
+	msg := nats.NewMsg(natsTopic)
+	msg.Header.Set(replyErrorHeader, err.Error())
+	go func() {
+		system.MsgOnErrorReturn(ft.runtime.nc.PublishMsg(msg))
+	}()
+}
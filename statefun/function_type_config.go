@@ -2,7 +2,10 @@
 
 package statefun
 
-import "github.com/foliagecp/easyjson"
+import (
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+)
 
 const (
 	MsgAckWaitTimeoutMs = 10000
@@ -10,16 +13,63 @@ const (
 	MsgAckChannelSize   = 64
 	BalanceNeeded       = true
 	MutexLifetimeSec    = 120
+	MsgMaxDeliver       = -1
+)
+
+// ContextLifetimePolicy defines when function contexts of a function type are deleted
+type ContextLifetimePolicy int
+
+const (
+	// ContextKeepForever keeps function contexts until they are deleted explicitly
+	ContextKeepForever ContextLifetimePolicy = iota
+	// ContextTTL deletes function contexts which were not written for the TTL
+	ContextTTL
+	// ContextDeleteOnGC deletes the function context of an id when its id handler is garbage collected, unless the id is
+	// being handled by another runtime meanwhile
+	ContextDeleteOnGC
 )
 
+func (p ContextLifetimePolicy) String() string {
+	switch p {
+	case ContextTTL:
+		return "ttl"
+	case ContextDeleteOnGC:
+		return "gc"
+	}
+	return "forever"
+}
+
 type FunctionTypeConfig struct {
 	msgAckWaitMs      int
 	msgChannelSize    int
 	msgAckChannelSize int
 	balanceNeeded     bool
 	balanced          bool
+	balancePartitions int
 	mutexLifeTimeSec  int
+	maxDeliver        int
+	maxAckPending     int
+	dedicatedStream   bool
+	retention         nats.RetentionPolicy
+	maxAgeSec         int
+	storage           nats.StorageType
+	replicas          int
 	options           *easyjson.JSON
+	payloadSchema     *easyjson.JSON
+	optionsSchema     *easyjson.JSON
+	schedules         []functionTypeSchedule
+
+	contextMigrations []ContextMigration
+
+	contextLifetimePolicy ContextLifetimePolicy
+	contextTTLSec         int
+}
+
+type functionTypeSchedule struct {
+	name    string
+	spec    string
+	id      string
+	payload *easyjson.JSON
 }
 
 func NewFunctionTypeConfig() *FunctionTypeConfig {
@@ -29,6 +79,7 @@ func NewFunctionTypeConfig() *FunctionTypeConfig {
 		msgAckChannelSize: MsgAckChannelSize,
 		balanceNeeded:     BalanceNeeded,
 		mutexLifeTimeSec:  MutexLifetimeSec,
+		maxDeliver:        MsgMaxDeliver,
 		options:           easyjson.NewJSONObject().GetPtr(),
 	}
 }
@@ -38,11 +89,16 @@ func (ftc *FunctionTypeConfig) SetMsgAckWaitMs(msgAckWaitMs int) *FunctionTypeCo
 	return ftc
 }
 
-func (ftc *FunctionTypeConfig) SeMsgChannelSize(msgChannelSize int) *FunctionTypeConfig {
+func (ftc *FunctionTypeConfig) SetMsgChannelSize(msgChannelSize int) *FunctionTypeConfig {
 	ftc.msgChannelSize = msgChannelSize
 	return ftc
 }
 
+// Deprecated: use SetMsgChannelSize
+func (ftc *FunctionTypeConfig) SeMsgChannelSize(msgChannelSize int) *FunctionTypeConfig {
+	return ftc.SetMsgChannelSize(msgChannelSize)
+}
+
 func (ftc *FunctionTypeConfig) SetMsgAckChannelSize(msgAckChannelSize int) *FunctionTypeConfig {
 	ftc.msgAckChannelSize = msgAckChannelSize
 	return ftc
@@ -53,12 +109,116 @@ func (ftc *FunctionTypeConfig) SetBalanceNeeded(balanceNeeded bool) *FunctionTyp
 	return ftc
 }
 
+/*
+SetBalancePartitions balances a function type with balanceNeeded by partitions instead of the whole typename: ids are
+spread over the partitions by their hash and partitions are spread by consistent hashing over live runtimes serving
+the function type. Each partition is owned by one runtime at a time, messages received by another runtime are forwarded
+to the owner. 0 (default) balances the whole typename: it is served by the runtime which locked it first.
+*/
+func (ftc *FunctionTypeConfig) SetBalancePartitions(balancePartitions int) *FunctionTypeConfig {
+	ftc.balancePartitions = balancePartitions
+	return ftc
+}
+
 func (ftc *FunctionTypeConfig) SetMutexLifeTimeSec(mutexLifeTimeSec int) *FunctionTypeConfig {
 	ftc.mutexLifeTimeSec = mutexLifeTimeSec
 	return ftc
 }
 
+// SetMaxDeliver sets how many times a message is delivered to the function before it is moved to the dead letter stream,
+// -1 means unlimited. A failed call the caller waits for (sync or request/reply) is not redelivered, the caller gets the error.
+func (ftc *FunctionTypeConfig) SetMaxDeliver(maxDeliver int) *FunctionTypeConfig {
+	ftc.maxDeliver = maxDeliver
+	return ftc
+}
+
+// SetMaxAckPending sets how many messages may be delivered to the function and not yet acked, 0 means the server default
+func (ftc *FunctionTypeConfig) SetMaxAckPending(maxAckPending int) *FunctionTypeConfig {
+	ftc.maxAckPending = maxAckPending
+	return ftc
+}
+
+// SetReplicas sets the number of replicas of the function's consumer, and of its stream if it is a dedicated one
+func (ftc *FunctionTypeConfig) SetReplicas(replicas int) *FunctionTypeConfig {
+	ftc.replicas = replicas
+	return ftc
+}
+
+// SetDedicatedStream moves the function type into a stream of its own, which is configured by SetRetention, SetMaxAgeSec
+// and SetStorage. Messages left in the stream the function type was stored in before are not moved.
+func (ftc *FunctionTypeConfig) SetDedicatedStream(dedicatedStream bool) *FunctionTypeConfig {
+	ftc.dedicatedStream = dedicatedStream
+	return ftc
+}
+
+// SetRetention sets the retention policy of the dedicated stream of the function type, see SetDedicatedStream
+func (ftc *FunctionTypeConfig) SetRetention(retention nats.RetentionPolicy) *FunctionTypeConfig {
+	ftc.retention = retention
+	return ftc
+}
+
+// SetMaxAgeSec sets the age messages of the dedicated stream of the function type are discarded after (see SetDedicatedStream),
+// 0 means unlimited
+func (ftc *FunctionTypeConfig) SetMaxAgeSec(maxAgeSec int) *FunctionTypeConfig {
+	ftc.maxAgeSec = maxAgeSec
+	return ftc
+}
+
+// SetStorage sets the storage type of the dedicated stream of the function type, see SetDedicatedStream
+func (ftc *FunctionTypeConfig) SetStorage(storage nats.StorageType) *FunctionTypeConfig {
+	ftc.storage = storage
+	return ftc
+}
+
 func (ftc *FunctionTypeConfig) SetOptions(options *easyjson.JSON) *FunctionTypeConfig {
 	ftc.options = options
 	return ftc
 }
+
+// SetPayloadSchema sets a JSON Schema (see the jsonschema package) the payload of each call must conform to. Calls which
+// do not are not passed to the handler, the caller is replied with {"status":"failed","result":[<violations>]}
+func (ftc *FunctionTypeConfig) SetPayloadSchema(schema *easyjson.JSON) *FunctionTypeConfig {
+	ftc.payloadSchema = schema
+	return ftc
+}
+
+// SetOptionsSchema sets a JSON Schema the options of each call merged with the ones of the function type must conform to
+func (ftc *FunctionTypeConfig) SetOptionsSchema(schema *easyjson.JSON) *FunctionTypeConfig {
+	ftc.optionsSchema = schema
+	return ftc
+}
+
+/*
+AddSchedule makes the function with the id be called with the payload recurringly according to the cron-like spec
+(see cron.Parse), e.g. "*\/5 * * * *" or "@every 30s". The caller of such call is "schedule" with the id equal to name.
+Each occurrence is fired once across all runtimes, the state of the schedule is kept in the NATS KV under its name.
+*/
+func (ftc *FunctionTypeConfig) AddSchedule(name string, spec string, id string, payload *easyjson.JSON) *FunctionTypeConfig {
+	ftc.schedules = append(ftc.schedules, functionTypeSchedule{name: name, spec: spec, id: id, payload: payload})
+	return ftc
+}
+
+/*
+SetContextMigrations declares the schema version of function contexts of the function type as the number of migrations,
+the i-th migration upgrades a context from version i to i+1 (contexts stored before versioning have version 0).
+Contexts of older versions are migrated when read and stored back, the version is kept under ContextVersionKey and is
+hidden from handlers. Versioned contexts must be JSON objects. Object contexts are not versioned: they are shared by
+all function types and are read directly from the cache store, e.g. by graph CRUD and JPGQL.
+*/
+func (ftc *FunctionTypeConfig) SetContextMigrations(migrations ...ContextMigration) *FunctionTypeConfig {
+	ftc.contextMigrations = migrations
+	return ftc
+}
+
+// SetContextLifetimePolicy sets when function contexts are deleted, they are kept forever by default
+func (ftc *FunctionTypeConfig) SetContextLifetimePolicy(contextLifetimePolicy ContextLifetimePolicy) *FunctionTypeConfig {
+	ftc.contextLifetimePolicy = contextLifetimePolicy
+	return ftc
+}
+
+// SetContextTTLSec makes function contexts be deleted when they were not written for the TTL (ContextTTL policy)
+func (ftc *FunctionTypeConfig) SetContextTTLSec(contextTTLSec int) *FunctionTypeConfig {
+	ftc.contextLifetimePolicy = ContextTTL
+	ftc.contextTTLSec = contextTTLSec
+	return ftc
+}
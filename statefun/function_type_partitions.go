@@ -0,0 +1,188 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrPartitionNotOwned is returned to a Golang sync call of an id whose partition was handed off while the call was queued
+var ErrPartitionNotOwned = errors.New("partition is not owned by the runtime")
+
+type functionTypePartition struct {
+	mutex     sync.RWMutex // Messages are passed to id handlers under the read lock, ownership is changed under the write one
+	owned     bool
+	releasing bool        // Being released in the background, not acquired again until it is unlocked
+	token     uint64      // Fencing token of the partition mutex
+	fence     cache.Fence // Fence of the last ownership, not valid anymore once the partition is released
+	handlers  int64       // Running id handlers of the partition
+}
+
+func partitionKey(typename string, partition int) string {
+	return typename + ".partition." + strconv.Itoa(partition)
+}
+
+func (ft *FunctionType) partitioned() bool {
+	return ft.config.balanceNeeded && ft.config.balancePartitions > 0
+}
+
+func (ft *FunctionType) started() bool {
+	return ft.subscription != nil
+}
+
+func (ft *FunctionType) partitionOf(id string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(ft.partitions)))
+}
+
+// partitionFence returns the fence of the partition of the id if the runtime owns it
+func (ft *FunctionType) partitionFence(id string) (cache.Fence, bool) {
+	part := ft.partitions[ft.partitionOf(id)]
+	part.mutex.RLock()
+	defer part.mutex.RUnlock()
+	return part.fence, part.owned
+}
+
+// handlePartitionedMsg passes the message to the id handler if the runtime owns the partition of the id, forwards it
+// to the owner otherwise. A message already forwarded to the runtime is not forwarded again.
+func (ft *FunctionType) handlePartitionedMsg(id string, msg *nats.Msg, forwarded bool) {
+	p := ft.partitionOf(id)
+	part := ft.partitions[p]
+	part.mutex.RLock()
+	if part.owned && part.fence.Valid() {
+		ft.dispatchNatsMsg(id, msg)
+		part.mutex.RUnlock()
+		return
+	}
+	part.mutex.RUnlock()
+
+	owner := ft.runtime.balancer.owner(ft.name, p)
+	if forwarded || len(owner) == 0 || owner == ft.runtime.instanceID {
+		// The partition is not acquired by its owner yet, the message is redelivered after the handoff is likely done
+		system.MsgOnErrorReturn(msg.NakWithDelay(ft.runtime.balancer.handoffDelay()))
+		ft.metrics.nak(NakReasonPartitionHandoff)
+		return
+	}
+	ft.runtime.balancer.forward(owner, ft, id, msg)
+}
+
+func (ft *FunctionType) handleForwardedMsg(msg *nats.Msg) {
+	tokens := strings.Split(msg.Subject, ".")
+	ft.handlePartitionedMsg(tokens[len(tokens)-1], msg, true)
+}
+
+// balancePartitions acquires partitions the runtime must own and releases ones it must not own or has lost
+func (ft *FunctionType) balancePartitions(owner func(typename string, partition int) string) {
+	for p, part := range ft.partitions {
+		mustOwn := owner(ft.name, p) == ft.runtime.instanceID
+		part.mutex.RLock()
+		owned, lost := part.owned, part.owned && !part.fence.Valid()
+		part.mutex.RUnlock()
+
+		switch {
+		case lost:
+			ft.logger.Warn("Partition lease is lost, releasing the partition", "partition", p)
+			ft.releasePartitionAsync(p)
+		case owned && !mustOwn:
+			ft.logger.Debug("Handing off partition", "partition", p)
+			ft.releasePartitionAsync(p)
+		case !owned && mustOwn:
+			ft.acquirePartition(p)
+		}
+	}
+}
+
+// acquirePartition tries to lock the partition, it fails while the previous owner has not released it
+func (ft *FunctionType) acquirePartition(p int) {
+	part := ft.partitions[p]
+	part.mutex.RLock()
+	releasing := part.releasing
+	part.mutex.RUnlock()
+	if releasing {
+		return
+	}
+
+	key := partitionKey(ft.name, p)
+	token, err := KeyMutexTryLock(ft.runtime, key, "Partition")
+	if err != nil {
+		return
+	}
+	keyMutexSetLongLived(ft.runtime, key, token)
+
+	part.mutex.Lock()
+	part.owned, part.token, part.fence = true, token, KeyMutexFence(ft.runtime, key, token)
+	part.mutex.Unlock()
+	ft.metrics.partitionsOwned.Inc()
+	ft.logger.Debug("Partition is acquired", "partition", p, "token", token)
+}
+
+/*
+releasePartition stops id handlers of the partition and unlocks it once they are done with messages already passed to
+them. The partition stays locked while any of them runs, even past the message ack wait: otherwise the new owner would
+handle the same ids concurrently, and only context writes of the handlers are fenced, not their calls and egress.
+*/
+func (ft *FunctionType) releasePartition(p int) {
+	part := ft.partitions[p]
+	part.mutex.Lock()
+	if !part.owned {
+		part.mutex.Unlock()
+		return
+	}
+	part.owned = false // No more messages are passed to id handlers of the partition
+	part.releasing = true
+	token := part.token
+	part.mutex.Unlock()
+	ft.metrics.partitionsOwned.Dec()
+
+	ft.idHandlersChannel.Range(func(key, value interface{}) bool {
+		if id := key.(string); ft.partitionOf(id) == p {
+			ft.stopIDHandler(id)
+		}
+		return true
+	})
+	deadline := time.Now().Add(time.Duration(ft.config.msgAckWaitMs) * time.Millisecond)
+	for warned := false; atomic.LoadInt64(&part.handlers) > 0; {
+		if !warned && time.Now().After(deadline) {
+			ft.logger.Warn("Id handlers of partition are not stopped in time, the partition is kept locked till they are", "partition", p)
+			warned = true
+		}
+		time.Sleep(idHandlersStopPollInterval)
+	}
+	if err := KeyMutexUnlock(ft.runtime, partitionKey(ft.name, p), token, "Partition"); err != nil {
+		ft.logger.Warn("Partition was not held till its release", "partition", p, logger.ErrorKey, err)
+	}
+	part.mutex.Lock()
+	part.releasing = false
+	part.mutex.Unlock()
+}
+
+// releasePartitionAsync releases the partition in the background, so the balancer keeps heartbeating while id handlers
+// of the partition finish their messages
+func (ft *FunctionType) releasePartitionAsync(p int) {
+	ft.partitionReleases.Add(1)
+	go func() {
+		defer ft.partitionReleases.Done()
+		ft.releasePartition(p)
+	}()
+}
+
+// releasePartitions releases all partitions owned by the runtime and waits for ones being released in the background,
+// e.g. on shutdown. The balancer must not release partitions meanwhile.
+func (ft *FunctionType) releasePartitions() {
+	for p := range ft.partitions {
+		ft.releasePartition(p)
+	}
+	ft.partitionReleases.Wait()
+}
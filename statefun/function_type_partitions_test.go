@@ -0,0 +1,147 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+const (
+	partitionedTypename = "partitioned.counter"
+	partitionedIDs      = 40
+)
+
+// partitionedCounter counts messages of the id, a call with {"get": true} replies the counter instead
+func partitionedCounter(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	context := contextProcessor.GetFunctionContext()
+	counter := context.GetByPath("counter").AsNumericDefault(0)
+	if contextProcessor.Payload.GetByPath("get").AsBoolDefault(false) {
+		contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, easyjson.NewJSONObjectWithKeyValue("counter", easyjson.NewJSON(counter)).GetPtr(), nil)
+		return
+	}
+	context.SetByPath("counter", easyjson.NewJSON(counter+1))
+	contextProcessor.SetFunctionContext(context)
+}
+
+/*
+settledOwners sends batches of messages to all ids until two batches in a row are handled with every id by the same
+single node and the ids are spread over exactly the nodes, i.e. partitions are handed off and messages received by other
+nodes are forwarded to the owners. Returns the node handling each id.
+*/
+func settledOwners(t *testing.T, sim *statefuntest.Simulation, nodes ...int) map[string]int {
+	t.Helper()
+	want := fmt.Sprint(nodes)
+	deadline := time.Now().Add(60 * time.Second)
+	previous := ""
+	for {
+		since := len(sim.Executions())
+		for i := 0; i < partitionedIDs; i++ {
+			if err := sim.Send(partitionedTypename, fmt.Sprintf("id%d", i), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sim.WaitForDelivery(30 * time.Second); err != nil {
+			t.Fatalf("%s\nevents: %v", err, sim.Events())
+		}
+
+		owners := map[string]int{}
+		handling := map[int]bool{}
+		settled := true
+		for _, e := range sim.Executions()[since:] {
+			if owner, ok := owners[e.ID]; ok && owner != e.Node {
+				settled = false
+			}
+			owners[e.ID] = e.Node
+			handling[e.Node] = true
+		}
+		got := []int{}
+		for node := range handling {
+			got = append(got, node)
+		}
+		sort.Ints(got)
+		if settled && fmt.Sprint(got) == want {
+			if fmt.Sprint(owners) == previous {
+				return owners
+			}
+			previous = fmt.Sprint(owners)
+		} else {
+			previous = ""
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got ids handled by nodes %v (single owner of each id %t), want by %s\nevents: %v", got, settled, want, sim.Events())
+		}
+		time.Sleep(time.Second) // A heartbeat interval, the balancer may move partitions meanwhile
+	}
+}
+
+// expectSyncCallsOnOwners calls all ids synchronously from every running node and checks that they are handled by the owners
+func expectSyncCallsOnOwners(t *testing.T, sim *statefuntest.Simulation, owners map[string]int, nodes ...int) {
+	t.Helper()
+	since := len(sim.Executions())
+	get := easyjson.NewJSONObjectWithKeyValue("get", easyjson.NewJSON(true))
+	for _, node := range nodes {
+		for id := range owners {
+			if _, err := sim.Node(node).Runtime().IngressGolangSync(partitionedTypename, id, &get, nil); err != nil {
+				t.Fatalf("sync call of %s on node %d: %s", id, node, err)
+			}
+		}
+	}
+	for _, e := range sim.Executions()[since:] {
+		if e.Seq < 0 && e.Node != owners[e.ID] {
+			t.Errorf("got sync call of %s handled by node %d, want by the owner %d", e.ID, e.Node, owners[e.ID])
+		}
+	}
+}
+
+func TestPartitionsKillAndRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several runtimes for seconds")
+	}
+
+	config := statefuntest.NewSimulationConfig(3).SetRuntimeConfig(func(node int) *statefun.RuntimeConfig {
+		return statefun.NewRuntimeConfigSimple(nats.DefaultURL, "sim").
+			SetBalancerHeartbeatIntervalSec(1).
+			SetKVMutexLifeTimeSec(2) // Partitions of the killed node expire soon
+	})
+	sim, err := statefuntest.NewSimulation(config, func(node *statefuntest.Node) {
+		statefun.NewFunctionType(node.Runtime(), partitionedTypename, node.Handler(partitionedCounter), *statefun.NewFunctionTypeConfig().SetBalancePartitions(16).SetMsgAckWaitMs(1000))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	owners := settledOwners(t, sim, 0, 1, 2)
+	expectSyncCallsOnOwners(t, sim, owners, 0, 1, 2)
+
+	// Partitions of the killed node are acquired by the others once their leases expire
+	if err := sim.Kill(1); err != nil {
+		t.Fatal(err)
+	}
+	owners = settledOwners(t, sim, 0, 2)
+	expectSyncCallsOnOwners(t, sim, owners, 0, 2)
+
+	// Some partitions are handed off to the joining node
+	if err := sim.Restart(1); err != nil {
+		t.Fatal(err)
+	}
+	owners = settledOwners(t, sim, 0, 1, 2)
+	expectSyncCallsOnOwners(t, sim, owners, 0, 1, 2)
+
+	if err := sim.CheckInvariants(); err != nil {
+		t.Errorf("%s\nevents: %v", err, sim.Events())
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+)
+
+const (
+	idHandlersStopPollInterval = 10 * time.Millisecond
+)
+
+// functionTypes returns a snapshot of registered function types
+func (r *Runtime) functionTypes() []*FunctionType {
+	r.functionTypesMutex.RLock()
+	defer r.functionTypesMutex.RUnlock()
+	fts := make([]*FunctionType, 0, len(r.registeredFunctionTypes))
+	for _, ft := range r.registeredFunctionTypes {
+		fts = append(fts, ft)
+	}
+	return fts
+}
+
+func (r *Runtime) functionType(name string) (*FunctionType, bool) {
+	r.functionTypesMutex.RLock()
+	defer r.functionTypesMutex.RUnlock()
+	ft, ok := r.registeredFunctionTypes[name]
+	return ft, ok
+}
+
+/*
+StartFunctionType starts a function type created by NewFunctionType on an already running runtime: adds its subject to
+the stream, creates its consumer, subscribes to it and starts its recurring schedules. A function type created before
+Runtime.Start is started by it, nothing is done here in that case.
+*/
+func (r *Runtime) StartFunctionType(ft *FunctionType) error {
+	r.registrationMutex.Lock()
+	defer r.registrationMutex.Unlock()
+
+	if !r.started {
+		return nil
+	}
+	if r.ctx.Err() != nil {
+		return fmt.Errorf("cannot start function type %s, runtime is shut down", ft.name)
+	}
+	if registered, ok := r.functionType(ft.name); !ok {
+		return fmt.Errorf("cannot start function type %s, it is not registered in the runtime", ft.name)
+	} else if registered != ft {
+		return fmt.Errorf("cannot start function type %s, another one with the same name is already registered", ft.name)
+	}
+	if ft.subscription != nil {
+		return fmt.Errorf("function type %s is already started", ft.name)
+	}
+
+	if err := r.reconcileStreams(); err != nil {
+		return err
+	}
+	if err := ft.Start(ft.targetStreamName()); err != nil {
+		return err
+	}
+	if ft.partitioned() {
+		r.balancer.touch() // Other runtimes learn the function type is served by the runtime
+	}
+	return r.scheduler.addRecurring(ft)
+}
+
+/*
+UnregisterFunctionType removes the function type from the runtime: stops receiving its messages, lets its id handlers
+finish messages already received and stop, releases its typename mutex or partitions and stops its recurring schedules.
+Only this runtime stops handling the function type, its consumer and stream are kept for other runtimes; use
+DeleteFunctionType to remove the function type from all of them.
+*/
+func (r *Runtime) UnregisterFunctionType(name string) error {
+	r.registrationMutex.Lock()
+	defer r.registrationMutex.Unlock()
+
+	_, err := r.unregisterFunctionType(name)
+	return err
+}
+
+/*
+DeleteFunctionType unregisters the function type (see UnregisterFunctionType), deletes its consumer and removes its
+subject from the stream (deletes the dedicated stream). Consumers and streams are shared by all runtimes, so the
+function type stops being handled everywhere: messages left in its dedicated stream are dropped, publishing into the
+subject removed from the shared stream fails.
+*/
+func (r *Runtime) DeleteFunctionType(name string) error {
+	r.registrationMutex.Lock()
+	defer r.registrationMutex.Unlock()
+
+	ft, err := r.unregisterFunctionType(name)
+	if err != nil {
+		return err
+	}
+	ft.logger.Info("Deleting function type from the stream")
+	return ft.removeFromStream()
+}
+
+// unregisterFunctionType must be called under the registration mutex
+func (r *Runtime) unregisterFunctionType(name string) (*FunctionType, error) {
+	r.functionTypesMutex.Lock()
+	ft, ok := r.registeredFunctionTypes[name]
+	delete(r.registeredFunctionTypes, name) // No new GolangCallSync calls from now on
+	r.functionTypesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("function type %s is not registered", name)
+	}
+	if !r.started || ft.subscription == nil { // Not started yet
+		return ft, nil
+	}
+
+	r.scheduler.removeRecurring(name)
+
+	if err := ft.stop(); err != nil {
+		ft.logger.Error("Cannot drain subscription of function type", logger.ErrorKey, err)
+	}
+
+	// Handlers being stopped may still call this function type via GolangCallSync, so repeat until no handler is left
+	handlersStopped := make(chan struct{})
+	go func() {
+		ft.idHandlersRunning.Wait()
+		close(handlersStopped)
+	}()
+	for stopped := false; !stopped; {
+		ft.stopIDHandlers()
+		select {
+		case <-handlersStopped:
+			stopped = true
+		case <-time.After(idHandlersStopPollInterval):
+		}
+	}
+
+	ft.releaseTypename()
+	ft.releasePartitions()
+	if ft.partitioned() {
+		r.balancer.touch()
+	}
+
+	ft.logger.Info("Function type is unregistered")
+	return ft, nil
+}
+
+// DescribeFunctionTypes returns descriptions of registered function types keyed by their typenames: the config,
+// the options and the schemas, e.g. to publish them for discovery by other services
+func (r *Runtime) DescribeFunctionTypes() map[string]*easyjson.JSON {
+	descriptions := map[string]*easyjson.JSON{}
+	for _, ft := range r.functionTypes() {
+		descriptions[ft.name] = ft.describe()
+	}
+	return descriptions
+}
+
+func (ft *FunctionType) describe() *easyjson.JSON {
+	config := easyjson.NewJSONObject()
+	config.SetByPath("msg_ack_wait_ms", easyjson.NewJSON(ft.config.msgAckWaitMs))
+	config.SetByPath("msg_channel_size", easyjson.NewJSON(ft.config.msgChannelSize))
+	config.SetByPath("msg_ack_channel_size", easyjson.NewJSON(ft.config.msgAckChannelSize))
+	config.SetByPath("balance_needed", easyjson.NewJSON(ft.config.balanceNeeded))
+	config.SetByPath("balance_partitions", easyjson.NewJSON(ft.config.balancePartitions))
+	config.SetByPath("mutex_lifetime_sec", easyjson.NewJSON(ft.config.mutexLifeTimeSec))
+	config.SetByPath("max_deliver", easyjson.NewJSON(ft.config.maxDeliver))
+	config.SetByPath("max_ack_pending", easyjson.NewJSON(ft.config.maxAckPending))
+	config.SetByPath("stream", easyjson.NewJSON(ft.targetStreamName()))
+	config.SetByPath("context_lifetime", easyjson.NewJSON(ft.config.contextLifetimePolicy.String()))
+	if ft.config.contextLifetimePolicy == ContextTTL {
+		config.SetByPath("context_ttl_sec", easyjson.NewJSON(ft.config.contextTTLSec))
+	}
+	schedules := easyjson.NewJSONObject()
+	for _, fts := range ft.config.schedules {
+		schedules.SetByPathCustomDelimiter(fts.name, easyjson.NewJSONObjectWithKeyValue("spec", easyjson.NewJSON(fts.spec)), "/")
+	}
+	config.SetByPath("schedules", schedules)
+
+	description := easyjson.NewJSONObject()
+	description.SetByPath("name", easyjson.NewJSON(ft.name))
+	description.SetByPath("config", config)
+	description.SetByPath("options", ft.config.options.Clone())
+	description.SetByPath("schemas", *ft.Schemas())
+	return &description
+}
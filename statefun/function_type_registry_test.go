@@ -0,0 +1,163 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestFunctionTypeRegistry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	const keptTypename = "registry.kept" // Keeps the shared stream when subjects of other function types are removed
+	r := startTestRuntime(t, newTestRuntimeConfig(newTestServer(t)), func(r *Runtime) {
+		NewFunctionType(r, keptTypename, echoHandler, *NewFunctionTypeConfig().SetBalanceNeeded(false))
+	})
+	payload := easyjson.NewJSONObjectWithKeyValue("a", easyjson.NewJSON(1.0))
+
+	streamSubjects := func(t *testing.T) []string {
+		t.Helper()
+		info, err := r.js.StreamInfo(r.config.functionTypesStreamName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Config.Subjects
+	}
+	hasSubject := func(t *testing.T, subject string) bool {
+		t.Helper()
+		for _, s := range streamSubjects(t) {
+			if s == subject {
+				return true
+			}
+		}
+		return false
+	}
+	startEcho := func(t *testing.T, name string, handler FunctionHandler) *FunctionType {
+		t.Helper()
+		ft := NewFunctionType(r, name, handler, *NewFunctionTypeConfig().SetBalanceNeeded(false))
+		if err := r.StartFunctionType(ft); err != nil {
+			t.Fatal(err)
+		}
+		return ft
+	}
+
+	t.Run("start on a running runtime", func(t *testing.T) {
+		ft := startEcho(t, "registry.started", echoHandler)
+		if !hasSubject(t, ft.subject) {
+			t.Errorf("subject %s is not in the stream subjects %v", ft.subject, streamSubjects(t))
+		}
+		if _, err := r.js.ConsumerInfo(ft.streamName, ft.consumerName()); err != nil {
+			t.Errorf("consumer: %s", err)
+		}
+		reply, err := r.IngressNATSSync(ft.name, "a", &payload, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.Equals(payload) {
+			t.Errorf("got reply %s, want %s", reply.ToString(), payload.ToString())
+		}
+		if err := r.StartFunctionType(ft); err == nil || !strings.Contains(err.Error(), "already started") {
+			t.Errorf("got error %v starting twice, want already started", err)
+		}
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		ft := startEcho(t, "registry.duplicate", echoHandler)
+		duplicate := NewFunctionType(r, ft.name, echoHandler, *NewFunctionTypeConfig().SetBalanceNeeded(false))
+		if err := r.StartFunctionType(duplicate); err == nil || !strings.Contains(err.Error(), "already registered") {
+			t.Errorf("got error %v, want already registered", err)
+		}
+		if registered, _ := r.functionType(ft.name); registered != ft {
+			t.Error("registered function type is replaced")
+		}
+		if _, err := r.IngressGolangSync(ft.name, "a", &payload, nil); err != nil {
+			t.Errorf("registered function type is not handled: %s", err)
+		}
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		schema := easyjson.NewJSONObjectWithKeyValue("$ref", easyjson.NewJSON("#"))
+		ft := NewFunctionType(r, "registry.schema", echoHandler, *NewFunctionTypeConfig().SetBalanceNeeded(false).SetOptionsSchema(&schema))
+		if err := r.StartFunctionType(ft); err == nil || !strings.Contains(err.Error(), "options schema: schema/$ref: $ref is not supported") {
+			t.Errorf("got error %v, want the options schema error", err)
+		}
+		if ft.subscription != nil {
+			t.Error("function type with an invalid schema is subscribed")
+		}
+	})
+
+	t.Run("unregister", func(t *testing.T) {
+		entered, release := make(chan struct{}), make(chan struct{})
+		ft := startEcho(t, "registry.unregistered", func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+			close(entered)
+			<-release
+			echoHandler(executor, contextProcessor)
+		})
+		replied := make(chan error, 1)
+		go func() {
+			_, err := r.IngressGolangSync(ft.name, "a", &payload, nil)
+			replied <- err
+		}()
+		<-entered
+
+		unregistered := make(chan error, 1)
+		go func() { unregistered <- r.UnregisterFunctionType(ft.name) }()
+		select {
+		case err := <-unregistered:
+			t.Fatalf("unregistered with a running handler: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+		close(release)
+		if err := <-replied; err != nil {
+			t.Errorf("running handler did not finish: %s", err)
+		}
+		if err := <-unregistered; err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := r.IngressGolangSync(ft.name, "a", &payload, nil); err == nil {
+			t.Error("unregistered function type is called")
+		}
+		if !hasSubject(t, ft.subject) {
+			t.Errorf("subject %s is removed from the stream subjects %v", ft.subject, streamSubjects(t))
+		}
+		if _, err := r.js.ConsumerInfo(ft.streamName, ft.consumerName()); err != nil {
+			t.Errorf("consumer is not kept for other runtimes: %s", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ft := startEcho(t, "registry.deleted", echoHandler)
+		if err := r.DeleteFunctionType(ft.name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.js.ConsumerInfo(ft.streamName, ft.consumerName()); !errors.Is(err, nats.ErrConsumerNotFound) {
+			t.Errorf("got error %v, want consumer not found", err)
+		}
+		if hasSubject(t, ft.subject) {
+			t.Errorf("subject %s is kept in the stream subjects %v", ft.subject, streamSubjects(t))
+		}
+		if !hasSubject(t, keptTypename+".*") {
+			t.Errorf("subjects of other function types are removed: %v", streamSubjects(t))
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if err := r.UnregisterFunctionType("registry.unknown"); err == nil {
+			t.Error("unknown function type is unregistered")
+		}
+		if err := r.DeleteFunctionType("registry.unknown"); err == nil {
+			t.Error("unknown function type is deleted")
+		}
+	})
+}
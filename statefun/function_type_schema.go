@@ -0,0 +1,93 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/jsonschema"
+	"github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+type functionTypeSchemas struct {
+	payload *jsonschema.Schema
+	options *jsonschema.Schema
+	err     error // Error of schemas compilation, returned on start of the function type
+}
+
+func compileFunctionTypeSchemas(config *FunctionTypeConfig) (schemas functionTypeSchemas) {
+	var err error
+	if config.payloadSchema != nil {
+		if schemas.payload, err = jsonschema.Compile(config.payloadSchema); err != nil {
+			schemas.err = fmt.Errorf("payload schema: %w", err)
+			return
+		}
+	}
+	if config.optionsSchema != nil {
+		if schemas.options, err = jsonschema.Compile(config.optionsSchema); err != nil {
+			schemas.err = fmt.Errorf("options schema: %w", err)
+		}
+	}
+	return
+}
+
+// validateCall returns violations of the payload and options schemas by the current call of the context processor
+func (ft *FunctionType) validateCall(contextProcessor *sfPlugins.StatefunContextProcessor) []string {
+	violations := []string{}
+	if ft.schemas.payload != nil {
+		for _, v := range ft.schemas.payload.Validate(contextProcessor.Payload) {
+			violations = append(violations, "payload"+v.Path+": "+v.Message)
+		}
+	}
+	if ft.schemas.options != nil {
+		for _, v := range ft.schemas.options.Validate(contextProcessor.Options) {
+			violations = append(violations, "options"+v.Path+": "+v.Message)
+		}
+	}
+	return violations
+}
+
+// replyInvalidCall replies the caller with {"status":"failed","result":[<violations>]} instead of calling the handler
+func (ft *FunctionType) replyInvalidCall(contextProcessor *sfPlugins.StatefunContextProcessor, violations []string) {
+	ft.metrics.invalidCalls.Inc()
+	contextProcessor.Logger.Warn("Call does not conform to the schema", "violations", violations)
+
+	caller := contextProcessor.Caller
+	if len(caller.Typename) == 0 || len(caller.ID) == 0 {
+		return
+	}
+	result := easyjson.NewJSONObject()
+	result.SetByPath("status", easyjson.NewJSON("failed"))
+	result.SetByPath("result", easyjson.JSONFromArray(violations))
+	contextProcessor.Call(caller.Typename, caller.ID, &result, nil)
+}
+
+// Schemas returns {"payload":<schema>,"options":<schema>} of the function type, a schema is absent if it was not set
+func (ft *FunctionType) Schemas() *easyjson.JSON {
+	schemas := easyjson.NewJSONObject()
+	if ft.config.payloadSchema != nil {
+		schemas.SetByPath("payload", ft.config.payloadSchema.Clone())
+	}
+	if ft.config.optionsSchema != nil {
+		schemas.SetByPath("options", ft.config.optionsSchema.Clone())
+	}
+	return &schemas
+}
+
+// FunctionTypeSchemas returns the payload and options schemas of all registered function types keyed by their typenames
+func (r *Runtime) FunctionTypeSchemas() *easyjson.JSON {
+	result := easyjson.NewJSONObject()
+	for _, ft := range r.functionTypes() {
+		result.SetByPathCustomDelimiter(ft.name, *ft.Schemas(), "/") // Typenames contain dots
+	}
+	return &result
+}
+
+func (ft *FunctionType) logSchemasError() {
+	if ft.schemas.err != nil {
+		ft.logger.Error("Invalid schema of function type", logger.ErrorKey, ft.schemas.err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun_test
+
+import (
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+const schemaTypename = "schema.test"
+
+func TestInvalidCallReply(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	handlerCalls := make(chan struct{}, 10)
+	handler := func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		handlerCalls <- struct{}{}
+		contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, easyjson.NewJSONObjectWithKeyValue("status", easyjson.NewJSON("ok")).GetPtr(), nil)
+	}
+	schema, _ := easyjson.JSONFromString(`{"type": "object", "required": ["n"], "properties": {"n": {"type": "number"}}}`)
+	sim, err := statefuntest.NewSimulation(statefuntest.NewSimulationConfig(1), func(node *statefuntest.Node) {
+		statefun.NewFunctionType(node.Runtime(), schemaTypename, handler, *statefun.NewFunctionTypeConfig().SetBalanceNeeded(false).SetPayloadSchema(&schema))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	runtime := sim.Node(0).Runtime()
+
+	callers := []struct {
+		name string
+		call func(payload *easyjson.JSON) (*easyjson.JSON, error)
+	}{
+		{name: "golang sync", call: func(payload *easyjson.JSON) (*easyjson.JSON, error) {
+			return runtime.IngressGolangSync(schemaTypename, "a", payload, nil)
+		}},
+		{name: "nats request/reply", call: func(payload *easyjson.JSON) (*easyjson.JSON, error) {
+			return runtime.IngressNATSSync(schemaTypename, "a", payload, nil)
+		}},
+	}
+	for _, caller := range callers {
+		t.Run(caller.name, func(t *testing.T) {
+			invalid := easyjson.NewJSONObjectWithKeyValue("n", easyjson.NewJSON("x"))
+			reply, err := caller.call(&invalid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `{"result":["payload/n: must be of type number, got string"],"status":"failed"}`; reply == nil || reply.ToString() != want {
+				t.Errorf("got reply %v, want %s", reply, want)
+			}
+			select {
+			case <-handlerCalls:
+				t.Error("handler was called with an invalid payload")
+			default:
+			}
+
+			valid := easyjson.NewJSONObjectWithKeyValue("n", easyjson.NewJSON(1))
+			reply, err = caller.call(&valid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, _ := reply.GetByPath("status").AsString(); status != "ok" {
+				t.Errorf("got reply %s to a valid payload, want ok", reply.ToString())
+			}
+			<-handlerCalls
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+func echoHandler(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, contextProcessor.Payload, nil)
+}
+
+func TestReplyTraceParent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	const typename = "trace.echo"
+	r := startTestRuntime(t, newTestRuntimeConfig(newTestServer(t)), func(r *Runtime) {
+		NewFunctionType(r, typename, echoHandler, *NewFunctionTypeConfig().SetBalanceNeeded(false))
+	})
+
+	replySubject := nats.NewInbox()
+	sub, err := r.nc.SubscribeSync(replySubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const traceParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	data := buildFunctionCallData("ingress", "nats", easyjson.NewJSONObject().GetPtr(), nil, traceParent)
+	data.SetByPath("reply_subject", easyjson.NewJSON(replySubject))
+	if err := r.nc.Publish(typename+".a", data.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := sub.NextMsg(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reply.Header.Get(traceParentHeader); got != traceParent {
+		t.Errorf("got reply traceparent %q, want %q", got, traceParent)
+	}
+}
+
+// counterHandler increments the "counter" of the function context and replies it to the caller
+func counterHandler(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	context := contextProcessor.GetFunctionContext()
+	context.SetByPath("counter", easyjson.NewJSON(context.GetByPath("counter").AsNumericDefault(0)+1))
+	contextProcessor.SetFunctionContext(context)
+	contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, context, nil)
+}
+
+func TestContextLifetime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	const contextTTLSec = 1
+	typenames := map[ContextLifetimePolicy]string{
+		ContextKeepForever: "lifetime.forever",
+		ContextTTL:         "lifetime.ttl",
+		ContextDeleteOnGC:  "lifetime.gc",
+	}
+	r := startTestRuntime(t, newTestRuntimeConfig(newTestServer(t)), func(r *Runtime) {
+		for policy, typename := range typenames {
+			config := NewFunctionTypeConfig().SetBalanceNeeded(false).SetContextLifetimePolicy(policy)
+			if policy == ContextTTL {
+				config.SetContextTTLSec(contextTTLSec)
+			}
+			NewFunctionType(r, typename, counterHandler, *config)
+		}
+	})
+	// handle stores the context of the id and garbage collects its id handler
+	handle := func(t *testing.T, typename string, id string) {
+		t.Helper()
+		if _, err := r.IngressGolangSync(typename, id, easyjson.NewJSONObject().GetPtr(), nil); err != nil {
+			t.Fatal(err)
+		}
+		ft, _ := r.functionType(typename)
+		if collected, _ := ft.gc(0); collected != 1 {
+			t.Fatalf("got %d garbage collected id handlers, want 1", collected)
+		}
+	}
+	expectContext := func(t *testing.T, typename string, id string, kept bool) {
+		t.Helper()
+		if _, err := r.cacheStore.GetValue(typename + "." + id); (err == nil) != kept {
+			t.Errorf("got context of %s.%s kept=%t, want %t", typename, id, err == nil, kept)
+		}
+	}
+
+	t.Run("keep forever", func(t *testing.T) {
+		handle(t, typenames[ContextKeepForever], "a")
+		expectContext(t, typenames[ContextKeepForever], "a", true)
+	})
+
+	t.Run("delete on gc", func(t *testing.T) {
+		handle(t, typenames[ContextDeleteOnGC], "a")
+		expectContext(t, typenames[ContextDeleteOnGC], "a", false)
+	})
+
+	t.Run("delete on gc while handled elsewhere", func(t *testing.T) {
+		typename := typenames[ContextDeleteOnGC]
+		if _, err := r.IngressGolangSync(typename, "b", easyjson.NewJSONObject().GetPtr(), nil); err != nil {
+			t.Fatal(err)
+		}
+		lockRevisionID, err := KeyMutexTryLock(r, typename+".b") // As another runtime handling the id does
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := KeyMutexUnlock(r, typename+".b", lockRevisionID); err != nil {
+				t.Error(err)
+			}
+		}()
+		ft, _ := r.functionType(typename)
+		ft.gc(0)
+		expectContext(t, typename, "b", true)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		typename := typenames[ContextTTL]
+		handle(t, typename, "a")
+		expectContext(t, typename, "a", true) // Not deleted on GC
+		time.Sleep(contextTTLSec*time.Second + 100*time.Millisecond)
+		handle(t, typename, "b")
+
+		ft, _ := r.functionType(typename)
+		if deleted := ft.deleteExpiredContexts(); deleted != 1 {
+			t.Errorf("got %d expired contexts deleted, want 1", deleted)
+		}
+		expectContext(t, typename, "a", false)
+		expectContext(t, typename, "b", true)
+	})
+}
+
+func TestFencedContextWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	const typename = "fence.lost"
+	type handling struct {
+		fence   cache.Fence
+		release chan struct{}
+	}
+	handlings := make(chan handling)
+	written := make(chan struct{}, 1)
+	handler := func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		context := contextProcessor.GetFunctionContext()
+		h := handling{fence: contextProcessor.Fence, release: make(chan struct{})}
+		handlings <- h
+		<-h.release
+		context.SetByPath("written", easyjson.NewJSON(true))
+		contextProcessor.SetFunctionContext(context)
+		contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, context, nil)
+		written <- struct{}{}
+	}
+	r := startTestRuntime(t, newTestRuntimeConfig(newTestServer(t)).SetKVMutexLifeTimeSec(1), func(r *Runtime) {
+		NewFunctionType(r, typename, handler, *NewFunctionTypeConfig().SetBalanceNeeded(false))
+	})
+
+	t.Run("lease lost", func(t *testing.T) {
+		r.IngressNATS(typename, "a", easyjson.NewJSONObject().GetPtr(), nil)
+		h := <-handlings
+		if h.fence.IsZero() {
+			t.Fatal("call delivered through NATS is not fenced")
+		}
+		// Another runtime takes the context mutex over, e.g. after this one was paused longer than the lease lifetime
+		state := kvMutexState{Owner: "other", AcquiredAt: system.GetCurrentTimeNs(), ExpiresAt: system.GetCurrentTimeNs() + int64(time.Minute)}
+		if _, err := r.kv.Put(typename+".a.mutex", state.encode()); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for h.fence.Valid() {
+			if time.Now().After(deadline) {
+				t.Fatal("lease is not lost")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		close(h.release)
+		<-written
+		if _, err := r.cacheStore.GetValue(typename + ".a"); err == nil {
+			t.Error("context is written with the lost lease")
+		}
+	})
+
+	t.Run("golang sync call", func(t *testing.T) {
+		go func() {
+			h := <-handlings
+			if !h.fence.IsZero() {
+				t.Error("golang sync call of a not balanced function type is fenced")
+			}
+			close(h.release)
+		}()
+		if _, err := r.IngressGolangSync(typename, "b", easyjson.NewJSONObject().GetPtr(), nil); err != nil {
+			t.Fatal(err)
+		}
+		<-written
+		if _, err := r.cacheStore.GetValue(typename + ".b"); err != nil {
+			t.Errorf("context is not written: %s", err)
+		}
+	})
+}
+
+func TestPartitionReleaseWaitsForHandlers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	const typename = "partition.release"
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		started <- struct{}{}
+		<-release
+	}
+	r := startTestRuntime(t, newTestRuntimeConfig(newTestServer(t)), func(r *Runtime) {
+		NewFunctionType(r, typename, handler, *NewFunctionTypeConfig().SetBalancePartitions(1).SetMsgAckWaitMs(100))
+	})
+	ft, _ := r.functionType(typename)
+	deadline := time.Now().Add(10 * time.Second)
+	for _, owned := ft.partitionFence("a"); !owned; _, owned = ft.partitionFence("a") {
+		if time.Now().After(deadline) {
+			t.Fatal("partition is not acquired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	go func() {
+		_, _ = r.IngressGolangSync(typename, "a", easyjson.NewJSONObject().GetPtr(), nil)
+	}()
+	<-started
+	part := ft.partitions[0]
+	part.mutex.RLock()
+	token := part.token
+	part.mutex.RUnlock()
+	released := make(chan struct{})
+	go func() {
+		ft.releasePartition(0)
+		close(released)
+	}()
+
+	// The partition stays locked past the message ack wait while the handler runs
+	select {
+	case <-released:
+		t.Fatal("partition is released while its id handler runs")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if !KeyMutexFence(r, partitionKey(typename, 0), token).Valid() {
+		t.Error("partition lease is lost while its id handler runs")
+	}
+	close(release)
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("partition is not released after its id handler exited")
+	}
+}
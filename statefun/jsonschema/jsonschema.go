@@ -0,0 +1,493 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun jsonschema package.
+// Provides validation of JSON values against JSON Schemas
+package jsonschema
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/foliagecp/easyjson"
+)
+
+// Violation describes a place where a value does not conform to a schema
+type Violation struct {
+	// JSON pointer to the violating value, empty for the root one
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	if len(v.Path) == 0 {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+/*
+Schema is a compiled JSON Schema. Supported keywords are:
+
+	type, enum, const,
+	properties, required, additionalProperties, minProperties, maxProperties,
+	items, minItems, maxItems, uniqueItems,
+	minLength, maxLength, pattern,
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+	allOf, anyOf, oneOf, not
+
+Annotations (title, description, default, examples etc.) are kept in the source only, "$ref" is not supported.
+*/
+type Schema struct {
+	source *easyjson.JSON
+
+	alwaysFails bool // false boolean schema
+
+	types      []string
+	enum       []interface{}
+	constValue interface{}
+	hasConst   bool
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	minProperties        *int
+	maxProperties        *int
+	items                *Schema
+	minItems             *int
+	maxItems             *int
+	uniqueItems          bool
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	multipleOf           *float64
+	allOf, anyOf, oneOf  []*Schema
+	not                  *Schema
+}
+
+var knownTypes = map[string]bool{"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true}
+
+// Compile compiles a JSON Schema, an error is returned if the schema itself is invalid
+func Compile(schema *easyjson.JSON) (*Schema, error) {
+	if schema == nil {
+		return nil, fmt.Errorf("schema is nil")
+	}
+	s, err := compile(normalize(schema.Value), "")
+	if err != nil {
+		return nil, err
+	}
+	s.source = schema.Clone().GetPtr()
+	return s, nil
+}
+
+// Source returns the schema as it was compiled
+func (s *Schema) Source() *easyjson.JSON {
+	return s.source
+}
+
+// Validate returns violations of the schema by the value, nil if the value conforms to the schema
+func (s *Schema) Validate(value *easyjson.JSON) []Violation {
+	var v interface{}
+	if value != nil {
+		v = normalize(value.Value)
+	}
+	return s.validate(v, "")
+}
+
+func compile(schema interface{}, path string) (*Schema, error) {
+	if b, ok := schema.(bool); ok {
+		return &Schema{alwaysFails: !b}, nil
+	}
+	m, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or a boolean", schemaPath(path))
+	}
+
+	s := &Schema{}
+	var err error
+	for keyword, value := range m {
+		keywordPath := path + "/" + keyword
+		switch keyword {
+		case "$ref":
+			return nil, fmt.Errorf("%s: $ref is not supported", schemaPath(keywordPath))
+		case "type":
+			switch t := value.(type) {
+			case string:
+				s.types = []string{t}
+			case []interface{}:
+				for _, item := range t {
+					str, ok := item.(string)
+					if !ok {
+						return nil, fmt.Errorf("%s: must be a string or an array of strings", schemaPath(keywordPath))
+					}
+					s.types = append(s.types, str)
+				}
+			default:
+				return nil, fmt.Errorf("%s: must be a string or an array of strings", schemaPath(keywordPath))
+			}
+			for _, t := range s.types {
+				if !knownTypes[t] {
+					return nil, fmt.Errorf("%s: unknown type %q", schemaPath(keywordPath), t)
+				}
+			}
+		case "enum":
+			if s.enum, ok = value.([]interface{}); !ok {
+				return nil, fmt.Errorf("%s: must be an array", schemaPath(keywordPath))
+			}
+		case "const":
+			s.constValue = value
+			s.hasConst = true
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: must be an object", schemaPath(keywordPath))
+			}
+			s.properties = map[string]*Schema{}
+			for name, propSchema := range props {
+				if s.properties[name], err = compile(propSchema, keywordPath+"/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			items, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: must be an array of strings", schemaPath(keywordPath))
+			}
+			for _, item := range items {
+				str, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: must be an array of strings", schemaPath(keywordPath))
+				}
+				s.required = append(s.required, str)
+			}
+		case "additionalProperties":
+			if s.additionalProperties, err = compile(value, keywordPath); err != nil {
+				return nil, err
+			}
+		case "items":
+			if s.items, err = compile(value, keywordPath); err != nil {
+				return nil, err
+			}
+		case "not":
+			if s.not, err = compile(value, keywordPath); err != nil {
+				return nil, err
+			}
+		case "allOf", "anyOf", "oneOf":
+			items, ok := value.([]interface{})
+			if !ok || len(items) == 0 {
+				return nil, fmt.Errorf("%s: must be a non empty array", schemaPath(keywordPath))
+			}
+			schemas := make([]*Schema, len(items))
+			for i, item := range items {
+				if schemas[i], err = compile(item, fmt.Sprintf("%s/%d", keywordPath, i)); err != nil {
+					return nil, err
+				}
+			}
+			switch keyword {
+			case "allOf":
+				s.allOf = schemas
+			case "anyOf":
+				s.anyOf = schemas
+			default:
+				s.oneOf = schemas
+			}
+		case "minProperties", "maxProperties", "minItems", "maxItems", "minLength", "maxLength":
+			n, ok := value.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return nil, fmt.Errorf("%s: must be a non negative integer", schemaPath(keywordPath))
+			}
+			i := int(n)
+			switch keyword {
+			case "minProperties":
+				s.minProperties = &i
+			case "maxProperties":
+				s.maxProperties = &i
+			case "minItems":
+				s.minItems = &i
+			case "maxItems":
+				s.maxItems = &i
+			case "minLength":
+				s.minLength = &i
+			default:
+				s.maxLength = &i
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf":
+			n, ok := value.(float64)
+			if !ok || (keyword == "multipleOf" && n <= 0) {
+				return nil, fmt.Errorf("%s: must be a number", schemaPath(keywordPath))
+			}
+			switch keyword {
+			case "minimum":
+				s.minimum = &n
+			case "maximum":
+				s.maximum = &n
+			case "exclusiveMinimum":
+				s.exclusiveMinimum = &n
+			case "exclusiveMaximum":
+				s.exclusiveMaximum = &n
+			default:
+				s.multipleOf = &n
+			}
+		case "uniqueItems":
+			if s.uniqueItems, ok = value.(bool); !ok {
+				return nil, fmt.Errorf("%s: must be a boolean", schemaPath(keywordPath))
+			}
+		case "pattern":
+			str, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: must be a string", schemaPath(keywordPath))
+			}
+			if s.pattern, err = regexp.Compile(str); err != nil {
+				return nil, fmt.Errorf("%s: %w", schemaPath(keywordPath), err)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *Schema) validate(value interface{}, path string) (violations []Violation) {
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.alwaysFails {
+		fail("no value is allowed")
+		return
+	}
+
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if typeMatches(t, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must be of type %s, got %s", strings.Join(s.types, " or "), typeOf(value))
+			return // Other keywords are meaningless for a value of a wrong type
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", toString(s.enum))
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constValue, value) {
+		fail("must be equal to %s", toString(s.constValue))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		if s.minProperties != nil && len(v) < *s.minProperties {
+			fail("must have at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(v) > *s.maxProperties {
+			fail("must have at most %d properties", *s.maxProperties)
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names) // Deterministic order of violations
+		for _, name := range names {
+			propertyPath := path + "/" + escapePointerToken(name)
+			if propSchema, ok := s.properties[name]; ok {
+				violations = append(violations, propSchema.validate(v[name], propertyPath)...)
+			} else if s.additionalProperties != nil {
+				if s.additionalProperties.alwaysFails {
+					violations = append(violations, Violation{Path: propertyPath, Message: "additional property is not allowed"})
+				} else {
+					violations = append(violations, s.additionalProperties.validate(v[name], propertyPath)...)
+				}
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+		unique:
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						fail("items %d and %d must be unique", i, j)
+						break unique
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				violations = append(violations, s.items.validate(item, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match pattern %q", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be > %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be < %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			if q := v / *s.multipleOf; q != math.Trunc(q) {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		violations = append(violations, sub.validate(value, path)...)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if len(sub.validate(value, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(value, path)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema of oneOf, matched %d", matched)
+		}
+	}
+	if s.not != nil && len(s.not.validate(value, path)) == 0 {
+		fail("must not match the schema of not")
+	}
+	return
+}
+
+func typeMatches(t string, value interface{}) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return typeOf(value) == t
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// normalize converts a value to the form produced by encoding/json: numbers to float64, typed maps and slices to generic ones
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = normalize(item)
+		}
+		return a
+	case float64:
+		return v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32:
+		return reflect.ValueOf(v).Convert(reflect.TypeOf(float64(0))).Float()
+	case easyjson.JSON:
+		return normalize(v.Value)
+	case *easyjson.JSON:
+		if v == nil {
+			return nil
+		}
+		return normalize(v.Value)
+	}
+	// Typed maps and slices (e.g. []string) are converted through their JSON representation
+	rv := reflect.ValueOf(value)
+	if rv.IsValid() && (rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice) {
+		if j, ok := easyjson.JSONFromBytes(easyjson.NewJSON(value).ToBytes()); ok {
+			return normalize(j.Value)
+		}
+	}
+	return value
+}
+
+func toString(value interface{}) string {
+	return easyjson.NewJSON(value).ToString()
+}
+
+func schemaPath(path string) string {
+	if len(path) == 0 {
+		return "schema"
+	}
+	return "schema" + path
+}
+
+func escapePointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
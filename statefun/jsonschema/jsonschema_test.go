@@ -0,0 +1,143 @@
+// Copyright 2023 NJWS Inc.
+
+package jsonschema_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/jsonschema"
+)
+
+func mustJSON(t *testing.T, s string) *easyjson.JSON {
+	t.Helper()
+	j, ok := easyjson.JSONFromString(s)
+	if !ok {
+		t.Fatalf("not a JSON: %s", s)
+	}
+	return &j
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		want   []string // Violations as "<path>: <message>", the path is omitted for the root value
+	}{
+		{name: "true schema", schema: `true`, value: `1`},
+		{name: "false schema", schema: `false`, value: `1`, want: []string{"no value is allowed"}},
+
+		{name: "type", schema: `{"type": "string"}`, value: `"a"`},
+		{name: "type mismatch", schema: `{"type": "string"}`, value: `1`, want: []string{"must be of type string, got number"}},
+		{name: "type list", schema: `{"type": ["string", "null"]}`, value: `null`},
+		{name: "type integer", schema: `{"type": "integer"}`, value: `2`},
+		{name: "type integer fraction", schema: `{"type": "integer"}`, value: `2.5`, want: []string{"must be of type integer, got number"}},
+		{name: "type mismatch skips other keywords", schema: `{"type": "string", "minimum": 5}`, value: `true`, want: []string{"must be of type string, got boolean"}},
+
+		{name: "enum", schema: `{"enum": ["a", 1]}`, value: `1`},
+		{name: "enum mismatch", schema: `{"enum": ["a", 1]}`, value: `"b"`, want: []string{`must be one of ["a",1]`}},
+		{name: "const", schema: `{"const": {"a": 1}}`, value: `{"a": 1}`},
+		{name: "const mismatch", schema: `{"const": {"a": 1}}`, value: `{"a": 2}`, want: []string{`must be equal to {"a":1}`}},
+
+		{name: "properties", schema: `{"properties": {"a": {"type": "number"}}}`, value: `{"a": 1, "b": "x"}`},
+		{name: "properties mismatch", schema: `{"properties": {"a": {"type": "number"}}}`, value: `{"a": "x"}`, want: []string{"/a: must be of type number, got string"}},
+		{name: "property path escaped", schema: `{"properties": {"a/b~c": {"type": "number"}}}`, value: `{"a/b~c": "x"}`, want: []string{"/a~1b~0c: must be of type number, got string"}},
+		{name: "required", schema: `{"required": ["a", "b"]}`, value: `{"a": 1}`, want: []string{`missing required property "b"`}},
+		{name: "additionalProperties false", schema: `{"properties": {"a": {}}, "additionalProperties": false}`, value: `{"a": 1, "b": 2}`, want: []string{"/b: additional property is not allowed"}},
+		{name: "additionalProperties schema", schema: `{"additionalProperties": {"type": "string"}}`, value: `{"a": "x", "b": 2}`, want: []string{"/b: must be of type string, got number"}},
+		{name: "minProperties", schema: `{"minProperties": 2}`, value: `{"a": 1}`, want: []string{"must have at least 2 properties"}},
+		{name: "maxProperties", schema: `{"maxProperties": 1}`, value: `{"a": 1, "b": 2}`, want: []string{"must have at most 1 properties"}},
+
+		{name: "items", schema: `{"items": {"type": "number"}}`, value: `[1, "x", 3]`, want: []string{"/1: must be of type number, got string"}},
+		{name: "minItems", schema: `{"minItems": 2}`, value: `[1]`, want: []string{"must have at least 2 items"}},
+		{name: "maxItems", schema: `{"maxItems": 1}`, value: `[1, 2]`, want: []string{"must have at most 1 items"}},
+		{name: "uniqueItems", schema: `{"uniqueItems": true}`, value: `[1, {"a": 1}]`},
+		{name: "uniqueItems mismatch", schema: `{"uniqueItems": true}`, value: `[{"a": 1}, 2, {"a": 1}]`, want: []string{"items 0 and 2 must be unique"}},
+
+		{name: "minLength counts runes", schema: `{"minLength": 2}`, value: `"яя"`},
+		{name: "minLength", schema: `{"minLength": 2}`, value: `"a"`, want: []string{"must be at least 2 characters long"}},
+		{name: "maxLength", schema: `{"maxLength": 1}`, value: `"ab"`, want: []string{"must be at most 1 characters long"}},
+		{name: "pattern", schema: `{"pattern": "^a+$"}`, value: `"aa"`},
+		{name: "pattern mismatch", schema: `{"pattern": "^a+$"}`, value: `"ab"`, want: []string{`must match pattern "^a+$"`}},
+
+		{name: "minimum", schema: `{"minimum": 1}`, value: `1`},
+		{name: "minimum mismatch", schema: `{"minimum": 1}`, value: `0`, want: []string{"must be >= 1"}},
+		{name: "maximum", schema: `{"maximum": 1}`, value: `2`, want: []string{"must be <= 1"}},
+		{name: "exclusiveMinimum", schema: `{"exclusiveMinimum": 1}`, value: `1`, want: []string{"must be > 1"}},
+		{name: "exclusiveMaximum", schema: `{"exclusiveMaximum": 1}`, value: `1`, want: []string{"must be < 1"}},
+		{name: "multipleOf", schema: `{"multipleOf": 0.5}`, value: `1.5`},
+		{name: "multipleOf mismatch", schema: `{"multipleOf": 2}`, value: `3`, want: []string{"must be a multiple of 2"}},
+		{name: "keywords of other types ignored", schema: `{"minimum": 5, "minLength": 5, "required": ["a"]}`, value: `[]`},
+
+		{name: "allOf", schema: `{"allOf": [{"minimum": 1}, {"maximum": 2}]}`, value: `3`, want: []string{"must be <= 2"}},
+		{name: "anyOf", schema: `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, value: `1`},
+		{name: "anyOf mismatch", schema: `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, value: `true`, want: []string{"must match at least one schema of anyOf"}},
+		{name: "oneOf", schema: `{"oneOf": [{"minimum": 2}, {"maximum": 1}]}`, value: `0`},
+		{name: "oneOf several matched", schema: `{"oneOf": [{"minimum": 0}, {"maximum": 1}]}`, value: `0`, want: []string{"must match exactly one schema of oneOf, matched 2"}},
+		{name: "not", schema: `{"not": {"type": "string"}}`, value: `"a"`, want: []string{"must not match the schema of not"}},
+
+		{name: "annotations ignored", schema: `{"title": "t", "description": "d", "default": 1, "examples": [1]}`, value: `"a"`},
+		{name: "nested paths", schema: `{"properties": {"a": {"items": {"required": ["b"]}}}}`, value: `{"a": [{"b": 1}, {}]}`, want: []string{`/a/1: missing required property "b"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := jsonschema.Compile(mustJSON(t, tt.schema))
+			if err != nil {
+				t.Fatalf("Compile: %s", err)
+			}
+			got := []string{}
+			for _, v := range s.Validate(mustJSON(t, tt.value)) {
+				got = append(got, v.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got violations %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGoValues(t *testing.T) {
+	s, err := jsonschema.Compile(mustJSON(t, `{"properties": {"n": {"type": "integer", "maximum": 3}, "tags": {"items": {"type": "string"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := easyjson.NewJSON(map[string]interface{}{"n": 5, "tags": []string{"a", "b"}})
+	violations := s.Validate(&value)
+	if len(violations) != 1 || violations[0].String() != "/n: must be <= 3" {
+		t.Errorf("got violations %v, want the one of /n", violations)
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    string
+		wantError string
+	}{
+		{name: "$ref", schema: `{"$ref": "#/definitions/a"}`, wantError: "schema/$ref: $ref is not supported"},
+		{name: "nested $ref", schema: `{"properties": {"a": {"$ref": "#"}}}`, wantError: "schema/properties/a/$ref: $ref is not supported"},
+		{name: "not an object", schema: `1`, wantError: "schema: schema must be an object or a boolean"},
+		{name: "unknown type", schema: `{"type": "float"}`, wantError: `schema/type: unknown type "float"`},
+		{name: "type not a string", schema: `{"type": 1}`, wantError: "schema/type: must be a string or an array of strings"},
+		{name: "enum not an array", schema: `{"enum": "a"}`, wantError: "schema/enum: must be an array"},
+		{name: "required not strings", schema: `{"required": [1]}`, wantError: "schema/required: must be an array of strings"},
+		{name: "negative minLength", schema: `{"minLength": -1}`, wantError: "schema/minLength: must be a non negative integer"},
+		{name: "fractional maxItems", schema: `{"maxItems": 1.5}`, wantError: "schema/maxItems: must be a non negative integer"},
+		{name: "zero multipleOf", schema: `{"multipleOf": 0}`, wantError: "schema/multipleOf: must be a number"},
+		{name: "uniqueItems not a boolean", schema: `{"uniqueItems": 1}`, wantError: "schema/uniqueItems: must be a boolean"},
+		{name: "invalid pattern", schema: `{"pattern": "("}`, wantError: "schema/pattern:"},
+		{name: "empty anyOf", schema: `{"anyOf": []}`, wantError: "schema/anyOf: must be a non empty array"},
+		{name: "invalid subschema", schema: `{"allOf": [{"type": "x"}]}`, wantError: "schema/allOf/0/type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jsonschema.Compile(mustJSON(t, tt.schema))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantError) {
+				t.Errorf("got error %v, want %s", err, tt.wantError)
+			}
+		})
+	}
+}
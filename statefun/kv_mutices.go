@@ -3,157 +3,495 @@
 package statefun
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
 	"github.com/foliagecp/sdk/statefun/system"
 	"github.com/nats-io/nats.go"
 )
 
-var (
-	keyValueMutexOperationMutex sync.Mutex
-	kwWatchMutex                sync.Mutex
-)
+// A held lease is renewed that many times per the mutex lifetime
+const kvMutexRenewalsPerLifetime = 3
 
-func KeyMutexLock(runtime *Runtime, key string, errorOnLocked bool, debugCaller ...string) (uint64, error) {
-	caller := strings.Join(debugCaller, "-")
-	kv := runtime.kv
-	mutexResetLock := func(keyMutex string, now int64) (uint64, error) {
-		lockRevisionID, err := kv.Put(keyMutex, system.Int64ToBytes(now))
-		if err == nil {
-			fmt.Printf("============== %s: Locked %s\n", caller, keyMutex)
-			return lockRevisionID, nil
+// ErrKeyMutexLocked is returned on an attempt to lock a mutex which is locked by someone else
+var ErrKeyMutexLocked = errors.New("key mutex is locked")
+
+// ErrKeyMutexLeaseLost is returned on unlock of a mutex whose lease expired or was taken over by another owner
+var ErrKeyMutexLeaseLost = errors.New("key mutex lease is lost")
+
+// kvMutexState is the value of a mutex in the NATS KV, the mutex is not locked exclusively if Owner is empty
+type kvMutexState struct {
+	Owner      string `json:"owner,omitempty"`
+	AcquiredAt int64  `json:"acquired_at,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+	// Shared holders of the mutex
+	Readers map[string]kvMutexReader `json:"readers,omitempty"`
+}
+
+type kvMutexReader struct {
+	AcquiredAt int64 `json:"acquired_at"`
+	ExpiresAt  int64 `json:"expires_at"`
+}
+
+func decodeKVMutexState(value []byte, lifetime time.Duration) kvMutexState {
+	state, err := parseKVMutexState(value, lifetime)
+	system.MsgOnErrorReturn(err)
+	return state
+}
+
+func parseKVMutexState(value []byte, lifetime time.Duration) (kvMutexState, error) {
+	state := kvMutexState{}
+	if len(value) == 8 { // Legacy value: lock time, 0 if unlocked
+		if lockTime := system.BytesToInt64(value); lockTime != 0 {
+			state.Owner = "unknown"
+			state.AcquiredAt = lockTime
+			state.ExpiresAt = lockTime + lifetime.Nanoseconds()
 		}
-		return 0, err
+		return state, nil
 	}
-	mutexMereLock := func(entry nats.KeyValueEntry, now int64) (uint64, error) {
-		// Try to lock mutex by updating it with current time value using revision obtained during last Get
-		lockRevisionID, err := kv.Update(entry.Key(), system.Int64ToBytes(now), entry.Revision())
-		if err != nil { // If no error appeared
-			if strings.Contains(err.Error(), "nats: wrong last sequence") { // If error "wrong revision" appeared
-				fmt.Printf("%s: ERROR mutexMereLock: tried to lock with wrong revisionId\n", caller)
-			}
-			return 0, err // Terminate with error
-		}
-		fmt.Printf("============== %s: Locked %s\n", caller, entry.Key())
-		return lockRevisionID, nil // Successfully locked
-	}
-	getKeyWatch := func(keyMutex string) (nats.KeyWatcher, error) {
-		kwWatchMutex.Lock()
-		return kv.Watch(keyMutex)
-	}
-	releaseKeyWatch := func(w nats.KeyWatcher) {
-		system.MsgOnErrorReturn(w.Stop())
-		kwWatchMutex.Unlock()
-	}
-	mutexWaitForUnlock := func(keyMutex string) {
-		for {
-			if w, err := getKeyWatch(keyMutex); err == nil {
-				entry := <-w.Updates()
-				if entry != nil {
-					lockTime := system.BytesToInt64(entry.Value())
-					if lockTime == 0 {
-						releaseKeyWatch(w)
-						return
-					}
-					if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < system.GetCurrentTimeNs() {
-						fmt.Printf("======================= %s: WAITING FOR UNLOCK DONE (MUTEX IS DEAD)\n", caller)
-						releaseKeyWatch(w)
-						return
-					}
-				}
-				releaseKeyWatch(w)
-			} else {
-				fmt.Printf("KeyMutexLock kv.Watch error %s\n", err)
+	err := json.Unmarshal(value, &state)
+	return state, err
+}
+
+// locked reports whether the mutex is locked exclusively
+func (s kvMutexState) locked(now int64) bool {
+	return len(s.Owner) > 0 && s.ExpiresAt >= now
+}
+
+// blockedTill returns the time in ns the mutex can not be locked (shared or exclusively) till, 0 if it can be now
+func (s kvMutexState) blockedTill(now int64, shared bool) int64 {
+	if s.locked(now) {
+		return s.ExpiresAt
+	}
+	var till int64 = 0
+	if !shared {
+		for _, reader := range s.Readers {
+			if reader.ExpiresAt >= now && (till == 0 || reader.ExpiresAt < till) {
+				till = reader.ExpiresAt // Earliest one, the mutex is checked again then
 			}
-			// Maybe sleep is needed to prevent to often kv.Watch
-			// time.Sleep(100 * time.Microsecond)
 		}
 	}
+	return till
+}
 
-	keyMutex := key + ".mutex"
-	mutexResetLockNeeded := false
+func (s *kvMutexState) dropExpiredReaders(now int64) {
+	for id, reader := range s.Readers {
+		if reader.ExpiresAt < now {
+			delete(s.Readers, id)
+		}
+	}
+}
 
-	fmt.Printf("============== %s: Locking %s\n", caller, keyMutex)
-	for {
-		now := system.GetCurrentTimeNs()
+func (s kvMutexState) encode() []byte {
+	b, _ := json.Marshal(s)
+	return b
+}
 
-		keyValueMutexOperationMutex.Lock()
+func isKVWrongSequence(err error) bool {
+	return errors.Is(err, nats.ErrKeyExists) || strings.Contains(err.Error(), "wrong last sequence")
+}
 
-		entry, err := kv.Get(keyMutex) // Getting last mutex state for key
+// keyMutexUpdate applies the change to the state of the mutex in the NATS KV, it is retried if the state was changed
+// concurrently. An error returned by the change cancels the update.
+func keyMutexUpdate(kv nats.KeyValue, keyMutex string, lifetime time.Duration, change func(state *kvMutexState) error) (uint64, error) {
+	for {
+		entry, err := kv.Get(keyMutex)
 		if err != nil {
-			if err == nats.ErrKeyNotFound {
-				mutexResetLockNeeded = true
-			} else {
-				keyValueMutexOperationMutex.Unlock()
-				return 0, err
+			return 0, err
+		}
+		state := decodeKVMutexState(entry.Value(), lifetime)
+		if err := change(&state); err != nil {
+			return 0, err
+		}
+		revision, err := kv.Update(keyMutex, state.encode(), entry.Revision())
+		if err == nil || !isKVWrongSequence(err) {
+			return revision, err
+		}
+	}
+}
+
+type keyMutexLeaseID struct {
+	key   string
+	token uint64
+}
+
+/*
+keyMutexLease is a mutex held by the runtime. The lease is renewed in the NATS KV while it is held, so it does not
+expire as long as the runtime is alive. The fencing token is the KV revision the mutex was acquired with, it grows
+monotonically with each acquisition, so writes guarded by the mutex can be checked against the newest holder.
+*/
+type keyMutexLease struct {
+	runtime   *Runtime
+	key       string
+	keyMutex  string
+	owner     string
+	reader    string // Id of the shared holder, empty if the mutex is held exclusively
+	token     uint64
+	lifetime  time.Duration
+	acquired  int64
+	mutex     sync.Mutex // Guards fields below
+	revision  uint64
+	validTill int64
+	lost      bool
+	longLived bool // Held as long as the runtime needs it, e.g. a typename mutex, never reported as stuck
+	stuck     bool // Reported as stuck
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func (l *keyMutexLease) valid() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return !l.lost && system.GetCurrentTimeNs() < l.validTill
+}
+
+func (l *keyMutexLease) fence() cache.Fence {
+	return cache.Fence{Lock: l.keyMutex, Token: l.token, Valid: l.valid}
+}
+
+func (l *keyMutexLease) renew() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(l.lifetime / kvMutexRenewalsPerLifetime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.runtime.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		l.mutex.Lock()
+		now := system.GetCurrentTimeNs()
+		expiresAt := now + l.lifetime.Nanoseconds()
+		var revision uint64
+		var err error
+		if len(l.reader) == 0 {
+			// No one else writes the mutex while it is held exclusively
+			state := kvMutexState{Owner: l.owner, AcquiredAt: l.acquired, ExpiresAt: expiresAt}
+			revision, err = l.runtime.kv.Update(l.keyMutex, state.encode(), l.revision)
+			if err != nil && isKVWrongSequence(err) {
+				err = ErrKeyMutexLeaseLost
 			}
+		} else {
+			// Other shared holders write the mutex too
+			revision, err = keyMutexUpdate(l.runtime.kv, l.keyMutex, l.lifetime, func(state *kvMutexState) error {
+				if reader, ok := state.Readers[l.reader]; !ok || reader.ExpiresAt < now {
+					return ErrKeyMutexLeaseLost
+				}
+				state.Readers[l.reader] = kvMutexReader{AcquiredAt: l.acquired, ExpiresAt: expiresAt}
+				return nil
+			})
 		}
-		if mutexResetLockNeeded {
-			defer keyValueMutexOperationMutex.Unlock()
-			return mutexResetLock(keyMutex, now)
+		if err == nil {
+			l.revision = revision
+			l.validTill = expiresAt
+		} else if errors.Is(err, ErrKeyMutexLeaseLost) || now >= l.validTill {
+			l.lost = true
 		}
+		lost := l.lost
+		l.mutex.Unlock()
 
-		lockTime := system.BytesToInt64(entry.Value())
-		if lockTime == 0 { // Mutex is ready to be locked
-			defer keyValueMutexOperationMutex.Unlock()
-			return mutexMereLock(entry, now)
-		} else if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < now { // Mutex was locked by someone else and its lock is too old
-			fmt.Printf("WARNING: Context mutex for key=%s is too old, will be unlocked!\n", key)
-			mutexResetLockNeeded = true
-			keyValueMutexOperationMutex.Unlock()
-			continue
+		if lost {
+			l.runtime.logger.Error("Key mutex lease is lost, writes guarded by it will be rejected", "key", l.key, "token", l.token, logger.ErrorKey, err)
+			return
+		} else if err != nil {
+			l.runtime.logger.Warn("Cannot renew key mutex lease", "key", l.key, logger.ErrorKey, err)
 		}
+	}
+}
 
-		keyValueMutexOperationMutex.Unlock()
+// release stops renewal of the lease and removes it from the mutex in the NATS KV
+func (l *keyMutexLease) release() error {
+	close(l.stop)
+	<-l.stopped
 
-		if errorOnLocked {
-			return 0, fmt.Errorf("error: errorOnLocked")
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lost {
+		return fmt.Errorf("%w: key %s", ErrKeyMutexLeaseLost, l.key)
+	}
+	l.lost = true // Not valid anymore
+	if len(l.reader) == 0 {
+		if _, err := l.runtime.kv.Update(l.keyMutex, kvMutexState{}.encode(), l.revision); err != nil {
+			if isKVWrongSequence(err) {
+				return fmt.Errorf("%w: key %s", ErrKeyMutexLeaseLost, l.key)
+			}
+			return err
+		}
+		return nil
+	}
+	_, err := keyMutexUpdate(l.runtime.kv, l.keyMutex, l.lifetime, func(state *kvMutexState) error {
+		if _, ok := state.Readers[l.reader]; !ok {
+			return fmt.Errorf("%w: key %s", ErrKeyMutexLeaseLost, l.key)
 		}
-		mutexWaitForUnlock(keyMutex)
+		delete(state.Readers, l.reader)
+		return nil
+	})
+	return err
+}
+
+// KeyMutexLock locks the mutex of the key across all runtimes and returns its fencing token. The lease of the mutex is
+// renewed until KeyMutexUnlock. If errorOnLocked is set ErrKeyMutexLocked is returned instead of waiting for the mutex
+// to unlock, otherwise it waits until the runtime is shut down.
+func KeyMutexLock(runtime *Runtime, key string, errorOnLocked bool, debugCaller ...string) (uint64, error) {
+	if errorOnLocked {
+		return KeyMutexTryLock(runtime, key, debugCaller...)
 	}
+	return KeyMutexLockCtx(runtime.ctx, runtime, key, debugCaller...)
 }
 
-func KeyMutexUnlock(runtime *Runtime, key string, lockRevisionID uint64, debugCaller ...string) error {
+// KeyMutexTryLock locks the mutex of the key if it is not locked and no one in the runtime waits for it,
+// ErrKeyMutexLocked is returned otherwise
+func KeyMutexTryLock(runtime *Runtime, key string, debugCaller ...string) (uint64, error) {
+	return keyMutexTryLock(runtime, key, false, debugCaller...)
+}
+
+/*
+KeyMutexLockCtx locks the mutex of the key like KeyMutexLock, waiting for it to unlock until the context is done, the
+error of the context is returned then. Waiters of the same runtime get the mutex in the FIFO order: only the first of
+them competes for the mutex with other runtimes and watches its key, the rest wait for their turn.
+*/
+func KeyMutexLockCtx(ctx context.Context, runtime *Runtime, key string, debugCaller ...string) (uint64, error) {
+	return keyMutexLockCtx(ctx, runtime, key, false, debugCaller...)
+}
+
+// KeyMutexTryRLock locks the mutex of the key shared if it is not locked exclusively, see KeyMutexTryLock
+func KeyMutexTryRLock(runtime *Runtime, key string, debugCaller ...string) (uint64, error) {
+	return keyMutexTryLock(runtime, key, true, debugCaller...)
+}
+
+// KeyMutexRLockCtx locks the mutex of the key shared, see KeyMutexLockCtx. Any number of shared holders can hold the
+// mutex at the same time, while an exclusive holder excludes all others.
+func KeyMutexRLockCtx(ctx context.Context, runtime *Runtime, key string, debugCaller ...string) (uint64, error) {
+	return keyMutexLockCtx(ctx, runtime, key, true, debugCaller...)
+}
+
+func keyMutexTryLock(runtime *Runtime, key string, shared bool, debugCaller ...string) (uint64, error) {
+	turn := keyMutexEnqueue(runtime, key)
+	defer keyMutexLeave(runtime, key, turn)
+	select {
+	case <-turn:
+	default:
+		return 0, ErrKeyMutexLocked
+	}
+	token, _, err := keyMutexTryAcquire(runtime, key, shared, debugCaller...)
+	return token, err
+}
+
+func keyMutexLockCtx(ctx context.Context, runtime *Runtime, key string, shared bool, debugCaller ...string) (uint64, error) {
+	turn := keyMutexEnqueue(runtime, key)
+	defer keyMutexLeave(runtime, key, turn)
+	select {
+	case <-turn:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// Watching before the first attempt, so the unlock between the attempt and the wait is not missed
+	w, err := runtime.kv.Watch(key + ".mutex")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	for {
+		token, lockedTill, err := keyMutexTryAcquire(runtime, key, shared, debugCaller...)
+		if !errors.Is(err, ErrKeyMutexLocked) {
+			return token, err
+		}
+		// An owner which is gone does not unlock, its lease expires then
+		timer := time.NewTimer(time.Duration(lockedTill - system.GetCurrentTimeNs()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case _, ok := <-w.Updates():
+			if !ok {
+				timer.Stop()
+				return 0, fmt.Errorf("watcher of key mutex %s is stopped", key)
+			}
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// keyMutexTryAcquire makes one attempt to lock the mutex of the key, if it is locked ErrKeyMutexLocked is returned
+// along with the time in ns its lease expires at
+func keyMutexTryAcquire(runtime *Runtime, key string, shared bool, debugCaller ...string) (token uint64, lockedTill int64, err error) {
 	caller := strings.Join(debugCaller, "-")
 	kv := runtime.kv
+	log := runtime.logger.With("caller", caller, "key", key)
+	lifetime := time.Duration(runtime.config.kvMutexLifeTimeSec) * time.Second
 
-	keyValueMutexOperationMutex.Lock()
-	defer keyValueMutexOperationMutex.Unlock()
+	lease := &keyMutexLease{
+		runtime:  runtime,
+		key:      key,
+		keyMutex: key + ".mutex",
+		owner:    runtime.instanceID,
+		lifetime: lifetime,
+		acquired: system.GetCurrentTimeNs(),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if len(caller) > 0 {
+		lease.owner += "/" + caller
+	}
+	if shared {
+		lease.reader = lease.owner + "#" + system.GetUniqueStrID()
+	}
+	now := lease.acquired
+	lease.validTill = now + lifetime.Nanoseconds()
 
-	keyMutex := key + ".mutex"
-	entry, err := kv.Get(keyMutex)
-	if err != nil {
-		return err
+	state := kvMutexState{}
+	entry, err := kv.Get(lease.keyMutex) // Getting last mutex state for key
+	if err == nil {
+		state = decodeKVMutexState(entry.Value(), lifetime)
+	} else if err != nats.ErrKeyNotFound {
+		return 0, 0, err
 	}
-	if entry.Revision() != lockRevisionID {
-		fmt.Printf("WARNING: Context mutex for key=%s with revision=%d was violated, new revision=%d!\n", key, lockRevisionID, entry.Revision())
+	if till := state.blockedTill(now, shared); till > 0 {
+		return 0, till, ErrKeyMutexLocked
 	}
-	lockTime := system.BytesToInt64(entry.Value())
-	if lockTime != 0 {
-		_, err := kv.Update(keyMutex, system.Int64ToBytes(0), entry.Revision())
-		if err != nil {
-			return err
+	if len(state.Owner) > 0 {
+		log.Warn("Key mutex lease is expired, will be taken over!", "owner", state.Owner)
+	}
+	if shared {
+		state.dropExpiredReaders(now)
+		if state.Readers == nil {
+			state.Readers = map[string]kvMutexReader{}
 		}
+		state.Readers[lease.reader] = kvMutexReader{AcquiredAt: now, ExpiresAt: lease.validTill}
+		state.Owner, state.AcquiredAt, state.ExpiresAt = "", 0, 0
+	} else {
+		state = kvMutexState{Owner: lease.owner, AcquiredAt: now, ExpiresAt: lease.validTill}
+	}
+	// Revision check makes only one of the competitors for the mutex succeed, no matter if they are in different
+	// runtimes or in the same one, so acquisitions and releases are not serialized
+	if entry == nil {
+		lease.revision, err = kv.Create(lease.keyMutex, state.encode())
 	} else {
-		fmt.Printf("WARNING: Context mutex for key=%s was already unlocked!\n", key)
+		lease.revision, err = kv.Update(lease.keyMutex, state.encode(), entry.Revision())
+	}
+	if err != nil {
+		if isKVWrongSequence(err) {
+			return 0, now, ErrKeyMutexLocked // Someone else was faster
+		}
+		return 0, 0, err
+	}
+
+	lease.token = lease.revision
+	runtime.kvMutexLeases.Store(keyMutexLeaseID{key: key, token: lease.token}, lease)
+	go lease.renew()
+	log.Debug("Locked", "token", lease.token, "shared", shared)
+	return lease.token, 0, nil
+}
+
+// keyMutexEnqueue puts a waiter for the mutex of the key into the queue of the runtime, the returned channel is closed
+// when it is the waiter's turn
+func keyMutexEnqueue(runtime *Runtime, key string) chan struct{} {
+	runtime.kvMutexQueuesMutex.Lock()
+	defer runtime.kvMutexQueuesMutex.Unlock()
+	turn := make(chan struct{})
+	runtime.kvMutexQueues[key] = append(runtime.kvMutexQueues[key], turn)
+	if len(runtime.kvMutexQueues[key]) == 1 {
+		close(turn)
+	}
+	return turn
+}
+
+// keyMutexLeave removes the waiter from the queue, the turn is passed to the next one if it was the waiter's turn
+func keyMutexLeave(runtime *Runtime, key string, turn chan struct{}) {
+	runtime.kvMutexQueuesMutex.Lock()
+	defer runtime.kvMutexQueuesMutex.Unlock()
+	queue := runtime.kvMutexQueues[key]
+	for i, t := range queue {
+		if t != turn {
+			continue
+		}
+		queue = append(queue[:i], queue[i+1:]...)
+		if len(queue) == 0 {
+			delete(runtime.kvMutexQueues, key)
+		} else {
+			runtime.kvMutexQueues[key] = queue
+			if i == 0 {
+				close(queue[0])
+			}
+		}
+		return
+	}
+}
+
+// KeyMutexUnlock unlocks the mutex of the key locked (shared or exclusively) with the fencing token.
+// ErrKeyMutexLeaseLost is returned if the lease was lost meanwhile, the mutex is left to its new owner then.
+func KeyMutexUnlock(runtime *Runtime, key string, lockRevisionID uint64, debugCaller ...string) error {
+	caller := strings.Join(debugCaller, "-")
+	log := runtime.logger.With("caller", caller, "key", key)
+
+	v, ok := runtime.kvMutexLeases.LoadAndDelete(keyMutexLeaseID{key: key, token: lockRevisionID})
+	if !ok {
+		log.Warn("Key mutex is not held with the token!", "token", lockRevisionID)
+		return fmt.Errorf("%w: key %s is not held with the token %d", ErrKeyMutexLeaseLost, key, lockRevisionID)
+	}
+	if err := v.(*keyMutexLease).release(); err != nil {
+		log.Warn("Key mutex was violated!", "token", lockRevisionID, logger.ErrorKey, err)
+		return err
 	}
-	fmt.Printf("============== %s: Unlocked %s\n", caller, keyMutex)
+	log.Debug("Unlocked")
 	return nil // Successfully unlocked
 }
 
+// KeyMutexRUnlock unlocks the mutex of the key locked shared, see KeyMutexUnlock
+func KeyMutexRUnlock(runtime *Runtime, key string, lockRevisionID uint64, debugCaller ...string) error {
+	return KeyMutexUnlock(runtime, key, lockRevisionID, debugCaller...)
+}
+
+// KeyMutexFence returns the fence of writes guarded by the mutex of the key held with the fencing token
+// (see cache.Store.SetValueFenced), writes are rejected once the lease of the mutex is lost
+func KeyMutexFence(runtime *Runtime, key string, token uint64) cache.Fence {
+	if v, ok := runtime.kvMutexLeases.Load(keyMutexLeaseID{key: key, token: token}); ok {
+		return v.(*keyMutexLease).fence()
+	}
+	return cache.Fence{Lock: key + ".mutex", Token: token, Valid: func() bool { return false }}
+}
+
 func ContextMutexLock(ft *FunctionType, id string, errorOnLocked bool) (uint64, error) {
 	return KeyMutexLock(ft.runtime, ft.name+"."+id, errorOnLocked, "ContextMutexLock")
 }
 
+func ContextMutexLockCtx(ctx context.Context, ft *FunctionType, id string) (uint64, error) {
+	return KeyMutexLockCtx(ctx, ft.runtime, ft.name+"."+id, "ContextMutexLock")
+}
+
 func ContextMutexUnlock(ft *FunctionType, id string, lockRevisionID uint64) error {
 	return KeyMutexUnlock(ft.runtime, ft.name+"."+id, lockRevisionID, "ContextMutexUnlock")
 }
 
 func FunctionTypeMutexLock(ft *FunctionType, errorOnLocked bool) (uint64, error) {
-	return KeyMutexLock(ft.runtime, ft.name, errorOnLocked, "FunctionTypeMutexLock")
+	token, err := KeyMutexLock(ft.runtime, ft.name, errorOnLocked, "FunctionTypeMutexLock")
+	if err == nil {
+		keyMutexSetLongLived(ft.runtime, ft.name, token) // Held while the function type is balanced by the runtime
+	}
+	return token, err
+}
+
+// keyMutexSetLongLived marks the mutex held as long as the runtime needs it, so it is never reported as stuck
+func keyMutexSetLongLived(runtime *Runtime, key string, token uint64) {
+	if v, ok := runtime.kvMutexLeases.Load(keyMutexLeaseID{key: key, token: token}); ok {
+		lease := v.(*keyMutexLease)
+		lease.mutex.Lock()
+		lease.longLived = true
+		lease.mutex.Unlock()
+	}
 }
 
 func FunctionTypeMutexUnlock(ft *FunctionType, lockRevisionID uint64) error {
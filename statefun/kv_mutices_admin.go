@@ -0,0 +1,306 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+// Waiters of a runtime for the mutex of a key are published at <key>.mutex.waiters.<instance id>
+const kvMutexWaitersInfix = ".mutex.waiters."
+
+var errKeyMutexNotHeld = errors.New("key mutex is not held")
+
+type kvMutexWaiters struct {
+	Waiters   int   `json:"waiters"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// KeyMutexHolder is a holder of a KV mutex
+type KeyMutexHolder struct {
+	RuntimeID  string // Instance id of the holding runtime, see Runtime.InstanceID
+	Caller     string // Debug caller the mutex was locked by
+	Shared     bool
+	AcquiredAt time.Time
+	ExpiresAt  time.Time // The lease is renewed while the holder is alive, so a holder past it is dead
+}
+
+func (h KeyMutexHolder) Age(now time.Time) time.Duration {
+	return now.Sub(h.AcquiredAt)
+}
+
+func (h KeyMutexHolder) Expired(now time.Time) bool {
+	return now.After(h.ExpiresAt)
+}
+
+// KeyMutexInfo describes the mutex of a key
+type KeyMutexInfo struct {
+	Key     string
+	Holders []KeyMutexHolder
+	Waiters int // Waiters of all runtimes, published once per renewal of leases
+}
+
+func newKeyMutexHolder(owner string, shared bool, acquiredAt int64, expiresAt int64) KeyMutexHolder {
+	holder := KeyMutexHolder{Shared: shared, AcquiredAt: time.Unix(0, acquiredAt), ExpiresAt: time.Unix(0, expiresAt)}
+	if shared { // Id of a shared holder is <owner>#<unique id>
+		if i := strings.LastIndex(owner, "#"); i >= 0 {
+			owner = owner[:i]
+		}
+	}
+	holder.RuntimeID, holder.Caller, _ = strings.Cut(owner, "/")
+	return holder
+}
+
+func (s kvMutexState) holders() []KeyMutexHolder {
+	holders := []KeyMutexHolder{}
+	if len(s.Owner) > 0 {
+		holders = append(holders, newKeyMutexHolder(s.Owner, false, s.AcquiredAt, s.ExpiresAt))
+	}
+	for id, reader := range s.Readers {
+		holders = append(holders, newKeyMutexHolder(id, true, reader.AcquiredAt, reader.ExpiresAt))
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].AcquiredAt.Before(holders[j].AcquiredAt) })
+	return holders
+}
+
+/*
+KeyMutexInspector reads the state of KV mutices of all runtimes sharing the NATS KV bucket and releases mutices of
+dead holders. It needs no running runtime, so it can be used by tools, e.g. cmd/kvmutex.
+*/
+type KeyMutexInspector struct {
+	kv       nats.KeyValue
+	lifetime time.Duration
+}
+
+// NewKeyMutexInspector creates an inspector of mutices in the bucket, lifetimeSec must match kv_mutex_lifetime_sec of
+// the runtimes
+func NewKeyMutexInspector(kv nats.KeyValue, lifetimeSec int) *KeyMutexInspector {
+	return &KeyMutexInspector{kv: kv, lifetime: time.Duration(lifetimeSec) * time.Second}
+}
+
+// KeyMutexInspector creates an inspector of mutices in the KV bucket of the runtime
+func (r *Runtime) KeyMutexInspector() *KeyMutexInspector {
+	return NewKeyMutexInspector(r.kv, r.config.kvMutexLifeTimeSec)
+}
+
+/*
+List returns mutices which are held or waited for, sorted by their keys. Keys of the bucket are streamed without their
+values, only mutices and published waiters are read then.
+*/
+func (i *KeyMutexInspector) List() ([]KeyMutexInfo, error) {
+	now := system.GetCurrentTimeNs()
+	infos := map[string]*KeyMutexInfo{}
+	info := func(key string) *KeyMutexInfo {
+		if _, ok := infos[key]; !ok {
+			infos[key] = &KeyMutexInfo{Key: key, Holders: []KeyMutexHolder{}}
+		}
+		return infos[key]
+	}
+	err := forEachKVKey(i.kv, ">", func(kvKey string) {
+		if key, _, ok := strings.Cut(kvKey, kvMutexWaitersInfix); ok {
+			if waiters, ok := i.getWaiters(kvKey, now); ok {
+				info(key).Waiters += waiters
+			}
+		} else if key, ok := strings.CutSuffix(kvKey, ".mutex"); ok {
+			entry, err := i.kv.Get(kvKey)
+			if err != nil {
+				return // Deleted meanwhile
+			}
+			state, err := parseKVMutexState(entry.Value(), i.lifetime)
+			if err != nil {
+				return // Not a mutex
+			}
+			if holders := state.holders(); len(holders) > 0 {
+				info(key).Holders = holders
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]KeyMutexInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+// forEachKVKey calls f for keys of the bucket matching the pattern as they are received, unlike nats.KeyValue.Keys
+// they are not collected at once
+func forEachKVKey(kv nats.KeyValue, pattern string, f func(kvKey string)) error {
+	w, err := kv.Watch(pattern, nats.MetaOnly(), nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+	for entry := range w.Updates() {
+		if entry == nil { // All current keys are received
+			break
+		}
+		f(entry.Key())
+	}
+	return nil
+}
+
+// getWaiters returns the number of waiters published by a runtime, ones not updated for the mutex lifetime are left
+// by a dead runtime and ignored
+func (i *KeyMutexInspector) getWaiters(kvKey string, now int64) (int, bool) {
+	entry, err := i.kv.Get(kvKey)
+	if err != nil {
+		return 0, false
+	}
+	waiters := kvMutexWaiters{}
+	if json.Unmarshal(entry.Value(), &waiters) != nil || waiters.UpdatedAt+i.lifetime.Nanoseconds() < now {
+		return 0, false
+	}
+	return waiters.Waiters, true
+}
+
+// Stuck returns mutices having a holder which is alive and holds the mutex longer than the threshold
+func (i *KeyMutexInspector) Stuck(threshold time.Duration) ([]KeyMutexInfo, error) {
+	infos, err := i.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stuck := []KeyMutexInfo{}
+	for _, info := range infos {
+		for _, holder := range info.Holders {
+			if !holder.Expired(now) && holder.Age(now) > threshold {
+				stuck = append(stuck, info)
+				break
+			}
+		}
+	}
+	return stuck, nil
+}
+
+/*
+ForceRelease removes expired holders from the mutex of the key and returns their number. If force is set alive holders
+are removed too: they lose their leases, so their fenced writes are rejected. Otherwise ErrKeyMutexLocked is returned
+if the mutex has an alive holder, nothing is removed then.
+*/
+func (i *KeyMutexInspector) ForceRelease(key string, force bool) (int, error) {
+	released := 0
+	_, err := keyMutexUpdate(i.kv, key+".mutex", i.lifetime, func(state *kvMutexState) error {
+		now := time.Now()
+		holders := state.holders()
+		if len(holders) == 0 {
+			return errKeyMutexNotHeld
+		}
+		if !force {
+			for _, holder := range holders {
+				if !holder.Expired(now) {
+					return fmt.Errorf("%w: key %s is held by alive runtime %s", ErrKeyMutexLocked, key, holder.RuntimeID)
+				}
+			}
+		}
+		released = len(holders)
+		*state = kvMutexState{}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errKeyMutexNotHeld) && !errors.Is(err, nats.ErrKeyNotFound) {
+		return 0, err
+	}
+
+	// Waiters left by dead runtimes
+	now := system.GetCurrentTimeNs()
+	err = forEachKVKey(i.kv, key+kvMutexWaitersInfix+"*", func(kvKey string) {
+		if _, ok := i.getWaiters(kvKey, now); !ok {
+			system.MsgOnErrorReturn(i.kv.Delete(kvKey))
+		}
+	})
+	return released, err
+}
+
+/*
+runKeyMutexMonitor publishes the numbers of waiters of the runtime for mutices and reports mutices held by the runtime
+longer than kv_mutex_stuck_threshold_sec, once per renewal of leases until the runtime is shut down.
+*/
+func (r *Runtime) runKeyMutexMonitor() {
+	published := map[string]bool{}
+	ticker := time.NewTicker(time.Duration(r.config.kvMutexLifeTimeSec) * time.Second / kvMutexRenewalsPerLifetime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			for key := range published {
+				system.MsgOnErrorReturn(r.kv.Delete(key + kvMutexWaitersInfix + r.instanceID))
+			}
+			return
+		case <-ticker.C:
+		}
+		r.publishKeyMutexWaiters(published)
+		r.reportStuckKeyMutices()
+	}
+}
+
+func (r *Runtime) publishKeyMutexWaiters(published map[string]bool) {
+	waiters := map[string]int{}
+	r.kvMutexQueuesMutex.Lock()
+	for key, queue := range r.kvMutexQueues {
+		waiters[key] = len(queue) // A waiter leaves the queue once it gets the mutex
+	}
+	r.kvMutexQueuesMutex.Unlock()
+
+	now := system.GetCurrentTimeNs()
+	for key, n := range waiters {
+		value, _ := json.Marshal(kvMutexWaiters{Waiters: n, UpdatedAt: now})
+		if _, err := r.kv.Put(key+kvMutexWaitersInfix+r.instanceID, value); err == nil {
+			published[key] = true
+		}
+	}
+	for key := range published {
+		if _, ok := waiters[key]; !ok {
+			system.MsgOnErrorReturn(r.kv.Delete(key + kvMutexWaitersInfix + r.instanceID))
+			delete(published, key)
+		}
+	}
+}
+
+func (r *Runtime) reportStuckKeyMutices() {
+	if r.config.kvMutexStuckThresholdSec <= 0 {
+		return
+	}
+	threshold := time.Duration(r.config.kvMutexStuckThresholdSec) * time.Second
+	now := system.GetCurrentTimeNs()
+	r.kvMutexLeases.Range(func(_, v any) bool {
+		lease := v.(*keyMutexLease)
+		lease.mutex.Lock()
+		age := time.Duration(now - lease.acquired)
+		report := !lease.longLived && !lease.lost && !lease.stuck && age > threshold
+		if report {
+			lease.stuck = true
+		}
+		lease.mutex.Unlock()
+		if report {
+			r.logger.Warn("Key mutex is held longer than the threshold", "key", lease.key, "owner", lease.owner, "token", lease.token, "age", age.String())
+		}
+		return true
+	})
+}
+
+// stuckKeyMutices returns the number of mutices held by the runtime which were reported as stuck
+func (r *Runtime) stuckKeyMutices() int {
+	stuck := 0
+	r.kvMutexLeases.Range(func(_, v any) bool {
+		lease := v.(*keyMutexLease)
+		lease.mutex.Lock()
+		if lease.stuck && !lease.lost {
+			stuck++
+		}
+		lease.mutex.Unlock()
+		return true
+	})
+	return stuck
+}
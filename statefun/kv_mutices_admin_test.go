@@ -0,0 +1,177 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// findKeyMutex returns the info of the key listed by the inspector
+func findKeyMutex(t *testing.T, inspector *KeyMutexInspector, key string) (KeyMutexInfo, bool) {
+	t.Helper()
+	infos, err := inspector.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Key == key {
+			return info, true
+		}
+	}
+	return KeyMutexInfo{}, false
+}
+
+func TestKeyMutexInspector(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs runtimes")
+	}
+	runtimes := startTestRuntimes(t, 2)
+	r1, r2 := runtimes[0], runtimes[1]
+	inspector := r1.KeyMutexInspector()
+
+	t.Run("list", func(t *testing.T) {
+		token := mustLock(t, r1, "list.a")
+		defer mustUnlock(t, r1, "list.a", token)
+		rToken, err := KeyMutexTryRLock(r2, "list.b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { system.MsgOnErrorReturn(KeyMutexRUnlock(r2, "list.b", rToken)) }()
+
+		infos, err := inspector.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := map[string]KeyMutexInfo{}
+		for _, info := range infos {
+			listed[info.Key] = info
+		}
+		for key, want := range map[string]KeyMutexHolder{"list.a": {RuntimeID: r1.instanceID}, "list.b": {RuntimeID: r2.instanceID, Shared: true}} {
+			info, ok := listed[key]
+			if !ok || len(info.Holders) != 1 {
+				t.Errorf("got %s listed=%t with holders %v, want one holder", key, ok, info.Holders)
+				continue
+			}
+			if holder := info.Holders[0]; holder.RuntimeID != want.RuntimeID || holder.Shared != want.Shared || holder.Expired(time.Now()) {
+				t.Errorf("got %s holder %+v, want alive %s shared=%t", key, holder, want.RuntimeID, want.Shared)
+			}
+		}
+
+		mustUnlock(t, r1, "list.c", mustLock(t, r1, "list.c"))
+		if info, ok := findKeyMutex(t, inspector, "list.c"); ok {
+			t.Errorf("got unlocked mutex listed: %+v", info)
+		}
+	})
+
+	t.Run("waiters", func(t *testing.T) {
+		token := mustLock(t, r1, "waiters")
+		locked := make(chan uint64, 1)
+		go func() {
+			token, err := KeyMutexLockCtx(context.Background(), r2, "waiters")
+			if err != nil {
+				t.Error(err)
+			}
+			locked <- token
+		}()
+		published := map[string]bool{}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			r2.publishKeyMutexWaiters(published)
+			if info, _ := findKeyMutex(t, inspector, "waiters"); info.Waiters == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("waiter is not published")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		mustUnlock(t, r1, "waiters", token)
+		mustUnlock(t, r2, "waiters", <-locked)
+		r2.publishKeyMutexWaiters(published)
+		if info, ok := findKeyMutex(t, inspector, "waiters"); ok {
+			t.Errorf("got %+v, want the waiter removed", info)
+		}
+		if len(published) != 0 {
+			t.Errorf("got published waiters %v, want none", published)
+		}
+	})
+
+	t.Run("stuck", func(t *testing.T) {
+		token := mustLock(t, r1, "stuck")
+		defer mustUnlock(t, r1, "stuck", token)
+		// A dead holder is not stuck
+		now := system.GetCurrentTimeNs()
+		dead := kvMutexState{Owner: "dead/caller", AcquiredAt: now - int64(time.Hour), ExpiresAt: now - 1}
+		if _, err := r1.kv.Put("stuck.dead.mutex", dead.encode()); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { system.MsgOnErrorReturn(r1.kv.Delete("stuck.dead.mutex")) }()
+
+		time.Sleep(10 * time.Millisecond)
+		stuck, err := inspector.Stuck(5 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, info := range stuck {
+			keys = append(keys, info.Key)
+		}
+		if len(keys) != 1 || keys[0] != "stuck" {
+			t.Errorf("got stuck %v, want [stuck]", keys)
+		}
+		if stuck, err := inspector.Stuck(time.Hour); err != nil || len(stuck) != 0 {
+			t.Errorf("got stuck %v (%v), want none", stuck, err)
+		}
+	})
+
+	t.Run("force release", func(t *testing.T) {
+		if released, err := inspector.ForceRelease("release.none", false); err != nil || released != 0 {
+			t.Errorf("got %d released (%v) of a mutex which is not held, want 0", released, err)
+		}
+
+		token := mustLock(t, r1, "release.alive")
+		if _, err := inspector.ForceRelease("release.alive", false); !errors.Is(err, ErrKeyMutexLocked) {
+			t.Errorf("got error %v, want ErrKeyMutexLocked", err)
+		}
+		if !KeyMutexFence(r1, "release.alive", token).Valid() {
+			t.Error("lease is lost without force")
+		}
+		if released, err := inspector.ForceRelease("release.alive", true); err != nil || released != 1 {
+			t.Errorf("got %d released (%v), want 1", released, err)
+		}
+		if err := KeyMutexUnlock(r1, "release.alive", token); !errors.Is(err, ErrKeyMutexLeaseLost) {
+			t.Errorf("got error %v on unlock, want ErrKeyMutexLeaseLost", err)
+		}
+		mustUnlock(t, r2, "release.alive", mustLock(t, r2, "release.alive"))
+
+		// Mutex and waiters left by a dead runtime
+		now := system.GetCurrentTimeNs()
+		dead := kvMutexState{Owner: "dead/caller", AcquiredAt: now - int64(time.Hour), ExpiresAt: now - 1}
+		if _, err := r1.kv.Put("release.dead.mutex", dead.encode()); err != nil {
+			t.Fatal(err)
+		}
+		waiters, _ := json.Marshal(kvMutexWaiters{Waiters: 3, UpdatedAt: now - int64(time.Hour)})
+		if _, err := r1.kv.Put("release.dead"+kvMutexWaitersInfix+"dead", waiters); err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := findKeyMutex(t, inspector, "release.dead"); info.Waiters != 0 {
+			t.Errorf("got %d waiters, want ones of the dead runtime ignored", info.Waiters)
+		}
+		if released, err := inspector.ForceRelease("release.dead", false); err != nil || released != 1 {
+			t.Errorf("got %d released (%v), want 1", released, err)
+		}
+		if info, ok := findKeyMutex(t, inspector, "release.dead"); ok {
+			t.Errorf("got %+v, want released", info)
+		}
+		if _, err := r1.kv.Get("release.dead" + kvMutexWaitersInfix + "dead"); err == nil {
+			t.Error("waiters of the dead runtime are kept")
+		}
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+KeyMutexLockAll locks mutices of the keys: exclusively for exclusiveKeys and shared for sharedKeys (exclusively if a key
+is in both). Either all of them are locked and their fencing tokens are returned by keys, or none of them if locking
+of any one fails or the context is done. Mutices are locked in the order of their keys, so runtimes locking
+overlapping sets of keys do not deadlock each other.
+*/
+func KeyMutexLockAll(ctx context.Context, runtime *Runtime, exclusiveKeys []string, sharedKeys []string, debugCaller ...string) (map[string]uint64, error) {
+	shared := map[string]bool{}
+	for _, key := range sharedKeys {
+		shared[key] = true
+	}
+	for _, key := range exclusiveKeys {
+		shared[key] = false
+	}
+	keys := make([]string, 0, len(shared))
+	for key := range shared {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tokens := map[string]uint64{}
+	for _, key := range keys {
+		var token uint64
+		var err error
+		if shared[key] {
+			token, err = KeyMutexRLockCtx(ctx, runtime, key, debugCaller...)
+		} else {
+			token, err = KeyMutexLockCtx(ctx, runtime, key, debugCaller...)
+		}
+		if err != nil {
+			for i := len(tokens) - 1; i >= 0; i-- {
+				system.MsgOnErrorReturn(KeyMutexUnlock(runtime, keys[i], tokens[keys[i]], debugCaller...))
+			}
+			return nil, err
+		}
+		tokens[key] = token
+	}
+	return tokens, nil
+}
+
+// KeyMutexUnlockAll unlocks mutices locked by KeyMutexLockAll, all of them are unlocked even if some fail
+func KeyMutexUnlockAll(runtime *Runtime, tokens map[string]uint64, debugCaller ...string) error {
+	keys := make([]string, 0, len(tokens))
+	for key := range tokens {
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	var errs []error
+	for _, key := range keys {
+		if err := KeyMutexUnlock(runtime, key, tokens[key], debugCaller...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyMutexLockAll(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs runtimes")
+	}
+	runtimes := startTestRuntimes(t, 2)
+	r1, r2 := runtimes[0], runtimes[1]
+
+	t.Run("exclusive and shared", func(t *testing.T) {
+		tokens, err := KeyMutexLockAll(context.Background(), r1, []string{"mode.a"}, []string{"mode.a", "mode.b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 2 {
+			t.Errorf("got tokens %v, want of 2 keys", tokens)
+		}
+		if _, err := KeyMutexTryRLock(r2, "mode.a"); !errors.Is(err, ErrKeyMutexLocked) {
+			t.Errorf("got error %v, want the key in both sets locked exclusively", err)
+		}
+		token, err := KeyMutexTryRLock(r2, "mode.b")
+		if err != nil {
+			t.Errorf("shared key is locked exclusively: %s", err)
+		} else if err := KeyMutexRUnlock(r2, "mode.b", token); err != nil {
+			t.Error(err)
+		}
+		if err := KeyMutexUnlockAll(r1, tokens); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failure releases locked keys", func(t *testing.T) {
+		token := mustLock(t, r2, "fail.b")
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if _, err := KeyMutexLockAll(ctx, r1, []string{"fail.b", "fail.a"}, nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v, want context.DeadlineExceeded", err)
+		}
+		mustUnlock(t, r2, "fail.a", mustLock(t, r2, "fail.a")) // Locked first and released
+		mustUnlock(t, r2, "fail.b", token)
+	})
+
+	t.Run("unlock all despite failures", func(t *testing.T) {
+		tokens, err := KeyMutexLockAll(context.Background(), r1, []string{"unlock.a", "unlock.b"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens["unlock.b"]++ // Not held with the token
+		if err := KeyMutexUnlockAll(r1, tokens); !errors.Is(err, ErrKeyMutexLeaseLost) {
+			t.Errorf("got error %v, want ErrKeyMutexLeaseLost", err)
+		}
+		mustUnlock(t, r2, "unlock.a", mustLock(t, r2, "unlock.a"))
+		tokens["unlock.b"]--
+		if err := KeyMutexUnlock(r1, "unlock.b", tokens["unlock.b"]); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("overlapping keys do not deadlock", func(t *testing.T) {
+		keySets := [][]string{{"overlap.a", "overlap.b", "overlap.c"}, {"overlap.c", "overlap.b", "overlap.a"}, {"overlap.b", "overlap.c"}}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*len(keySets))
+		for _, r := range runtimes {
+			for _, keys := range keySets {
+				wg.Add(1)
+				go func(r *Runtime, keys []string) {
+					defer wg.Done()
+					for i := 0; i < 5; i++ {
+						tokens, err := KeyMutexLockAll(ctx, r, keys, nil)
+						if err != nil {
+							errs <- fmt.Errorf("lock %v: %w", keys, err)
+							return
+						}
+						if err := KeyMutexUnlockAll(r, tokens); err != nil {
+							errs <- fmt.Errorf("unlock %v: %w", keys, err)
+							return
+						}
+					}
+				}(r, keys)
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,357 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// startTestRuntimes starts n runtimes connected to one in-process server
+func startTestRuntimes(t *testing.T, n int) []*Runtime {
+	t.Helper()
+	s := newTestServer(t)
+	runtimes := make([]*Runtime, n)
+	for i := range runtimes {
+		runtimes[i] = startTestRuntime(t, newTestRuntimeConfig(s), nil)
+	}
+	return runtimes
+}
+
+func mustLock(t *testing.T, runtime *Runtime, key string) uint64 {
+	t.Helper()
+	token, err := KeyMutexTryLock(runtime, key)
+	if err != nil {
+		t.Fatalf("lock %s: %s", key, err)
+	}
+	return token
+}
+
+func mustUnlock(t *testing.T, runtime *Runtime, key string, token uint64) {
+	t.Helper()
+	if err := KeyMutexUnlock(runtime, key, token); err != nil {
+		t.Fatalf("unlock %s: %s", key, err)
+	}
+}
+
+func TestKeyMutexLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs runtimes")
+	}
+	runtimes := startTestRuntimes(t, 2)
+	r1, r2 := runtimes[0], runtimes[1]
+
+	t.Run("try lock while locked", func(t *testing.T) {
+		token := mustLock(t, r1, "try")
+		for i, r := range runtimes {
+			if _, err := KeyMutexTryLock(r, "try"); !errors.Is(err, ErrKeyMutexLocked) {
+				t.Errorf("runtime %d: got error %v, want ErrKeyMutexLocked", i, err)
+			}
+		}
+		mustUnlock(t, r1, "try", token)
+		mustUnlock(t, r2, "try", mustLock(t, r2, "try"))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		token := mustLock(t, r1, "cancel")
+		defer mustUnlock(t, r1, "cancel", token)
+		for i, r := range runtimes {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			if _, err := KeyMutexLockCtx(ctx, r, "cancel"); !errors.Is(err, context.Canceled) {
+				t.Errorf("runtime %d: got error %v, want context.Canceled", i, err)
+			}
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		token := mustLock(t, r1, "timeout")
+		defer mustUnlock(t, r1, "timeout", token)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := KeyMutexLockCtx(ctx, r2, "timeout"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v, want context.DeadlineExceeded", err)
+		}
+		if waited := time.Since(start); waited < 200*time.Millisecond {
+			t.Errorf("waited %s, want the timeout", waited)
+		}
+	})
+
+	t.Run("waiting in the queue", func(t *testing.T) {
+		token := mustLock(t, r1, "queue")
+		first := make(chan error, 1)
+		go func() {
+			token, err := KeyMutexLockCtx(context.Background(), r1, "queue")
+			if err == nil {
+				err = KeyMutexUnlock(r1, "queue", token)
+			}
+			first <- err
+		}()
+		time.Sleep(100 * time.Millisecond) // The first waiter is in the queue
+
+		// The second waiter gives up waiting for its turn, the first one is not affected
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err := KeyMutexLockCtx(ctx, r1, "queue"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v, want context.DeadlineExceeded", err)
+		}
+		mustUnlock(t, r1, "queue", token)
+		if err := <-first; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("fifo hand-over", func(t *testing.T) {
+		token := mustLock(t, r1, "fifo")
+		var mutex sync.Mutex
+		order := []int{}
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				token, err := KeyMutexLockCtx(context.Background(), r1, "fifo")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				order = append(order, i)
+				mutex.Unlock()
+				if err := KeyMutexUnlock(r1, "fifo", token); err != nil {
+					t.Error(err)
+				}
+			}(i)
+			time.Sleep(50 * time.Millisecond) // Waiters are enqueued in order
+		}
+		if _, err := KeyMutexTryLock(r1, "fifo"); !errors.Is(err, ErrKeyMutexLocked) {
+			t.Errorf("got error %v, want ErrKeyMutexLocked with waiters in the queue", err)
+		}
+		mustUnlock(t, r1, "fifo", token)
+		wg.Wait()
+		if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+			t.Errorf("got waiters locked in order %v, want [0 1 2]", order)
+		}
+	})
+
+	t.Run("other runtime waits for unlock", func(t *testing.T) {
+		token := mustLock(t, r1, "unlock")
+		locked := make(chan error, 1)
+		go func() {
+			token, err := KeyMutexLockCtx(context.Background(), r2, "unlock")
+			if err == nil {
+				err = KeyMutexUnlock(r2, "unlock", token)
+			}
+			locked <- err
+		}()
+		select {
+		case err := <-locked:
+			t.Fatalf("locked while held by another runtime: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+		mustUnlock(t, r1, "unlock", token)
+		select {
+		case err := <-locked:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("not locked after unlock")
+		}
+	})
+
+	t.Run("mutual exclusion", func(t *testing.T) {
+		var holders int32
+		var wg sync.WaitGroup
+		for _, r := range runtimes {
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(r *Runtime) {
+					defer wg.Done()
+					for j := 0; j < 5; j++ {
+						token, err := KeyMutexLockCtx(context.Background(), r, "exclusive")
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if n := atomic.AddInt32(&holders, 1); n != 1 {
+							t.Errorf("got %d holders of the mutex", n)
+						}
+						time.Sleep(time.Millisecond)
+						atomic.AddInt32(&holders, -1)
+						if err := KeyMutexUnlock(r, "exclusive", token); err != nil {
+							t.Error(err)
+						}
+					}
+				}(r)
+			}
+		}
+		wg.Wait()
+	})
+
+	t.Run("takeover after expiry", func(t *testing.T) {
+		token := mustLock(t, r1, "expiry")
+		// The lease expires as if r1 was paused for longer than the lifetime
+		now := system.GetCurrentTimeNs()
+		expired := kvMutexState{Owner: r1.instanceID, AcquiredAt: now - int64(time.Minute), ExpiresAt: now - 1}
+		if _, err := r1.kv.Put("expiry.mutex", expired.encode()); err != nil {
+			t.Fatal(err)
+		}
+		takenOver := mustLock(t, r2, "expiry")
+		if takenOver <= token {
+			t.Errorf("got fencing token %d after %d, want it to grow", takenOver, token)
+		}
+		if err := KeyMutexUnlock(r1, "expiry", token); !errors.Is(err, ErrKeyMutexLeaseLost) {
+			t.Errorf("got error %v unlocking the expired lease, want ErrKeyMutexLeaseLost", err)
+		}
+		if KeyMutexFence(r1, "expiry", token).Valid() {
+			t.Error("fence of the expired lease is valid")
+		}
+		mustUnlock(t, r2, "expiry", takenOver)
+	})
+}
+
+func TestKVMutexStateBlockedTill(t *testing.T) {
+	const now = 1000
+	tests := []struct {
+		name   string
+		state  kvMutexState
+		shared bool
+		want   int64
+	}{
+		{name: "unlocked", state: kvMutexState{}, want: 0},
+		{name: "locked", state: kvMutexState{Owner: "a", ExpiresAt: 2000}, want: 2000},
+		{name: "locked shared", state: kvMutexState{Owner: "a", ExpiresAt: 2000}, shared: true, want: 2000},
+		{name: "expired owner", state: kvMutexState{Owner: "a", ExpiresAt: 999}, want: 0},
+		{
+			name:  "readers block writer till the earliest expiry",
+			state: kvMutexState{Readers: map[string]kvMutexReader{"a": {ExpiresAt: 3000}, "b": {ExpiresAt: 2000}, "c": {ExpiresAt: 999}}},
+			want:  2000,
+		},
+		{name: "readers do not block reader", state: kvMutexState{Readers: map[string]kvMutexReader{"a": {ExpiresAt: 3000}}}, shared: true, want: 0},
+		{name: "expired readers", state: kvMutexState{Readers: map[string]kvMutexReader{"a": {ExpiresAt: 999}}}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.blockedTill(now, tt.shared); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("drop expired readers", func(t *testing.T) {
+		state := kvMutexState{Readers: map[string]kvMutexReader{"a": {ExpiresAt: 999}, "b": {ExpiresAt: 1000}}}
+		state.dropExpiredReaders(now)
+		if _, ok := state.Readers["a"]; ok || len(state.Readers) != 1 {
+			t.Errorf("got readers %v, want only b", state.Readers)
+		}
+	})
+}
+
+func TestKeyMutexRLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs runtimes")
+	}
+	runtimes := startTestRuntimes(t, 2)
+	r1, r2 := runtimes[0], runtimes[1]
+
+	t.Run("readers coexist", func(t *testing.T) {
+		tokens := map[*Runtime][]uint64{}
+		for _, r := range []*Runtime{r1, r2, r1} {
+			token, err := KeyMutexTryRLock(r, "readers")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens[r] = append(tokens[r], token)
+		}
+		for i, r := range runtimes {
+			if _, err := KeyMutexTryLock(r, "readers"); !errors.Is(err, ErrKeyMutexLocked) {
+				t.Errorf("runtime %d: got error %v locking exclusively, want ErrKeyMutexLocked", i, err)
+			}
+		}
+		for r, rTokens := range tokens {
+			for _, token := range rTokens {
+				if err := KeyMutexRUnlock(r, "readers", token); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		mustUnlock(t, r2, "readers", mustLock(t, r2, "readers"))
+	})
+
+	t.Run("writer excludes readers", func(t *testing.T) {
+		token := mustLock(t, r1, "writer")
+		for i, r := range runtimes {
+			if _, err := KeyMutexTryRLock(r, "writer"); !errors.Is(err, ErrKeyMutexLocked) {
+				t.Errorf("runtime %d: got error %v, want ErrKeyMutexLocked", i, err)
+			}
+		}
+		mustUnlock(t, r1, "writer", token)
+	})
+
+	t.Run("writer waits for readers", func(t *testing.T) {
+		token, err := KeyMutexTryRLock(r1, "wait")
+		if err != nil {
+			t.Fatal(err)
+		}
+		locked := make(chan error, 1)
+		go func() {
+			token, err := KeyMutexLockCtx(context.Background(), r2, "wait")
+			if err == nil {
+				err = KeyMutexUnlock(r2, "wait", token)
+			}
+			locked <- err
+		}()
+		select {
+		case err := <-locked:
+			t.Fatalf("locked exclusively while read: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+		if err := KeyMutexRUnlock(r1, "wait", token); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-locked:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("not locked after the reader unlocked")
+		}
+	})
+
+	t.Run("expired readers", func(t *testing.T) {
+		// A reader of a runtime which is gone expires
+		now := system.GetCurrentTimeNs()
+		state := kvMutexState{Readers: map[string]kvMutexReader{"gone": {AcquiredAt: now - int64(time.Minute), ExpiresAt: now - 1}}}
+		if _, err := r1.kv.Put("expired.mutex", state.encode()); err != nil {
+			t.Fatal(err)
+		}
+		token, err := KeyMutexTryRLock(r1, "expired")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := r1.kv.Get("expired.mutex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readers := decodeKVMutexState(entry.Value(), time.Minute).Readers; len(readers) != 1 {
+			t.Errorf("got readers %v, want the expired one dropped", readers)
+		}
+		if err := KeyMutexRUnlock(r1, "expired", token); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := r1.kv.Put("expired.mutex", state.encode()); err != nil {
+			t.Fatal(err)
+		}
+		mustUnlock(t, r2, "expired", mustLock(t, r2, "expired"))
+	})
+}
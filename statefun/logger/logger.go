@@ -0,0 +1,110 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun logger package.
+// Provides pluggable leveled structured logging for all statefun subsystems, log/slog is used by default
+package logger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Keys of the common structured logging fields
+const (
+	TypenameKey = "typename"
+	IDKey       = "id"
+	QueryIDKey  = "query_id"
+	ErrorKey    = "error"
+)
+
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+	// With returns a logger which adds the given key-value pairs to each record
+	With(args ...any) Logger
+}
+
+type slogLogger struct {
+	l *slog.Logger // nil means slog.Default() at the moment of logging
+}
+
+// NewSlogLogger creates Logger which writes records into the given slog.Logger, slog.Default() is used if l is nil
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+// NewTextLogger creates Logger which writes records of the given level and above in the text format into w
+func NewTextLogger(w io.Writer, level slog.Level) Logger {
+	return NewSlogLogger(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// NewJSONLogger creates Logger which writes records of the given level and above in the JSON format into w
+func NewJSONLogger(w io.Writer, level slog.Level) Logger {
+	return NewSlogLogger(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// NewNopLogger creates Logger which discards all records
+func NewNopLogger() Logger {
+	return NewSlogLogger(slog.New(nopHandler{}))
+}
+
+func (sl *slogLogger) logger() *slog.Logger {
+	if sl.l == nil {
+		return slog.Default()
+	}
+	return sl.l
+}
+
+func (sl *slogLogger) Debug(msg string, args ...any) {
+	sl.logger().Debug(msg, args...)
+}
+
+func (sl *slogLogger) Info(msg string, args ...any) {
+	sl.logger().Info(msg, args...)
+}
+
+func (sl *slogLogger) Warn(msg string, args ...any) {
+	sl.logger().Warn(msg, args...)
+}
+
+func (sl *slogLogger) Error(msg string, args ...any) {
+	sl.logger().Error(msg, args...)
+}
+
+func (sl *slogLogger) With(args ...any) Logger {
+	return &slogLogger{l: sl.logger().With(args...)}
+}
+
+type nopHandler struct{}
+
+func (nopHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (nopHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h nopHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h nopHandler) WithGroup(string) slog.Handler           { return h }
+
+type loggerHolder struct {
+	l Logger
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerHolder{l: NewSlogLogger(nil)})
+}
+
+// Default returns the logger used by subsystems which have no access to a runtime (for e.g. system.MsgOnErrorReturn)
+func Default() Logger {
+	return defaultLogger.Load().(loggerHolder).l
+}
+
+// SetDefault replaces the default logger, nil restores the one writing into slog.Default()
+func SetDefault(l Logger) {
+	if l == nil {
+		l = NewSlogLogger(nil)
+	}
+	defaultLogger.Store(loggerHolder{l: l})
+}
@@ -0,0 +1,356 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun metrics package.
+// Provides counters, gauges and histograms which can be exposed in the OpenMetrics text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefaultDurationBuckets are histogram buckets in seconds suitable for handler latencies
+var DefaultDurationBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mutex.Unlock()
+}
+
+// Write writes all registered metrics into w in the OpenMetrics text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// Handler returns http.Handler which serves all registered metrics in the OpenMetrics text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.Write(w)
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.metricType)
+	if len(f.help) > 0 {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	}
+}
+
+func (f *family) labelsString(labelValues []string, extra ...string) string {
+	if len(f.labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(f.labelNames)+len(extra)/2)
+	for i, name := range f.labelNames {
+		pairs = append(pairs, name+`="`+escape(labelValues[i], true)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1], true)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type vec[T any] struct {
+	family
+	mutex    sync.Mutex
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func (v *vec[T]) withLabelValues(labelValues ...string) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c
+	}
+	c := v.newChild()
+	v.children[key] = c
+	v.values[key] = append([]string{}, labelValues...)
+	return c
+}
+
+func (v *vec[T]) sorted(f func(labelValues []string, child *T)) {
+	v.mutex.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+		values[i] = v.values[k]
+	}
+	v.mutex.Unlock()
+	for i := range keys {
+		f(values[i], children[i])
+	}
+}
+
+func newVec[T any](name string, help string, metricType string, labelNames []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		family:   family{name: name, help: help, metricType: metricType, labelNames: labelNames},
+		children: map[string]*T{},
+		values:   map[string][]string{},
+		newChild: newChild,
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+type Counter struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter, negative values are ignored
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.mutex.Lock()
+	c.value += delta
+	c.mutex.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.value
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// NewCounterVec registers a counter family, name must not contain the "_total" suffix
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	cv := &CounterVec{newVec(name, help, "counter", labelNames, func() *Counter { return &Counter{} })}
+	r.register(cv)
+	return cv
+}
+
+func (cv *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return cv.withLabelValues(labelValues...)
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.writeHeader(w)
+	cv.sorted(func(labelValues []string, c *Counter) {
+		fmt.Fprintf(w, "%s_total%s %s\n", cv.name, cv.labelsString(labelValues), formatFloat(c.Value()))
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+type Gauge struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(value float64) {
+	g.mutex.Lock()
+	g.value = value
+	g.mutex.Unlock()
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.mutex.Lock()
+	g.value += delta
+	g.mutex.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	gv := &GaugeVec{newVec(name, help, "gauge", labelNames, func() *Gauge { return &Gauge{} })}
+	r.register(gv)
+	return gv
+}
+
+func (gv *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return gv.withLabelValues(labelValues...)
+}
+
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	gv.writeHeader(w)
+	gv.sorted(func(labelValues []string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", gv.name, gv.labelsString(labelValues), formatFloat(g.Value()))
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+type Histogram struct {
+	mutex        sync.Mutex
+	upperBounds  []float64
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, upperBound := range h.upperBounds {
+		if value <= upperBound {
+			h.bucketCounts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper bounds, DefaultDurationBuckets are used if buckets is empty
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultDurationBuckets
+	}
+	upperBounds := append([]float64{}, buckets...)
+	sort.Float64s(upperBounds)
+	hv := &HistogramVec{newVec(name, help, "histogram", labelNames, func() *Histogram {
+		return &Histogram{upperBounds: upperBounds, bucketCounts: make([]uint64, len(upperBounds))}
+	})}
+	r.register(hv)
+	return hv
+}
+
+func (hv *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return hv.withLabelValues(labelValues...)
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.writeHeader(w)
+	hv.sorted(func(labelValues []string, h *Histogram) {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		for i, upperBound := range h.upperBounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelsString(labelValues, "le", formatFloat(upperBound)), h.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelsString(labelValues, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, hv.labelsString(labelValues), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, hv.labelsString(labelValues), formatFloat(h.sum))
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+type funcMetric struct {
+	family
+	f func() float64
+}
+
+// NewCounterFunc registers a counter which value is obtained by calling f on each scrape, name must not contain the "_total" suffix
+func (r *Registry) NewCounterFunc(name string, help string, f func() float64) {
+	r.register(&funcMetric{family: family{name: name, help: help, metricType: "counter"}, f: f})
+}
+
+// NewGaugeFunc registers a gauge which value is obtained by calling f on each scrape
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.register(&funcMetric{family: family{name: name, help: help, metricType: "gauge"}, f: f})
+}
+
+func (fm *funcMetric) write(w *bufio.Writer) {
+	fm.writeHeader(w)
+	sampleName := fm.name
+	if fm.metricType == "counter" {
+		sampleName += "_total"
+	}
+	fmt.Fprintf(w, "%s %s\n", sampleName, formatFloat(fm.f()))
+}
+
+// ----------------------------------------------------------------------------
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 NJWS Inc.
+
+package metrics_test
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/sdk/statefun/metrics"
+)
+
+const golden = `# TYPE calls counter
+# HELP calls Function calls, "quoted" \\ with a line\nbreak
+calls_total{typename="a"} 2
+calls_total{typename="b\"c\\d\ne"} 0.5
+# TYPE live gauge
+live{typename="a"} -1
+live{typename="b"} +Inf
+# TYPE duration histogram
+# HELP duration Handler duration
+duration_bucket{typename="a",le="0.1"} 1
+duration_bucket{typename="a",le="1"} 2
+duration_bucket{typename="a",le="+Inf"} 3
+duration_count{typename="a"} 3
+duration_sum{typename="a"} 6.1
+# TYPE uptime counter
+# HELP uptime Uptime
+uptime_total 42
+# TYPE connected gauge
+connected NaN
+# EOF
+`
+
+func TestWrite(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	calls := r.NewCounterVec("calls", "Function calls, \"quoted\" \\ with a line\nbreak", "typename")
+	calls.WithLabelValues("a").Inc()
+	calls.WithLabelValues("a").Add(1)
+	calls.WithLabelValues("a").Add(-5) // Ignored
+	calls.WithLabelValues("b\"c\\d\ne").Add(0.5)
+
+	live := r.NewGaugeVec("live", "", "typename")
+	live.WithLabelValues("b").Set(math.Inf(1))
+	live.WithLabelValues("a").Inc()
+	live.WithLabelValues("a").Add(-2)
+
+	duration := r.NewHistogramVec("duration", "Handler duration", []float64{1, 0.1}, "typename")
+	duration.WithLabelValues("a").Observe(0.1) // Bucket upper bounds are inclusive
+	duration.WithLabelValues("a").Observe(1)
+	duration.WithLabelValues("a").Observe(5)
+
+	r.NewCounterFunc("uptime", "Uptime", func() float64 { return 42 })
+	r.NewGaugeFunc("connected", "", func() float64 { return math.NaN() })
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != golden {
+		t.Errorf("got exposition:\n%s\nwant:\n%s", b.String(), golden)
+	}
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if got := recorder.Header().Get("Content-Type"); got != metrics.ContentType {
+		t.Errorf("got content type %q", got)
+	}
+	if recorder.Body.String() != golden {
+		t.Errorf("got served exposition:\n%s", recorder.Body.String())
+	}
+}
+
+func TestLabelValuesCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on a wrong number of label values")
+		}
+	}()
+	metrics.NewRegistry().NewCounterVec("calls", "", "typename").WithLabelValues("a", "b")
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/nats-io/nats.go"
+)
+
+// natsOptions builds NATS connection options from the runtime config
+func (r *Runtime) natsOptions() ([]nats.Option, error) {
+	c := &r.config
+	opts := []nats.Option{
+		nats.Name(c.traceServiceName),
+		nats.DisconnectErrHandler(r.onNATSDisconnected),
+		nats.ReconnectHandler(r.onNATSReconnected),
+		nats.ClosedHandler(r.onNATSClosed),
+	}
+	if len(c.natsCredentialsFile) > 0 {
+		opts = append(opts, nats.UserCredentials(c.natsCredentialsFile))
+	}
+	if len(c.natsUserJWT) > 0 {
+		opts = append(opts, nats.UserJWTAndSeed(c.natsUserJWT, c.natsUserSeed))
+	}
+	if len(c.natsNKeySeedFile) > 0 {
+		opt, err := nats.NkeyOptionFromSeed(c.natsNKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load NATS nkey seed file %s: %w", c.natsNKeySeedFile, err)
+		}
+		opts = append(opts, opt)
+	}
+	if len(c.natsTLSCertFile) > 0 || len(c.natsTLSKeyFile) > 0 {
+		opts = append(opts, nats.ClientCert(c.natsTLSCertFile, c.natsTLSKeyFile))
+	}
+	if len(c.natsTLSRootCAFiles) > 0 {
+		opts = append(opts, nats.RootCAs(c.natsTLSRootCAFiles...))
+	}
+	if c.natsTLSConfig != nil {
+		opts = append(opts, nats.Secure(c.natsTLSConfig))
+	}
+	if c.natsReconnectWaitMs > 0 {
+		opts = append(opts, nats.ReconnectWait(time.Duration(c.natsReconnectWaitMs)*time.Millisecond))
+	}
+	if c.natsMaxReconnects != 0 {
+		opts = append(opts, nats.MaxReconnects(c.natsMaxReconnects))
+	}
+	if c.natsPingIntervalSec > 0 {
+		opts = append(opts, nats.PingInterval(time.Duration(c.natsPingIntervalSec)*time.Second))
+	}
+	return append(opts, c.natsOptions...), nil
+}
+
+// natsServers returns comma separated URLs of the NATS servers to connect to
+func (r *Runtime) natsServers() string {
+	servers := append([]string{r.config.natsURL}, r.config.natsServers...)
+	return strings.Join(servers, ",")
+}
+
+func (r *Runtime) onNATSDisconnected(nc *nats.Conn, err error) {
+	if r.ctx.Err() != nil {
+		return // Runtime is being shut down
+	}
+	r.metrics.natsConnectionEvents.WithLabelValues("disconnected").Inc()
+	r.logger.Warn("Disconnected from NATS", logger.ErrorKey, err)
+	if r.config.onNATSDisconnected != nil {
+		r.config.onNATSDisconnected(err)
+	}
+}
+
+func (r *Runtime) onNATSReconnected(nc *nats.Conn) {
+	r.metrics.natsConnectionEvents.WithLabelValues("reconnected").Inc()
+	r.logger.Info("Reconnected to NATS", "url", nc.ConnectedUrlRedacted())
+	if r.config.onNATSReconnected != nil {
+		r.config.onNATSReconnected(nc.ConnectedUrlRedacted())
+	}
+}
+
+// onNATSClosed shuts the runtime down if the connection was closed not by the runtime itself, e.g. all reconnect attempts failed
+func (r *Runtime) onNATSClosed(nc *nats.Conn) {
+	if r.ctx.Err() != nil {
+		return // Closed by the runtime shutdown
+	}
+	r.metrics.natsConnectionEvents.WithLabelValues("closed").Inc()
+	r.logger.Error("NATS connection is closed, shutting the runtime down")
+	if r.config.onNATSClosed != nil {
+		r.config.onNATSClosed()
+	}
+	r.connectionErr = nats.ErrConnectionClosed
+	go func() {
+		_ = r.Shutdown(context.Background())
+	}()
+}
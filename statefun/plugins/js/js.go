@@ -7,6 +7,7 @@ import (
 
 	"github.com/foliagecp/easyjson"
 
+	"github.com/foliagecp/sdk/statefun/logger"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
 	v8 "rogchap.com/v8go"
@@ -30,7 +31,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetSelfTypenane := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getSelfTypename: %v\n", info.Args()) // when the JS function is called this Go callback will execute
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getSelfTypename error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getSelfTypename error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -41,7 +42,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetSelfID := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getSelfId: %v\n", info.Args())
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getSelfId error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getSelfId error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -52,7 +53,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetCallerTypenane := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getCallerTypename: %v\n", info.Args()) // when the JS function is called this Go callback will execute
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getCallerTypename error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getCallerTypename error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -63,7 +64,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetCallerID := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getCallerId: %v\n", info.Args())
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getCallerId error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getCallerId error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -74,7 +75,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetFunctionContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getFunctionContext: %v\n", info.Args())
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getFunctionContext error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getFunctionContext error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -85,7 +86,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunSetFunctionContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_setFunctionContext: %v\n", info.Args())
 		if len(info.Args()) != 1 {
-			fmt.Printf("statefun_setFunctionContext error: requies 1 argument but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_setFunctionContext error: requires 1 argument", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, int32(1))
 			return v
 		}
@@ -108,7 +109,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetObjectContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getObjectContext: %v\n", info.Args())
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getObjectContext error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getObjectContext error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -119,7 +120,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunSetObjectContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_setObjectContext: %v\n", info.Args())
 		if len(info.Args()) != 1 {
-			fmt.Printf("statefun_setObjectContext error: requies 1 argument but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_setObjectContext error: requires 1 argument", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, int32(1))
 			return v
 		}
@@ -142,7 +143,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetPayload := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getPayload: %v", info.Args())
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getPayload error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getPayload error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -153,7 +154,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunGetOptions := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_getOptions: %v", info.Args())
 		if len(info.Args()) != 0 {
-			fmt.Printf("statefun_getOptions error: requies no arguments but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_getOptions error: requires no arguments", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, nil)
 			return v
 		}
@@ -164,7 +165,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunCall := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_call: %v\n", info.Args())
 		if len(info.Args()) != 4 {
-			fmt.Printf("statefun_call error: requies 4 argument but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_call error: requires 4 argument", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, int32(1))
 			return v
 		}
@@ -175,7 +176,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 					if o, ok := easyjson.JSONFromString(info.Args()[3].String()); ok {
 						options = &o
 					} else {
-						fmt.Printf("statefunCall options is not empty and not a JSON: %s\n", info.Args()[3].String())
+						logger.Default().Error("statefunCall options is not empty and not a JSON", "options", info.Args()[3].String())
 						v, _ := v8.NewValue(sfejs.vw, int32(3))
 						return v
 					}
@@ -184,7 +185,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 				v, _ := v8.NewValue(sfejs.vw, int32(0))
 				return v
 			}
-			fmt.Printf("statefunCall payload is not a JSON: %s\n", info.Args()[2].String())
+			logger.Default().Error("statefunCall payload is not a JSON", "payload", info.Args()[2].String())
 			v, _ := v8.NewValue(sfejs.vw, int32(3))
 			return v
 		}
@@ -195,7 +196,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	statefunEgress := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//fmt.Printf("statefun_egress: %v\n", info.Args())
 		if len(info.Args()) != 2 {
-			fmt.Printf("statefun_egress error: requies 2 argument but got %d\n", len(info.Args()))
+			logger.Default().Error("statefun_egress error: requires 2 argument", "got", len(info.Args()))
 			v, _ := v8.NewValue(sfejs.vw, int32(1))
 			return v
 		}
@@ -205,7 +206,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 				v, _ := v8.NewValue(sfejs.vw, int32(0))
 				return v
 			}
-			fmt.Printf("statefunEgress payload is not a JSON: %s\n", info.Args()[1].String())
+			logger.Default().Error("statefunEgress payload is not a JSON", "payload", info.Args()[1].String())
 			v, _ := v8.NewValue(sfejs.vw, int32(3))
 			return v
 		}
@@ -214,7 +215,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 	})
 	// (string)
 	print := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
-		fmt.Printf("%s: %v\n", alias, info.Args())
+		logger.Default().Info(fmt.Sprintf("%v", info.Args()), "alias", alias)
 		return nil
 	})
 
@@ -5,12 +5,13 @@
 package plugins
 
 import (
-	"fmt"
 	"sync"
+	"time"
 
 	"github.com/foliagecp/easyjson"
 
 	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
 )
 
 type StatefunAddress struct {
@@ -22,16 +23,29 @@ type StatefunContextProcessor struct {
 	GlobalCache        *cache.Store
 	GetFunctionContext func() *easyjson.JSON
 	SetFunctionContext func(*easyjson.JSON)
-	GetObjectContext   func() *easyjson.JSON
-	SetObjectContext   func(*easyjson.JSON)
-	Call               func(string, string, *easyjson.JSON, *easyjson.JSON)
+	// Deletes the function context from the cache and the NATS KV, GetFunctionContext returns an empty one afterwards
+	DeleteFunctionContext func()
+	GetObjectContext      func() *easyjson.JSON
+	SetObjectContext      func(*easyjson.JSON)
+	Call                  func(string, string, *easyjson.JSON, *easyjson.JSON)
 	// TODO: DownstreamCall(<function type>, <links filters>, <payload>, <options>)
 	GolangCallSync func(string, string, *easyjson.JSON, *easyjson.JSON) (*easyjson.JSON, error)
-	Egress         func(string, *easyjson.JSON)
-	Self           StatefunAddress
-	Caller         StatefunAddress
-	Payload        *easyjson.JSON
-	Options        *easyjson.JSON
+	// Calls a function after a delay, the call is persisted and survives runtime restarts
+	CallAfter func(string, string, *easyjson.JSON, *easyjson.JSON, time.Duration)
+	Egress    func(string, *easyjson.JSON)
+	// Replies the caller waiting synchronously (GolangCallSync, IngressGolangSync, IngressNATSSync) with an error instead of a result
+	ReplyError func(error)
+	// Logger with the typename and the id of the function
+	Logger logger.Logger
+	// W3C traceparent of the span of the current function call, the one of the caller if tracing is disabled
+	TraceParent string
+	Self        StatefunAddress
+	Caller      StatefunAddress
+	Payload     *easyjson.JSON
+	Options     *easyjson.JSON
+	// Fence of the KV mutex lease guarding the current call, writes with it are rejected once the lease is lost
+	// Zero for Golang sync calls of function types which are not balanced, they are not guarded by a mutex
+	Fence cache.Fence
 }
 
 type StatefunExecutor interface {
@@ -55,10 +69,10 @@ func NewTypenameExecutor(alias string, source string, executorContructorFunction
 
 func (tnex *TypenameExecutorPlugin) AddForID(id string) {
 	if tnex.executorContructorFunction == nil {
-		fmt.Printf("Cannot create new StatefunExecutor for id=%s: missing newExecutor function\n", id)
+		logger.Default().Error("Cannot create new StatefunExecutor: missing newExecutor function", logger.IDKey, id)
 		tnex.idExecutors.Store(id, nil)
 	} else {
-		fmt.Printf("______________ Created StatefunExecutor for id=%s\n", id)
+		logger.Default().Debug("Created StatefunExecutor", logger.IDKey, id)
 		executor := tnex.executorContructorFunction(tnex.alias, tnex.source)
 		tnex.idExecutors.Store(id, executor)
 	}
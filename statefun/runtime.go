@@ -6,26 +6,58 @@ package statefun
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/foliagecp/easyjson"
 
 	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/foliagecp/sdk/statefun/trace"
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 )
 
 type Runtime struct {
 	config     RuntimeConfig
+	instanceID string
 	nc         *nats.Conn
 	js         nats.JetStreamContext
 	kv         nats.KeyValue
 	cacheStore *cache.Store
+	logger     logger.Logger
+	metrics    *runtimeMetrics
+	tracer     *trace.Tracer // nil if tracing is disabled
+	scheduler  *scheduler
+	balancer   *balancer
+
+	embeddedNats        *server.Server // nil if connected to an external NATS server
+	embeddedNatsTempDir string
 
 	registeredFunctionTypes map[string]*FunctionType
+	functionTypesMutex      sync.RWMutex
+	registrationMutex       sync.Mutex // Serializes starting and unregistering of function types along with their streams
+	started                 bool       // Function types are started, guarded by registrationMutex
+
+	ctx                context.Context
+	cancel             context.CancelFunc
+	gcMutex            sync.Mutex
+	shutdownHooks      []func(runtime *Runtime)
+	shutdownHooksMutex sync.Mutex
+	shutdownOnce       sync.Once
+	shutdownErr        error
+	connectionErr      error         // Set if the runtime was shut down due to the lost NATS connection
+	stopped            chan struct{} // Closed when runtime shutdown is completed
+
+	kvMutexLeases      sync.Map // Key -> *keyMutexLease held by the runtime
+	kvMutexQueues      map[string][]chan struct{}
+	kvMutexQueuesMutex sync.Mutex
 
 	gt0  int64 // Global time 0 - time of the very first message receving by any function type
 	glce int64 // Global last call ended - time of last call of last function handling id of any function type
@@ -35,10 +67,47 @@ type Runtime struct {
 func NewRuntime(config RuntimeConfig) (r *Runtime, err error) {
 	r = &Runtime{
 		config:                  config,
+		instanceID:              system.GetUniqueStrID(),
 		registeredFunctionTypes: make(map[string]*FunctionType),
+		kvMutexQueues:           make(map[string][]chan struct{}),
+		stopped:                 make(chan struct{}),
+		metrics:                 newRuntimeMetrics(),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	if config.logger != nil {
+		logger.SetDefault(config.logger) // For subsystems which have no access to the runtime
+	}
+	r.logger = logger.Default()
+
+	if config.traceExporter != nil {
+		r.tracer = trace.NewTracer(config.traceServiceName, config.traceExporter)
+	}
+
+	natsServers := r.natsServers()
+	natsOptions, err := r.natsOptions()
+	if err != nil {
+		return nil, err
+	}
+	if r.config.embeddedNats {
+		inProcessOption, e := r.startEmbeddedNats()
+		if e != nil {
+			return nil, e
+		}
+		defer func() {
+			if err != nil {
+				r.cancel() // Not a connection loss, see onNATSClosed
+				if r.nc != nil {
+					r.nc.Close()
+				}
+				r.stopEmbeddedNats()
+			}
+		}()
+		natsServers = ""
+		natsOptions = append(natsOptions, inProcessOption)
 	}
 
-	r.nc, err = nats.Connect(config.natsURL)
+	r.nc, err = nats.Connect(natsServers, natsOptions...)
 	if err != nil {
 		return
 	}
@@ -74,59 +143,210 @@ func NewRuntime(config RuntimeConfig) (r *Runtime, err error) {
 	}
 	// --------------------------------------------------------------
 
+	r.metrics.registerKeyMutices(r)
+	go r.runKeyMutexMonitor()
+
 	return
 }
 
+// Start starts handling registered function types and blocks until the runtime is shut down. If the runtime fails to start,
+// it is shut down and the error is returned.
 func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Runtime)) (err error) {
-	// Create stream if does not exist ------------------------------
-	streamExists := false
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	for info := range r.js.StreamsInfo(nats.Context(ctx)) {
-		if info.Config.Name == r.config.functionTypesStreamName {
-			streamExists = true
-			break
-		}
+	r.registrationMutex.Lock()
+
+	// Create streams or reconcile existing ones with registered function types
+	if err := r.reconcileStreams(); err != nil {
+		return r.failStart(err)
 	}
-	if !streamExists {
-		var subjects []string
-		for _, functionType := range r.registeredFunctionTypes {
-			subjects = append(subjects, functionType.subject)
-		}
-		_, err := r.js.AddStream(&nats.StreamConfig{
-			Name:     r.config.functionTypesStreamName,
-			Subjects: subjects,
-		})
-		system.MsgOnErrorReturn(err)
+
+	if err := r.createDeadLetterStream(); err != nil {
+		return r.failStart(err)
 	}
-	// --------------------------------------------------------------
 
-	fmt.Println("Initializing the cache store...")
+	r.logger.Info("Initializing the cache store...")
 	r.cacheStore = cache.NewCacheStore(context.Background(), cacheConfig, r.kv)
-	fmt.Println("Cache store inited!")
+	r.logger.Info("Cache store inited!")
+	r.metrics.registerCacheStore(r.cacheStore)
 
+	if len(r.config.metricsAddress) > 0 {
+		if err := r.metrics.serve(r.config.metricsAddress, r.logger); err != nil {
+			return r.failStart(err)
+		}
+	}
+
+	r.balancer = newBalancer(r) // Function types balanced by partitions forward messages by it
 	// Start function subscriptions ---------------------------------
-	for _, ft := range r.registeredFunctionTypes {
-		system.MsgOnErrorReturn(ft.Start(r.config.functionTypesStreamName))
+	for _, ft := range r.functionTypes() {
+		if err := ft.Start(ft.targetStreamName()); err != nil {
+			return r.failStart(fmt.Errorf("function type %s: %w", ft.name, err))
+		}
 	}
 	// --------------------------------------------------------------
 
+	r.scheduler = newScheduler(r)
+	system.MsgOnErrorReturn(r.scheduler.start())
+
+	system.MsgOnErrorReturn(r.balancer.start())
+
+	r.started = true
+	r.registrationMutex.Unlock()
+
 	onAfterStart(r)
 	system.MsgOnErrorReturn(r.runGarbageCellector())
 
-	return
+	<-r.stopped
+	if r.shutdownErr != nil {
+		return r.shutdownErr
+	}
+	return r.connectionErr
+}
+
+// failStart shuts down the runtime which failed to start, Start holds the registration mutex till then
+func (r *Runtime) failStart(err error) error {
+	if r.balancer != nil {
+		close(r.balancer.stopped) // Is not started yet
+	}
+	r.registrationMutex.Unlock()
+	system.MsgOnErrorReturn(r.Shutdown(context.Background()))
+	return err
+}
+
+// Shutdown gracefully stops the runtime: stops receiving messages for all function types, lets in-flight id handlers
+// finish and ack their messages, releases held typename mutices and partitions, flushes the cache store into the NATS KV and closes
+// the NATS connection. If ctx is done before that, the NATS connection is closed immediately and ctx's error is returned.
+// Start returns once the shutdown is completed.
+func (r *Runtime) Shutdown(ctx context.Context) error {
+	r.shutdownOnce.Do(func() {
+		r.cancel()
+
+		done := make(chan struct{})
+		go func() {
+			r.shutdown()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			r.shutdownErr = ctx.Err()
+			r.nc.Close()
+		}
+		close(r.stopped)
+	})
+	return r.shutdownErr
+}
+
+// OnShutdown adds a hook called on shutdown before function types stop receiving messages, hooks are called in reverse order
+func (r *Runtime) OnShutdown(hook func(runtime *Runtime)) {
+	r.shutdownHooksMutex.Lock()
+	defer r.shutdownHooksMutex.Unlock()
+	r.shutdownHooks = append(r.shutdownHooks, hook)
+}
+
+// InstanceID returns the id of the runtime unique among all runtimes
+func (r *Runtime) InstanceID() string {
+	return r.instanceID
+}
+
+// Logger returns the logger of the runtime set by RuntimeConfig.SetLogger
+func (r *Runtime) Logger() logger.Logger {
+	return r.logger
+}
+
+func (r *Runtime) shutdown() {
+	// Wait for the current garbage collection iteration to finish, no other will be started
+	r.gcMutex.Lock()
+	defer r.gcMutex.Unlock()
+
+	r.logger.Info("Shutting down the runtime...")
+
+	// Function types are still handling messages, so hooks may call them
+	r.shutdownHooksMutex.Lock()
+	hooks := r.shutdownHooks
+	r.shutdownHooksMutex.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](r)
+	}
+
+	if r.scheduler != nil {
+		<-r.scheduler.stopped
+	}
+	if r.balancer != nil {
+		<-r.balancer.stopped // No partitions are acquired from now on
+	}
+
+	// Stop receiving new messages ----------------------------------
+	for _, ft := range r.functionTypes() {
+		system.MsgOnErrorReturn(ft.stop())
+	}
+	// --------------------------------------------------------------
+
+	// Let in-flight id handlers finish -----------------------------
+	// Handlers being stopped may still call other ones via GolangCallSync, so repeat until no handler is left
+	for {
+		stoppedHandlers := 0
+		for _, ft := range r.functionTypes() {
+			stoppedHandlers += ft.stopIDHandlers()
+		}
+		if stoppedHandlers == 0 {
+			break
+		}
+	}
+	for _, ft := range r.functionTypes() {
+		ft.idHandlersRunning.Wait()
+	}
+	// --------------------------------------------------------------
+
+	// Release held typename mutices and partitions -----------------
+	for _, ft := range r.functionTypes() {
+		ft.releaseTypename()
+		ft.releasePartitions()
+	}
+	// --------------------------------------------------------------
+
+	if r.cacheStore != nil {
+		r.logger.Info("Flushing the cache store...")
+		r.cacheStore.Destroy()
+	}
+
+	system.MsgOnErrorReturn(r.nc.Flush())
+	r.nc.Close()
+	r.stopEmbeddedNats()
+
+	r.metrics.stop()
+
+	if closer, ok := r.config.traceExporter.(io.Closer); ok {
+		system.MsgOnErrorReturn(closer.Close())
+	}
+
+	r.logger.Info("Runtime is shut down!")
 }
 
 func (r *Runtime) runGarbageCellector() (err error) {
+	lastContextTTLCheck := time.Now()
 	for {
+		r.gcMutex.Lock()
+		if r.ctx.Err() != nil {
+			r.gcMutex.Unlock()
+			return
+		}
+
 		// Start function subscriptions ---------------------------------
 		var totalIdsGrbageCollected int
 		var totalIDHandlersRunning int
-		for _, ft := range r.registeredFunctionTypes {
+		for _, ft := range r.functionTypes() {
 			n1, n2 := ft.gc(r.config.functionTypeIDLifetimeMs)
 			totalIdsGrbageCollected += n1
 			totalIDHandlersRunning += n2
 		}
+		if time.Since(lastContextTTLCheck) >= time.Duration(r.config.contextTTLCheckIntervalSec)*time.Second {
+			for _, ft := range r.functionTypes() {
+				if deleted := ft.deleteExpiredContexts(); deleted > 0 {
+					ft.logger.Debug("Deleted expired function contexts", "count", deleted)
+				}
+			}
+			lastContextTTLCheck = time.Now()
+		}
 		if totalIdsGrbageCollected > 0 && totalIDHandlersRunning == 0 {
 			// Result time output -----------------------------------------------------------------
 			if totalIDHandlersRunning == 0 {
@@ -137,55 +357,113 @@ func (r *Runtime) runGarbageCellector() (err error) {
 				dt := glce - gt0
 
 				if gc > 0 && dt > 0 {
-					fmt.Printf("!!!!!!!!!!!!!!!!! %d runs, total time (ns/ms): %d/%d, function dt (ns/ms): %d/%d -> %dHz\n", gc, dt, dt/1000000, dt/gc, dt/gc/1000000, gc*1000000000/dt)
+					r.logger.Info("Throughput", "runs", gc, "total_time_ms", dt/1000000, "function_dt_ns", dt/gc, "hz", gc*1000000000/dt)
 					atomic.StoreInt64(&r.gc, 0)
 				}
 				// ------------------------------------------------------------------------------------
 			}
 			// --------------------------------------------------------------
 		}
-		time.Sleep(1 * time.Second)
+		r.gcMutex.Unlock()
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
 func (r *Runtime) IngressNATS(typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) {
-	r.callFunction("ingress", "nats", typename, id, payload, options)
+	r.callFunction("ingress", "nats", typename, id, payload, options, "")
+}
+
+// IngressNATSSync calls a function through NATS and waits for the reply the function sends back to its caller.
+// Unlike IngressGolangSync the target function does not have to be registered in this runtime.
+func (r *Runtime) IngressNATSSync(typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	return r.callFunctionNATSSync("ingress", "nats", typename, id, payload, options, "")
 }
 
 func (r *Runtime) IngressGolangSync(typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
-	return r.callFunctionGolangSync("ingress", "go", typename, id, payload, options)
+	return r.callFunctionGolangSync("ingress", "go", typename, id, payload, options, "")
 }
 
-func (r *Runtime) callFunction(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) {
-	data := easyjson.NewJSONObject()
-	data.SetByPath("caller_typename", easyjson.NewJSON(callerTypename))
-	data.SetByPath("caller_id", easyjson.NewJSON(callerID))
-	if payload != nil {
-		data.SetByPath("payload", *payload)
-	}
-	if options != nil {
-		data.SetByPath("options", *options)
-	}
+func (r *Runtime) callFunction(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, traceParent string) {
+	data := buildFunctionCallData(callerTypename, callerID, payload, options, traceParent)
 	go func() {
 		system.MsgOnErrorReturn(r.nc.Publish(targetTypename+"."+targetID, data.ToBytes()))
 	}()
 }
 
-// TODO: return error also
-func (r *Runtime) callFunctionGolangSync(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+func (r *Runtime) callFunctionNATSSync(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, traceParent string) (*easyjson.JSON, error) {
+	replySubject := nats.NewInbox()
+	sub, err := r.nc.SubscribeSync(replySubject)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(sub.Unsubscribe()) }()
+
+	data := buildFunctionCallData(callerTypename, callerID, payload, options, traceParent)
+	data.SetByPath("reply_subject", easyjson.NewJSON(replySubject))
+	if err := r.nc.Publish(targetTypename+"."+targetID, data.ToBytes()); err != nil {
+		return nil, err
+	}
+
+	msg, err := sub.NextMsg(time.Duration(r.config.ingressCallNATSSyncTimeoutSec) * time.Second)
+	if err != nil {
+		if err == nats.ErrTimeout {
+			return nil, fmt.Errorf("timeout occured while executing callFunctionNATSSync for function with the typename %s", targetTypename)
+		}
+		return nil, err
+	}
+	if errStr := msg.Header.Get(replyErrorHeader); len(errStr) > 0 {
+		return nil, errors.New(errStr)
+	}
+	if j, ok := easyjson.JSONFromBytes(msg.Data); ok {
+		return &j, nil
+	}
+	return nil, fmt.Errorf("callFunctionNATSSync received reply which is not a JSON from function with the typename %s", targetTypename)
+}
+
+func (r *Runtime) callFunctionGolangSync(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, traceParent string) (*easyjson.JSON, error) {
 	resultJSONChannel := make(chan *easyjson.JSON, 1)
+	errorChannel := make(chan error, 1)
 
-	msg := &GoMsg{ResultJSONChannel: resultJSONChannel, Caller: &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID}, Payload: payload}
-	if targetFT, ok := r.registeredFunctionTypes[targetTypename]; ok {
+	msg := &GoMsg{ResultJSONChannel: resultJSONChannel, ErrorChannel: errorChannel, Caller: &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID}, Payload: payload, Options: options, TraceParent: traceParent}
+	if targetFT, ok := r.functionType(targetTypename); ok {
+		if targetFT.partitioned() {
+			if _, owned := targetFT.partitionFence(targetID); !owned {
+				// Only the owner of the partition handles the id, the call reaches it through the stream
+				return r.callFunctionNATSSync(callerTypename, callerID, targetTypename, targetID, payload, options, traceParent)
+			}
+		}
 		targetFT.sendMsgToIDHandler(targetID, msg, nil)
 	} else {
-		return nil, fmt.Errorf("callFunctionGolangSync cannot call function with the typename %s, not registered", callerTypename)
+		return nil, fmt.Errorf("callFunctionGolangSync cannot call function with the typename %s, not registered", targetTypename)
 	}
 
 	select {
 	case resultJSON := <-resultJSONChannel:
 		return resultJSON, nil
+	case err := <-errorChannel:
+		return nil, err
 	case <-time.After(time.Duration(r.config.ingressCallGoLangSyncTimeoutSec) * time.Second):
-		return nil, fmt.Errorf("timeout occured while executing callFunctionGolangSync for function with the typename %s", callerTypename)
+		return nil, fmt.Errorf("timeout occured while executing callFunctionGolangSync for function with the typename %s", targetTypename)
+	}
+}
+
+func buildFunctionCallData(callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON, traceParent string) easyjson.JSON {
+	data := easyjson.NewJSONObject()
+	data.SetByPath("caller_typename", easyjson.NewJSON(callerTypename))
+	data.SetByPath("caller_id", easyjson.NewJSON(callerID))
+	if payload != nil {
+		data.SetByPath("payload", *payload)
+	}
+	if options != nil {
+		data.SetByPath("options", *options)
+	}
+	if len(traceParent) > 0 {
+		data.SetByPath("trace_parent", easyjson.NewJSON(traceParent))
 	}
+	return data
 }
@@ -3,7 +3,12 @@
 package statefun
 
 import (
+	"crypto/tls"
 	"fmt"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/trace"
+	"github.com/nats-io/nats.go"
 )
 
 const (
@@ -11,20 +16,58 @@ const (
 	RuntimeName                  = "foliage_runtime"
 	KeyValueStoreBucketName      = RuntimeName + "_kv_store"
 	FunctionTypesStreamName      = RuntimeName + "_stream"
+	DeadLetterStreamName         = RuntimeName + "_dead_letter_stream"
+	DeadLetterSubjectPrefix      = "dead_letter"
 	KVMutexLifetimeSec           = 120
 	KVMutexIsOldPollingInterval  = 10
+	KVMutexStuckThresholdSec     = 600
+	BalancerHeartbeatIntervalSec = 3
 	FunctionTypeIDLifetimeMs     = 5000
 	IngressCallGolangSyncTimeout = 60
+	IngressCallNATSSyncTimeout   = 60
+	ContextTTLCheckIntervalSec   = 10
 )
 
 type RuntimeConfig struct {
 	natsURL                         string
 	keyValueStoreBucketName         string
 	functionTypesStreamName         string
+	deadLetterStreamName            string
+	deadLetterSubjectPrefix         string
 	kvMutexLifeTimeSec              int
 	kvMutexIsOldPollingIntervalSec  int
+	kvMutexStuckThresholdSec        int
+	balancerHeartbeatIntervalSec    int
 	functionTypeIDLifetimeMs        int
 	ingressCallGoLangSyncTimeoutSec int
+	ingressCallNATSSyncTimeoutSec   int
+	contextTTLCheckIntervalSec      int
+	logger                          logger.Logger
+	metricsAddress                  string
+	traceServiceName                string
+	traceExporter                   trace.Exporter
+	functionTypeOverrides           map[string]functionTypeConfigFile
+
+	natsServers         []string
+	natsCredentialsFile string
+	natsUserJWT         string
+	natsUserSeed        string
+	natsNKeySeedFile    string
+	natsTLSCertFile     string
+	natsTLSKeyFile      string
+	natsTLSRootCAFiles  []string
+	natsTLSConfig       *tls.Config
+	natsReconnectWaitMs int
+	natsMaxReconnects   int
+	natsPingIntervalSec int
+	natsOptions         []nats.Option
+	onNATSDisconnected  func(err error)
+	onNATSReconnected   func(url string)
+	onNATSClosed        func()
+
+	embeddedNats         bool
+	embeddedNatsStoreDir string
+	embeddedNatsPort     int
 }
 
 func NewRuntimeConfig() *RuntimeConfig {
@@ -32,16 +75,23 @@ func NewRuntimeConfig() *RuntimeConfig {
 		natsURL:                         NatsURL,
 		keyValueStoreBucketName:         KeyValueStoreBucketName,
 		functionTypesStreamName:         FunctionTypesStreamName,
+		deadLetterStreamName:            DeadLetterStreamName,
+		deadLetterSubjectPrefix:         DeadLetterSubjectPrefix,
 		kvMutexLifeTimeSec:              KVMutexLifetimeSec,
 		kvMutexIsOldPollingIntervalSec:  KVMutexIsOldPollingInterval,
+		kvMutexStuckThresholdSec:        KVMutexStuckThresholdSec,
+		balancerHeartbeatIntervalSec:    BalancerHeartbeatIntervalSec,
 		functionTypeIDLifetimeMs:        FunctionTypeIDLifetimeMs,
 		ingressCallGoLangSyncTimeoutSec: IngressCallGolangSyncTimeout,
+		ingressCallNATSSyncTimeoutSec:   IngressCallNATSSyncTimeout,
+		contextTTLCheckIntervalSec:      ContextTTLCheckIntervalSec,
+		traceServiceName:                RuntimeName,
 	}
 }
 
 func NewRuntimeConfigSimple(natsURL string, runtimeName string) *RuntimeConfig {
 	ro := NewRuntimeConfig()
-	return ro.SetNatsURL(natsURL).SeKeyValueStoreBucketName(fmt.Sprintf("%s_kv_store", runtimeName)).SetFunctionTypesStreamName(fmt.Sprintf("%s_stream", runtimeName))
+	return ro.SetNatsURL(natsURL).SetKeyValueStoreBucketName(fmt.Sprintf("%s_kv_store", runtimeName)).SetFunctionTypesStreamName(fmt.Sprintf("%s_stream", runtimeName)).SetDeadLetterStreamName(fmt.Sprintf("%s_dead_letter_stream", runtimeName)).SetDeadLetterSubjectPrefix(fmt.Sprintf("%s_dead_letter", runtimeName)).SetTraceServiceName(runtimeName)
 }
 
 func (ro *RuntimeConfig) SetNatsURL(natsURL string) *RuntimeConfig {
@@ -49,16 +99,31 @@ func (ro *RuntimeConfig) SetNatsURL(natsURL string) *RuntimeConfig {
 	return ro
 }
 
-func (ro *RuntimeConfig) SeKeyValueStoreBucketName(keyValueStoreBucketName string) *RuntimeConfig {
+func (ro *RuntimeConfig) SetKeyValueStoreBucketName(keyValueStoreBucketName string) *RuntimeConfig {
 	ro.keyValueStoreBucketName = keyValueStoreBucketName
 	return ro
 }
 
+// Deprecated: use SetKeyValueStoreBucketName
+func (ro *RuntimeConfig) SeKeyValueStoreBucketName(keyValueStoreBucketName string) *RuntimeConfig {
+	return ro.SetKeyValueStoreBucketName(keyValueStoreBucketName)
+}
+
 func (ro *RuntimeConfig) SetFunctionTypesStreamName(functionTypesStreamName string) *RuntimeConfig {
 	ro.functionTypesStreamName = functionTypesStreamName
 	return ro
 }
 
+func (ro *RuntimeConfig) SetDeadLetterStreamName(deadLetterStreamName string) *RuntimeConfig {
+	ro.deadLetterStreamName = deadLetterStreamName
+	return ro
+}
+
+func (ro *RuntimeConfig) SetDeadLetterSubjectPrefix(deadLetterSubjectPrefix string) *RuntimeConfig {
+	ro.deadLetterSubjectPrefix = deadLetterSubjectPrefix
+	return ro
+}
+
 func (ro *RuntimeConfig) SetKVMutexIsOldPollingIntervalSec(kvMutexIsOldPollingIntervalSec int) *RuntimeConfig {
 	ro.kvMutexIsOldPollingIntervalSec = kvMutexIsOldPollingIntervalSec
 	return ro
@@ -69,6 +134,21 @@ func (ro *RuntimeConfig) SetKVMutexLifeTimeSec(kvMutexLifeTimeSec int) *RuntimeC
 	return ro
 }
 
+// SetKVMutexStuckThresholdSec sets the time a KV mutex held by the runtime is reported as stuck after, 0 disables reporting.
+// Typename and partition mutices of balanced function types are held as long as the runtime serves them and are never reported.
+func (ro *RuntimeConfig) SetKVMutexStuckThresholdSec(kvMutexStuckThresholdSec int) *RuntimeConfig {
+	ro.kvMutexStuckThresholdSec = kvMutexStuckThresholdSec
+	return ro
+}
+
+// SetBalancerHeartbeatIntervalSec sets how often the runtime announces itself to runtimes balancing function types by
+// partitions with it, a runtime is considered gone after 3 missed heartbeats and its partitions are handed off.
+// Not positive values keep the default interval.
+func (ro *RuntimeConfig) SetBalancerHeartbeatIntervalSec(balancerHeartbeatIntervalSec int) *RuntimeConfig {
+	ro.balancerHeartbeatIntervalSec = balancerHeartbeatIntervalSec
+	return ro
+}
+
 func (ro *RuntimeConfig) SetFunctionTypeIDLifetimeMs(functionTypeIDLifetimeMs int) *RuntimeConfig {
 	ro.functionTypeIDLifetimeMs = functionTypeIDLifetimeMs
 	return ro
@@ -78,3 +158,137 @@ func (ro *RuntimeConfig) SetIngressCallGoLangSyncTimeoutSec(ingressCallGoLangSyn
 	ro.ingressCallGoLangSyncTimeoutSec = ingressCallGoLangSyncTimeoutSec
 	return ro
 }
+
+// SetContextTTLCheckIntervalSec sets how often function contexts of function types with the ContextTTL policy are checked for expiration
+func (ro *RuntimeConfig) SetContextTTLCheckIntervalSec(contextTTLCheckIntervalSec int) *RuntimeConfig {
+	ro.contextTTLCheckIntervalSec = contextTTLCheckIntervalSec
+	return ro
+}
+
+func (ro *RuntimeConfig) SetIngressCallNATSSyncTimeoutSec(ingressCallNATSSyncTimeoutSec int) *RuntimeConfig {
+	ro.ingressCallNATSSyncTimeoutSec = ingressCallNATSSyncTimeoutSec
+	return ro
+}
+
+// SetLogger sets the logger used by the runtime and all its subsystems, the one writing into slog.Default() is used if not set
+func (ro *RuntimeConfig) SetLogger(l logger.Logger) *RuntimeConfig {
+	ro.logger = l
+	return ro
+}
+
+// SetMetricsAddress sets the address (e.g. ":9090") of the HTTP endpoint serving runtime metrics at "/metrics", metrics are not served if empty
+func (ro *RuntimeConfig) SetMetricsAddress(metricsAddress string) *RuntimeConfig {
+	ro.metricsAddress = metricsAddress
+	return ro
+}
+
+// SetTraceExporter enables tracing of function calls, spans are exported via the given exporter (e.g. trace.NewStdoutExporter())
+func (ro *RuntimeConfig) SetTraceExporter(traceExporter trace.Exporter) *RuntimeConfig {
+	ro.traceExporter = traceExporter
+	return ro
+}
+
+func (ro *RuntimeConfig) SetTraceServiceName(traceServiceName string) *RuntimeConfig {
+	ro.traceServiceName = traceServiceName
+	return ro
+}
+
+// SetNatsServers sets additional NATS server URLs of a cluster, the runtime connects to any of them and to the one set by SetNatsURL
+func (ro *RuntimeConfig) SetNatsServers(natsServers ...string) *RuntimeConfig {
+	ro.natsServers = natsServers
+	return ro
+}
+
+// SetNatsCredentialsFile sets a user credentials file with a JWT and an nkey seed
+func (ro *RuntimeConfig) SetNatsCredentialsFile(natsCredentialsFile string) *RuntimeConfig {
+	ro.natsCredentialsFile = natsCredentialsFile
+	return ro
+}
+
+// SetNatsUserJWTAndSeed sets a user JWT and an nkey seed
+func (ro *RuntimeConfig) SetNatsUserJWTAndSeed(natsUserJWT string, natsUserSeed string) *RuntimeConfig {
+	ro.natsUserJWT = natsUserJWT
+	ro.natsUserSeed = natsUserSeed
+	return ro
+}
+
+// SetNatsNKeySeedFile sets a file with an nkey seed for the nkey authentication
+func (ro *RuntimeConfig) SetNatsNKeySeedFile(natsNKeySeedFile string) *RuntimeConfig {
+	ro.natsNKeySeedFile = natsNKeySeedFile
+	return ro
+}
+
+// SetNatsTLSClientCert sets a client certificate and its key for the mutual TLS
+func (ro *RuntimeConfig) SetNatsTLSClientCert(certFile string, keyFile string) *RuntimeConfig {
+	ro.natsTLSCertFile = certFile
+	ro.natsTLSKeyFile = keyFile
+	return ro
+}
+
+// SetNatsTLSRootCAs sets files with root CAs to verify NATS servers' certificates
+func (ro *RuntimeConfig) SetNatsTLSRootCAs(caFiles ...string) *RuntimeConfig {
+	ro.natsTLSRootCAFiles = caFiles
+	return ro
+}
+
+// SetNatsTLSConfig sets the TLS config of the NATS connection, it replaces the one built from SetNatsTLSClientCert and SetNatsTLSRootCAs
+func (ro *RuntimeConfig) SetNatsTLSConfig(natsTLSConfig *tls.Config) *RuntimeConfig {
+	ro.natsTLSConfig = natsTLSConfig
+	return ro
+}
+
+// SetNatsReconnectWaitMs sets how long to wait between attempts to reconnect to the same NATS server
+func (ro *RuntimeConfig) SetNatsReconnectWaitMs(natsReconnectWaitMs int) *RuntimeConfig {
+	ro.natsReconnectWaitMs = natsReconnectWaitMs
+	return ro
+}
+
+// SetNatsMaxReconnects sets how many reconnect attempts are made before the connection is closed, -1 means unlimited
+func (ro *RuntimeConfig) SetNatsMaxReconnects(natsMaxReconnects int) *RuntimeConfig {
+	ro.natsMaxReconnects = natsMaxReconnects
+	return ro
+}
+
+// SetNatsPingIntervalSec sets how often NATS servers are pinged to detect a stale connection
+func (ro *RuntimeConfig) SetNatsPingIntervalSec(natsPingIntervalSec int) *RuntimeConfig {
+	ro.natsPingIntervalSec = natsPingIntervalSec
+	return ro
+}
+
+// SetNatsOptions sets any other NATS connection options, they are applied after all the others
+func (ro *RuntimeConfig) SetNatsOptions(natsOptions ...nats.Option) *RuntimeConfig {
+	ro.natsOptions = natsOptions
+	return ro
+}
+
+// SetOnNatsDisconnected sets a callback called when the NATS connection is lost, the runtime keeps reconnecting
+func (ro *RuntimeConfig) SetOnNatsDisconnected(onNATSDisconnected func(err error)) *RuntimeConfig {
+	ro.onNATSDisconnected = onNATSDisconnected
+	return ro
+}
+
+// SetOnNatsReconnected sets a callback called when the NATS connection is restored
+func (ro *RuntimeConfig) SetOnNatsReconnected(onNATSReconnected func(url string)) *RuntimeConfig {
+	ro.onNATSReconnected = onNATSReconnected
+	return ro
+}
+
+// SetOnNatsClosed sets a callback called when the NATS connection is closed not by the runtime (e.g. reconnect attempts
+// are exhausted), after that the runtime shuts down and Start returns nats.ErrConnectionClosed
+func (ro *RuntimeConfig) SetOnNatsClosed(onNATSClosed func()) *RuntimeConfig {
+	ro.onNATSClosed = onNATSClosed
+	return ro
+}
+
+/*
+SetEmbeddedNats makes NewRuntime start an in-process NATS server with JetStream and connect to it instead of the NATS URL,
+e.g. for tests or single binary deployments. JetStream data is kept in storeDir, if it is empty a temporary directory
+removed on the runtime shutdown is used. port may be EmbeddedNatsNoListen to accept in-process connections only or
+EmbeddedNatsRandomPort to listen on a random free port (see Runtime.NatsURL).
+*/
+func (ro *RuntimeConfig) SetEmbeddedNats(storeDir string, port int) *RuntimeConfig {
+	ro.embeddedNats = true
+	ro.embeddedNatsStoreDir = storeDir
+	ro.embeddedNatsPort = port
+	return ro
+}
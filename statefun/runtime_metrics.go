@@ -0,0 +1,123 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/metrics"
+)
+
+const (
+	NakReasonChannelFull    = "channel_full"
+	NakReasonTypenameLocked = "typename_locked"
+	NakReasonContextLocked  = "context_locked"
+	NakReasonHandlerFailed  = "handler_failed"
+	// The partition of the message's id is being handed off between runtimes
+	NakReasonPartitionHandoff = "partition_handoff"
+)
+
+type runtimeMetrics struct {
+	registry             *metrics.Registry
+	calls                *metrics.CounterVec
+	handlerDuration      *metrics.HistogramVec
+	naks                 *metrics.CounterVec
+	invalidCalls         *metrics.CounterVec
+	idHandlers           *metrics.GaugeVec
+	forwardedMsgs        *metrics.CounterVec
+	partitionsOwned      *metrics.GaugeVec
+	natsConnectionEvents *metrics.CounterVec
+	server               *http.Server
+}
+
+func newRuntimeMetrics() *runtimeMetrics {
+	registry := metrics.NewRegistry()
+	return &runtimeMetrics{
+		registry:             registry,
+		calls:                registry.NewCounterVec("statefun_function_calls", "Function handler invocations", "typename"),
+		handlerDuration:      registry.NewHistogramVec("statefun_function_handler_duration_seconds", "Function handler execution time", metrics.DefaultDurationBuckets, "typename"),
+		naks:                 registry.NewCounterVec("statefun_function_naks", "Messages NAK'd by a function type", "typename", "reason"),
+		invalidCalls:         registry.NewCounterVec("statefun_function_invalid_calls", "Calls rejected by the payload or options schema of a function type", "typename"),
+		idHandlers:           registry.NewGaugeVec("statefun_function_id_handlers", "Live id handlers of a function type", "typename"),
+		forwardedMsgs:        registry.NewCounterVec("statefun_function_forwarded_msgs", "Messages forwarded to the runtime owning the partition of their id", "typename"),
+		partitionsOwned:      registry.NewGaugeVec("statefun_function_partitions_owned", "Partitions of a function type owned by the runtime", "typename"),
+		natsConnectionEvents: registry.NewCounterVec("statefun_nats_connection_events", "NATS connection state changes", "event"),
+	}
+}
+
+func (rm *runtimeMetrics) registerCacheStore(cs *cache.Store) {
+	rm.registry.NewCounterFunc("statefun_cache_hits", "Cache store values found in memory", func() float64 { return float64(cs.Stats().Hits) })
+	rm.registry.NewCounterFunc("statefun_cache_misses", "Cache store values requested from the KV", func() float64 { return float64(cs.Stats().Misses) })
+	rm.registry.NewCounterFunc("statefun_cache_lru_purges", "Cache store values purged from memory by the LRU policy", func() float64 { return float64(cs.Stats().LRUPurges) })
+	rm.registry.NewGaugeFunc("statefun_cache_kv_write_lag_seconds", "Age of the oldest value not yet written into the KV by the lazy writer", func() float64 {
+		return float64(cs.Stats().KVWriteLagNs) / float64(time.Second)
+	})
+}
+
+func (rm *runtimeMetrics) registerKeyMutices(r *Runtime) {
+	rm.registry.NewGaugeFunc("statefun_kv_mutices_stuck", "KV mutices held by the runtime longer than kv_mutex_stuck_threshold_sec", func() float64 {
+		return float64(r.stuckKeyMutices())
+	})
+}
+
+// serve starts the HTTP endpoint serving metrics at "/metrics"
+func (rm *runtimeMetrics) serve(address string, log logger.Logger) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", rm.registry.Handler())
+	rm.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := rm.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Metrics server stopped", logger.ErrorKey, err)
+		}
+	}()
+	log.Info("Serving metrics", "address", listener.Addr().String())
+	return nil
+}
+
+func (rm *runtimeMetrics) stop() {
+	if rm.server != nil {
+		rm.server.Close()
+	}
+}
+
+// Metrics returns the registry of the runtime metrics, e.g. to serve them by an application's own HTTP server
+func (r *Runtime) Metrics() *metrics.Registry {
+	return r.metrics.registry
+}
+
+type functionTypeMetrics struct {
+	typename        string
+	calls           *metrics.Counter
+	handlerDuration *metrics.Histogram
+	idHandlers      *metrics.Gauge
+	forwardedMsgs   *metrics.Counter
+	partitionsOwned *metrics.Gauge
+	naks            *metrics.CounterVec
+	invalidCalls    *metrics.Counter
+}
+
+func (rm *runtimeMetrics) forFunctionType(typename string) *functionTypeMetrics {
+	return &functionTypeMetrics{
+		typename:        typename,
+		calls:           rm.calls.WithLabelValues(typename),
+		handlerDuration: rm.handlerDuration.WithLabelValues(typename),
+		idHandlers:      rm.idHandlers.WithLabelValues(typename),
+		forwardedMsgs:   rm.forwardedMsgs.WithLabelValues(typename),
+		partitionsOwned: rm.partitionsOwned.WithLabelValues(typename),
+		naks:            rm.naks,
+		invalidCalls:    rm.invalidCalls.WithLabelValues(typename),
+	}
+}
+
+func (ftm *functionTypeMetrics) nak(reason string) {
+	ftm.naks.WithLabelValues(ftm.typename, reason).Inc()
+}
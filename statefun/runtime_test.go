@@ -0,0 +1,173 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
+)
+
+const testRuntimeShutdownTimeoutSec = 30
+
+// newTestServer starts an in-process NATS server with JetStream which is shut down on the test cleanup
+func newTestServer(t *testing.T) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{JetStream: true, StoreDir: t.TempDir(), NoSigs: true, DontListen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(func() {
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+	if !s.ReadyForConnections(EmbeddedNatsStartTimeoutSec * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	return s
+}
+
+// newTestRuntimeConfig returns the config of a runtime connected to the in-process server
+func newTestRuntimeConfig(s *server.Server) *RuntimeConfig {
+	return NewRuntimeConfigSimple(nats.DefaultURL, "test").SetNatsOptions(nats.InProcessServer(s)).SetLogger(logger.NewNopLogger())
+}
+
+// startTestRuntime starts a runtime, setup registers function types before the start. The runtime is shut down on the test cleanup.
+func startTestRuntime(t *testing.T, config *RuntimeConfig, setup func(runtime *Runtime)) *Runtime {
+	t.Helper()
+	r, err := NewRuntime(*config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(r)
+	}
+
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Start(cache.NewCacheConfig(), func(*Runtime) { close(started) })
+	}()
+	select {
+	case <-started:
+	case err := <-done:
+		t.Fatalf("runtime stopped while starting: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testRuntimeShutdownTimeoutSec*time.Second)
+		defer cancel()
+		if err := r.Shutdown(ctx); err != nil {
+			t.Errorf("runtime shutdown: %s", err)
+		}
+		<-done
+	})
+	return r
+}
+
+func TestStartError(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a runtime")
+	}
+
+	tests := []struct {
+		name      string
+		prepare   func(t *testing.T, js nats.JetStreamContext) // Called before the runtime is created
+		config    func(t *testing.T, config *RuntimeConfig)
+		setup     func(r *Runtime) // Registers function types
+		wantError string
+	}{
+		{
+			name: "dead letter stream",
+			prepare: func(t *testing.T, js nats.JetStreamContext) {
+				if _, err := js.AddStream(&nats.StreamConfig{Name: "other", Subjects: []string{"test_dead_letter.>"}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantError: "subjects overlap",
+		},
+		{
+			name: "metrics address",
+			config: func(t *testing.T, config *RuntimeConfig) {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { listener.Close() })
+				config.SetMetricsAddress(listener.Addr().String())
+			},
+			wantError: "address already in use",
+		},
+		{
+			name: "consumer",
+			prepare: func(t *testing.T, js nats.JetStreamContext) {
+				if _, err := js.AddStream(&nats.StreamConfig{Name: "test_stream", Subjects: []string{"start.consumer.*"}}); err != nil {
+					t.Fatal(err)
+				}
+				// Deliver policy of an existing consumer cannot be updated
+				_, err := js.AddConsumer("test_stream", &nats.ConsumerConfig{Durable: "startconsumer", DeliverSubject: "startconsumer", DeliverPolicy: nats.DeliverNewPolicy, AckPolicy: nats.AckExplicitPolicy, AckWait: time.Second})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			setup: func(r *Runtime) {
+				NewFunctionType(r, "start.consumer", echoHandler, *NewFunctionTypeConfig())
+			},
+			wantError: "function type start.consumer: nats: deliver policy can not be updated",
+		},
+		{
+			name: "payload schema",
+			setup: func(r *Runtime) {
+				schema := easyjson.NewJSONObjectWithKeyValue("$ref", easyjson.NewJSON("#"))
+				NewFunctionType(r, "start.schema", echoHandler, *NewFunctionTypeConfig().SetPayloadSchema(&schema))
+			},
+			wantError: "function type start.schema: payload schema: schema/$ref: $ref is not supported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			nc, err := nats.Connect("", nats.InProcessServer(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			js, err := nc.JetStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, js)
+			}
+			config := newTestRuntimeConfig(s)
+			if tt.config != nil {
+				tt.config(t, config)
+			}
+
+			r, err := NewRuntime(*config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			err = r.Start(cache.NewCacheConfig(), func(*Runtime) { t.Error("runtime is started") })
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got error %v, want %s", err, tt.wantError)
+			}
+			if !r.nc.IsClosed() {
+				t.Error("runtime is not shut down")
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/cron"
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	delayedCallsKVPrefix   = "schedule.delayed"
+	recurringCallsKVPrefix = "schedule.recurring"
+	schedulerTickInterval  = 100 * time.Millisecond
+	recurringCheckInterval = 1 * time.Second
+)
+
+type delayedCall struct {
+	revision uint64
+	fireAt   int64
+	subject  string
+	data     easyjson.JSON
+}
+
+type recurringCall struct {
+	typename string
+	key      string
+	subject  string
+	schedule cron.Schedule
+	data     easyjson.JSON
+}
+
+/*
+scheduler fires delayed and recurring function calls. Calls are persisted in the NATS KV, so they survive restarts
+of runtimes. Every runtime sharing the same stream and KV bucket tries to fire due calls; a call is published into
+the stream with the JetStream message id unique for the call, so duplicates from several runtimes are dropped by the stream.
+*/
+type scheduler struct {
+	runtime *Runtime
+	logger  logger.Logger
+
+	delayedMutex sync.Mutex
+	delayed      map[string]delayedCall // key in KV -> call
+
+	recurringMutex sync.Mutex
+	recurring      []recurringCall
+
+	stopped chan struct{}
+}
+
+func newScheduler(runtime *Runtime) *scheduler {
+	return &scheduler{
+		runtime: runtime,
+		logger:  runtime.logger.With("subsystem", "scheduler"),
+		delayed: map[string]delayedCall{},
+		stopped: make(chan struct{}),
+	}
+}
+
+// start loads recurring schedules of all registered function types and runs the scheduler until the runtime is stopped
+func (s *scheduler) start() error {
+	for _, ft := range s.runtime.functionTypes() {
+		if err := s.addRecurring(ft); err != nil {
+			close(s.stopped)
+			return err
+		}
+	}
+
+	w, err := s.watchDelayed()
+	if err != nil {
+		close(s.stopped)
+		return err
+	}
+	go s.run(w)
+	return nil
+}
+
+// watchDelayed watches delayed calls in the KV, known ones are dropped since the watcher delivers all current calls first
+func (s *scheduler) watchDelayed() (nats.KeyWatcher, error) {
+	w, err := s.runtime.kv.Watch(delayedCallsKVPrefix + ".>")
+	if err != nil {
+		return nil, err
+	}
+	s.delayedMutex.Lock()
+	s.delayed = map[string]delayedCall{}
+	s.delayedMutex.Unlock()
+	return w, nil
+}
+
+// addRecurring adds recurring schedules of the function type, none is added if any of them is invalid
+func (s *scheduler) addRecurring(ft *FunctionType) error {
+	calls := []recurringCall{}
+	for _, fts := range ft.config.schedules {
+		schedule, err := cron.Parse(fts.spec)
+		if err != nil {
+			return fmt.Errorf("function type %s schedule %s: %w", ft.name, fts.name, err)
+		}
+		calls = append(calls, recurringCall{
+			typename: ft.name,
+			key:      recurringCallsKVPrefix + "." + ft.name + "." + fts.name,
+			subject:  ft.name + "." + fts.id,
+			schedule: schedule,
+			data:     buildFunctionCallData("schedule", fts.name, fts.payload, nil, ""),
+		})
+	}
+
+	s.recurringMutex.Lock()
+	defer s.recurringMutex.Unlock()
+	s.recurring = append(s.recurring, calls...)
+	return nil
+}
+
+// removeRecurring stops firing recurring schedules of the function type, their state in the KV is kept
+func (s *scheduler) removeRecurring(typename string) {
+	s.recurringMutex.Lock()
+	defer s.recurringMutex.Unlock()
+	recurring := []recurringCall{}
+	for _, call := range s.recurring {
+		if call.typename != typename {
+			recurring = append(recurring, call)
+		}
+	}
+	s.recurring = recurring
+}
+
+func (s *scheduler) run(w nats.KeyWatcher) {
+	defer close(s.stopped)
+	defer func() { _ = w.Stop() }()
+
+	ticker := time.NewTicker(schedulerTickInterval)
+	defer ticker.Stop()
+	lastRecurringCheck := time.Time{}
+	updates := w.Updates()
+
+	for {
+		select {
+		case <-s.runtime.ctx.Done():
+			return
+		case entry, ok := <-updates:
+			if !ok { // Closed by the KV, e.g. on a lost connection
+				s.logger.Warn("Delayed calls watcher is closed, watching again")
+				updates = nil
+				continue
+			}
+			if entry != nil {
+				s.onDelayedCallUpdate(entry)
+			}
+		case now := <-ticker.C:
+			s.fireDelayed(now)
+			if now.Sub(lastRecurringCheck) >= recurringCheckInterval {
+				s.fireRecurring(now)
+				lastRecurringCheck = now
+				if updates == nil {
+					if newW, err := s.watchDelayed(); err == nil {
+						_ = w.Stop()
+						w, updates = newW, newW.Updates()
+					} else {
+						s.logger.Warn("Cannot watch delayed calls", logger.ErrorKey, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (s *scheduler) onDelayedCallUpdate(entry nats.KeyValueEntry) {
+	s.delayedMutex.Lock()
+	defer s.delayedMutex.Unlock()
+
+	if entry.Operation() != nats.KeyValuePut {
+		delete(s.delayed, entry.Key())
+		return
+	}
+	j, ok := easyjson.JSONFromBytes(entry.Value())
+	if !ok {
+		s.logger.Error("Delayed call is not a JSON", "key", entry.Key())
+		return
+	}
+	fireAt, _ := j.GetByPath("fire_at").AsNumeric()
+	subject, _ := j.GetByPath("subject").AsString()
+	s.delayed[entry.Key()] = delayedCall{
+		revision: entry.Revision(),
+		fireAt:   int64(fireAt),
+		subject:  subject,
+		data:     j.GetByPath("data"),
+	}
+}
+
+func (s *scheduler) fireDelayed(now time.Time) {
+	due := map[string]delayedCall{}
+	s.delayedMutex.Lock()
+	for key, call := range s.delayed {
+		if call.fireAt <= now.UnixNano() {
+			due[key] = call
+			delete(s.delayed, key)
+		}
+	}
+	s.delayedMutex.Unlock()
+
+	for key, call := range due {
+		if _, err := s.runtime.js.Publish(call.subject, call.data.ToBytes(), nats.MsgId(key)); err != nil {
+			s.logger.Error("Cannot fire delayed call", "key", key, logger.ErrorKey, err)
+			s.retryDelayed(key, call)
+			continue
+		}
+		// Fails with the wrong last sequence if the call was already removed by another runtime
+		if err := s.runtime.kv.Purge(key, nats.LastRevision(call.revision)); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+			s.logger.Error("Cannot remove fired delayed call", "key", key, logger.ErrorKey, err)
+			s.retryDelayed(key, call) // Published again, the stream drops the duplicate by the message id
+		}
+	}
+}
+
+// retryDelayed fires the call again on next tick
+func (s *scheduler) retryDelayed(key string, call delayedCall) {
+	s.delayedMutex.Lock()
+	s.delayed[key] = call
+	s.delayedMutex.Unlock()
+}
+
+func (s *scheduler) fireRecurring(now time.Time) {
+	s.recurringMutex.Lock()
+	recurring := s.recurring
+	s.recurringMutex.Unlock()
+
+	for _, call := range recurring {
+		entry, err := s.runtime.kv.Get(call.key)
+		if err == nats.ErrKeyNotFound {
+			// First start of the schedule, occurrences are counted from now
+			_, err = s.runtime.kv.Create(call.key, system.Int64ToBytes(now.UnixNano()))
+			if err != nil && err != nats.ErrKeyExists {
+				s.logger.Error("Cannot create recurring call", "key", call.key, logger.ErrorKey, err)
+			}
+			continue
+		}
+		if err != nil {
+			s.logger.Error("Cannot get recurring call", "key", call.key, logger.ErrorKey, err)
+			continue
+		}
+
+		// Only the latest missed occurrence is fired, e.g. after all runtimes were down for a while
+		var fireAt time.Time
+		lastFiredAt := time.Unix(0, system.BytesToInt64(entry.Value()))
+		for next := call.schedule.Next(lastFiredAt); !next.IsZero() && !next.After(now); next = call.schedule.Next(next) {
+			fireAt = next
+		}
+		if fireAt.IsZero() {
+			continue
+		}
+
+		msgID := call.key + "." + strconv.FormatInt(fireAt.UnixNano(), 10)
+		if _, err := s.runtime.js.Publish(call.subject, call.data.ToBytes(), nats.MsgId(msgID)); err != nil {
+			s.logger.Error("Cannot fire recurring call", "key", call.key, logger.ErrorKey, err)
+			continue
+		}
+		// Fails if another runtime has already fired this occurrence
+		_, _ = s.runtime.kv.Update(call.key, system.Int64ToBytes(fireAt.UnixNano()), entry.Revision())
+	}
+}
+
+// callFunctionAfter persists a call which will be fired by one of the runtimes after the delay
+func (r *Runtime) callFunctionAfter(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, traceParent string, delay time.Duration) error {
+	call := easyjson.NewJSONObject()
+	call.SetByPath("fire_at", easyjson.NewJSON(time.Now().Add(delay).UnixNano()))
+	call.SetByPath("subject", easyjson.NewJSON(targetTypename+"."+targetID))
+	call.SetByPath("data", buildFunctionCallData(callerTypename, callerID, payload, options, traceParent))
+
+	_, err := r.kv.Create(delayedCallsKVPrefix+"."+system.GetUniqueStrID(), call.ToBytes())
+	return err
+}
+
+// IngressNATSAfter calls a function through NATS after the delay. The call is persisted, so it is fired even if
+// this runtime is restarted, by any runtime sharing the same stream and KV bucket.
+func (r *Runtime) IngressNATSAfter(typename string, id string, payload *easyjson.JSON, options *easyjson.JSON, delay time.Duration) error {
+	return r.callFunctionAfter("ingress", "nats", typename, id, payload, options, "", delay)
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+)
+
+// purgeFailingKV fails purges with err if it is set
+type purgeFailingKV struct {
+	nats.KeyValue
+	err error
+}
+
+func (kv *purgeFailingKV) Purge(key string, opts ...nats.DeleteOpt) error {
+	if kv.err != nil {
+		return kv.err
+	}
+	return kv.KeyValue.Purge(key, opts...)
+}
+
+func TestFireDelayed(t *testing.T) {
+	nc, err := nats.Connect("", nats.InProcessServer(newTestServer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "functions", Subjects: []string{"fn.*"}}); err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &purgeFailingKV{KeyValue: bucket}
+	s := newScheduler(&Runtime{js: js, kv: kv, logger: logger.NewNopLogger()})
+
+	published := func(t *testing.T) uint64 {
+		t.Helper()
+		info, err := js.StreamInfo("functions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.State.Msgs
+	}
+	// schedule stores a due call, other runtimes see its revision as of when they were watching it
+	schedule := func(t *testing.T, key string, updates int) delayedCall {
+		t.Helper()
+		revision, err := bucket.Create(key, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < updates; i++ {
+			if _, err := bucket.Put(key, []byte("{}")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		call := delayedCall{revision: revision, subject: "fn." + key[len(delayedCallsKVPrefix)+1:], data: easyjson.NewJSONObject()}
+		s.delayed[key] = call
+		return call
+	}
+	expectPurged := func(t *testing.T, key string, purged bool) {
+		t.Helper()
+		if _, err := bucket.Get(key); errors.Is(err, nats.ErrKeyNotFound) != purged {
+			t.Errorf("got call purged=%t, want %t (%v)", !purged, purged, err)
+		}
+	}
+
+	t.Run("fired", func(t *testing.T) {
+		key := delayedCallsKVPrefix + ".a"
+		schedule(t, key, 0)
+		before := published(t)
+		s.fireDelayed(time.Now())
+		if got := published(t) - before; got != 1 {
+			t.Errorf("got %d published calls, want 1", got)
+		}
+		expectPurged(t, key, true)
+		if _, ok := s.delayed[key]; ok {
+			t.Error("fired call is kept")
+		}
+	})
+
+	t.Run("removed by another runtime", func(t *testing.T) {
+		key := delayedCallsKVPrefix + ".b"
+		schedule(t, key, 1) // Stale revision
+		s.fireDelayed(time.Now())
+		expectPurged(t, key, false)
+		if _, ok := s.delayed[key]; ok {
+			t.Error("call is retried although the wrong last sequence is the expected failure")
+		}
+	})
+
+	t.Run("purge failure", func(t *testing.T) {
+		key := delayedCallsKVPrefix + ".c"
+		schedule(t, key, 0)
+		before := published(t)
+		kv.err = errors.New("connection lost")
+		s.fireDelayed(time.Now())
+		if _, ok := s.delayed[key]; !ok {
+			t.Fatal("call is not retried")
+		}
+		expectPurged(t, key, false)
+
+		kv.err = nil
+		s.fireDelayed(time.Now())
+		expectPurged(t, key, true)
+		if got := published(t) - before; got != 1 {
+			t.Errorf("got %d published calls, want the retry dropped as a duplicate", got)
+		}
+	})
+
+	t.Run("not due", func(t *testing.T) {
+		key := delayedCallsKVPrefix + ".d"
+		call := schedule(t, key, 0)
+		call.fireAt = time.Now().Add(time.Hour).UnixNano()
+		s.delayed[key] = call
+		s.fireDelayed(time.Now())
+		expectPurged(t, key, false)
+		if _, ok := s.delayed[key]; !ok {
+			t.Error("call is fired before it is due")
+		}
+	})
+}
@@ -0,0 +1,482 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun test package.
+// Provides an in-memory harness to run stateful function handlers deterministically without NATS and the runtime
+package statefuntest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	KVBucketName = "statefuntest_kv_store"
+)
+
+// Call is an asynchronous call made by a handler via Call or CallAfter
+type Call struct {
+	Caller  sfPlugins.StatefunAddress
+	Target  sfPlugins.StatefunAddress
+	Payload *easyjson.JSON
+	Options *easyjson.JSON
+	Delay   time.Duration
+}
+
+// SyncCall is a call made by a handler via GolangCallSync along with the reply it got
+type SyncCall struct {
+	Caller  sfPlugins.StatefunAddress
+	Target  sfPlugins.StatefunAddress
+	Payload *easyjson.JSON
+	Options *easyjson.JSON
+	Reply   *easyjson.JSON
+	Err     error
+}
+
+// Egress is a message published by a handler via Egress
+type Egress struct {
+	Caller  sfPlugins.StatefunAddress
+	Topic   string
+	Payload *easyjson.JSON
+}
+
+// SyncReplyFunc produces a scripted reply for a GolangCallSync call
+type SyncReplyFunc func(call SyncCall) (*easyjson.JSON, error)
+
+/*
+Harness runs stateful function handlers against an in-memory cache store. All calls made by handlers are recorded,
+GolangCallSync calls are answered by scripted replies or by handlers registered in the harness, which are executed in
+the calling goroutine, so a test is deterministic.
+*/
+type Harness struct {
+	KV    *MemoryKeyValue
+	Cache *cache.Store
+
+	cancel context.CancelFunc
+
+	mutex       sync.Mutex
+	handlers    map[string]statefun.FunctionHandler
+	options     map[string]*easyjson.JSON
+	syncReplies map[sfPlugins.StatefunAddress]SyncReplyFunc
+	migrations  map[string][]statefun.ContextMigration
+	fences      map[sfPlugins.StatefunAddress]cache.Fence
+	calls       []Call
+	pending     []Call
+	syncCalls   []SyncCall
+	egresses    []Egress
+	replyErrors []error
+	logger      logger.Logger
+}
+
+func New() *Harness {
+	ctx, cancel := context.WithCancel(context.Background())
+	kv := NewMemoryKeyValue(KVBucketName)
+	return &Harness{
+		KV:          kv,
+		Cache:       cache.NewCacheStore(ctx, cache.NewCacheConfig().SetLogger(logger.NewNopLogger()), kv),
+		cancel:      cancel,
+		handlers:    map[string]statefun.FunctionHandler{},
+		options:     map[string]*easyjson.JSON{},
+		syncReplies: map[sfPlugins.StatefunAddress]SyncReplyFunc{},
+		migrations:  map[string][]statefun.ContextMigration{},
+		fences:      map[sfPlugins.StatefunAddress]cache.Fence{},
+		logger:      logger.NewNopLogger(),
+	}
+}
+
+// Close stops the cache store, the harness cannot be used afterwards
+func (h *Harness) Close() {
+	h.Cache.Destroy()
+	h.cancel()
+}
+
+// SetLogger sets the logger handlers get via the context processor, the nop one is used if not set
+func (h *Harness) SetLogger(l logger.Logger) *Harness {
+	h.logger = l
+	return h
+}
+
+// RegisterHandler registers the handler of the typename with its default options, calls to the typename are executed by it
+func (h *Harness) RegisterHandler(typename string, handler statefun.FunctionHandler, options *easyjson.JSON) *Harness {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.handlers[typename] = handler
+	h.options[typename] = options
+	return h
+}
+
+/*
+SetContextMigrations sets the context migrations of the typename as statefun.FunctionTypeConfig.SetContextMigrations
+does: function contexts of older schema versions are migrated when read and stored back, contexts are stored with the
+latest version. A failed migration panics as in the runtime, a handler reading such a context replies the error.
+*/
+func (h *Harness) SetContextMigrations(typename string, migrations ...statefun.ContextMigration) *Harness {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.migrations[typename] = migrations
+	return h
+}
+
+// SetFence sets the fence handlers of the function get as the lease of the KV mutex guarding their calls, context
+// writes made with a stale fence are rejected and logged as in the runtime
+func (h *Harness) SetFence(typename string, id string, fence cache.Fence) *Harness {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.fences[sfPlugins.StatefunAddress{Typename: typename, ID: id}] = fence
+	return h
+}
+
+// OnGolangCallSync scripts the reply for GolangCallSync calls of the function, an empty id matches any id of the typename
+func (h *Harness) OnGolangCallSync(typename string, id string, reply SyncReplyFunc) *Harness {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.syncReplies[sfPlugins.StatefunAddress{Typename: typename, ID: id}] = reply
+	return h
+}
+
+// ReplyWith returns a SyncReplyFunc which always replies with the result
+func ReplyWith(result *easyjson.JSON) SyncReplyFunc {
+	return func(SyncCall) (*easyjson.JSON, error) { return result, nil }
+}
+
+// ReplyWithError returns a SyncReplyFunc which always replies with the error
+func ReplyWithError(err error) SyncReplyFunc {
+	return func(SyncCall) (*easyjson.JSON, error) { return nil, err }
+}
+
+// Invoke calls the handler as if it got an asynchronous message, Call to the caller is recorded as a regular call
+func (h *Harness) Invoke(handler statefun.FunctionHandler, self sfPlugins.StatefunAddress, caller sfPlugins.StatefunAddress, payload *easyjson.JSON, options *easyjson.JSON) error {
+	_, err := h.invoke(handler, self, caller, payload, options, false)
+	return err
+}
+
+// InvokeSync calls the handler as if it was called via GolangCallSync, Call to the caller is returned as the reply
+func (h *Harness) InvokeSync(handler statefun.FunctionHandler, self sfPlugins.StatefunAddress, caller sfPlugins.StatefunAddress, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	return h.invoke(handler, self, caller, payload, options, true)
+}
+
+// Drain executes recorded asynchronous calls to registered handlers in order until none is left, including calls made
+// while draining. Delayed calls are executed immediately. Returns the first error of a handler.
+func (h *Harness) Drain() error {
+	var firstErr error
+	for {
+		h.mutex.Lock()
+		if len(h.pending) == 0 {
+			h.mutex.Unlock()
+			return firstErr
+		}
+		call := h.pending[0]
+		h.pending = h.pending[1:]
+		handler := h.handlers[call.Target.Typename]
+		defaultOptions := h.options[call.Target.Typename]
+		h.mutex.Unlock()
+
+		if _, err := h.invoke(handler, call.Target, call.Caller, call.Payload, mergeOptions(defaultOptions, call.Options), false); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+}
+
+// Reset forgets all recorded calls, egresses and reply errors. Contexts and scripted replies are kept.
+func (h *Harness) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.calls = nil
+	h.pending = nil
+	h.syncCalls = nil
+	h.egresses = nil
+	h.replyErrors = nil
+}
+
+func (h *Harness) Calls() []Call {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]Call{}, h.calls...)
+}
+
+func (h *Harness) SyncCalls() []SyncCall {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]SyncCall{}, h.syncCalls...)
+}
+
+func (h *Harness) Egresses() []Egress {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]Egress{}, h.egresses...)
+}
+
+func (h *Harness) ReplyErrors() []error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]error{}, h.replyErrors...)
+}
+
+// CallsTo returns recorded asynchronous calls to the function, an empty id matches any id of the typename
+func (h *Harness) CallsTo(typename string, id string) []Call {
+	calls := []Call{}
+	for _, c := range h.Calls() {
+		if c.Target.Typename == typename && (len(id) == 0 || c.Target.ID == id) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// SetFunctionContext sets the context of the function the same way a handler does via SetFunctionContext, unfenced
+func (h *Harness) SetFunctionContext(typename string, id string, context *easyjson.JSON) {
+	system.MsgOnErrorReturn(h.setContext(typename+"."+id, context, h.contextMigrations(typename), cache.Fence{}))
+}
+
+// FunctionContext returns the context of the function the same way a handler gets it via GetFunctionContext, unfenced
+func (h *Harness) FunctionContext(typename string, id string) *easyjson.JSON {
+	return h.getContext(typename+"."+id, h.contextMigrations(typename), cache.Fence{})
+}
+
+// SetObjectContext sets the context of the object the same way a handler does via SetObjectContext, unfenced
+func (h *Harness) SetObjectContext(id string, context *easyjson.JSON) {
+	system.MsgOnErrorReturn(h.setContext(id, context, nil, cache.Fence{}))
+}
+
+func (h *Harness) ObjectContext(id string) *easyjson.JSON {
+	return h.getContext(id, nil, cache.Fence{})
+}
+
+func (h *Harness) AssertFunctionContext(t testing.TB, typename string, id string, expected *easyjson.JSON) {
+	t.Helper()
+	if actual := h.FunctionContext(typename, id); !jsonEqual(actual, expected) {
+		t.Errorf("function context of %s.%s: expected %s, got %s", typename, id, jsonString(expected), jsonString(actual))
+	}
+}
+
+func (h *Harness) AssertObjectContext(t testing.TB, id string, expected *easyjson.JSON) {
+	t.Helper()
+	if actual := h.ObjectContext(id); !jsonEqual(actual, expected) {
+		t.Errorf("object context of %s: expected %s, got %s", id, jsonString(expected), jsonString(actual))
+	}
+}
+
+// AssertCalled checks that the function was called asynchronously with the payload, a nil payload matches any
+func (h *Harness) AssertCalled(t testing.TB, typename string, id string, payload *easyjson.JSON) {
+	t.Helper()
+	calls := h.CallsTo(typename, id)
+	for _, c := range calls {
+		if payload == nil || jsonEqual(c.Payload, payload) {
+			return
+		}
+	}
+	if len(calls) == 0 {
+		t.Errorf("expected call to %s.%s, got none", typename, id)
+	} else {
+		t.Errorf("expected call to %s.%s with payload %s, got %d calls with other payloads", typename, id, jsonString(payload), len(calls))
+	}
+}
+
+func (h *Harness) AssertNotCalled(t testing.TB, typename string, id string) {
+	t.Helper()
+	if calls := h.CallsTo(typename, id); len(calls) > 0 {
+		t.Errorf("expected no calls to %s.%s, got %d", typename, id, len(calls))
+	}
+}
+
+// AssertEgress checks that the payload was published into the topic, a nil payload matches any
+func (h *Harness) AssertEgress(t testing.TB, topic string, payload *easyjson.JSON) {
+	t.Helper()
+	for _, e := range h.Egresses() {
+		if e.Topic == topic && (payload == nil || jsonEqual(e.Payload, payload)) {
+			return
+		}
+	}
+	t.Errorf("expected egress into %s with payload %s", topic, jsonString(payload))
+}
+
+func (h *Harness) invoke(handler statefun.FunctionHandler, self sfPlugins.StatefunAddress, caller sfPlugins.StatefunAddress, payload *easyjson.JSON, options *easyjson.JSON, sync bool) (reply *easyjson.JSON, err error) {
+	if handler == nil {
+		return nil, fmt.Errorf("no handler registered for the typename %s", self.Typename)
+	}
+	if payload == nil {
+		payload = easyjson.NewJSONObject().GetPtr()
+	}
+	if options == nil {
+		options = easyjson.NewJSONObject().GetPtr()
+	}
+
+	h.mutex.Lock()
+	fence := h.fences[self]
+	migrations := h.migrations[self.Typename]
+	h.mutex.Unlock()
+
+	// Context writes are fenced as in the runtime, rejected ones are logged
+	functionLogger := h.logger.With(logger.TypenameKey, self.Typename, logger.IDKey, self.ID)
+	logOnError := func(msg string, err error) {
+		if err != nil {
+			functionLogger.Error(msg, logger.ErrorKey, err)
+		}
+	}
+
+	replied := false
+	contextProcessor := &sfPlugins.StatefunContextProcessor{
+		GlobalCache:        h.Cache,
+		Fence:              fence,
+		GetFunctionContext: func() *easyjson.JSON { return h.getContext(self.Typename+"."+self.ID, migrations, fence) },
+		SetFunctionContext: func(context *easyjson.JSON) {
+			logOnError("Cannot store context", h.setContext(self.Typename+"."+self.ID, context, migrations, fence))
+		},
+		DeleteFunctionContext: func() {
+			logOnError("Cannot delete function context", h.Cache.DeleteValueFenced(self.Typename+"."+self.ID, true, -1, "", fence))
+		},
+		GetObjectContext: func() *easyjson.JSON { return h.getContext(self.ID, nil, fence) },
+		SetObjectContext: func(context *easyjson.JSON) {
+			logOnError("Cannot store context", h.setContext(self.ID, context, nil, fence))
+		},
+		Call: func(targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) {
+			if sync && !replied && caller.Typename == targetTypename && caller.ID == targetID {
+				replied = true
+				reply = j
+				return
+			}
+			h.recordCall(Call{Caller: self, Target: sfPlugins.StatefunAddress{Typename: targetTypename, ID: targetID}, Payload: j, Options: o})
+		},
+		GolangCallSync: func(targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) (*easyjson.JSON, error) {
+			return h.callSync(self, sfPlugins.StatefunAddress{Typename: targetTypename, ID: targetID}, j, o)
+		},
+		CallAfter: func(targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON, delay time.Duration) {
+			h.recordCall(Call{Caller: self, Target: sfPlugins.StatefunAddress{Typename: targetTypename, ID: targetID}, Payload: j, Options: o, Delay: delay})
+		},
+		Egress: func(topic string, j *easyjson.JSON) {
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+			h.egresses = append(h.egresses, Egress{Caller: self, Topic: topic, Payload: j})
+		},
+		Logger:  functionLogger,
+		Self:    self,
+		Caller:  caller,
+		Payload: payload,
+		Options: options,
+	}
+	contextProcessor.ReplyError = func(e error) {
+		h.mutex.Lock()
+		h.replyErrors = append(h.replyErrors, e)
+		h.mutex.Unlock()
+		if !replied {
+			replied = true
+			err = e
+		}
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				contextProcessor.ReplyError(fmt.Errorf("function handler panicked: %v", r))
+			}
+		}()
+		handler(nil, contextProcessor)
+	}()
+
+	if sync && !replied {
+		return nil, fmt.Errorf("function %s.%s did not reply", self.Typename, self.ID)
+	}
+	return reply, err
+}
+
+func (h *Harness) recordCall(call Call) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.calls = append(h.calls, call)
+	if _, ok := h.handlers[call.Target.Typename]; ok {
+		h.pending = append(h.pending, call)
+	}
+}
+
+// callSync answers with a scripted reply if there is one, otherwise executes the registered handler
+func (h *Harness) callSync(caller sfPlugins.StatefunAddress, target sfPlugins.StatefunAddress, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	call := SyncCall{Caller: caller, Target: target, Payload: payload, Options: options}
+
+	h.mutex.Lock()
+	replyFunc, ok := h.syncReplies[target]
+	if !ok {
+		replyFunc, ok = h.syncReplies[sfPlugins.StatefunAddress{Typename: target.Typename}]
+	}
+	handler := h.handlers[target.Typename]
+	defaultOptions := h.options[target.Typename]
+	h.mutex.Unlock()
+
+	switch {
+	case ok:
+		call.Reply, call.Err = replyFunc(call)
+	case handler != nil:
+		call.Reply, call.Err = h.invoke(handler, target, caller, payload, mergeOptions(defaultOptions, options), true)
+	default:
+		call.Err = fmt.Errorf("callFunctionGolangSync cannot call function with the typename %s, not registered", target.Typename)
+	}
+
+	h.mutex.Lock()
+	h.syncCalls = append(h.syncCalls, call)
+	h.mutex.Unlock()
+	return call.Reply, call.Err
+}
+
+// getContext returns the context migrated to the latest schema version, the migrated one is stored back
+func (h *Harness) getContext(keyValueID string, migrations []statefun.ContextMigration, fence cache.Fence) *easyjson.JSON {
+	j, err := h.Cache.GetValueAsJSON(keyValueID)
+	if err != nil {
+		return easyjson.NewJSONObject().GetPtr()
+	}
+	if len(migrations) == 0 {
+		return j
+	}
+	migrated, changed, err := statefun.MigrateContext(j, migrations)
+	if err != nil {
+		panic(fmt.Errorf("context %s: %w", keyValueID, err))
+	}
+	if changed {
+		system.MsgOnErrorReturn(h.setContext(keyValueID, migrated, migrations, fence))
+	}
+	return migrated
+}
+
+func (h *Harness) setContext(keyValueID string, context *easyjson.JSON, migrations []statefun.ContextMigration, fence cache.Fence) error {
+	var value []byte
+	if context != nil {
+		value = statefun.VersionedContext(context, migrations).ToBytes()
+	}
+	return h.Cache.SetValueFenced(keyValueID, value, true, -1, "", fence)
+}
+
+func (h *Harness) contextMigrations(typename string) []statefun.ContextMigration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.migrations[typename]
+}
+
+func mergeOptions(defaultOptions *easyjson.JSON, options *easyjson.JSON) *easyjson.JSON {
+	merged := easyjson.NewJSONObject()
+	if defaultOptions != nil {
+		merged = defaultOptions.Clone()
+	}
+	if options != nil {
+		merged.DeepMerge(*options)
+	}
+	return &merged
+}
+
+func jsonEqual(a *easyjson.JSON, b *easyjson.JSON) bool {
+	return jsonString(a) == jsonString(b)
+}
+
+func jsonString(j *easyjson.JSON) string {
+	if j == nil {
+		return "null"
+	}
+	return j.ToString()
+}
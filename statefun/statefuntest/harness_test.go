@@ -0,0 +1,103 @@
+// Copyright 2023 NJWS Inc.
+
+package statefuntest_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+const harnessTypename = "harness.fn"
+
+// incrementHandler increments the "counter" of the function context
+func incrementHandler(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	context := contextProcessor.GetFunctionContext()
+	context.SetByPath("counter", easyjson.NewJSON(context.GetByPath("counter").AsNumericDefault(0)+1))
+	contextProcessor.SetFunctionContext(context)
+}
+
+func TestHarnessContextMigrations(t *testing.T) {
+	self := sfPlugins.StatefunAddress{Typename: harnessTypename, ID: "a"}
+	caller := sfPlugins.StatefunAddress{Typename: "ingress", ID: "test"}
+	renameCount := func(context *easyjson.JSON) (*easyjson.JSON, error) {
+		migrated := easyjson.NewJSONObjectWithKeyValue("counter", context.GetByPath("count"))
+		return &migrated, nil
+	}
+
+	t.Run("migrated", func(t *testing.T) {
+		h := statefuntest.New().SetContextMigrations(harnessTypename, renameCount)
+		defer h.Close()
+		h.Cache.SetValue(self.Typename+"."+self.ID, []byte(`{"count":5}`), true, -1, "") // Stored before versioning
+		if err := h.Invoke(incrementHandler, self, caller, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		h.AssertFunctionContext(t, self.Typename, self.ID, easyjson.NewJSONObjectWithKeyValue("counter", easyjson.NewJSON(6)).GetPtr())
+		stored, err := h.Cache.GetValueAsJSON(self.Typename + "." + self.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stored.GetByPath(statefun.ContextVersionKey).AsNumericDefault(-1); got != 1 {
+			t.Errorf("got stored context version %v, want 1", got)
+		}
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		h := statefuntest.New().SetContextMigrations(harnessTypename, renameCount)
+		defer h.Close()
+		h.Cache.SetValue(self.Typename+"."+self.ID, []byte(`{"__context_version":2}`), true, -1, "")
+		err := h.Invoke(incrementHandler, self, caller, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "newer than the latest known one") {
+			t.Errorf("got error %v, want a newer version replied", err)
+		}
+	})
+
+	t.Run("failed migration", func(t *testing.T) {
+		h := statefuntest.New().SetContextMigrations(harnessTypename, func(*easyjson.JSON) (*easyjson.JSON, error) {
+			return nil, errors.New("broken")
+		})
+		defer h.Close()
+		h.Cache.SetValue(self.Typename+"."+self.ID, []byte(`{"count":5}`), true, -1, "")
+		if err := h.Invoke(incrementHandler, self, caller, nil, nil); err == nil || !strings.Contains(err.Error(), "broken") {
+			t.Errorf("got error %v, want the migration error replied", err)
+		}
+		if stored, _ := h.Cache.GetValueAsJSON(self.Typename + "." + self.ID); stored.ToString() != `{"count":5}` {
+			t.Errorf("got stored context %s, want it kept", stored.ToString())
+		}
+	})
+}
+
+func TestHarnessFence(t *testing.T) {
+	self := sfPlugins.StatefunAddress{Typename: harnessTypename, ID: "a"}
+	caller := sfPlugins.StatefunAddress{Typename: "ingress", ID: "test"}
+	leaseHeld := true
+	fence := cache.Fence{Lock: "lock", Token: 1, Valid: func() bool { return leaseHeld }}
+
+	h := statefuntest.New().SetFence(self.Typename, self.ID, fence)
+	defer h.Close()
+	var got cache.Fence
+	if err := h.Invoke(func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		got = contextProcessor.Fence
+		incrementHandler(executor, contextProcessor)
+	}, self, caller, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got.Lock != fence.Lock || got.Token != fence.Token {
+		t.Errorf("got fence %s/%d, want %s/%d", got.Lock, got.Token, fence.Lock, fence.Token)
+	}
+	counter := easyjson.NewJSONObjectWithKeyValue("counter", easyjson.NewJSON(1))
+	h.AssertFunctionContext(t, self.Typename, self.ID, &counter)
+
+	leaseHeld = false
+	if err := h.Invoke(incrementHandler, self, caller, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	h.AssertFunctionContext(t, self.Typename, self.ID, &counter) // The write with the lost lease is rejected
+}
@@ -0,0 +1,326 @@
+// Copyright 2023 NJWS Inc.
+
+package statefuntest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type memoryKVEntry struct {
+	bucket    string
+	key       string
+	value     []byte
+	revision  uint64
+	created   time.Time
+	operation nats.KeyValueOp
+}
+
+func (e *memoryKVEntry) Bucket() string             { return e.bucket }
+func (e *memoryKVEntry) Key() string                { return e.key }
+func (e *memoryKVEntry) Value() []byte              { return e.value }
+func (e *memoryKVEntry) Revision() uint64           { return e.revision }
+func (e *memoryKVEntry) Created() time.Time         { return e.created }
+func (e *memoryKVEntry) Delta() uint64              { return 0 }
+func (e *memoryKVEntry) Operation() nats.KeyValueOp { return e.operation }
+
+type memoryKVWatcher struct {
+	kv      *MemoryKeyValue
+	pattern string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	updates chan nats.KeyValueEntry
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   []nats.KeyValueEntry
+	stopped bool
+}
+
+func (w *memoryKVWatcher) Context() context.Context           { return w.ctx }
+func (w *memoryKVWatcher) Updates() <-chan nats.KeyValueEntry { return w.updates }
+
+func (w *memoryKVWatcher) Stop() error {
+	w.kv.removeWatcher(w)
+	w.mutex.Lock()
+	w.stopped = true
+	w.mutex.Unlock()
+	w.cond.Broadcast()
+	w.cancel()
+	return nil
+}
+
+// push queues an entry without blocking the writer, even if nobody reads the updates
+func (w *memoryKVWatcher) push(entry nats.KeyValueEntry) {
+	w.mutex.Lock()
+	w.queue = append(w.queue, entry)
+	w.mutex.Unlock()
+	w.cond.Signal()
+}
+
+func (w *memoryKVWatcher) pump() {
+	defer close(w.updates)
+	for {
+		w.mutex.Lock()
+		for len(w.queue) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.mutex.Unlock()
+			return
+		}
+		entry := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mutex.Unlock()
+
+		select {
+		case w.updates <- entry:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+MemoryKeyValue is an in-memory implementation of nats.KeyValue for tests, which is enough for the cache store and the KV
+mutices. Delete, purge and watch options are ignored, a watcher receives current values followed by nil and then updates.
+*/
+type MemoryKeyValue struct {
+	bucket string
+
+	mutex    sync.Mutex
+	revision uint64
+	history  map[string][]*memoryKVEntry
+	watchers map[*memoryKVWatcher]bool
+}
+
+func NewMemoryKeyValue(bucket string) *MemoryKeyValue {
+	return &MemoryKeyValue{
+		bucket:   bucket,
+		history:  map[string][]*memoryKVEntry{},
+		watchers: map[*memoryKVWatcher]bool{},
+	}
+}
+
+func (kv *MemoryKeyValue) last(key string) *memoryKVEntry {
+	if h := kv.history[key]; len(h) > 0 {
+		return h[len(h)-1]
+	}
+	return nil
+}
+
+// append must be called with the mutex locked
+func (kv *MemoryKeyValue) append(key string, value []byte, operation nats.KeyValueOp) uint64 {
+	kv.revision++
+	entry := &memoryKVEntry{
+		bucket:    kv.bucket,
+		key:       key,
+		value:     append([]byte{}, value...),
+		revision:  kv.revision,
+		created:   time.Now(),
+		operation: operation,
+	}
+	if operation == nats.KeyValuePurge {
+		kv.history[key] = []*memoryKVEntry{entry}
+	} else {
+		kv.history[key] = append(kv.history[key], entry)
+	}
+	for w := range kv.watchers {
+		if subjectMatches(w.pattern, key) {
+			w.push(entry)
+		}
+	}
+	return entry.revision
+}
+
+func (kv *MemoryKeyValue) Get(key string) (nats.KeyValueEntry, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if e := kv.last(key); e != nil && e.operation == nats.KeyValuePut {
+		return e, nil
+	}
+	return nil, nats.ErrKeyNotFound
+}
+
+func (kv *MemoryKeyValue) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for _, e := range kv.history[key] {
+		if e.revision == revision && e.operation == nats.KeyValuePut {
+			return e, nil
+		}
+	}
+	return nil, nats.ErrKeyNotFound
+}
+
+func (kv *MemoryKeyValue) Put(key string, value []byte) (uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.append(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *MemoryKeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.Put(key, []byte(value))
+}
+
+func (kv *MemoryKeyValue) Create(key string, value []byte) (uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if e := kv.last(key); e != nil && e.operation == nats.KeyValuePut {
+		return 0, nats.ErrKeyExists
+	}
+	return kv.append(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *MemoryKeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	var current uint64
+	if e := kv.last(key); e != nil {
+		current = e.revision
+	}
+	if current != last {
+		return 0, fmt.Errorf("nats: wrong last sequence: %d", current)
+	}
+	return kv.append(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *MemoryKeyValue) Delete(key string, opts ...nats.DeleteOpt) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.append(key, nil, nats.KeyValueDelete)
+	return nil
+}
+
+func (kv *MemoryKeyValue) Purge(key string, opts ...nats.DeleteOpt) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.append(key, nil, nats.KeyValuePurge)
+	return nil
+}
+
+func (kv *MemoryKeyValue) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &memoryKVWatcher{kv: kv, pattern: keys, ctx: ctx, cancel: cancel, updates: make(chan nats.KeyValueEntry, 256)}
+	w.cond = sync.NewCond(&w.mutex)
+
+	for _, key := range kv.sortedKeys() {
+		if e := kv.last(key); e.operation == nats.KeyValuePut && subjectMatches(keys, key) {
+			w.queue = append(w.queue, e)
+		}
+	}
+	w.queue = append(w.queue, nil) // Initial values are delivered
+	kv.watchers[w] = true
+
+	go w.pump()
+	return w, nil
+}
+
+func (kv *MemoryKeyValue) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.Watch(">", opts...)
+}
+
+func (kv *MemoryKeyValue) Keys(opts ...nats.WatchOpt) ([]string, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	keys := []string{}
+	for _, key := range kv.sortedKeys() {
+		if kv.last(key).operation == nats.KeyValuePut {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nats.ErrNoKeysFound
+	}
+	return keys, nil
+}
+
+func (kv *MemoryKeyValue) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	h := kv.history[key]
+	if len(h) == 0 {
+		return nil, nats.ErrKeyNotFound
+	}
+	entries := make([]nats.KeyValueEntry, len(h))
+	for i, e := range h {
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+func (kv *MemoryKeyValue) Bucket() string {
+	return kv.bucket
+}
+
+func (kv *MemoryKeyValue) PurgeDeletes(opts ...nats.PurgeOpt) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for key := range kv.history {
+		if kv.last(key).operation != nats.KeyValuePut {
+			delete(kv.history, key)
+		}
+	}
+	return nil
+}
+
+func (kv *MemoryKeyValue) Status() (nats.KeyValueStatus, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	var values uint64
+	for _, h := range kv.history {
+		values += uint64(len(h))
+	}
+	return &memoryKVStatus{bucket: kv.bucket, values: values}, nil
+}
+
+func (kv *MemoryKeyValue) removeWatcher(w *memoryKVWatcher) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	delete(kv.watchers, w)
+}
+
+func (kv *MemoryKeyValue) sortedKeys() []string {
+	keys := make([]string, 0, len(kv.history))
+	for key := range kv.history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type memoryKVStatus struct {
+	bucket string
+	values uint64
+}
+
+func (s *memoryKVStatus) Bucket() string       { return s.bucket }
+func (s *memoryKVStatus) Values() uint64       { return s.values }
+func (s *memoryKVStatus) History() int64       { return 0 }
+func (s *memoryKVStatus) TTL() time.Duration   { return 0 }
+func (s *memoryKVStatus) BackingStore() string { return "Memory" }
+func (s *memoryKVStatus) Bytes() uint64        { return 0 }
+
+// subjectMatches reports whether a NATS subject matches a pattern with "*" and ">" wildcards
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, pt := range patternTokens {
+		if pt == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (pt != "*" && pt != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
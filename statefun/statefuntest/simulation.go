@@ -0,0 +1,646 @@
+// Copyright 2023 NJWS Inc.
+
+package statefuntest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	// SimSeqKey is the payload key with the sequence number of a message sent by Simulation.Send
+	SimSeqKey                 = "sim_seq"
+	SimStartTimeoutSec        = 30
+	SimShutdownTimeoutSec     = 30
+	SimDeliveryPollIntervalMs = 50
+)
+
+var (
+	// Markers of outgoing NATS protocol data carrying KV operations: puts into and reads, watches of KV streams
+	kvProtocolMarkers = [][]byte{[]byte("$KV."), []byte(".KV_")}
+)
+
+type SimulationConfig struct {
+	nodes           int
+	seed            int64
+	runtimeConfig   func(node int) *statefun.RuntimeConfig
+	cacheConfig     func(node int) *cache.Config
+	startTimeoutSec int
+}
+
+func NewSimulationConfig(nodes int) *SimulationConfig {
+	return &SimulationConfig{
+		nodes: nodes,
+		seed:  1,
+		runtimeConfig: func(node int) *statefun.RuntimeConfig {
+			return statefun.NewRuntimeConfigSimple(nats.DefaultURL, "sim").SetTraceServiceName(fmt.Sprintf("sim-%d", node))
+		},
+		cacheConfig:     func(node int) *cache.Config { return cache.NewCacheConfig() },
+		startTimeoutSec: SimStartTimeoutSec,
+	}
+}
+
+// SetSeed sets the seed of the random faults made by RunChaos and of the KV delay jitter, it does not make the timing of runtimes reproducible
+func (sc *SimulationConfig) SetSeed(seed int64) *SimulationConfig {
+	sc.seed = seed
+	return sc
+}
+
+// SetRuntimeConfig sets the constructor of runtime configs for nodes, which must share stream and KV bucket names.
+// NATS connection options are overridden by the simulation.
+func (sc *SimulationConfig) SetRuntimeConfig(runtimeConfig func(node int) *statefun.RuntimeConfig) *SimulationConfig {
+	sc.runtimeConfig = runtimeConfig
+	return sc
+}
+
+func (sc *SimulationConfig) SetCacheConfig(cacheConfig func(node int) *cache.Config) *SimulationConfig {
+	sc.cacheConfig = cacheConfig
+	return sc
+}
+
+func (sc *SimulationConfig) SetStartTimeoutSec(startTimeoutSec int) *SimulationConfig {
+	sc.startTimeoutSec = startTimeoutSec
+	return sc
+}
+
+// Execution is a single call of a function handler observed on a node
+type Execution struct {
+	Node       int
+	Generation int // Incremented on every restart of the node
+	Typename   string
+	ID         string
+	Seq        int64 // SimSeqKey of the payload, -1 if absent
+	Start      time.Time
+	End        time.Time
+	Completed  bool // Handler returned without a panic before the node was killed
+}
+
+/*
+Node is a runtime of the simulation. It is connected to the shared NATS server via an in-process connection which can be
+paused, delayed and cut.
+*/
+type Node struct {
+	sim   *Simulation
+	index int
+
+	mutex      sync.Mutex
+	runtime    *statefun.Runtime
+	generation int
+	conn       net.Conn
+	killed     bool
+	killedAt   map[int]time.Time
+	paused     chan struct{} // Closed on resume, nil if not paused
+	kvDelay    time.Duration
+	kvJitter   time.Duration
+	kvRand     *rand.Rand // Jitter of the node, does not take numbers from faults of RunChaos made concurrently
+	done       chan error // Receives the result of Runtime.Start
+}
+
+func (n *Node) Index() int {
+	return n.index
+}
+
+// Runtime returns the current runtime of the node, nil if the node is not running
+func (n *Node) Runtime() *statefun.Runtime {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.runtime
+}
+
+/*
+Handler wraps the function handler to record its executions on the node. Must be used for every function type
+registered in the setup of the simulation for the invariants to be checked. A killed node executes nothing.
+*/
+func (n *Node) Handler(handler statefun.FunctionHandler) statefun.FunctionHandler {
+	n.mutex.Lock()
+	generation := n.generation
+	n.mutex.Unlock()
+
+	return func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		if !n.alive(generation) {
+			return
+		}
+		execution := Execution{
+			Node:       n.index,
+			Generation: generation,
+			Typename:   contextProcessor.Self.Typename,
+			ID:         contextProcessor.Self.ID,
+			Seq:        -1,
+			Start:      time.Now(),
+		}
+		if seq, ok := contextProcessor.Payload.GetByPath(SimSeqKey).AsNumeric(); ok {
+			execution.Seq = int64(seq)
+		}
+		defer func() {
+			execution.End = time.Now()
+			n.mutex.Lock()
+			if killedAt, ok := n.killedAt[generation]; ok && killedAt.Before(execution.End) {
+				execution.End = killedAt
+				execution.Completed = false
+			}
+			n.mutex.Unlock()
+			n.sim.record(execution)
+		}()
+		handler(executor, contextProcessor)
+		execution.Completed = true
+	}
+}
+
+func (n *Node) alive(generation int) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, killed := n.killedAt[generation]
+	return !killed
+}
+
+// InProcessConn implements nats.InProcessConnProvider, connections are refused while the node is killed
+func (n *Node) InProcessConn() (net.Conn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.killed {
+		return nil, fmt.Errorf("simulation node %d is killed", n.index)
+	}
+	conn, err := n.sim.server.InProcessConn()
+	if err != nil {
+		return nil, err
+	}
+	n.conn = &simConn{Conn: conn, node: n}
+	return n.conn, nil
+}
+
+func (n *Node) waitResumed() {
+	n.mutex.Lock()
+	paused := n.paused
+	n.mutex.Unlock()
+	if paused != nil {
+		<-paused
+	}
+}
+
+func (n *Node) writeDelay(b []byte) time.Duration {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.kvDelay == 0 && n.kvJitter == 0 {
+		return 0
+	}
+	for _, marker := range kvProtocolMarkers {
+		if bytes.Contains(b, marker) {
+			delay := n.kvDelay
+			if n.kvJitter > 0 {
+				delay += time.Duration(n.kvRand.Int63n(int64(n.kvJitter)))
+			}
+			return delay
+		}
+	}
+	return 0
+}
+
+// simConn blocks the traffic of a paused node and delays outgoing data carrying KV operations
+type simConn struct {
+	net.Conn
+	node *Node
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	c.node.waitResumed()
+	return c.Conn.Read(b)
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	c.node.waitResumed()
+	if delay := c.node.writeDelay(b); delay > 0 {
+		time.Sleep(delay)
+	}
+	return c.Conn.Write(b)
+}
+
+/*
+Simulation runs several runtimes in a single process against one embedded NATS server. Nodes can be paused, killed and
+restarted, KV operations of a node can be delayed. Executions of handlers wrapped by Node.Handler and messages sent by
+Send are recorded to check invariants afterwards. The schedule of faults made by RunChaos and the KV delay jitter are
+determined by the seed, timings of runtimes are not: goroutines, NATS redeliveries and lease expirations run in real time.
+Making them seed-driven would need the runtime to run on a simulated clock and network, which is out of scope of the
+simulation, so a run is not reproducible and a failure found with a seed may not show up again with it. Failed runs
+should be analyzed by Events, which start with the seed.
+*/
+type Simulation struct {
+	config   *SimulationConfig
+	setup    func(node *Node)
+	server   *server.Server
+	storeDir string
+	nc       *nats.Conn
+	js       nats.JetStreamContext
+	nodes    []*Node
+
+	mutex      sync.Mutex
+	rand       *rand.Rand
+	seq        int64
+	sent       map[int64]string
+	delivered  map[int64]int
+	executions []Execution
+	events     []string
+}
+
+// NewSimulation starts the NATS server of the simulation, setup is called on every (re)start of a node to register function types
+func NewSimulation(config *SimulationConfig, setup func(node *Node)) (*Simulation, error) {
+	s := &Simulation{
+		config:    config,
+		setup:     setup,
+		rand:      rand.New(rand.NewSource(config.seed)),
+		sent:      map[int64]string{},
+		delivered: map[int64]int{},
+	}
+
+	storeDir, err := os.MkdirTemp("", "foliage-sim-*")
+	if err != nil {
+		return nil, err
+	}
+	s.storeDir = storeDir
+
+	s.server, err = server.NewServer(&server.Options{
+		ServerName: "simulation",
+		JetStream:  true,
+		StoreDir:   storeDir,
+		NoSigs:     true,
+		DontListen: true,
+	})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	go s.server.Start()
+	if !s.server.ReadyForConnections(statefun.EmbeddedNatsStartTimeoutSec * time.Second) {
+		s.Close()
+		return nil, fmt.Errorf("simulation NATS server is not ready for connections in %ds", statefun.EmbeddedNatsStartTimeoutSec)
+	}
+
+	if s.nc, err = nats.Connect("", nats.InProcessServer(s.server)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.js, err = s.nc.JetStream(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	for i := 0; i < config.nodes; i++ {
+		s.nodes = append(s.nodes, &Node{sim: s, index: i, killedAt: map[int]time.Time{}, kvRand: rand.New(rand.NewSource(config.seed + int64(i) + 1))})
+	}
+	s.event("seed %d", config.seed)
+	return s, nil
+}
+
+// Start starts all nodes one by one
+func (s *Simulation) Start() error {
+	for i := range s.nodes {
+		if err := s.startNode(s.nodes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Simulation) Node(i int) *Node {
+	return s.nodes[i]
+}
+
+func (s *Simulation) Nodes() []*Node {
+	return s.nodes
+}
+
+// Pause blocks all NATS traffic of the node until Resume, the runtime keeps working locally
+func (s *Simulation) Pause(i int) {
+	n := s.nodes[i]
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.paused == nil {
+		n.paused = make(chan struct{})
+	}
+	s.event("pause %d", i)
+}
+
+func (s *Simulation) Resume(i int) {
+	n := s.nodes[i]
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.paused != nil {
+		close(n.paused)
+		n.paused = nil
+		s.event("resume %d", i)
+	}
+}
+
+// SetKVDelay delays outgoing KV operations of the node by delay plus a random duration up to jitter, zeros disable it
+func (s *Simulation) SetKVDelay(i int, delay time.Duration, jitter time.Duration) {
+	n := s.nodes[i]
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.kvDelay != delay || n.kvJitter != jitter {
+		n.kvDelay, n.kvJitter = delay, jitter
+		s.event("kv delay %d %s+%s", i, delay, jitter)
+	}
+}
+
+/*
+Kill simulates a crash of the node: its NATS connection is cut, reconnection is refused and the runtime is stopped
+without reaching NATS, so held mutices are not released and unacked messages are redelivered. Handlers of the killed
+runtime which are still running are considered ended at the moment of the kill.
+*/
+func (s *Simulation) Kill(i int) error {
+	n := s.nodes[i]
+	n.mutex.Lock()
+	if n.runtime == nil {
+		n.mutex.Unlock()
+		return fmt.Errorf("simulation node %d is not running", i)
+	}
+	runtime := n.runtime
+	n.runtime = nil
+	n.killed = true
+	n.killedAt[n.generation] = time.Now()
+	if n.paused != nil {
+		close(n.paused)
+		n.paused = nil
+	}
+	if n.conn != nil {
+		system.MsgOnErrorReturn(n.conn.Close())
+	}
+	n.mutex.Unlock()
+	s.event("kill %d", i)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // Do not wait for the graceful shutdown
+	_ = runtime.Shutdown(ctx)
+	<-n.done
+	return nil
+}
+
+// Stop gracefully shuts the node down
+func (s *Simulation) Stop(i int) error {
+	n := s.nodes[i]
+	n.mutex.Lock()
+	runtime := n.runtime
+	n.runtime = nil
+	n.mutex.Unlock()
+	if runtime == nil {
+		return fmt.Errorf("simulation node %d is not running", i)
+	}
+	s.Resume(i) // A paused node cannot reach NATS to shut down
+	s.event("stop %d", i)
+
+	ctx, cancel := context.WithTimeout(context.Background(), SimShutdownTimeoutSec*time.Second)
+	defer cancel()
+	err := runtime.Shutdown(ctx)
+	<-n.done
+	return err
+}
+
+// Restart kills the node if it is running and starts it again
+func (s *Simulation) Restart(i int) error {
+	if s.nodes[i].Runtime() != nil {
+		if err := s.Kill(i); err != nil {
+			return err
+		}
+	}
+	s.event("restart %d", i)
+	return s.startNode(s.nodes[i])
+}
+
+// Send publishes a message into the function through the JetStream with SimSeqKey added to the payload to track its delivery
+func (s *Simulation) Send(typename string, id string, payload *easyjson.JSON) error {
+	s.mutex.Lock()
+	s.seq++
+	seq := s.seq
+	s.sent[seq] = typename + "." + id
+	s.mutex.Unlock()
+
+	p := easyjson.NewJSONObject()
+	if payload != nil {
+		p = payload.Clone()
+	}
+	p.SetByPath(SimSeqKey, easyjson.NewJSON(seq))
+
+	data := easyjson.NewJSONObject()
+	data.SetByPath("caller_typename", easyjson.NewJSON("ingress"))
+	data.SetByPath("caller_id", easyjson.NewJSON("simulation"))
+	data.SetByPath("payload", p)
+	_, err := s.js.Publish(typename+"."+id, data.ToBytes())
+	return err
+}
+
+// WaitForDelivery waits until every message sent by Send is handled to completion at least once
+func (s *Simulation) WaitForDelivery(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if len(s.lost()) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return s.CheckNoLostMessages()
+		}
+		time.Sleep(SimDeliveryPollIntervalMs * time.Millisecond)
+	}
+}
+
+/*
+RunChaos makes steps random faults separated by interval: pauses a node for up to two intervals, restarts a node or
+changes KV delays of a node. All nodes are resumed and KV delays are removed at the end. The sequence of faults depends
+on the seed only.
+*/
+func (s *Simulation) RunChaos(steps int, interval time.Duration) error {
+	defer func() {
+		for i := range s.nodes {
+			s.Resume(i)
+			s.SetKVDelay(i, 0, 0)
+		}
+	}()
+	for step := 0; step < steps; step++ {
+		time.Sleep(interval)
+		i := int(s.randInt63n(int64(len(s.nodes))))
+		switch s.randInt63n(3) {
+		case 0:
+			s.Pause(i)
+			time.Sleep(time.Duration(s.randInt63n(int64(2*interval)) + 1))
+			s.Resume(i)
+		case 1:
+			if err := s.Restart(i); err != nil {
+				return err
+			}
+		case 2:
+			delay := time.Duration(s.randInt63n(int64(interval/4) + 1))
+			s.SetKVDelay(i, delay, delay)
+		}
+	}
+	return nil
+}
+
+func (s *Simulation) Executions() []Execution {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Execution{}, s.executions...)
+}
+
+// Events returns the log of faults made to nodes
+func (s *Simulation) Events() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.events...)
+}
+
+// CheckExclusiveHandling checks that no id was handled by different runtimes at the same time
+func (s *Simulation) CheckExclusiveHandling() error {
+	byFunction := map[string][]Execution{}
+	for _, e := range s.Executions() {
+		key := e.Typename + "." + e.ID
+		byFunction[key] = append(byFunction[key], e)
+	}
+
+	var errs []error
+	for _, key := range sortedMapKeys(byFunction) {
+		executions := byFunction[key]
+		sort.Slice(executions, func(i, j int) bool { return executions[i].Start.Before(executions[j].Start) })
+		latest := executions[0] // Execution ending latest among already passed ones
+		for _, e := range executions[1:] {
+			if e.Start.Before(latest.End) && (e.Node != latest.Node || e.Generation != latest.Generation) {
+				errs = append(errs, fmt.Errorf("%s is handled by node %d (generation %d) and node %d (generation %d) at the same time since %s",
+					key, latest.Node, latest.Generation, e.Node, e.Generation, e.Start.Format(time.RFC3339Nano)))
+			}
+			if e.End.After(latest.End) {
+				latest = e
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckNoLostMessages checks that every message sent by Send is handled to completion at least once
+func (s *Simulation) CheckNoLostMessages() error {
+	var errs []error
+	for _, seq := range s.lost() {
+		s.mutex.Lock()
+		target := s.sent[seq]
+		s.mutex.Unlock()
+		errs = append(errs, fmt.Errorf("message %d sent to %s is lost", seq, target))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Simulation) CheckInvariants() error {
+	return errors.Join(s.CheckExclusiveHandling(), s.CheckNoLostMessages())
+}
+
+// Close stops all running nodes gracefully and the NATS server
+func (s *Simulation) Close() {
+	for i, n := range s.nodes {
+		if n.Runtime() != nil {
+			system.MsgOnErrorReturn(s.Stop(i))
+		}
+	}
+	if s.nc != nil {
+		s.nc.Close()
+	}
+	if s.server != nil {
+		s.server.Shutdown()
+		s.server.WaitForShutdown()
+	}
+	if len(s.storeDir) > 0 {
+		system.MsgOnErrorReturn(os.RemoveAll(s.storeDir))
+	}
+}
+
+func (s *Simulation) startNode(n *Node) error {
+	n.mutex.Lock()
+	n.generation++
+	n.killed = false
+	n.mutex.Unlock()
+
+	config := s.config.runtimeConfig(n.index).
+		SetNatsOptions(nats.InProcessServer(n)).
+		SetNatsMaxReconnects(-1).
+		SetNatsReconnectWaitMs(100)
+	runtime, err := statefun.NewRuntime(*config)
+	if err != nil {
+		return fmt.Errorf("simulation node %d: %w", n.index, err)
+	}
+	n.mutex.Lock()
+	n.runtime = runtime
+	n.done = make(chan error, 1)
+	n.mutex.Unlock()
+
+	s.setup(n)
+
+	started := make(chan struct{})
+	go func() {
+		n.done <- runtime.Start(s.config.cacheConfig(n.index), func(*statefun.Runtime) { close(started) })
+	}()
+	select {
+	case <-started:
+		return nil
+	case err := <-n.done:
+		n.mutex.Lock()
+		n.runtime = nil
+		n.mutex.Unlock()
+		return fmt.Errorf("simulation node %d stopped while starting: %v", n.index, err)
+	case <-time.After(time.Duration(s.config.startTimeoutSec) * time.Second):
+		return fmt.Errorf("simulation node %d is not started in %ds", n.index, s.config.startTimeoutSec)
+	}
+}
+
+func (s *Simulation) record(e Execution) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.executions = append(s.executions, e)
+	if e.Completed && e.Seq >= 0 {
+		s.delivered[e.Seq]++
+	}
+}
+
+func (s *Simulation) lost() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lost := []int64{}
+	for seq := range s.sent {
+		if s.delivered[seq] == 0 {
+			lost = append(lost, seq)
+		}
+	}
+	sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+	return lost
+}
+
+func (s *Simulation) event(format string, args ...any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, time.Now().Format(time.RFC3339Nano)+" "+fmt.Sprintf(format, args...))
+}
+
+func (s *Simulation) randInt63n(n int64) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rand.Int63n(n)
+}
+
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 NJWS Inc.
+
+package statefuntest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+const simTypename = "sim.counter"
+
+// simCounter counts messages of the id, a call with {"get": true} replies the counter instead
+func simCounter(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	context := contextProcessor.GetFunctionContext()
+	counter := context.GetByPath("counter").AsNumericDefault(0)
+	if contextProcessor.Payload.GetByPath("get").AsBoolDefault(false) {
+		contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, easyjson.NewJSONObjectWithKeyValue("counter", easyjson.NewJSON(counter)).GetPtr(), nil)
+		return
+	}
+	time.Sleep(5 * time.Millisecond) // Let concurrent executions of the same id overlap
+	context.SetByPath("counter", easyjson.NewJSON(counter+1))
+	contextProcessor.SetFunctionContext(context)
+}
+
+// simSender sends messages to ids of simTypename and counts them per id
+type simSender struct {
+	t    *testing.T
+	sim  *statefuntest.Simulation
+	sent map[string]int
+}
+
+func (s *simSender) send(n int) {
+	s.t.Helper()
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("id%d", i%10)
+		if err := s.sim.Send(simTypename, id, nil); err != nil {
+			s.t.Fatal(err)
+		}
+		s.sent[id]++
+	}
+}
+
+// expectCounters waits until counters of all ids seen by the runtime of the node are equal to the number of messages sent to them
+func (s *simSender) expectCounters(node int) {
+	s.t.Helper()
+	get := easyjson.NewJSONObjectWithKeyValue("get", easyjson.NewJSON(true))
+	for id, sent := range s.sent {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			reply, err := s.sim.Node(node).Runtime().IngressGolangSync(simTypename, id, &get, nil)
+			counter := -1
+			if err == nil {
+				counter = int(reply.GetByPath("counter").AsNumericDefault(-1))
+				if counter == sent {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				s.t.Fatalf("got counter %d (%v) of %s, want %d", counter, err, id, sent)
+			}
+			time.Sleep(50 * time.Millisecond) // Cache of the node is updated from the KV
+		}
+	}
+}
+
+func TestSimulationKillAndRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several runtimes for seconds")
+	}
+
+	config := statefuntest.NewSimulationConfig(3).SetRuntimeConfig(func(node int) *statefun.RuntimeConfig {
+		return statefun.NewRuntimeConfigSimple(nats.DefaultURL, "sim").
+			SetTraceServiceName(fmt.Sprintf("sim-%d", node)).
+			SetKVMutexLifeTimeSec(2) // Mutices of the killed node expire soon
+	})
+	sim, err := statefuntest.NewSimulation(config, func(node *statefuntest.Node) {
+		statefun.NewFunctionType(node.Runtime(), simTypename, node.Handler(simCounter), *statefun.NewFunctionTypeConfig().SetBalanceNeeded(false).SetMsgAckWaitMs(1000))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender := &simSender{t: t, sim: sim, sent: map[string]int{}}
+
+	// Counters are not checked: ids are handled by all runtimes in turn, each of them reads contexts from its own cache
+	// updated from the KV asynchronously, so increments may be lost. A killed node also loses context writes not yet
+	// flushed into the KV and messages it handled but did not ack are handled again. See the balanced scenario.
+	sender.send(100)
+	if err := sim.Kill(1); err != nil {
+		t.Fatal(err)
+	}
+	sender.send(100)
+	if err := sim.WaitForDelivery(30 * time.Second); err != nil {
+		t.Fatalf("after kill: %s\nevents: %v", err, sim.Events())
+	}
+
+	if err := sim.Restart(1); err != nil {
+		t.Fatal(err)
+	}
+	sender.send(100)
+	if err := sim.WaitForDelivery(30 * time.Second); err != nil {
+		t.Fatalf("after restart: %s\nevents: %v", err, sim.Events())
+	}
+
+	if err := sim.CheckInvariants(); err != nil {
+		t.Errorf("%s\nevents: %v", err, sim.Events())
+	}
+}
+
+func TestSimulationBalancedStopAndStart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several runtimes for seconds")
+	}
+
+	sim, err := statefuntest.NewSimulation(statefuntest.NewSimulationConfig(3), func(node *statefuntest.Node) {
+		// Typename balanced: only the runtime holding the typename mutex handles messages, others NAK them
+		statefun.NewFunctionType(node.Runtime(), simTypename, node.Handler(simCounter), *statefun.NewFunctionTypeConfig().SetMsgAckWaitMs(500))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender := &simSender{t: t, sim: sim, sent: map[string]int{}}
+
+	// holder returns the node which handled all messages since the execution, fails if there are several
+	holder := func(since int) int {
+		t.Helper()
+		nodes := map[int]bool{}
+		for _, e := range sim.Executions()[since:] {
+			if e.Seq >= 0 {
+				nodes[e.Node] = true
+			}
+		}
+		if len(nodes) != 1 {
+			t.Fatalf("got messages of the typename handled by nodes %v, want one\nevents: %v", nodes, sim.Events())
+		}
+		for node := range nodes {
+			return node
+		}
+		return -1
+	}
+
+	sender.send(50)
+	if err := sim.WaitForDelivery(30 * time.Second); err != nil {
+		t.Fatalf("%s\nevents: %v", err, sim.Events())
+	}
+	first := holder(0)
+
+	// Stopped holder releases the typename, another node takes it over
+	if err := sim.Stop(first); err != nil {
+		t.Fatal(err)
+	}
+	executions := len(sim.Executions())
+	sender.send(50)
+	if err := sim.WaitForDelivery(30 * time.Second); err != nil {
+		t.Fatalf("after stop: %s\nevents: %v", err, sim.Events())
+	}
+	second := holder(executions)
+	if second == first {
+		t.Fatalf("stopped node %d handled messages", first)
+	}
+
+	if err := sim.Restart(first); err != nil {
+		t.Fatal(err)
+	}
+	executions = len(sim.Executions())
+	sender.send(50)
+	if err := sim.WaitForDelivery(30 * time.Second); err != nil {
+		t.Fatalf("after start: %s\nevents: %v", err, sim.Events())
+	}
+	if third := holder(executions); third != second {
+		t.Errorf("typename moved from node %d to %d without a stop", second, third)
+	}
+
+	sender.expectCounters(second)
+	if err := sim.CheckInvariants(); err != nil {
+		t.Errorf("%s\nevents: %v", err, sim.Events())
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/logger"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+reconcileStreams creates or updates streams for all registered function types. Function types with a dedicated stream
+config get a stream of their own, all others share the function types stream. Subjects of function types registered in
+other runtimes sharing the same stream are kept. A change of the storage or the retention of an existing stream fails with
+ErrStreamConfigImmutable.
+*/
+func (r *Runtime) reconcileStreams() error {
+	sharedSubjects := map[string]bool{}
+	dedicatedSubjects := map[string]bool{}
+	for _, ft := range r.functionTypes() {
+		if ft.config.dedicatedStream {
+			dedicatedSubjects[ft.subject] = true
+		} else {
+			sharedSubjects[ft.subject] = true
+		}
+	}
+
+	// Shared stream must be reconciled first: subjects moved to dedicated streams must be removed from it to avoid an overlap
+	sharedConfig := &nats.StreamConfig{Name: r.config.functionTypesStreamName}
+	if info, err := r.js.StreamInfo(sharedConfig.Name); err == nil {
+		sharedConfig = &info.Config
+		for _, subject := range info.Config.Subjects {
+			if !dedicatedSubjects[subject] {
+				sharedSubjects[subject] = true
+			}
+		}
+	} else if !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+	sharedConfig.Subjects = sortedKeys(sharedSubjects)
+	if err := r.ensureStream(sharedConfig); err != nil {
+		return err
+	}
+
+	for _, ft := range r.functionTypes() {
+		if !ft.config.dedicatedStream {
+			continue
+		}
+		if err := r.ensureStream(ft.streamConfig()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrStreamConfigImmutable is returned if the desired config of an existing stream changes fields NATS cannot change
+var ErrStreamConfigImmutable = errors.New("stream config cannot be changed, the stream must be recreated")
+
+// ensureStream creates a stream or updates the existing one if its config differs from the desired one
+func (r *Runtime) ensureStream(config *nats.StreamConfig) error {
+	info, err := r.js.StreamInfo(config.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		if len(config.Subjects) == 0 {
+			return nil // Nothing to handle yet
+		}
+		r.logger.Info("Creating stream", "stream", config.Name, "subjects", strings.Join(config.Subjects, ","))
+		_, err = r.js.AddStream(config)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	current := info.Config
+	desired := current
+	desired.Subjects = config.Subjects
+	desired.Retention = config.Retention
+	desired.MaxAge = config.MaxAge
+	desired.Storage = config.Storage
+	if config.Replicas > 0 {
+		desired.Replicas = config.Replicas
+	}
+	if sameStreamConfig(current, desired) {
+		return nil
+	}
+	if current.Storage != desired.Storage {
+		return fmt.Errorf("%w: stream %s storage %s -> %s", ErrStreamConfigImmutable, config.Name, current.Storage, desired.Storage)
+	}
+	if current.Retention != desired.Retention {
+		return fmt.Errorf("%w: stream %s retention %s -> %s", ErrStreamConfigImmutable, config.Name, current.Retention, desired.Retention)
+	}
+
+	r.logger.Info("Updating stream", "stream", config.Name, "subjects", strings.Join(desired.Subjects, ","))
+	_, err = r.js.UpdateStream(&desired)
+	return err
+}
+
+func sameStreamConfig(a nats.StreamConfig, b nats.StreamConfig) bool {
+	aSubjects := append([]string{}, a.Subjects...)
+	bSubjects := append([]string{}, b.Subjects...)
+	sort.Strings(aSubjects)
+	sort.Strings(bSubjects)
+	return reflect.DeepEqual(aSubjects, bSubjects) &&
+		a.Retention == b.Retention &&
+		a.MaxAge == b.MaxAge &&
+		a.Storage == b.Storage &&
+		a.Replicas == b.Replicas
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ----------------------------------------------------------------------------
+
+func (ft *FunctionType) consumerName() string {
+	return strings.ReplaceAll(ft.name, ".", "")
+}
+
+// targetStreamName returns the name of the stream messages of the function type are stored in
+func (ft *FunctionType) targetStreamName() string {
+	if ft.config.dedicatedStream {
+		return ft.runtime.config.functionTypesStreamName + "_" + ft.consumerName()
+	}
+	return ft.runtime.config.functionTypesStreamName
+}
+
+func (ft *FunctionType) streamConfig() *nats.StreamConfig {
+	return &nats.StreamConfig{
+		Name:      ft.targetStreamName(),
+		Subjects:  []string{ft.subject},
+		Retention: ft.config.retention,
+		MaxAge:    time.Duration(ft.config.maxAgeSec) * time.Second,
+		Storage:   ft.config.storage,
+		Replicas:  ft.config.replicas,
+	}
+}
+
+func (ft *FunctionType) consumerConfig() *nats.ConsumerConfig {
+	consumerName := ft.consumerName()
+	return &nats.ConsumerConfig{
+		Name:           consumerName,
+		Durable:        consumerName,
+		DeliverSubject: consumerName,
+		DeliverGroup:   consumerName + "-group",
+		FilterSubject:  ft.subject,
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        time.Duration(ft.config.msgAckWaitMs) * time.Millisecond, // AckWait should be long due to async message Ack
+		MaxDeliver:     ft.config.maxDeliver,
+		MaxAckPending:  ft.config.maxAckPending,
+		Replicas:       ft.config.replicas,
+	}
+}
+
+// ensureConsumer creates the consumer of the function type or updates the existing one if its config differs from the desired one
+func (ft *FunctionType) ensureConsumer(streamName string) error {
+	config := ft.consumerConfig()
+	info, err := ft.runtime.js.ConsumerInfo(streamName, config.Name)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = ft.runtime.js.AddConsumer(streamName, config)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	current := info.Config
+	if current.AckWait == config.AckWait && current.MaxDeliver == config.MaxDeliver &&
+		(config.MaxAckPending == 0 || current.MaxAckPending == config.MaxAckPending) &&
+		(config.Replicas == 0 || current.Replicas == config.Replicas) {
+		return nil
+	}
+	ft.logger.Info("Updating consumer", "stream", streamName, "consumer", config.Name)
+	_, err = ft.runtime.js.UpdateConsumer(streamName, config)
+	return err
+}
+
+// removeStaleConsumer deletes the consumer of the function type left in the shared stream after the function type got a dedicated one
+func (ft *FunctionType) removeStaleConsumer() {
+	if !ft.config.dedicatedStream {
+		return
+	}
+	sharedStreamName := ft.runtime.config.functionTypesStreamName
+	if _, err := ft.runtime.js.ConsumerInfo(sharedStreamName, ft.consumerName()); err == nil {
+		if err := ft.runtime.js.DeleteConsumer(sharedStreamName, ft.consumerName()); err != nil {
+			ft.logger.Warn("Cannot delete stale consumer from the shared stream", logger.ErrorKey, err)
+		}
+	}
+}
+
+// removeFromStream deletes the consumer of the function type and removes its subject from the stream it is stored in
+func (ft *FunctionType) removeFromStream() error {
+	js := ft.runtime.js
+	ft.streamName = ft.targetStreamName() // Not set if the function type was never started
+	if err := js.DeleteConsumer(ft.streamName, ft.consumerName()); err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+
+	if ft.config.dedicatedStream {
+		if err := js.DeleteStream(ft.streamName); err != nil && !errors.Is(err, nats.ErrStreamNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	info, err := js.StreamInfo(ft.streamName)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	subjects := []string{}
+	for _, subject := range info.Config.Subjects {
+		if subject != ft.subject {
+			subjects = append(subjects, subject)
+		}
+	}
+	if len(subjects) == len(info.Config.Subjects) {
+		return nil
+	}
+	if len(subjects) == 0 { // A stream cannot be left without subjects, nothing can be stored in it anyway
+		return js.DeleteStream(ft.streamName)
+	}
+	config := info.Config
+	config.Subjects = subjects
+	ft.logger.Info("Updating stream", "stream", ft.streamName, "subjects", strings.Join(subjects, ","))
+	_, err = js.UpdateStream(&config)
+	return err
+}
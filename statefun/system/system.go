@@ -13,6 +13,8 @@ import (
 	"os"
 	"strconv"
 	"time"
+
+	"github.com/foliagecp/sdk/statefun/logger"
 )
 
 func CreateDimSizeChannel[T interface{}](maxBufferElements int, onBufferOverflow func()) (in chan T, out chan T) {
@@ -74,7 +76,7 @@ func CreateDimSizeChannel[T interface{}](maxBufferElements int, onBufferOverflow
 func MsgOnErrorReturn(retVars ...interface{}) {
 	for _, retVar := range retVars {
 		if err, ok := retVar.(error); ok {
-			fmt.Printf("ERROR: %s\n", err)
+			logger.Default().Error(err.Error())
 		}
 	}
 }
@@ -0,0 +1,138 @@
+// Copyright 2023 NJWS Inc.
+
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	otlpSpanKindConsumer = 5
+	otlpStatusCodeOk     = 1
+	otlpStatusCodeError  = 2
+)
+
+// OTLPJSONExporter writes each span as a line in the OTLP JSON file format (ExportTraceServiceRequest),
+// which can be read by the OpenTelemetry Collector's otlpjsonfile receiver
+type OTLPJSONExporter struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewOTLPJSONExporter(w io.Writer) *OTLPJSONExporter {
+	return &OTLPJSONExporter{w: w}
+}
+
+// NewStdoutExporter creates an exporter which writes spans into the stdout
+func NewStdoutExporter() *OTLPJSONExporter {
+	return NewOTLPJSONExporter(os.Stdout)
+}
+
+// NewFileExporter creates an exporter which appends spans to a file
+func NewFileExporter(path string) (*OTLPJSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPJSONExporter{w: f, closer: f}, nil
+}
+
+func (e *OTLPJSONExporter) ExportSpan(span *Span) error {
+	data, err := json.Marshal(otlpRequest(span))
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *OTLPJSONExporter) Close() error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpRequest(span *Span) otlpExportRequest {
+	s := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              otlpSpanKindConsumer,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusCodeOk},
+	}
+	if span.ParentSpanID.IsValid() {
+		s.ParentSpanID = span.ParentSpanID.String()
+	}
+	for _, a := range span.Attributes {
+		s.Attributes = append(s.Attributes, otlpKeyValue{Key: a.Key, Value: otlpAnyValue{StringValue: a.Value}})
+	}
+	if span.Err != nil {
+		s.Status = otlpStatus{Code: otlpStatusCodeError, Message: span.Err.Error()}
+	}
+
+	scopeSpans := otlpScopeSpans{Spans: []otlpSpan{s}}
+	scopeSpans.Scope.Name = "github.com/foliagecp/sdk/statefun"
+
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: span.tracer.ServiceName()}}}
+
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 NJWS Inc.
+
+package trace_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/trace"
+)
+
+func TestOTLPJSONExporter(t *testing.T) {
+	var b bytes.Buffer
+	tracer := trace.NewTracer("svc", trace.NewOTLPJSONExporter(&b))
+	parent, _ := trace.ParseTraceParent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	tests := []struct {
+		name string
+		span func() *trace.Span
+		want string
+	}{
+		{
+			name: "child with attributes",
+			span: func() *trace.Span {
+				span := tracer.StartSpan("fn", parent.TraceParent(), trace.Attribute{Key: "statefun.id", Value: "a\"b"})
+				span.Context.SpanID = trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+				return span
+			},
+			want: `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc"}}]},"scopeSpans":[{"scope":{"name":"github.com/foliagecp/sdk/statefun"},` +
+				`"spans":[{"traceId":"0af7651916cd43dd8448eb211c80319c","spanId":"0102030405060708","parentSpanId":"b7ad6b7169203331","name":"fn","kind":5,` +
+				`"startTimeUnixNano":"1000000000","endTimeUnixNano":"3000000000","attributes":[{"key":"statefun.id","value":{"stringValue":"a\"b"}}],"status":{"code":1}}]}]}]}`,
+		},
+		{
+			name: "root with error",
+			span: func() *trace.Span {
+				span := tracer.StartSpan("fn", "")
+				span.Context.TraceID = trace.TraceID{15: 1}
+				span.Context.SpanID = trace.SpanID{7: 2}
+				span.Err = errors.New("failed")
+				return span
+			},
+			want: `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc"}}]},"scopeSpans":[{"scope":{"name":"github.com/foliagecp/sdk/statefun"},` +
+				`"spans":[{"traceId":"00000000000000000000000000000001","spanId":"0000000000000002","name":"fn","kind":5,` +
+				`"startTimeUnixNano":"1000000000","endTimeUnixNano":"3000000000","status":{"code":2,"message":"failed"}}]}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.Reset()
+			span := tt.span()
+			span.Start, span.End = time.Unix(1, 0), time.Unix(3, 0)
+			if err := trace.NewOTLPJSONExporter(&b).ExportSpan(span); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want+"\n" {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("finished span", func(t *testing.T) {
+		b.Reset()
+		tracer.StartSpan("fn", "").Finish(nil)
+		if lines := strings.Count(b.String(), "\n"); lines != 1 {
+			t.Errorf("got %d exported lines, want 1", lines)
+		}
+	})
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	for i := 0; i < 2; i++ { // Spans are appended
+		exporter, err := trace.NewFileExporter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trace.NewTracer("svc", exporter).StartSpan("fn", "").Finish(nil)
+		if err := exporter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("got %d lines in the file, want 2", lines)
+	}
+}
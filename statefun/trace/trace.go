@@ -0,0 +1,155 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun trace package.
+// Provides spans with W3C trace context propagation and pluggable span exporters
+package trace
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// TraceParent returns span context in the W3C traceparent format
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-01"
+}
+
+// ParseTraceParent parses span context from the W3C traceparent format
+func ParseTraceParent(traceParent string) (sc SpanContext, ok bool) {
+	tokens := strings.Split(traceParent, "-")
+	if len(tokens) < 4 || len(tokens[0]) != 2 || tokens[0] == "ff" || len(tokens[1]) != 32 || len(tokens[2]) != 16 {
+		return
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(tokens[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(tokens[2])); err != nil {
+		return SpanContext{}, false
+	}
+	if !sc.IsValid() { // All zero ids are invalid
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+type Span struct {
+	Name         string
+	Context      SpanContext
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	Err          error
+
+	tracer *Tracer
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+}
+
+// Finish ends the span with the error the traced operation finished with (nil on success) and exports it
+func (s *Span) Finish(err error) {
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.export(s)
+}
+
+type Exporter interface {
+	ExportSpan(span *Span) error
+}
+
+type Tracer struct {
+	serviceName string
+	exporter    Exporter
+
+	randMutex sync.Mutex
+	rand      *rand.Rand
+}
+
+func NewTracer(serviceName string, exporter Exporter) *Tracer {
+	return &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (t *Tracer) ServiceName() string {
+	return t.serviceName
+}
+
+// StartSpan starts a span as a child of the one described by parentTraceParent, a new trace is started if
+// parentTraceParent is empty or invalid
+func (t *Tracer) StartSpan(name string, parentTraceParent string, attributes ...Attribute) *Span {
+	span := &Span{Name: name, Start: time.Now(), Attributes: attributes, tracer: t}
+	if parent, ok := ParseTraceParent(parentTraceParent); ok {
+		span.Context.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		t.randomID(span.Context.TraceID[:])
+	}
+	t.randomID(span.Context.SpanID[:])
+	return span
+}
+
+func (t *Tracer) export(span *Span) {
+	if t.exporter != nil {
+		_ = t.exporter.ExportSpan(span)
+	}
+}
+
+func (t *Tracer) randomID(id []byte) {
+	t.randMutex.Lock()
+	defer t.randMutex.Unlock()
+	for {
+		for i := 0; i < len(id); i += 8 {
+			binary.BigEndian.PutUint64(id[i:i+8], t.rand.Uint64())
+		}
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
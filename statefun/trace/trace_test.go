@@ -0,0 +1,81 @@
+// Copyright 2023 NJWS Inc.
+
+package trace_test
+
+import (
+	"testing"
+
+	"github.com/foliagecp/sdk/statefun/trace"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceParent string
+		wantOk      bool
+	}{
+		{name: "valid", traceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", wantOk: true},
+		{name: "not sampled", traceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", wantOk: true},
+		{name: "future version with more fields", traceParent: "01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-x", wantOk: true},
+		{name: "empty", traceParent: ""},
+		{name: "invalid version", traceParent: "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		{name: "missing flags", traceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331"},
+		{name: "short trace id", traceParent: "00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01"},
+		{name: "short span id", traceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01"},
+		{name: "trace id not hex", traceParent: "00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01"},
+		{name: "span id not hex", traceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333x-01"},
+		{name: "zero trace id", traceParent: "00-00000000000000000000000000000000-b7ad6b7169203331-01"},
+		{name: "zero span id", traceParent: "00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := trace.ParseTraceParent(tt.traceParent)
+			if ok != tt.wantOk {
+				t.Fatalf("got ok=%t, want %t", ok, tt.wantOk)
+			}
+			if !ok {
+				if sc != (trace.SpanContext{}) {
+					t.Errorf("got span context %v of an invalid traceparent", sc)
+				}
+				return
+			}
+			if sc.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" || sc.SpanID.String() != "b7ad6b7169203331" {
+				t.Errorf("got trace id %s, span id %s", sc.TraceID, sc.SpanID)
+			}
+			if got, want := sc.TraceParent(), "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"; got != want {
+				t.Errorf("got traceparent %s, want %s", got, want)
+			}
+		})
+	}
+
+	if got := (trace.SpanContext{}).TraceParent(); got != "" {
+		t.Errorf("got traceparent %q of an invalid span context", got)
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	tracer := trace.NewTracer("test", nil)
+
+	root := tracer.StartSpan("root", "")
+	if !root.Context.IsValid() || root.ParentSpanID.IsValid() {
+		t.Fatalf("got root span context %s, parent %s", root.Context.TraceParent(), root.ParentSpanID)
+	}
+	parsed, ok := trace.ParseTraceParent(root.Context.TraceParent())
+	if !ok || parsed != root.Context {
+		t.Errorf("traceparent %s is not parsed back", root.Context.TraceParent())
+	}
+
+	child := tracer.StartSpan("child", root.Context.TraceParent(), trace.Attribute{Key: "k", Value: "v"})
+	if child.Context.TraceID != root.Context.TraceID || child.ParentSpanID != root.Context.SpanID {
+		t.Errorf("got child trace id %s, parent %s", child.Context.TraceID, child.ParentSpanID)
+	}
+	if child.Context.SpanID == root.Context.SpanID {
+		t.Error("child has the span id of its parent")
+	}
+
+	orphan := tracer.StartSpan("orphan", "invalid")
+	if !orphan.Context.IsValid() || orphan.Context.TraceID == root.Context.TraceID || orphan.ParentSpanID.IsValid() {
+		t.Errorf("span with an invalid parent is not a root of a new trace")
+	}
+	orphan.Finish(nil) // No exporter
+}
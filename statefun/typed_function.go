@@ -0,0 +1,126 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Validator is implemented by typed requests, options and contexts which must be checked after decoding
+type Validator interface {
+	Validate() error
+}
+
+// TypedCall is passed to a typed function handler instead of the raw context processor which stays embedded
+// for calls, egress, caches etc.
+type TypedCall[Req any, Ctx any] struct {
+	*sfPlugins.StatefunContextProcessor
+	Executor sfPlugins.StatefunExecutor
+	// Request decoded from the payload
+	Request Req
+	// Function context decoded from the KV, stored back after the handler succeeds if it was changed, deleted if set to nil.
+	// It is stored as Ctx encodes it, so fields of the stored context unknown to Ctx are lost on any write.
+	Context *Ctx
+}
+
+// DecodeOptions decodes and validates the options of the call into v
+func (c *TypedCall[Req, Ctx]) DecodeOptions(v any) error {
+	if err := decodeTyped(c.Options, v); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+// TypedFunctionHandler handles a call with the decoded request and context, the returned response is sent to the caller
+type TypedFunctionHandler[Req any, Resp any, Ctx any] func(call *TypedCall[Req, Ctx]) (Resp, error)
+
+// RegisterTyped registers a function type with a handler working on Go structs instead of JSON. The payload and
+// the function context are decoded by encoding/json and validated if they implement Validator. The response
+// is encoded to JSON and sent to the caller, errors are replied via ReplyError. The wire format is the same
+// as for NewFunctionType, so typed and untyped functions can call each other.
+func RegisterTyped[Req any, Resp any, Ctx any](runtime *Runtime, name string, handler TypedFunctionHandler[Req, Resp, Ctx], config FunctionTypeConfig) *FunctionType {
+	return NewFunctionType(runtime, name, TypedHandler(handler), config)
+}
+
+// TypedHandler converts a typed function handler into a FunctionHandler
+func TypedHandler[Req any, Resp any, Ctx any](handler TypedFunctionHandler[Req, Resp, Ctx]) FunctionHandler {
+	return func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		call := &TypedCall[Req, Ctx]{StatefunContextProcessor: contextProcessor, Executor: executor}
+
+		if err := decodeTyped(contextProcessor.Payload, &call.Request); err != nil {
+			contextProcessor.ReplyError(fmt.Errorf("invalid payload: %w", err))
+			return
+		}
+
+		call.Context = new(Ctx)
+		if err := decodeTyped(contextProcessor.GetFunctionContext(), call.Context); err != nil {
+			contextProcessor.ReplyError(fmt.Errorf("invalid function context: %w", err))
+			return
+		}
+		// Compared with the context after the handler, not with the stored one which may have fields unknown to Ctx
+		initialContext, err := json.Marshal(call.Context)
+		if err != nil {
+			contextProcessor.ReplyError(fmt.Errorf("cannot encode function context: %w", err))
+			return
+		}
+
+		resp, err := handler(call)
+		if err != nil {
+			contextProcessor.ReplyError(err)
+			return
+		}
+
+		if call.Context == nil {
+			contextProcessor.DeleteFunctionContext()
+		} else {
+			updated, err := json.Marshal(call.Context)
+			if err != nil {
+				contextProcessor.ReplyError(fmt.Errorf("cannot encode function context: %w", err))
+				return
+			}
+			if !bytes.Equal(updated, initialContext) {
+				if j, ok := easyjson.JSONFromBytes(updated); ok {
+					contextProcessor.SetFunctionContext(&j)
+				}
+			}
+		}
+
+		if len(contextProcessor.Caller.Typename) > 0 && len(contextProcessor.Caller.ID) > 0 {
+			result, err := encodeTyped(resp)
+			if err != nil {
+				contextProcessor.ReplyError(fmt.Errorf("cannot encode response: %w", err))
+				return
+			}
+			contextProcessor.Call(contextProcessor.Caller.Typename, contextProcessor.Caller.ID, result, nil)
+		}
+	}
+}
+
+func decodeTyped(j *easyjson.JSON, v any) error {
+	if j != nil && !j.IsNull() {
+		if err := json.Unmarshal(j.ToBytes(), v); err != nil {
+			return err
+		}
+	}
+	if validator, ok := v.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// encodeTyped encodes v into a JSON, nil values are encoded as an empty object
+func encodeTyped(v any) (*easyjson.JSON, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if j, ok := easyjson.JSONFromBytes(b); ok && !j.IsNull() {
+		return &j, nil
+	}
+	return easyjson.NewJSONObject().GetPtr(), nil
+}
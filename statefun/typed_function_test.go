@@ -0,0 +1,155 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/statefuntest"
+)
+
+type addRequest struct {
+	Value int `json:"value"`
+}
+
+func (r *addRequest) Validate() error {
+	if r.Value < 0 {
+		return errors.New("value must not be negative")
+	}
+	return nil
+}
+
+type addResponse struct {
+	Sum int `json:"sum"`
+}
+
+type sumContext struct {
+	Sum int `json:"sum"`
+}
+
+func (c *sumContext) Validate() error {
+	if c.Sum > 100 {
+		return errors.New("sum overflow")
+	}
+	return nil
+}
+
+// addHandler adds the value to the sum of the context, the value 0 deletes the context
+var addHandler = statefun.TypedHandler(func(call *statefun.TypedCall[addRequest, sumContext]) (addResponse, error) {
+	switch call.Request.Value {
+	case 0:
+		call.Context = nil
+		return addResponse{}, nil
+	case 13:
+		return addResponse{}, errors.New("unlucky value")
+	}
+	call.Context.Sum += call.Request.Value
+	return addResponse{Sum: call.Context.Sum}, nil
+})
+
+func TestTypedHandler(t *testing.T) {
+	self := sfPlugins.StatefunAddress{Typename: "typed.add", ID: "a"}
+	caller := sfPlugins.StatefunAddress{Typename: "ingress", ID: "test"}
+	request := func(value string) *easyjson.JSON {
+		j, ok := easyjson.JSONFromString(`{"value":` + value + `}`)
+		if !ok {
+			t.Fatalf("invalid request value %s", value)
+		}
+		return &j
+	}
+	newHarness := func(t *testing.T, context string) *statefuntest.Harness {
+		t.Helper()
+		h := statefuntest.New()
+		t.Cleanup(h.Close)
+		if len(context) > 0 {
+			h.Cache.SetValue(self.Typename+"."+self.ID, []byte(context), true, -1, "")
+		}
+		return h
+	}
+
+	t.Run("reply to sync caller", func(t *testing.T) {
+		h := newHarness(t, `{"sum":1}`)
+		reply, err := h.InvokeSync(addHandler, self, caller, request("2"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reply.ToString(); got != `{"sum":3}` {
+			t.Errorf("got reply %s, want {\"sum\":3}", got)
+		}
+		h.AssertFunctionContext(t, self.Typename, self.ID, easyjson.NewJSONObjectWithKeyValue("sum", easyjson.NewJSON(3)).GetPtr())
+	})
+
+	t.Run("reply to async caller", func(t *testing.T) {
+		h := newHarness(t, "")
+		if err := h.Invoke(addHandler, self, caller, request("2"), nil); err != nil {
+			t.Fatal(err)
+		}
+		h.AssertCalled(t, caller.Typename, caller.ID, easyjson.NewJSONObjectWithKeyValue("sum", easyjson.NewJSON(2)).GetPtr())
+	})
+
+	errorTests := []struct {
+		name      string
+		context   string
+		request   *easyjson.JSON
+		wantError string
+	}{
+		{name: "undecodable payload", request: request(`"x"`), wantError: "invalid payload: json: cannot unmarshal string"},
+		{name: "invalid payload", request: request("-1"), wantError: "invalid payload: value must not be negative"},
+		{name: "undecodable context", context: `{"sum":"x"}`, request: request("1"), wantError: "invalid function context: json: cannot unmarshal string"},
+		{name: "invalid context", context: `{"sum":101}`, request: request("1"), wantError: "invalid function context: sum overflow"},
+		{name: "handler error", context: `{"sum":1}`, request: request("13"), wantError: "unlucky value"},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, tt.context)
+			if _, err := h.InvokeSync(addHandler, self, caller, tt.request, nil); err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got error %v, want %s", err, tt.wantError)
+			}
+			if errs := h.ReplyErrors(); len(errs) != 1 {
+				t.Errorf("got %d reply errors, want 1", len(errs))
+			}
+			if stored, _ := h.Cache.GetValue(self.Typename + "." + self.ID); len(tt.context) > 0 && string(stored) != tt.context {
+				t.Errorf("got context %s, want it kept", stored)
+			}
+		})
+	}
+
+	t.Run("unchanged context is not stored", func(t *testing.T) {
+		const context = `{"extra":true,"sum":1}` // A field unknown to the typed context survives as long as it is not written
+		h := newHarness(t, context)
+		if _, err := h.InvokeSync(statefun.TypedHandler(func(call *statefun.TypedCall[addRequest, sumContext]) (addResponse, error) {
+			return addResponse{Sum: call.Context.Sum}, nil
+		}), self, caller, request("1"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := h.Cache.GetValue(self.Typename + "." + self.ID); string(stored) != context {
+			t.Errorf("got context %s, want %s", stored, context)
+		}
+	})
+
+	t.Run("changed context loses unknown fields", func(t *testing.T) {
+		h := newHarness(t, `{"extra":true,"sum":1}`)
+		if _, err := h.InvokeSync(addHandler, self, caller, request("1"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := h.Cache.GetValue(self.Typename + "." + self.ID); string(stored) != `{"sum":2}` {
+			t.Errorf("got context %s, want {\"sum\":2}", stored)
+		}
+	})
+
+	t.Run("nil context deletes", func(t *testing.T) {
+		h := newHarness(t, `{"sum":1}`)
+		if _, err := h.InvokeSync(addHandler, self, caller, request("0"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.Cache.GetValue(self.Typename + "." + self.ID); err == nil {
+			t.Error("context is not deleted")
+		}
+	})
+}
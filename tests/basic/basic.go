@@ -5,14 +5,19 @@
 package basic
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/foliagecp/easyjson"
 
 	graphCRUD "github.com/foliagecp/sdk/embedded/graph/crud"
 	graphDebug "github.com/foliagecp/sdk/embedded/graph/debug"
 	"github.com/foliagecp/sdk/embedded/graph/jpgql"
+	"github.com/foliagecp/sdk/embedded/graph/registry"
 	statefun "github.com/foliagecp/sdk/statefun"
 	"github.com/foliagecp/sdk/statefun/cache"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
@@ -118,10 +123,12 @@ func RegisterFunctionTypes(runtime *statefun.Runtime) {
 	graphCRUD.RegisterAllFunctionTypes(runtime)
 	graphDebug.RegisterAllFunctionTypes(runtime)
 	jpgql.RegisterAllFunctionTypes(runtime, 30)
+	registry.RegisterAllFunctionTypes(runtime)
 }
 
 func Start() {
 	afterStart := func(runtime *statefun.Runtime) {
+		registry.Publish(runtime, registry.HeartbeatIntervalSec)
 		if CreateSimpleGraphTest {
 			CreateTestGraph(runtime)
 		}
@@ -133,6 +140,17 @@ func Start() {
 		}
 
 		RegisterFunctionTypes(runtime)
+
+		// Shutdown runtime gracefully on SIGINT or SIGTERM
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			<-signals
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			system.MsgOnErrorReturn(runtime.Shutdown(ctx))
+		}()
+
 		if err := runtime.Start(cache.NewCacheConfig(), afterStart); err != nil {
 			fmt.Printf("Cannot start due to an error: %s\n", err)
 		}